@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+// validEmail reports whether s is a bare address such as user@example.com
+func validEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	return err == nil && addr.Address == s && strings.Contains(s[strings.LastIndex(s, "@"):], ".")
+}
+
+// sendVerificationEmail issues a verification token for the user and mails it
+func sendVerificationEmail(userID int, email string) error {
+	token, err := createAccountToken(userID, purposeVerifyEmail, verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+	sendMail(email, "Verify your email address",
+		"Welcome! Confirm your email address by submitting this token to POST /verify-email:\n\n"+
+			token+"\n\nThe token expires in 24 hours.")
+	return nil
+}
+
+// VerifyEmail redeems a verification token and marks the user's email as verified
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Token == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeAccountToken(tx, req.Token, purposeVerifyEmail)
+	if err == ErrInvalidToken {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE users SET email_verified = TRUE WHERE id = $1", userID)
+	if err != nil || tx.Commit() != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email verified"})
+}
+
+// ForgotPassword mails a password reset token. It responds the same way whether
+// or not the account exists so it cannot be used to probe for accounts.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Email == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	var userID int
+	err = db.QueryRow("SELECT id FROM users WHERE email = $1 AND disabled = FALSE", req.Email).Scan(&userID)
+	if err == nil {
+		token, err := createAccountToken(userID, purposePasswordReset, passwordResetTTL)
+		if err != nil {
+			log.Printf("Failed to create password reset token for user %d: %v", userID, err)
+		} else {
+			sendMail(req.Email, "Reset your password",
+				"Someone asked to reset the password for this account. If it was you, submit this token "+
+					"with your new password to POST /password/reset:\n\n"+token+
+					"\n\nThe token expires in 1 hour. If you did not ask for a reset, ignore this email.")
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists, a reset email has been sent"})
+}
+
+// ResetPassword redeems a reset token, sets the new password and ends every
+// existing session of the user
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Token == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeAccountToken(tx, req.Token, purposePasswordReset)
+	if err == ErrInvalidToken {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	// Receiving the reset mail also proves ownership of the address
+	_, err = tx.Exec("UPDATE users SET password = $1, email_verified = TRUE WHERE id = $2", string(hashedPassword), userID)
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	// Any other outstanding reset tokens for the account stop working
+	_, err = tx.Exec("UPDATE user_tokens SET used_at = NOW() WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL",
+		userID, purposePasswordReset)
+	if err != nil || tx.Commit() != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	if redisClient != nil {
+		if err := RevokeUserSessions(userID); err != nil {
+			log.Printf("Failed to revoke sessions of user %d: %v", userID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset"})
+}
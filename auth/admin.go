@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"go_backend_legalForce/job"
+	"go_backend_legalForce/models"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// UserPage is one page of the admin user listing
+type UserPage struct {
+	Users   []models.User `json:"users"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"per_page"`
+	Total   int           `json:"total"`
+}
+
+// ListUsers returns a page of users, ordered by ID. Query parameters: page, per_page.
+func ListUsers(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPageSize
+	}
+	if perPage > maxPageSize {
+		perPage = maxPageSize
+	}
+
+	result := UserPage{Users: []models.User{}, Page: page, PerPage: perPage}
+	err = db.QueryRow("SELECT COUNT(*) FROM users").Scan(&result.Total)
+	if err != nil {
+		http.Error(w, "Failed to retrieve users", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query("SELECT id, email, role, disabled, email_verified, created_at FROM users ORDER BY id LIMIT $1 OFFSET $2",
+		perPage, (page-1)*perPage)
+	if err != nil {
+		http.Error(w, "Failed to retrieve users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user models.User
+		if err := rows.Scan(&user.ID, &user.Email, &user.Role, &user.Disabled, &user.EmailVerified, &user.CreatedAt); err != nil {
+			http.Error(w, "Failed to scan user", http.StatusInternalServerError)
+			return
+		}
+		result.Users = append(result.Users, user)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// SetUserDisabled disables or re-enables an account. Disabling also revokes every
+// session of the user so the change takes effect immediately.
+func SetUserDisabled(w http.ResponseWriter, r *http.Request, userID int, disabled bool) {
+	if admin, ok := UserFromContext(r.Context()); ok && admin.ID == userID {
+		http.Error(w, "Cannot change your own account", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("UPDATE users SET disabled = $1 WHERE id = $2", disabled, userID)
+	if err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if disabled && redisClient != nil {
+		if err := RevokeUserSessions(userID); err != nil {
+			log.Printf("Failed to revoke sessions of user %d: %v", userID, err)
+		}
+	}
+
+	message := "User enabled"
+	if disabled {
+		message = "User disabled"
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// orgSuccessor selects the member the organization files and folders of a deleted
+// user ($1) pass to: another owner if there is one, else an admin, else the member
+// who joined first. The roles are $2 and $3.
+func orgSuccessor(table string) string {
+	return `(SELECT m.user_id FROM org_members m WHERE m.org_id = ` + table + `.org_id AND m.user_id <> $1
+		ORDER BY m.role = $2 DESC, m.role = $3 DESC, m.created_at LIMIT 1)`
+}
+
+// DeleteUser removes a user together with their personal files and sessions. Files
+// and folders they added to an organization belong to the organization and are
+// handed over to another of its members.
+func DeleteUser(w http.ResponseWriter, r *http.Request, userID int) {
+	if admin, ok := UserFromContext(r.Context()); ok && admin.ID == userID {
+		http.Error(w, "Cannot delete your own account", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var orphaned bool
+	err = tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM files WHERE user_id = $1 AND org_id IS NOT NULL AND `+orgSuccessor("files")+` IS NULL)
+		OR EXISTS(SELECT 1 FROM folders WHERE user_id = $1 AND org_id IS NOT NULL AND `+orgSuccessor("folders")+` IS NULL)`,
+		userID, models.OrgRoleOwner, models.OrgRoleAdmin).Scan(&orphaned)
+	if err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	if orphaned {
+		http.Error(w, "User is the only member of an organization holding their files", http.StatusConflict)
+		return
+	}
+	orgIDs, err := reassignOrgFiles(tx, userID)
+	if err != nil {
+		log.Printf("Failed to hand over organization files of user %d: %v", userID, err)
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	_, keys, err := job.DeleteFiles(tx, "DELETE FROM files WHERE user_id = $1 AND org_id IS NULL RETURNING id, storage_key", userID)
+	if err != nil {
+		http.Error(w, "Failed to delete user files", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := tx.Exec("DELETE FROM users WHERE id = $1", userID)
+	if err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	// Stored files and sessions are cleaned up only once the rows are gone
+	for _, key := range keys {
+		job.RemoveStoredFile(key)
+	}
+	if redisClient != nil {
+		if err := RevokeUserSessions(userID); err != nil {
+			log.Printf("Failed to revoke sessions of user %d: %v", userID, err)
+		}
+		redisClient.Del(ctx, job.FilesCacheKey(userID, 0))
+		// The listings of the organizations show the new uploader
+		for _, orgID := range orgIDs {
+			redisClient.Del(ctx, job.FilesCacheKey(0, orgID))
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "User deleted"})
+}
+
+// reassignOrgFiles hands the organization files and folders of a user over to
+// their orgSuccessor and returns the organizations concerned
+func reassignOrgFiles(tx *sql.Tx, userID int) ([]int, error) {
+	_, err := tx.Exec("UPDATE folders SET user_id = "+orgSuccessor("folders")+" WHERE user_id = $1 AND org_id IS NOT NULL",
+		userID, models.OrgRoleOwner, models.OrgRoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query("UPDATE files SET user_id = "+orgSuccessor("files")+" WHERE user_id = $1 AND org_id IS NOT NULL RETURNING org_id",
+		userID, models.OrgRoleOwner, models.OrgRoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgIDs []int
+	seen := map[int]bool{}
+	for rows.Next() {
+		var orgID int
+		if err := rows.Scan(&orgID); err != nil {
+			return nil, err
+		}
+		if !seen[orgID] {
+			seen[orgID] = true
+			orgIDs = append(orgIDs, orgID)
+		}
+	}
+	return orgIDs, rows.Err()
+}
@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"go_backend_legalForce/models"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every API key so keys are recognisable in the Authorization
+// header and in secret scanners. A key looks like lf_<8-char id>_<secret>.
+const APIKeyPrefix = "lf_"
+
+var validScopes = map[string]bool{
+	models.ScopeRead:   true,
+	models.ScopeUpload: true,
+	models.ScopeShare:  true,
+	models.ScopeDelete: true,
+}
+
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseAPIKey splits a key into its lookup prefix, or returns false if it is malformed
+func parseAPIKey(key string) (string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(key, APIKeyPrefix), "_", 2)
+	if !strings.HasPrefix(key, APIKeyPrefix) || len(parts) != 2 || len(parts[0]) != 8 || parts[1] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func newAPIKey() (key, prefix string, err error) {
+	idBytes := make([]byte, 5)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	prefix = strings.ToLower(base32.StdEncoding.EncodeToString(idBytes))
+	return APIKeyPrefix + prefix + "_" + base64.RawURLEncoding.EncodeToString(secret), prefix, nil
+}
+
+func scanAPIKey(scan func(dest ...interface{}) error) (models.APIKey, error) {
+	var key models.APIKey
+	var scopes string
+	var lastUsed, revoked sql.NullTime
+	err := scan(&key.ID, &key.UserID, &key.Label, &key.Prefix, &scopes, &key.CreatedAt, &lastUsed, &revoked)
+	if err != nil {
+		return key, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	if lastUsed.Valid {
+		key.LastUsedAt = &lastUsed.Time
+	}
+	if revoked.Valid {
+		key.RevokedAt = &revoked.Time
+	}
+	return key, nil
+}
+
+// AuthenticateAPIKey resolves an API key to its owner and records that it was used
+func AuthenticateAPIKey(rawKey string) (models.User, models.APIKey, error) {
+	prefix, ok := parseAPIKey(rawKey)
+	if !ok {
+		return models.User{}, models.APIKey{}, ErrInvalidToken
+	}
+
+	var keyHash string
+	var scopes string
+	var key models.APIKey
+	err := db.QueryRow("SELECT id, user_id, label, prefix, key_hash, scopes FROM api_keys WHERE prefix = $1 AND revoked_at IS NULL", prefix).
+		Scan(&key.ID, &key.UserID, &key.Label, &key.Prefix, &keyHash, &scopes)
+	if err != nil {
+		return models.User{}, models.APIKey{}, ErrInvalidToken
+	}
+	if subtle.ConstantTimeCompare([]byte(keyHash), []byte(apiKeyHash(rawKey))) != 1 {
+		return models.User{}, models.APIKey{}, ErrInvalidToken
+	}
+	key.Scopes = strings.Split(scopes, ",")
+
+	user, err := GetUserByID(key.UserID)
+	if err != nil {
+		return models.User{}, models.APIKey{}, ErrInvalidToken
+	}
+
+	// Recording use at most once a minute keeps busy scripts from writing on every request
+	now := time.Now()
+	_, err = db.Exec("UPDATE api_keys SET last_used_at = $1 WHERE id = $2 AND (last_used_at IS NULL OR last_used_at < $3)",
+		now, key.ID, now.Add(-time.Minute))
+	if err != nil {
+		return models.User{}, models.APIKey{}, err
+	}
+	key.LastUsedAt = &now
+
+	return user, key, nil
+}
+
+// CreateAPIKey creates a key for the current user. The key itself is only returned here.
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Label  string   `json:"label"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	rawKey, prefix, err := newAPIKey()
+	if err != nil {
+		http.Error(w, "Failed to generate key", http.StatusInternalServerError)
+		return
+	}
+
+	key := models.APIKey{UserID: user.ID, Label: req.Label, Prefix: prefix, Scopes: req.Scopes}
+	err = db.QueryRow("INSERT INTO api_keys (user_id, label, prefix, key_hash, scopes) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		user.ID, req.Label, prefix, apiKeyHash(rawKey), strings.Join(req.Scopes, ",")).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		http.Error(w, "Failed to save key", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		models.APIKey
+		Key string `json:"key"`
+	}{key, rawKey})
+}
+
+// ListAPIKeys returns the current user's keys, including revoked ones
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := db.Query("SELECT id, user_id, label, prefix, scopes, created_at, last_used_at, revoked_at FROM api_keys WHERE user_id = $1 ORDER BY id", user.ID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve keys", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows.Scan)
+		if err != nil {
+			http.Error(w, "Failed to scan key", http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(keys)
+}
+
+// UpdateAPIKey changes the label of one of the current user's keys
+func UpdateAPIKey(w http.ResponseWriter, r *http.Request, keyID int) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Label string `json:"label"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	row := db.QueryRow(`UPDATE api_keys SET label = $1 WHERE id = $2 AND user_id = $3
+		RETURNING id, user_id, label, prefix, scopes, created_at, last_used_at, revoked_at`, req.Label, keyID, user.ID)
+	key, err := scanAPIKey(row.Scan)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update key", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(key)
+}
+
+// RevokeAPIKey permanently disables one of the current user's keys
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request, keyID int) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := db.Exec("UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL", keyID, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to revoke key", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Key revoked"})
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"go_backend_legalForce/models"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	claimsContextKey
+	apiKeyContextKey
+	membershipContextKey
+)
+
+// WithUser returns a copy of ctx that carries the authenticated user
+func WithUser(ctx context.Context, user models.User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFromContext returns the authenticated user stored by the auth middleware
+func UserFromContext(ctx context.Context) (models.User, bool) {
+	user, ok := ctx.Value(userContextKey).(models.User)
+	return user, ok
+}
+
+// WithClaims returns a copy of ctx that carries the claims of the access token in use
+func WithClaims(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, claimsContextKey, claims)
+}
+
+// ClaimsFromContext returns the access token claims stored by the auth middleware
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(Claims)
+	return claims, ok
+}
+
+// WithAPIKey returns a copy of ctx that records the request was authenticated with an API key
+func WithAPIKey(ctx context.Context, key models.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey, key)
+}
+
+// APIKeyFromContext returns the API key the request was authenticated with, if any
+func APIKeyFromContext(ctx context.Context) (models.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey).(models.APIKey)
+	return key, ok
+}
+
+// WithMembership returns a copy of ctx that acts within the member's organization
+func WithMembership(ctx context.Context, membership models.Membership) context.Context {
+	return context.WithValue(ctx, membershipContextKey, membership)
+}
+
+// MembershipFromContext returns the active organization membership selected for the
+// request, if any. Without one the request acts on the user's personal files.
+func MembershipFromContext(ctx context.Context) (models.Membership, bool) {
+	membership, ok := ctx.Value(membershipContextKey).(models.Membership)
+	return membership, ok
+}
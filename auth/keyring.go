@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// signingKey is one entry in a KeyRing. HMAC keys only carry a secret, RSA keys
+// carry a public key and, unless they are verify-only, a private key.
+type signingKey struct {
+	id        string
+	algorithm string
+	secret    []byte
+	private   *rsa.PrivateKey
+	public    *rsa.PublicKey
+}
+
+// KeyRing holds every key that tokens may be verified with and names the one new
+// tokens are signed with. Keeping the previous key in the ring after rotating lets
+// tokens signed before the rotation stay valid until they expire.
+type KeyRing struct {
+	mu     sync.RWMutex
+	active string
+	keys   map[string]*signingKey
+}
+
+// NewKeyRing returns an empty key ring
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[string]*signingKey)}
+}
+
+// AddHMAC adds an HS256 key
+func (k *KeyRing) AddHMAC(kid string, secret []byte) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("key %q: empty secret", kid)
+	}
+	return k.add(&signingKey{id: kid, algorithm: AlgHS256, secret: secret})
+}
+
+// AddRSA adds an RS256 key that can sign and verify
+func (k *KeyRing) AddRSA(kid string, private *rsa.PrivateKey) error {
+	return k.add(&signingKey{id: kid, algorithm: AlgRS256, private: private, public: &private.PublicKey})
+}
+
+// AddRSAPublic adds an RS256 key that can only verify, e.g. a retired key
+func (k *KeyRing) AddRSAPublic(kid string, public *rsa.PublicKey) error {
+	return k.add(&signingKey{id: kid, algorithm: AlgRS256, public: public})
+}
+
+func (k *KeyRing) add(key *signingKey) error {
+	if key.id == "" {
+		return errors.New("key id is required")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, exists := k.keys[key.id]; exists {
+		return fmt.Errorf("key %q: duplicate key id", key.id)
+	}
+	k.keys[key.id] = key
+	return nil
+}
+
+// SetActive selects the key new tokens are signed with
+func (k *KeyRing) SetActive(kid string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.keys[kid]
+	if !ok {
+		return ErrUnknownKey
+	}
+	if key.secret == nil && key.private == nil {
+		return fmt.Errorf("key %q: verify-only keys cannot sign", kid)
+	}
+	k.active = kid
+	return nil
+}
+
+// Sign signs the claims with the active key and stamps its kid on the header
+func (k *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	key, ok := k.keys[k.active]
+	k.mu.RUnlock()
+	if !ok {
+		return "", ErrUnknownKey
+	}
+
+	var token *jwt.Token
+	var signWith interface{}
+	switch key.algorithm {
+	case AlgHS256:
+		token = jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		signWith = key.secret
+	case AlgRS256:
+		token = jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		signWith = key.private
+	}
+	token.Header["kid"] = key.id
+	return token.SignedString(signWith)
+}
+
+// Keyfunc resolves the verification key from the token's kid and pins the
+// algorithm to the one registered for that key, so a token cannot pick its own
+func (k *KeyRing) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k.mu.RLock()
+	key, ok := k.keys[kid]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	if token.Method.Alg() != key.algorithm {
+		return nil, fmt.Errorf("unexpected signing method %q for key %q", token.Method.Alg(), kid)
+	}
+	if key.algorithm == AlgHS256 {
+		return key.secret, nil
+	}
+	return key.public, nil
+}
+
+// JWK is the public part of an asymmetric key as published in a JWKS document
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+// PublicKeys returns the JWKs of every asymmetric key. HMAC secrets are never published.
+func (k *KeyRing) PublicKeys() []JWK {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := []JWK{}
+	for _, key := range k.keys {
+		if key.public == nil {
+			continue
+		}
+		keys = append(keys, JWK{
+			KeyType:   "RSA",
+			KeyID:     key.id,
+			Algorithm: key.algorithm,
+			Use:       "sig",
+			N:         base64.RawURLEncoding.EncodeToString(key.public.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.public.E)).Bytes()),
+		})
+	}
+	return keys
+}
+
+// keyRingConfig is the layout of the file named by JWT_KEYS_FILE
+type keyRingConfig struct {
+	Active string `json:"active"`
+	Keys   []struct {
+		ID             string `json:"kid"`
+		Algorithm      string `json:"alg"`
+		Secret         string `json:"secret"`
+		PrivateKeyFile string `json:"private_key_file"`
+		PublicKeyFile  string `json:"public_key_file"`
+	} `json:"keys"`
+}
+
+// LoadKeyRing builds the key ring from JWT_KEYS_FILE. Without it, the ring holds a
+// single HS256 key taken from JWT_SECRET_KEY with the kid "default".
+func LoadKeyRing() (*KeyRing, error) {
+	path := os.Getenv("JWT_KEYS_FILE")
+	if path == "" {
+		return secretKeyRing(os.Getenv("JWT_SECRET_KEY"))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config keyRingConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	ring := NewKeyRing()
+	for _, kc := range config.Keys {
+		switch kc.Algorithm {
+		case AlgHS256:
+			err = ring.AddHMAC(kc.ID, []byte(kc.Secret))
+		case AlgRS256:
+			err = addRSAFromFiles(ring, kc.ID, kc.PrivateKeyFile, kc.PublicKeyFile)
+		default:
+			err = fmt.Errorf("key %q: unsupported algorithm %q", kc.ID, kc.Algorithm)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := ring.SetActive(config.Active); err != nil {
+		return nil, fmt.Errorf("active key %q: %w", config.Active, err)
+	}
+	return ring, nil
+}
+
+func addRSAFromFiles(ring *KeyRing, kid, privateKeyFile, publicKeyFile string) error {
+	if privateKeyFile != "" {
+		pem, err := os.ReadFile(privateKeyFile)
+		if err != nil {
+			return err
+		}
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", kid, err)
+		}
+		return ring.AddRSA(kid, private)
+	}
+
+	pem, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return err
+	}
+	public, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+	if err != nil {
+		return fmt.Errorf("key %q: %w", kid, err)
+	}
+	return ring.AddRSAPublic(kid, public)
+}
+
+func secretKeyRing(secret string) (*KeyRing, error) {
+	ring := NewKeyRing()
+	if err := ring.AddHMAC("default", []byte(secret)); err != nil {
+		return nil, err
+	}
+	if err := ring.SetActive("default"); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+var keyRing *KeyRing
+
+// SetKeyRing sets the key ring used to sign and verify access tokens
+func SetKeyRing(ring *KeyRing) {
+	keyRing = ring
+}
+
+// currentKeyRing falls back to JWT_SECRET_KEY when no ring has been set
+func currentKeyRing() (*KeyRing, error) {
+	if keyRing != nil {
+		return keyRing, nil
+	}
+	return secretKeyRing(os.Getenv("JWT_SECRET_KEY"))
+}
+
+// JWKS publishes the public signing keys so other services can verify tokens
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	ring, err := currentKeyRing()
+	if err != nil {
+		http.Error(w, "Signing keys unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]JWK{"keys": ring.PublicKeys()})
+}
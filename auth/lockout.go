@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Failed logins are counted per email and per client IP within a sliding window.
+// Once a counter reaches its threshold every further failure locks that key out,
+// doubling the lockout each time up to maxLockout.
+const (
+	attemptWindow      = 15 * time.Minute
+	emailFailThreshold = 5
+	ipFailThreshold    = 20
+	baseLockout        = time.Minute
+	maxLockout         = time.Hour
+)
+
+// dummyHash is compared against when the account does not exist so that a failed
+// login takes the same time whether or not the email is registered
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+// FailureLimiter counts failures per value, such as an email, within attemptWindow.
+// Once the count reaches Threshold every further failure locks the value out,
+// doubling the lockout each time up to maxLockout. Each limiter keeps its
+// counters under its own Prefix.
+type FailureLimiter struct {
+	Prefix    string
+	Threshold int64
+}
+
+var (
+	emailLimiter = FailureLimiter{Prefix: "login_email", Threshold: emailFailThreshold}
+	ipLimiter    = FailureLimiter{Prefix: "login_ip", Threshold: ipFailThreshold}
+)
+
+func (l FailureLimiter) attemptsKey(value string) string {
+	return l.Prefix + "_attempts:" + value
+}
+
+func (l FailureLimiter) lockKey(value string) string {
+	return l.Prefix + "_lock:" + value
+}
+
+// clientIP returns the caller's address. X-Forwarded-For is only trusted when
+// TRUST_PROXY_HEADERS is "true", i.e. when the service runs behind a proxy.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginLockedFor returns how long the email or IP is still locked out, or zero
+func loginLockedFor(email, ip string) time.Duration {
+	wait := emailLimiter.LockedFor(strings.ToLower(email))
+	if ipWait := ipLimiter.LockedFor(ip); ipWait > wait {
+		wait = ipWait
+	}
+	return wait
+}
+
+// recordLoginFailure counts a failed login for the email and the IP
+func recordLoginFailure(email, ip string) {
+	emailLimiter.RecordFailure(strings.ToLower(email))
+	ipLimiter.RecordFailure(ip)
+}
+
+// LockedFor returns how long value is still locked out, or zero
+func (l FailureLimiter) LockedFor(value string) time.Duration {
+	if redisClient == nil {
+		return 0
+	}
+	ttl, err := redisClient.PTTL(ctx, l.lockKey(value)).Result()
+	if err != nil || ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// RecordFailure counts a failure for value and locks it out once over the threshold
+func (l FailureLimiter) RecordFailure(value string) {
+	if redisClient == nil {
+		return
+	}
+
+	key := l.attemptsKey(value)
+	failures, err := redisClient.Incr(ctx, key).Result()
+	if err != nil {
+		return
+	}
+	if failures == 1 {
+		redisClient.Expire(ctx, key, attemptWindow)
+	}
+	if failures >= l.Threshold {
+		redisClient.Set(ctx, l.lockKey(value), 1, lockoutDuration(failures-l.Threshold))
+	}
+}
+
+// Clear resets the counter and lifts the lockout of value
+func (l FailureLimiter) Clear(value string) error {
+	if redisClient == nil {
+		return nil
+	}
+	return redisClient.Del(ctx, l.attemptsKey(value), l.lockKey(value)).Err()
+}
+
+func lockoutDuration(excess int64) time.Duration {
+	if excess >= 6 {
+		return maxLockout
+	}
+	lockout := baseLockout << uint(excess)
+	if lockout > maxLockout {
+		return maxLockout
+	}
+	return lockout
+}
+
+// clearLoginFailures resets the counters for an email after a successful login
+func clearLoginFailures(email string) {
+	emailLimiter.Clear(strings.ToLower(email))
+}
+
+// ClearLockout lets an admin lift the lockout of an email and/or IP address.
+// Query parameters: email, ip.
+func ClearLockout(w http.ResponseWriter, r *http.Request) {
+	email := strings.ToLower(r.URL.Query().Get("email"))
+	ip := r.URL.Query().Get("ip")
+	if email == "" && ip == "" {
+		http.Error(w, "email or ip is required", http.StatusBadRequest)
+		return
+	}
+	if redisClient == nil {
+		http.Error(w, "Lockout store unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	var err error
+	if email != "" {
+		err = emailLimiter.Clear(email)
+	}
+	if ip != "" && err == nil {
+		err = ipLimiter.Clear(ip)
+	}
+	if err != nil {
+		http.Error(w, "Failed to clear lockout", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Lockout cleared"})
+}
+
+// WriteLockedOut answers 429 with message and a Retry-After header of wait
+func WriteLockedOut(w http.ResponseWriter, wait time.Duration, message string) {
+	seconds := int(wait.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
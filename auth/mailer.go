@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain-text email
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer delivers mail through an SMTP server
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+// Send implements Mailer
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var smtpAuth smtp.Auth
+	if m.Username != "" {
+		host := m.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		smtpAuth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, smtpAuth, m.From, []string{to}, formatMessage(m.From, to, subject, body))
+}
+
+// OutboxMailer writes each message to a file in Dir and logs it instead of
+// delivering it, for local development
+type OutboxMailer struct {
+	Dir  string
+	From string
+}
+
+// Send implements Mailer
+func (m *OutboxMailer) Send(to, subject, body string) error {
+	if err := os.MkdirAll(m.Dir, os.ModePerm); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(to))
+	path := filepath.Join(m.Dir, name)
+	if err := os.WriteFile(path, formatMessage(m.From, to, subject, body), 0600); err != nil {
+		return err
+	}
+	log.Printf("Mail to %s (%s) written to %s", to, subject, path)
+	return nil
+}
+
+func formatMessage(from, to, subject, body string) []byte {
+	return []byte("From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body + "\r\n")
+}
+
+// NewMailerFromEnv returns an SMTPMailer when MAIL_DRIVER is "smtp" and an
+// OutboxMailer writing to MAIL_OUTBOX_DIR (default "outbox") otherwise
+func NewMailerFromEnv() Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	if os.Getenv("MAIL_DRIVER") == "smtp" {
+		return &SMTPMailer{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	}
+
+	dir := os.Getenv("MAIL_OUTBOX_DIR")
+	if dir == "" {
+		dir = "outbox"
+	}
+	return &OutboxMailer{Dir: dir, From: from}
+}
+
+var mailer Mailer
+
+// SetMailer sets the mailer used for verification and password reset mail
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+func sendMail(to, subject, body string) {
+	if mailer == nil {
+		log.Printf("No mailer configured, dropping mail to %s (%s)", to, subject)
+		return
+	}
+	if err := mailer.Send(to, subject, body); err != nil {
+		log.Printf("Failed to send mail to %s (%s): %v", to, subject, err)
+	}
+}
@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"go_backend_legalForce/models"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	recoveryCodeCount = 10
+	maxMFAAttempts    = 5
+	defaultMFAIssuer  = "LegalForce"
+)
+
+// mfaLimiter counts wrong codes per user across challenges, so logging in again
+// does not buy more guesses. Only a correct code clears it.
+var mfaLimiter = FailureLimiter{Prefix: "mfa_user", Threshold: maxMFAAttempts}
+
+// newRecoveryCodes returns fresh codes formatted as xxxxx-xxxxx
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(buf))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+	}
+	return codes, nil
+}
+
+func recoveryCodeHash(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// markTOTPStepUsed records that the user's code for a time step has been spent and
+// reports false if it, or a code of a later step, already was. The last step
+// spent is kept with the user, so codes cannot be replayed on any instance.
+func markTOTPStepUsed(userID int, step int64) (bool, error) {
+	result, err := db.Exec("UPDATE users SET totp_last_step = $1 WHERE id = $2 AND (totp_last_step IS NULL OR totp_last_step < $1)",
+		step, userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery code.
+// A TOTP code is only accepted once, and a recovery code is consumed on use.
+func verifySecondFactor(userID int, secret, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if step, ok := validateTOTP(secret, code, time.Now()); ok {
+		return markTOTPStepUsed(userID, step)
+	}
+
+	result, err := db.Exec("UPDATE mfa_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID, recoveryCodeHash(code))
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
+// EnrollMFA generates a pending TOTP secret for the current user. The second
+// factor only takes effect once a code from it is confirmed with ConfirmMFA.
+func EnrollMFA(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var enabled bool
+	err := db.QueryRow("SELECT totp_enabled FROM users WHERE id = $1", user.ID).Scan(&enabled)
+	if err != nil {
+		http.Error(w, "Failed to load user", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec("UPDATE users SET totp_secret = $1 WHERE id = $2", secret, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to save secret", http.StatusInternalServerError)
+		return
+	}
+
+	issuer := os.Getenv("MFA_ISSUER")
+	if issuer == "" {
+		issuer = defaultMFAIssuer
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": otpauthURI(issuer, user.Email, secret),
+	})
+}
+
+// ConfirmMFA enables the pending TOTP secret once the user proves they can
+// generate codes from it, and returns recovery codes. They are shown only once.
+func ConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	var secret sql.NullString
+	var enabled bool
+	err := db.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = $1", user.ID).Scan(&secret, &enabled)
+	if err != nil {
+		http.Error(w, "Failed to load user", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if !secret.Valid || secret.String == "" {
+		http.Error(w, "Start enrollment first", http.StatusBadRequest)
+		return
+	}
+	step, ok := validateTOTP(secret.String, strings.TrimSpace(req.Code), time.Now())
+	if ok {
+		ok, err = markTOTPStepUsed(user.ID, step)
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET totp_enabled = TRUE WHERE id = $1", user.ID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = $1", user.ID)
+	}
+	for _, code := range codes {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)", user.ID, recoveryCodeHash(code))
+	}
+	if err != nil || tx.Commit() != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DisableMFA turns the second factor off after checking a TOTP or recovery code
+func DisableMFA(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	var secret sql.NullString
+	var enabled bool
+	err := db.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = $1", user.ID).Scan(&secret, &enabled)
+	if err != nil {
+		http.Error(w, "Failed to load user", http.StatusInternalServerError)
+		return
+	}
+	if !enabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	valid, err := verifySecondFactor(user.ID, secret.String, req.Code)
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec("UPDATE users SET totp_enabled = FALSE, totp_secret = NULL WHERE id = $1", user.ID)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = $1", user.ID)
+	}
+	if err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// VerifyMFALogin exchanges the challenge token from LoginUser plus a TOTP or
+// recovery code for a full token pair. Each challenge allows a few attempts and
+// can only be redeemed once, and a user who keeps sending wrong codes is locked
+// out whatever challenge they come with.
+func VerifyMFALogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := parseToken(req.MFAToken, tokenTypeMFAChallenge)
+	if err != nil {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	if denied, err := IsTokenDenied(challenge.ID); err != nil || denied {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+	userKey := strconv.Itoa(challenge.UserID)
+	if wait := mfaLimiter.LockedFor(userKey); wait > 0 {
+		WriteLockedOut(w, wait, "Too many invalid codes, try again later")
+		return
+	}
+	if redisClient != nil {
+		key := "mfa_attempts:" + challenge.ID
+		attempts, err := redisClient.Incr(ctx, key).Result()
+		if err != nil {
+			http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+			return
+		}
+		redisClient.ExpireAt(ctx, key, challenge.ExpiresAt)
+		if attempts > maxMFAAttempts {
+			DenyToken(challenge.ID, challenge.ExpiresAt)
+			http.Error(w, "Too many attempts, log in again", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var user models.User
+	var secret sql.NullString
+	var enabled bool
+	err = db.QueryRow("SELECT id, email, role, disabled, totp_secret, totp_enabled FROM users WHERE id = $1", challenge.UserID).
+		Scan(&user.ID, &user.Email, &user.Role, &user.Disabled, &secret, &enabled)
+	if err != nil || user.Disabled || !enabled {
+		http.Error(w, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	valid, err := verifySecondFactor(user.ID, secret.String, req.Code)
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		mfaLimiter.RecordFailure(userKey)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if err := mfaLimiter.Clear(userKey); err != nil {
+		log.Printf("Failed to clear MFA failures of user %d: %v", user.ID, err)
+	}
+
+	if redisClient != nil {
+		if err := DenyToken(challenge.ID, challenge.ExpiresAt); err != nil {
+			log.Printf("Failed to deny MFA challenge %s: %v", challenge.ID, err)
+		}
+	}
+
+	tokens, err := IssueTokens(user)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
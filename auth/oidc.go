@@ -0,0 +1,516 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go_backend_legalForce/models"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+var (
+	errIDTokenInvalid   = errors.New("invalid id token")
+	errEmailNotVerified = errors.New("identity provider has not verified the email address")
+
+	validProviderName = regexp.MustCompile(`^[a-z0-9-]+$`)
+	oidcHTTPClient    = &http.Client{Timeout: 10 * time.Second}
+)
+
+// OIDCProvider is an OpenID Connect identity provider users can log in with. Only
+// ID tokens from the issuers of configured providers are accepted.
+type OIDCProvider struct {
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// oidcDiscovery is the part of the provider's discovery document we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLoginState is kept in Redis between the redirect to the provider and the callback
+type oidcLoginState struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// oidcIdentity is the verified result of a provider login
+type oidcIdentity struct {
+	Issuer  string
+	Subject string
+	Email   string
+}
+
+var oidcProviders = map[string]*OIDCProvider{}
+
+// LoadOIDCProviders reads the providers from the JSON file named by
+// OIDC_PROVIDERS_FILE, laid out as {"providers": [...]}. Without it, OIDC login is off.
+func LoadOIDCProviders() ([]*OIDCProvider, error) {
+	path := os.Getenv("OIDC_PROVIDERS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Providers []*OIDCProvider `json:"providers"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for _, p := range config.Providers {
+		if !validProviderName.MatchString(p.Name) {
+			return nil, fmt.Errorf("provider %q: name must be lower-case letters, digits and dashes", p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("provider %q: duplicate name", p.Name)
+		}
+		if p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "" {
+			return nil, fmt.Errorf("provider %q: issuer, client_id and redirect_url are required", p.Name)
+		}
+		seen[p.Name] = true
+	}
+	return config.Providers, nil
+}
+
+// SetOIDCProviders sets the identity providers users can log in with
+func SetOIDCProviders(providers []*OIDCProvider) {
+	byName := make(map[string]*OIDCProvider, len(providers))
+	for _, p := range providers {
+		byName[p.Name] = p
+	}
+	oidcProviders = byName
+}
+
+func getJSON(endpoint string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// metadata fetches the discovery document once and keeps it
+func (p *OIDCProvider) metadata() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var doc oidcDiscovery
+	if err := getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, err
+	}
+	if doc.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", doc.Issuer, p.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	p.discovery = &doc
+	return p.discovery, nil
+}
+
+// publicKey returns the provider's signing key by kid. An unknown kid refreshes the
+// key set once, so keys rotated at the provider are picked up.
+func (p *OIDCProvider) publicKey(kid string) (*rsa.PublicKey, error) {
+	meta, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := getJSON(meta.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		if key, err := rsaPublicKey(jwk); err == nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+	p.keys = keys
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func rsaPublicKey(jwk JWK) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() < 3 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+func randomURLToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// pkceChallenge derives the S256 code challenge for a verifier (RFC 7636)
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func oidcStateKey(state string) string {
+	return "oidc_state:" + state
+}
+
+// exchangeCode redeems the authorization code at the token endpoint and returns the ID token
+func (p *OIDCProvider) exchangeCode(code, verifier string) (string, error) {
+	meta, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token endpoint returned no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry and nonce
+// and requires an email address the provider has verified
+func (p *OIDCProvider) verifyIDToken(raw, nonce string) (oidcIdentity, error) {
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != AlgRS256 {
+			return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.publicKey(kid)
+	})
+	if err != nil || !token.Valid {
+		return oidcIdentity{}, errIDTokenInvalid
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !claims.VerifyExpiresAt(time.Now().Unix(), true) || !claims.VerifyIssuer(p.Issuer, true) {
+		return oidcIdentity{}, errIDTokenInvalid
+	}
+	if !audienceContains(claims["aud"], p.ClientID) {
+		return oidcIdentity{}, errIDTokenInvalid
+	}
+	tokenNonce, _ := claims["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return oidcIdentity{}, errIDTokenInvalid
+	}
+
+	subject, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	if subject == "" {
+		return oidcIdentity{}, errIDTokenInvalid
+	}
+	if !validEmail(email) || !claimTrue(claims["email_verified"]) {
+		return oidcIdentity{}, errEmailNotVerified
+	}
+	return oidcIdentity{Issuer: p.Issuer, Subject: subject, Email: email}, nil
+}
+
+// audienceContains accepts aud as a single string or a list of strings
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimTrue accepts true or "true", since some providers send booleans as strings
+func claimTrue(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// linkOIDCIdentity returns the user an identity belongs to. The first login links
+// the identity to the account with the same email, or creates that account.
+func linkOIDCIdentity(identity oidcIdentity) (models.User, bool, error) {
+	var user models.User
+	var totpEnabled bool
+	err := db.QueryRow(`SELECT u.id, u.email, u.role, u.disabled, u.totp_enabled FROM user_identities i
+		JOIN users u ON u.id = i.user_id WHERE i.issuer = $1 AND i.subject = $2`, identity.Issuer, identity.Subject).
+		Scan(&user.ID, &user.Email, &user.Role, &user.Disabled, &totpEnabled)
+	if err == nil {
+		user.EmailVerified = true
+		return user, totpEnabled, nil
+	}
+	if err != sql.ErrNoRows {
+		return user, false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return user, false, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT id, email, role, disabled, totp_enabled FROM users WHERE email = $1", identity.Email).
+		Scan(&user.ID, &user.Email, &user.Role, &user.Disabled, &totpEnabled)
+	switch {
+	case err == sql.ErrNoRows:
+		// Provisioned accounts get a random password nobody knows; a password can
+		// be set later through the reset flow
+		password, err := randomURLToken()
+		if err != nil {
+			return user, false, err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return user, false, err
+		}
+		user.Email = identity.Email
+		err = tx.QueryRow("INSERT INTO users (email, password, email_verified) VALUES ($1, $2, TRUE) RETURNING id, role",
+			identity.Email, string(hash)).Scan(&user.ID, &user.Role)
+		if err != nil {
+			return user, false, err
+		}
+	case err != nil:
+		return user, false, err
+	default:
+		// The provider has proven control of the address
+		if _, err := tx.Exec("UPDATE users SET email_verified = TRUE WHERE id = $1", user.ID); err != nil {
+			return user, false, err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO user_identities (user_id, issuer, subject, email) VALUES ($1, $2, $3, $4)",
+		user.ID, identity.Issuer, identity.Subject, identity.Email)
+	if err != nil {
+		return user, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return user, false, err
+	}
+	user.EmailVerified = true
+	return user, totpEnabled, nil
+}
+
+// OIDCLogin starts an authorization code login with PKCE by redirecting to the provider
+func OIDCLogin(w http.ResponseWriter, r *http.Request, providerName string) {
+	provider, ok := oidcProviders[providerName]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+	if redisClient == nil {
+		http.Error(w, "Login unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	meta, err := provider.metadata()
+	if err != nil {
+		log.Printf("OIDC discovery for %s failed: %v", provider.Name, err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	var state, nonce, verifier string
+	for _, v := range []*string{&state, &nonce, &verifier} {
+		if *v, err = randomURLToken(); err != nil {
+			http.Error(w, "Failed to start login", http.StatusInternalServerError)
+			return
+		}
+	}
+	data, _ := json.Marshal(oidcLoginState{Provider: provider.Name, Nonce: nonce, Verifier: verifier})
+	if err := redisClient.Set(ctx, oidcStateKey(state), data, oidcStateTTL).Err(); err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	scopes := provider.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	authURL, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.ClientID)
+	query.Set("redirect_uri", provider.RedirectURL)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	http.Redirect(w, r, authURL.String(), http.StatusFound)
+}
+
+// OIDCCallback completes a provider login and responds like LoginUser
+func OIDCCallback(w http.ResponseWriter, r *http.Request, providerName string) {
+	provider, ok := oidcProviders[providerName]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+	if redisClient == nil {
+		http.Error(w, "Login unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		http.Error(w, "Identity provider login failed", http.StatusUnauthorized)
+		return
+	}
+
+	// The state is single use and must have been issued for this provider
+	data, err := redisClient.GetDel(ctx, oidcStateKey(query.Get("state"))).Bytes()
+	if err == redis.Nil || query.Get("state") == "" {
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Login unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var state oidcLoginState
+	if err := json.Unmarshal(data, &state); err != nil || state.Provider != provider.Name {
+		http.Error(w, "Invalid or expired login state", http.StatusBadRequest)
+		return
+	}
+
+	rawIDToken, err := provider.exchangeCode(query.Get("code"), state.Verifier)
+	if err != nil {
+		log.Printf("OIDC code exchange with %s failed: %v", provider.Name, err)
+		http.Error(w, "Identity provider login failed", http.StatusUnauthorized)
+		return
+	}
+	identity, err := provider.verifyIDToken(rawIDToken, state.Nonce)
+	if err == errEmailNotVerified {
+		http.Error(w, "Email not verified by identity provider", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("OIDC ID token from %s rejected: %v", provider.Name, err)
+		http.Error(w, "Identity provider login failed", http.StatusUnauthorized)
+		return
+	}
+
+	user, totpEnabled, err := linkOIDCIdentity(identity)
+	if err != nil {
+		log.Printf("Failed to link OIDC identity: %v", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if user.Disabled {
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
+
+	completeLogin(w, user, totpEnabled)
+}
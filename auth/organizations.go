@@ -0,0 +1,455 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"go_backend_legalForce/models"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	invitationTTL    = 7 * 24 * time.Hour
+	maxOrgNameLength = 100
+)
+
+var validOrgRoles = map[string]bool{
+	models.OrgRoleOwner:  true,
+	models.OrgRoleAdmin:  true,
+	models.OrgRoleMember: true,
+}
+
+// GetMembership returns the user's role in the organization, or sql.ErrNoRows if
+// they are not a member
+func GetMembership(orgID, userID int) (models.Membership, error) {
+	membership := models.Membership{OrgID: orgID, UserID: userID}
+	err := db.QueryRow("SELECT role FROM org_members WHERE org_id = $1 AND user_id = $2", orgID, userID).
+		Scan(&membership.Role)
+	return membership, err
+}
+
+// requireOrgRole looks up the caller's membership and writes an error unless it has
+// one of the roles. Non-members get 404 so they cannot probe which organizations exist.
+func requireOrgRole(w http.ResponseWriter, orgID, userID int, roles ...string) (models.Membership, bool) {
+	membership, err := GetMembership(orgID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return membership, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to look up membership", http.StatusInternalServerError)
+		return membership, false
+	}
+	if len(roles) == 0 {
+		return membership, true
+	}
+	for _, role := range roles {
+		if membership.Role == role {
+			return membership, true
+		}
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return membership, false
+}
+
+func countOwners(orgID int) (int, error) {
+	var owners int
+	err := db.QueryRow("SELECT COUNT(*) FROM org_members WHERE org_id = $1 AND role = $2", orgID, models.OrgRoleOwner).
+		Scan(&owners)
+	return owners, err
+}
+
+// CreateOrganization creates an organization with the caller as its owner
+func CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxOrgNameLength {
+		http.Error(w, "Name must be between 1 and 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to create organization", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	org := models.Organization{Name: req.Name, Role: models.OrgRoleOwner}
+	err = tx.QueryRow("INSERT INTO organizations (name) VALUES ($1) RETURNING id, created_at", org.Name).
+		Scan(&org.ID, &org.CreatedAt)
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)",
+			org.ID, user.ID, models.OrgRoleOwner)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to create organization: %v", err)
+		http.Error(w, "Failed to create organization", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(org)
+}
+
+// ListOrganizations returns the organizations the caller belongs to with their role in each
+func ListOrganizations(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := db.Query(`SELECT o.id, o.name, m.role, o.created_at FROM organizations o
+		JOIN org_members m ON m.org_id = o.id WHERE m.user_id = $1 ORDER BY o.id`, user.ID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve organizations", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	orgs := []models.Organization{}
+	for rows.Next() {
+		var org models.Organization
+		if err := rows.Scan(&org.ID, &org.Name, &org.Role, &org.CreatedAt); err != nil {
+			http.Error(w, "Failed to scan organization", http.StatusInternalServerError)
+			return
+		}
+		orgs = append(orgs, org)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(orgs)
+}
+
+// ListMembers returns the members of an organization the caller belongs to
+func ListMembers(w http.ResponseWriter, r *http.Request, orgID int) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if _, ok := requireOrgRole(w, orgID, user.ID); !ok {
+		return
+	}
+
+	rows, err := db.Query(`SELECT m.user_id, u.email, m.role FROM org_members m
+		JOIN users u ON u.id = m.user_id WHERE m.org_id = $1 ORDER BY m.user_id`, orgID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve members", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	members := []models.Membership{}
+	for rows.Next() {
+		member := models.Membership{OrgID: orgID}
+		if err := rows.Scan(&member.UserID, &member.Email, &member.Role); err != nil {
+			http.Error(w, "Failed to scan member", http.StatusInternalServerError)
+			return
+		}
+		members = append(members, member)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(members)
+}
+
+// UpdateMemberRole changes a member's role. Admins manage admins and members; only
+// owners can grant or take away ownership. The last owner cannot be demoted.
+func UpdateMemberRole(w http.ResponseWriter, r *http.Request, orgID, memberID int) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	caller, ok := requireOrgRole(w, orgID, user.ID, models.OrgRoleOwner, models.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validOrgRoles[req.Role] {
+		http.Error(w, "Role must be owner, admin or member", http.StatusBadRequest)
+		return
+	}
+
+	target, err := GetMembership(orgID, memberID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to look up membership", http.StatusInternalServerError)
+		return
+	}
+
+	if (target.Role == models.OrgRoleOwner || req.Role == models.OrgRoleOwner) && caller.Role != models.OrgRoleOwner {
+		http.Error(w, "Only owners can change ownership", http.StatusForbidden)
+		return
+	}
+	if target.Role == models.OrgRoleOwner && req.Role != models.OrgRoleOwner {
+		if owners, err := countOwners(orgID); err != nil || owners <= 1 {
+			http.Error(w, "An organization needs at least one owner", http.StatusConflict)
+			return
+		}
+	}
+
+	_, err = db.Exec("UPDATE org_members SET role = $1 WHERE org_id = $2 AND user_id = $3", req.Role, orgID, memberID)
+	if err != nil {
+		http.Error(w, "Failed to update member", http.StatusInternalServerError)
+		return
+	}
+
+	target.Role = req.Role
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(target)
+}
+
+// RemoveMember removes a member from an organization. Any member may remove
+// themselves; owners and admins may remove others, but only owners remove owners.
+func RemoveMember(w http.ResponseWriter, r *http.Request, orgID, memberID int) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var caller models.Membership
+	if memberID == user.ID {
+		caller, ok = requireOrgRole(w, orgID, user.ID)
+	} else {
+		caller, ok = requireOrgRole(w, orgID, user.ID, models.OrgRoleOwner, models.OrgRoleAdmin)
+	}
+	if !ok {
+		return
+	}
+
+	target, err := GetMembership(orgID, memberID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to look up membership", http.StatusInternalServerError)
+		return
+	}
+	if target.Role == models.OrgRoleOwner {
+		if caller.Role != models.OrgRoleOwner {
+			http.Error(w, "Only owners can remove owners", http.StatusForbidden)
+			return
+		}
+		if owners, err := countOwners(orgID); err != nil || owners <= 1 {
+			http.Error(w, "An organization needs at least one owner", http.StatusConflict)
+			return
+		}
+	}
+
+	_, err = db.Exec("DELETE FROM org_members WHERE org_id = $1 AND user_id = $2", orgID, memberID)
+	if err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Member removed"})
+}
+
+func invitationTokenHash(token string) string {
+	sum := sha256.Sum256([]byte("org_invitation:" + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateInvitation emails an invitation to join the organization. Admins can invite
+// admins and members; only owners can invite owners.
+func CreateInvitation(w http.ResponseWriter, r *http.Request, orgID int) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	caller, ok := requireOrgRole(w, orgID, user.ID, models.OrgRoleOwner, models.OrgRoleAdmin)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validEmail(req.Email) {
+		http.Error(w, "A valid email address is required", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = models.OrgRoleMember
+	}
+	if !validOrgRoles[req.Role] {
+		http.Error(w, "Role must be owner, admin or member", http.StatusBadRequest)
+		return
+	}
+	if req.Role == models.OrgRoleOwner && caller.Role != models.OrgRoleOwner {
+		http.Error(w, "Only owners can invite owners", http.StatusForbidden)
+		return
+	}
+
+	token, err := randomURLToken()
+	if err != nil {
+		http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+		return
+	}
+	invitation := models.Invitation{OrgID: orgID, Email: req.Email, Role: req.Role, InvitedBy: user.ID,
+		ExpiresAt: time.Now().Add(invitationTTL)}
+	var orgName string
+	err = db.QueryRow(`INSERT INTO org_invitations (org_id, email, role, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at, (SELECT name FROM organizations WHERE id = $1)`,
+		orgID, invitation.Email, invitation.Role, invitationTokenHash(token), user.ID, invitation.ExpiresAt).
+		Scan(&invitation.ID, &invitation.CreatedAt, &orgName)
+	if err != nil {
+		log.Printf("Failed to create invitation: %v", err)
+		http.Error(w, "Failed to create invitation", http.StatusInternalServerError)
+		return
+	}
+
+	sendMail(invitation.Email, "You have been invited to "+orgName,
+		user.Email+" invited you to join "+orgName+" as "+invitation.Role+".\n\n"+
+			"Log in or register with this address and accept the invitation with the token below. "+
+			"It expires in 7 days.\n\n"+token+"\n")
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invitation)
+}
+
+// ListInvitations returns the organization's pending invitations
+func ListInvitations(w http.ResponseWriter, r *http.Request, orgID int) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if _, ok := requireOrgRole(w, orgID, user.ID, models.OrgRoleOwner, models.OrgRoleAdmin); !ok {
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, email, role, invited_by, expires_at, created_at FROM org_invitations
+		WHERE org_id = $1 AND accepted_at IS NULL AND expires_at > NOW() ORDER BY id`, orgID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve invitations", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	invitations := []models.Invitation{}
+	for rows.Next() {
+		invitation := models.Invitation{OrgID: orgID}
+		err := rows.Scan(&invitation.ID, &invitation.Email, &invitation.Role, &invitation.InvitedBy,
+			&invitation.ExpiresAt, &invitation.CreatedAt)
+		if err != nil {
+			http.Error(w, "Failed to scan invitation", http.StatusInternalServerError)
+			return
+		}
+		invitations = append(invitations, invitation)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(invitations)
+}
+
+// RevokeInvitation deletes a pending invitation
+func RevokeInvitation(w http.ResponseWriter, r *http.Request, orgID, invitationID int) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if _, ok := requireOrgRole(w, orgID, user.ID, models.OrgRoleOwner, models.OrgRoleAdmin); !ok {
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM org_invitations WHERE id = $1 AND org_id = $2 AND accepted_at IS NULL",
+		invitationID, orgID)
+	if err != nil {
+		http.Error(w, "Failed to revoke invitation", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Invitation revoked"})
+}
+
+// AcceptInvitation adds the caller to the organization. The invitation must have
+// been sent to the caller's email address.
+func AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	membership := models.Membership{UserID: user.ID}
+	err = tx.QueryRow(`UPDATE org_invitations SET accepted_at = NOW()
+		WHERE token_hash = $1 AND lower(email) = lower($2) AND accepted_at IS NULL AND expires_at > NOW()
+		RETURNING org_id, role`, invitationTokenHash(req.Token), user.Email).
+		Scan(&membership.OrgID, &membership.Role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid or expired invitation", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		// Someone who is already a member keeps their current role
+		err = tx.QueryRow(`INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3)
+			ON CONFLICT (org_id, user_id) DO UPDATE SET role = org_members.role RETURNING role`,
+			membership.OrgID, user.ID, membership.Role).Scan(&membership.Role)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to accept invitation: %v", err)
+		http.Error(w, "Failed to accept invitation", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(membership)
+}
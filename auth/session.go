@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"go_backend_legalForce/models"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+var ctx = context.Background()
+
+var (
+	ErrTokenReused      = errors.New("refresh token reused")
+	ErrStoreUnavailable = errors.New("token store unavailable")
+)
+
+// TokenPair is returned to clients on login and refresh
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// Redis layout:
+//   refresh_token:<sha256>  hash {user_id, family, used}  one per issued refresh token
+//   refresh_family:<id>     hash {user_id, access_jti, access_exp}  exists while the family is live
+//   user_families:<user_id> set of live family IDs
+//   denied_jti:<jti>        present until the revoked access token would have expired
+
+func refreshKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "refresh_token:" + hex.EncodeToString(sum[:])
+}
+
+func familyKey(family string) string {
+	return "refresh_family:" + family
+}
+
+func userFamiliesKey(userID int) string {
+	return "user_families:" + strconv.Itoa(userID)
+}
+
+func deniedKey(jti string) string {
+	return "denied_jti:" + jti
+}
+
+// IssueTokens starts a new refresh family for the user and returns its first token pair
+func IssueTokens(user models.User) (TokenPair, error) {
+	return issueInFamily(user, uuid.New().String())
+}
+
+func issueInFamily(user models.User, family string) (TokenPair, error) {
+	if redisClient == nil {
+		return TokenPair{}, ErrStoreUnavailable
+	}
+
+	accessToken, claims, err := GenerateToken(user, family)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return TokenPair{}, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(buf)
+
+	pipe := redisClient.TxPipeline()
+	pipe.HSet(ctx, familyKey(family), "user_id", user.ID, "access_jti", claims.ID, "access_exp", claims.ExpiresAt.Unix())
+	pipe.Expire(ctx, familyKey(family), refreshTokenTTL)
+	pipe.SAdd(ctx, userFamiliesKey(user.ID), family)
+	pipe.Expire(ctx, userFamiliesKey(user.ID), refreshTokenTTL)
+	pipe.HSet(ctx, refreshKey(refreshToken), "user_id", user.ID, "family", family, "used", 0)
+	pipe.Expire(ctx, refreshKey(refreshToken), refreshTokenTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new pair in the same family.
+// Presenting a token that was already exchanged revokes the whole family.
+func RotateRefreshToken(refreshToken string) (TokenPair, error) {
+	if redisClient == nil {
+		return TokenPair{}, ErrStoreUnavailable
+	}
+
+	key := refreshKey(refreshToken)
+	record, err := redisClient.HGetAll(ctx, key).Result()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if len(record) == 0 {
+		return TokenPair{}, ErrInvalidToken
+	}
+	family := record["family"]
+
+	// HINCRBY is atomic, so only one of several concurrent exchanges sees 1
+	used, err := redisClient.HIncrBy(ctx, key, "used", 1).Result()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if used > 1 {
+		if err := RevokeFamily(family); err != nil {
+			return TokenPair{}, err
+		}
+		return TokenPair{}, ErrTokenReused
+	}
+
+	live, err := redisClient.Exists(ctx, familyKey(family)).Result()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if live == 0 {
+		return TokenPair{}, ErrInvalidToken
+	}
+
+	userID, _ := strconv.Atoi(record["user_id"])
+	user, err := GetUserByID(userID)
+	if err != nil || user.Disabled {
+		return TokenPair{}, ErrInvalidToken
+	}
+
+	return issueInFamily(user, family)
+}
+
+// RevokeFamily ends a refresh family and denies the latest access token issued in it
+func RevokeFamily(family string) error {
+	if redisClient == nil {
+		return ErrStoreUnavailable
+	}
+
+	record, err := redisClient.HGetAll(ctx, familyKey(family)).Result()
+	if err != nil {
+		return err
+	}
+	if len(record) == 0 {
+		return nil
+	}
+
+	if jti := record["access_jti"]; jti != "" {
+		exp, _ := strconv.ParseInt(record["access_exp"], 10, 64)
+		if err := DenyToken(jti, time.Unix(exp, 0)); err != nil {
+			return err
+		}
+	}
+
+	userID, _ := strconv.Atoi(record["user_id"])
+	pipe := redisClient.TxPipeline()
+	pipe.Del(ctx, familyKey(family))
+	pipe.SRem(ctx, userFamiliesKey(userID), family)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// RevokeUserSessions revokes every refresh family belonging to the user
+func RevokeUserSessions(userID int) error {
+	if redisClient == nil {
+		return ErrStoreUnavailable
+	}
+
+	families, err := redisClient.SMembers(ctx, userFamiliesKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		if err := RevokeFamily(family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DenyToken adds an access token's jti to the denylist until it would have expired
+func DenyToken(jti string, expiresAt time.Time) error {
+	if redisClient == nil {
+		return ErrStoreUnavailable
+	}
+
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return redisClient.Set(ctx, deniedKey(jti), 1, ttl).Err()
+}
+
+// IsTokenDenied reports whether an access token has been revoked
+func IsTokenDenied(jti string) (bool, error) {
+	if redisClient == nil {
+		return false, nil
+	}
+
+	err := redisClient.Get(ctx, deniedKey(jti)).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"errors"
+	"go_backend_legalForce/models"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+)
+
+const (
+	accessTokenTTL       = 15 * time.Minute
+	mfaChallengeTokenTTL = 5 * time.Minute
+)
+
+// Token types, carried in the "typ" claim so a token issued for one purpose is
+// never accepted for another
+const (
+	tokenTypeAccess       = "access"
+	tokenTypeMFAChallenge = "mfa_challenge"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims holds the fields of a validated token
+type Claims struct {
+	UserID    int
+	Role      string
+	ID        string // jti, used as the denylist key
+	Family    string // refresh family the token was issued in, empty if none
+	ExpiresAt time.Time
+}
+
+// GenerateToken issues a short-lived access token whose subject is the user's ID
+func GenerateToken(user models.User, family string) (string, Claims, error) {
+	return signToken(tokenTypeAccess, user, family, accessTokenTTL)
+}
+
+// ParseToken validates an access token and returns its claims
+func ParseToken(tokenString string) (Claims, error) {
+	return parseToken(tokenString, tokenTypeAccess)
+}
+
+// generateMFAChallenge issues the intermediate token returned by login when the
+// account has a second factor; it can only be exchanged at /login/mfa
+func generateMFAChallenge(user models.User) (string, Claims, error) {
+	return signToken(tokenTypeMFAChallenge, user, "", mfaChallengeTokenTTL)
+}
+
+func signToken(tokenType string, user models.User, family string, ttl time.Duration) (string, Claims, error) {
+	claims := Claims{
+		UserID:    user.ID,
+		Role:      user.Role,
+		ID:        uuid.New().String(),
+		Family:    family,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	ring, err := currentKeyRing()
+	if err != nil {
+		return "", Claims{}, err
+	}
+	tokenString, err := ring.Sign(jwt.MapClaims{
+		"typ":   tokenType,
+		"sub":   strconv.Itoa(user.ID),
+		"email": user.Email,
+		"role":  user.Role,
+		"jti":   claims.ID,
+		"fam":   family,
+		"exp":   claims.ExpiresAt.Unix(),
+	})
+	return tokenString, claims, err
+}
+
+func parseToken(tokenString, tokenType string) (Claims, error) {
+	ring, err := currentKeyRing()
+	if err != nil {
+		return Claims{}, err
+	}
+	token, err := jwt.Parse(tokenString, ring.Keyfunc)
+	if err != nil || !token.Valid {
+		return Claims{}, ErrInvalidToken
+	}
+
+	mapClaims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return Claims{}, ErrInvalidToken
+	}
+	if typ, _ := mapClaims["typ"].(string); typ != tokenType {
+		return Claims{}, ErrInvalidToken
+	}
+	sub, _ := mapClaims["sub"].(string)
+	userID, err := strconv.Atoi(sub)
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	jti, _ := mapClaims["jti"].(string)
+	if jti == "" {
+		return Claims{}, ErrInvalidToken
+	}
+	family, _ := mapClaims["fam"].(string)
+	role, _ := mapClaims["role"].(string)
+	exp, _ := mapClaims["exp"].(float64)
+
+	return Claims{
+		UserID:    userID,
+		Role:      role,
+		ID:        jti,
+		Family:    family,
+		ExpiresAt: time.Unix(int64(exp), 0),
+	}, nil
+}
+
+// GetUserByID loads a user without their password hash
+func GetUserByID(userID int) (models.User, error) {
+	var user models.User
+	err := db.QueryRow("SELECT id, email, role, disabled, email_verified FROM users WHERE id = $1", userID).
+		Scan(&user.ID, &user.Email, &user.Role, &user.Disabled, &user.EmailVerified)
+	return user, err
+}
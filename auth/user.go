@@ -4,12 +4,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"go_backend_legalForce/models"
+	"io"
+	"log"
 	"net/http"
-	"os"
 	"sync"
-	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/go-redis/redis/v8"
 	"golang.org/x/crypto/bcrypt"
 
@@ -33,35 +32,129 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := clientIP(r)
+	if wait := loginLockedFor(user.Email, ip); wait > 0 {
+		WriteLockedOut(w, wait, "Too many login attempts, try again later")
+		return
+	}
+
 	var storedUser models.User
-	query := `SELECT id, email, password FROM users WHERE email = $1`
-	err = db.QueryRow(query, user.Email).Scan(&storedUser.ID, &storedUser.Email, &storedUser.Password)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusUnauthorized)
+	var totpEnabled bool
+	query := `SELECT id, email, password, role, disabled, totp_enabled FROM users WHERE email = $1`
+	err = db.QueryRow(query, user.Email).Scan(&storedUser.ID, &storedUser.Email, &storedUser.Password,
+		&storedUser.Role, &storedUser.Disabled, &totpEnabled)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Failed to look up user", http.StatusInternalServerError)
 		return
 	}
 
-	// Compare passwords
-	err = bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(user.Password))
-	if err != nil {
+	// Compare passwords. An unknown account is checked against a dummy hash so both
+	// failures take the same time and return the same message.
+	hash := []byte(storedUser.Password)
+	if err == sql.ErrNoRows {
+		hash = dummyHash
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(user.Password)) != nil || err == sql.ErrNoRows {
+		recordLoginFailure(user.Email, ip)
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
+	clearLoginFailures(user.Email)
+
+	if storedUser.Disabled {
+		http.Error(w, "Account disabled", http.StatusForbidden)
+		return
+	}
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email": storedUser.Email,
-		"exp":   time.Now().Add(time.Hour * 72).Unix(),
-	})
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET_KEY")))
+	completeLogin(w, storedUser, totpEnabled)
+}
+
+// completeLogin responds to a successful first-factor login, whether by password or
+// through an identity provider
+func completeLogin(w http.ResponseWriter, user models.User, totpEnabled bool) {
+	// Accounts with a second factor get a short-lived challenge instead of tokens
+	if totpEnabled {
+		challenge, _, err := generateMFAChallenge(user)
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"mfa_required": true, "mfa_token": challenge})
+		return
+	}
+
+	// Generate an access token and start a new refresh family
+	tokens, err := IssueTokens(user)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
-	// Respond with the token
+	// Respond with the tokens
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token pair
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := RotateRefreshToken(req.RefreshToken)
+	if err == ErrInvalidToken || err == ErrTokenReused {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to rotate refresh token: %v", err)
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// LogoutUser revokes the current access token and its refresh family.
+// With {"all": true} every session of the user is revoked.
+func LogoutUser(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		All bool `json:"all"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	err := DenyToken(claims.ID, claims.ExpiresAt)
+	if err == nil {
+		if req.All {
+			err = RevokeUserSessions(claims.UserID)
+		} else if claims.Family != "" {
+			err = RevokeFamily(claims.Family)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to revoke session: %v", err)
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"})
 }
 
 func RegisterUser(w http.ResponseWriter, r *http.Request) {
@@ -72,6 +165,15 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !validEmail(user.Email) {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+	if len(user.Password) < minPasswordLength {
+		http.Error(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+
 	// Hash the password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -88,29 +190,13 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Respond with success message
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully"})
-}
-
-func GetUsers(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, email FROM users")
-	if err != nil {
-		http.Error(w, "Failed to retrieve users: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var users []models.User
-	for rows.Next() {
-		var user models.User
-		if err := rows.Scan(&user.ID, &user.Email); err != nil {
-			http.Error(w, "Failed to scan user: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		users = append(users, user)
+	// Send the verification email; the account exists either way and the user can
+	// ask for a new token later
+	if err := sendVerificationEmail(user.ID, user.Email); err != nil {
+		log.Printf("Failed to create verification token for user %d: %v", user.ID, err)
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(users)
+	// Respond with success message
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "User registered successfully. Check your email to verify your account"})
 }
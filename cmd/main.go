@@ -15,6 +15,9 @@ import (
 	"go_backend_legalForce/fileupload"
 	"go_backend_legalForce/job"
 	"go_backend_legalForce/middleware"
+	"go_backend_legalForce/models"
+	"go_backend_legalForce/scanner"
+	"go_backend_legalForce/storage"
 
 	_ "github.com/lib/pq"
 )
@@ -32,16 +35,49 @@ func main() {
 	log.Println("Database initialized")
 	log.Println("Starting server...")
 
-	auth.SetDB(database.DB, redisClient)
-
 	// Update the global variables in main
 	db = database.DB
+	redisClient = database.RedisClient
+
+	auth.SetDB(db, redisClient)
+
+	keyRing, err := auth.LoadKeyRing()
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+	auth.SetKeyRing(keyRing)
+	mailer := auth.NewMailerFromEnv()
+	auth.SetMailer(mailer)
+
+	oidcProviders, err := auth.LoadOIDCProviders()
+	if err != nil {
+		log.Fatalf("Failed to load identity providers: %v", err)
+	}
+	auth.SetOIDCProviders(oidcProviders)
+
+	backend, err := storage.NewBackendFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure storage: %v", err)
+	}
+	storage.SetDefault(backend)
+
+	malwareScanner, err := scanner.NewScannerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure malware scanner: %v", err)
+	}
 
 	log.Println("Database initialized")
 	log.Println("Starting server...")
 
 	// Start the file cleanup service in a goroutine
-	go job.StartFileCleanup(db)
+	go job.StartFileCleanup(db, mailer)
+
+	// Uploads are only served once scanned, so without a scanner they stay pending
+	if malwareScanner != nil {
+		go job.StartScanWorker(db, redisClient, malwareScanner)
+	} else {
+		log.Println("WARNING: CLAMD_ADDRESS is not set, uploaded files cannot be downloaded until they are scanned")
+	}
 
 	router := mux.NewRouter()
 
@@ -54,32 +90,393 @@ func main() {
 		auth.LoginUser(w, r)
 	}).Methods("POST")
 
-	router.HandleFunc("/getusers", func(w http.ResponseWriter, r *http.Request) {
-		auth.GetUsers(w, r)
+	router.HandleFunc("/login/mfa", func(w http.ResponseWriter, r *http.Request) {
+		auth.VerifyMFALogin(w, r)
+	}).Methods("POST")
+
+	router.HandleFunc("/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		auth.RefreshToken(w, r)
+	}).Methods("POST")
+
+	router.HandleFunc("/verify-email", func(w http.ResponseWriter, r *http.Request) {
+		auth.VerifyEmail(w, r)
+	}).Methods("POST")
+
+	router.HandleFunc("/password/forgot", func(w http.ResponseWriter, r *http.Request) {
+		auth.ForgotPassword(w, r)
+	}).Methods("POST")
+
+	router.HandleFunc("/password/reset", func(w http.ResponseWriter, r *http.Request) {
+		auth.ResetPassword(w, r)
+	}).Methods("POST")
+
+	router.HandleFunc("/oidc/{provider}/login", func(w http.ResponseWriter, r *http.Request) {
+		auth.OIDCLogin(w, r, mux.Vars(r)["provider"])
 	}).Methods("GET")
 
-	router.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
-		fileupload.SearchFiles(w, r, db, redisClient)
+	router.HandleFunc("/oidc/{provider}/callback", func(w http.ResponseWriter, r *http.Request) {
+		auth.OIDCCallback(w, r, mux.Vars(r)["provider"])
+	}).Methods("GET")
+
+	router.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		auth.JWKS(w, r)
 	}).Methods("GET")
 
-	// Serve static files from the uploads directory
-	router.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("uploads/"))))
+	// Share links. Password protected links also accept the password as a form post.
+	router.HandleFunc("/s/{token}", func(w http.ResponseWriter, r *http.Request) {
+		fileupload.ServeShareLink(w, r, db, mux.Vars(r)["token"])
+	}).Methods("GET", "HEAD", "POST")
+
+	// Locally stored files. Only presigned URLs are served.
+	router.PathPrefix("/uploads/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.ServePresignedFile(w, r, db)
+	}).Methods("GET", "HEAD")
+
+	// Admin endpoints
+	admin_route := router.PathPrefix("/admin").Subrouter()
+	admin_route.Use(middleware.AuthMiddleware, middleware.SessionOnly, middleware.RequireRole(models.RoleAdmin))
+
+	admin_route.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		auth.ListUsers(w, r)
+	}).Methods("GET")
+
+	admin_route.HandleFunc("/users/{user_id:[0-9]+}/disable", func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		auth.SetUserDisabled(w, r, userID, true)
+	}).Methods("POST")
+
+	admin_route.HandleFunc("/users/{user_id:[0-9]+}/enable", func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		auth.SetUserDisabled(w, r, userID, false)
+	}).Methods("POST")
+
+	admin_route.HandleFunc("/users/{user_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		auth.DeleteUser(w, r, userID)
+	}).Methods("DELETE")
+
+	admin_route.HandleFunc("/lockouts", func(w http.ResponseWriter, r *http.Request) {
+		auth.ClearLockout(w, r)
+	}).Methods("DELETE")
+
+	admin_route.HandleFunc("/quarantine", func(w http.ResponseWriter, r *http.Request) {
+		fileupload.ListQuarantine(w, r, db)
+	}).Methods("GET")
+
+	admin_route.HandleFunc("/scans/rescan", func(w http.ResponseWriter, r *http.Request) {
+		fileupload.RescanFiles(w, r, db)
+	}).Methods("POST")
+
+	// Storage quotas of a user's personal files and of organizations
+	admin_route.HandleFunc("/quotas/users/{user_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		fileupload.GetQuota(w, r, db, userID, 0)
+	}).Methods("GET")
+
+	admin_route.HandleFunc("/quotas/users/{user_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(mux.Vars(r)["user_id"])
+		fileupload.SetQuota(w, r, db, userID, 0)
+	}).Methods("PUT")
+
+	admin_route.HandleFunc("/quotas/orgs/{org_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		orgID, _ := strconv.Atoi(mux.Vars(r)["org_id"])
+		fileupload.GetQuota(w, r, db, 0, orgID)
+	}).Methods("GET")
+
+	admin_route.HandleFunc("/quotas/orgs/{org_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		orgID, _ := strconv.Atoi(mux.Vars(r)["org_id"])
+		fileupload.SetQuota(w, r, db, 0, orgID)
+	}).Methods("PUT")
+
+	// Endpoints that need an interactive login and cannot be used with an API key
+	session_route := router.PathPrefix("/").Subrouter()
+	session_route.Use(middleware.AuthMiddleware, middleware.SessionOnly)
+
+	session_route.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		auth.LogoutUser(w, r)
+	}).Methods("POST")
+
+	session_route.HandleFunc("/mfa/enroll", func(w http.ResponseWriter, r *http.Request) {
+		auth.EnrollMFA(w, r)
+	}).Methods("POST")
+
+	session_route.HandleFunc("/mfa/confirm", func(w http.ResponseWriter, r *http.Request) {
+		auth.ConfirmMFA(w, r)
+	}).Methods("POST")
+
+	session_route.HandleFunc("/mfa/disable", func(w http.ResponseWriter, r *http.Request) {
+		auth.DisableMFA(w, r)
+	}).Methods("POST")
+
+	session_route.HandleFunc("/api-keys", func(w http.ResponseWriter, r *http.Request) {
+		auth.CreateAPIKey(w, r)
+	}).Methods("POST")
+
+	session_route.HandleFunc("/api-keys", func(w http.ResponseWriter, r *http.Request) {
+		auth.ListAPIKeys(w, r)
+	}).Methods("GET")
+
+	session_route.HandleFunc("/api-keys/{key_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		keyID, _ := strconv.Atoi(mux.Vars(r)["key_id"])
+		auth.UpdateAPIKey(w, r, keyID)
+	}).Methods("PATCH")
+
+	session_route.HandleFunc("/api-keys/{key_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		keyID, _ := strconv.Atoi(mux.Vars(r)["key_id"])
+		auth.RevokeAPIKey(w, r, keyID)
+	}).Methods("DELETE")
+
+	session_route.HandleFunc("/orgs", func(w http.ResponseWriter, r *http.Request) {
+		auth.CreateOrganization(w, r)
+	}).Methods("POST")
+
+	session_route.HandleFunc("/orgs", func(w http.ResponseWriter, r *http.Request) {
+		auth.ListOrganizations(w, r)
+	}).Methods("GET")
+
+	session_route.HandleFunc("/orgs/{org_id:[0-9]+}/members", func(w http.ResponseWriter, r *http.Request) {
+		orgID, _ := strconv.Atoi(mux.Vars(r)["org_id"])
+		auth.ListMembers(w, r, orgID)
+	}).Methods("GET")
+
+	session_route.HandleFunc("/orgs/{org_id:[0-9]+}/members/{user_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		orgID, _ := strconv.Atoi(vars["org_id"])
+		userID, _ := strconv.Atoi(vars["user_id"])
+		auth.UpdateMemberRole(w, r, orgID, userID)
+	}).Methods("PATCH")
+
+	session_route.HandleFunc("/orgs/{org_id:[0-9]+}/members/{user_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		orgID, _ := strconv.Atoi(vars["org_id"])
+		userID, _ := strconv.Atoi(vars["user_id"])
+		auth.RemoveMember(w, r, orgID, userID)
+	}).Methods("DELETE")
+
+	session_route.HandleFunc("/orgs/{org_id:[0-9]+}/invitations", func(w http.ResponseWriter, r *http.Request) {
+		orgID, _ := strconv.Atoi(mux.Vars(r)["org_id"])
+		auth.CreateInvitation(w, r, orgID)
+	}).Methods("POST")
+
+	session_route.HandleFunc("/orgs/{org_id:[0-9]+}/invitations", func(w http.ResponseWriter, r *http.Request) {
+		orgID, _ := strconv.Atoi(mux.Vars(r)["org_id"])
+		auth.ListInvitations(w, r, orgID)
+	}).Methods("GET")
+
+	session_route.HandleFunc("/orgs/{org_id:[0-9]+}/invitations/{invitation_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		orgID, _ := strconv.Atoi(vars["org_id"])
+		invitationID, _ := strconv.Atoi(vars["invitation_id"])
+		auth.RevokeInvitation(w, r, orgID, invitationID)
+	}).Methods("DELETE")
+
+	session_route.HandleFunc("/invitations/accept", func(w http.ResponseWriter, r *http.Request) {
+		auth.AcceptInvitation(w, r)
+	}).Methods("POST")
+
+	// Endpoints that also accept API keys, limited by the key's scopes. File endpoints
+	// act in the organization named by the X-Org-ID header, if any.
 	auth_route := router.PathPrefix("/").Subrouter()
-	auth_route.Use(middleware.AuthMiddleware)
+	auth_route.Use(middleware.AuthMiddleware, middleware.OrgScope)
 
-	auth_route.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+	requireRead := middleware.RequireScope(models.ScopeRead)
+	requireUpload := middleware.RequireScope(models.ScopeUpload)
+	requireShare := middleware.RequireScope(models.ScopeShare)
+	requireDelete := middleware.RequireScope(models.ScopeDelete)
+
+	auth_route.Handle("/upload", requireUpload(middleware.RequireVerifiedEmail(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fileupload.UploadFile(w, r, db, redisClient)
-	}).Methods("POST")
+	})))).Methods("POST")
+
+	// Resumable uploads (tus protocol)
+	router.HandleFunc(fileupload.TusPath, func(w http.ResponseWriter, r *http.Request) {
+		fileupload.TusOptions(w, r)
+	}).Methods("OPTIONS")
+
+	auth_route.Handle(fileupload.TusPath, requireUpload(middleware.RequireVerifiedEmail(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.CreateResumableUpload(w, r, db)
+	})))).Methods("POST")
+
+	auth_route.Handle(fileupload.TusPath+"/{upload_id}", requireUpload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.ResumableUploadStatus(w, r, db, mux.Vars(r)["upload_id"])
+	}))).Methods("HEAD")
+
+	auth_route.Handle(fileupload.TusPath+"/{upload_id}", requireUpload(middleware.RequireVerifiedEmail(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.PatchResumableUpload(w, r, db, redisClient, mux.Vars(r)["upload_id"])
+	})))).Methods("PATCH")
 
-	auth_route.HandleFunc("/files", func(w http.ResponseWriter, r *http.Request) {
+	auth_route.Handle(fileupload.TusPath+"/{upload_id}", requireUpload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.TerminateResumableUpload(w, r, db, mux.Vars(r)["upload_id"])
+	}))).Methods("DELETE")
+
+	auth_route.Handle("/files", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fileupload.RetrieveFiles(w, r, db, redisClient)
-	}).Methods("GET")
+	}))).Methods("GET")
+
+	auth_route.Handle("/files/{file_id:[0-9]+}", requireUpload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+		fileupload.UpdateFile(w, r, db, redisClient, fileID)
+	}))).Methods("PATCH")
+
+	auth_route.Handle("/files/{file_id:[0-9]+}", requireDelete(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+		fileupload.DeleteFile(w, r, db, redisClient, fileID)
+	}))).Methods("DELETE")
+
+	auth_route.Handle("/files/{file_id:[0-9]+}/copy", requireUpload(middleware.RequireVerifiedEmail(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+		fileupload.CopyFile(w, r, db, redisClient, fileID)
+	})))).Methods("POST")
+
+	// Folders
+	auth_route.Handle("/folders", requireUpload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.CreateFolder(w, r, db)
+	}))).Methods("POST")
+
+	auth_route.Handle("/folders", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.ListFolder(w, r, db, 0)
+	}))).Methods("GET")
+
+	auth_route.Handle("/folders/{folder_id:[0-9]+}", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		folderID, _ := strconv.Atoi(mux.Vars(r)["folder_id"])
+		fileupload.ListFolder(w, r, db, folderID)
+	}))).Methods("GET")
 
-	auth_route.HandleFunc("/share/{file_id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+	auth_route.Handle("/folders/{folder_id:[0-9]+}", requireUpload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		folderID, _ := strconv.Atoi(mux.Vars(r)["folder_id"])
+		fileupload.UpdateFolder(w, r, db, folderID)
+	}))).Methods("PATCH")
+
+	auth_route.Handle("/folders/{folder_id:[0-9]+}", requireDelete(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		folderID, _ := strconv.Atoi(mux.Vars(r)["folder_id"])
+		fileupload.DeleteFolder(w, r, db, redisClient, folderID)
+	}))).Methods("DELETE")
+
+	// Deleted files, until they are restored or purged
+	auth_route.Handle("/trash", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.ListTrash(w, r, db)
+	}))).Methods("GET")
+
+	auth_route.Handle("/trash", requireDelete(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.EmptyTrash(w, r, db)
+	}))).Methods("DELETE")
+
+	auth_route.Handle("/trash/{file_id:[0-9]+}/restore", requireUpload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+		fileupload.RestoreFile(w, r, db, redisClient, fileID)
+	}))).Methods("POST")
+
+	auth_route.Handle("/trash/{file_id:[0-9]+}", requireDelete(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+		fileupload.PurgeFile(w, r, db, fileID)
+	}))).Methods("DELETE")
+
+	auth_route.Handle("/files/{file_id:[0-9]+}/content", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+		fileupload.DownloadFile(w, r, db, fileID)
+	}))).Methods("GET", "HEAD")
+
+	// Versions of a file's contents
+	auth_route.Handle("/files/{file_id:[0-9]+}/versions", requireUpload(middleware.RequireVerifiedEmail(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+		fileupload.UploadVersion(w, r, db, redisClient, fileID)
+	})))).Methods("POST")
+
+	auth_route.Handle("/files/{file_id:[0-9]+}/versions", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+		fileupload.ListVersions(w, r, db, fileID)
+	}))).Methods("GET")
+
+	auth_route.Handle("/files/{file_id:[0-9]+}/versions/{version:[0-9]+}/content", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		fileID, _ := strconv.Atoi(vars["file_id"])
+		version, _ := strconv.Atoi(vars["version"])
+		fileupload.DownloadVersion(w, r, db, fileID, version)
+	}))).Methods("GET", "HEAD")
+
+	auth_route.Handle("/files/{file_id:[0-9]+}/versions/{version:[0-9]+}/restore", requireUpload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		fileID, _ := strconv.Atoi(vars["file_id"])
+		version, _ := strconv.Atoi(vars["version"])
+		fileupload.RestoreVersion(w, r, db, redisClient, fileID, version)
+	}))).Methods("POST")
+
+	auth_route.Handle("/files/{file_id:[0-9]+}/diff", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+		fileupload.DiffVersions(w, r, db, fileID)
+	}))).Methods("GET")
+
+	// Content types accepted in uploads, for the user or the organization in X-Org-ID
+	auth_route.Handle("/content-policy", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.GetContentPolicy(w, r, db)
+	}))).Methods("GET")
+
+	auth_route.Handle("/content-policy", requireUpload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.SetContentPolicy(w, r, db)
+	}))).Methods("PUT")
+
+	auth_route.Handle("/expiry-policy", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.GetExpiryPolicy(w, r, db)
+	}))).Methods("GET")
+
+	auth_route.Handle("/expiry-policy", requireUpload(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.SetExpiryPolicy(w, r, db)
+	}))).Methods("PUT")
+
+	// Storage used against the quota, by the user or the organization in X-Org-ID
+	auth_route.Handle("/me/usage", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.GetUsage(w, r, db)
+	}))).Methods("GET")
+
+	auth_route.Handle("/search", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.SearchFiles(w, r, db, redisClient)
+	}))).Methods("GET")
+
+	// Share links, reached without an account under /s/{token}
+	auth_route.Handle("/share/{file_id:[0-9]+}", requireShare(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		fileID, _ := strconv.Atoi(vars["file_id"])
 		fileupload.ShareFile(w, r, db, redisClient, fileID)
-	}).Methods("GET")
+	}))).Methods("POST")
+
+	auth_route.Handle("/share-links", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.ListShareLinks(w, r, db)
+	}))).Methods("GET")
+
+	auth_route.Handle("/share-links/{link_id:[0-9]+}", requireShare(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		linkID, _ := strconv.Atoi(mux.Vars(r)["link_id"])
+		fileupload.RevokeShareLink(w, r, db, redisClient, linkID)
+	}))).Methods("DELETE")
+
+	// Access granted to other users and organizations, on files and on folders with everything below them
+	auth_route.Handle("/files/{file_id:[0-9]+}/grants", requireShare(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+		fileupload.CreateFileGrant(w, r, db, fileID)
+	}))).Methods("POST")
+
+	auth_route.Handle("/files/{file_id:[0-9]+}/grants", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileID, _ := strconv.Atoi(mux.Vars(r)["file_id"])
+		fileupload.ListFileGrants(w, r, db, fileID)
+	}))).Methods("GET")
+
+	auth_route.Handle("/folders/{folder_id:[0-9]+}/grants", requireShare(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		folderID, _ := strconv.Atoi(mux.Vars(r)["folder_id"])
+		fileupload.CreateFolderGrant(w, r, db, folderID)
+	}))).Methods("POST")
+
+	auth_route.Handle("/folders/{folder_id:[0-9]+}/grants", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		folderID, _ := strconv.Atoi(mux.Vars(r)["folder_id"])
+		fileupload.ListFolderGrants(w, r, db, folderID)
+	}))).Methods("GET")
+
+	auth_route.Handle("/grants/{grant_id:[0-9]+}", requireShare(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grantID, _ := strconv.Atoi(mux.Vars(r)["grant_id"])
+		fileupload.DeleteGrant(w, r, db, grantID)
+	}))).Methods("DELETE")
+
+	auth_route.Handle("/shared-with-me", requireRead(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fileupload.ListSharedWithMe(w, r, db)
+	}))).Methods("GET")
 
 	log.Println("Server started at :8080")
 	http.ListenAndServe(":8080", router)
@@ -0,0 +1,23 @@
+-- Baseline schema for the users and files tables
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    email TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS files (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    file_name TEXT NOT NULL,
+    upload_date TIMESTAMP NOT NULL,
+    size BIGINT NOT NULL,
+    local_path TEXT NOT NULL,
+    file_type TEXT NOT NULL DEFAULT '',
+    s3_url TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    is_shared BOOLEAN NOT NULL DEFAULT FALSE,
+    expiration_date TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00'
+);
+
+CREATE INDEX IF NOT EXISTS files_user_id_idx ON files (user_id);
@@ -0,0 +1,7 @@
+-- Files keep the name they were uploaded with and the key their contents are
+-- stored under apart from file_name, which becomes the editable display name.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS original_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS storage_key TEXT NOT NULL DEFAULT '';
+
+-- Until now file_name was the storage key and the original name was not kept
+UPDATE files SET storage_key = file_name, original_name = file_name WHERE storage_key = '';
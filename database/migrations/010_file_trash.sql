@@ -0,0 +1,5 @@
+-- Deleted files stay in the trash, marked with the time they were deleted, until
+-- they are restored or purged.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS files_deleted_at_idx ON files (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,21 @@
+-- Every upload of a file's contents is kept as a version. files holds the
+-- metadata of the current version, which current_version points at.
+CREATE TABLE IF NOT EXISTS file_versions (
+    id SERIAL PRIMARY KEY,
+    file_id INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    uploaded_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    storage_key TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    sha256 TEXT NOT NULL DEFAULT '',
+    original_name TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (file_id, version)
+);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS current_version INTEGER NOT NULL DEFAULT 1;
+
+-- Existing files become their own first version
+INSERT INTO file_versions (file_id, version, uploaded_by, storage_key, size, original_name, created_at)
+SELECT id, 1, user_id, storage_key, size, original_name, upload_date FROM files
+ON CONFLICT (file_id, version) DO NOTHING;
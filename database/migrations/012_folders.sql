@@ -0,0 +1,23 @@
+-- Folders arrange a tenant's files in a tree. path is the materialized path of a
+-- folder: the ids from the top folder down to the folder itself, like /1/5/12/,
+-- so the folders below one are those whose path starts with its path.
+CREATE TABLE IF NOT EXISTS folders (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+    parent_id INTEGER REFERENCES folders(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    path TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Names are unique among the folders of a parent
+CREATE UNIQUE INDEX IF NOT EXISTS folders_user_name_idx ON folders (user_id, COALESCE(parent_id, 0), name) WHERE org_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS folders_org_name_idx ON folders (org_id, COALESCE(parent_id, 0), name) WHERE org_id IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS folders_path_idx ON folders (path text_pattern_ops);
+
+-- Files outside any folder are at the top of the tree
+ALTER TABLE files ADD COLUMN IF NOT EXISTS folder_id INTEGER REFERENCES folders(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS files_folder_id_idx ON files (folder_id);
@@ -0,0 +1,26 @@
+-- Contents are stored once per SHA-256 checksum, as a blob every version with
+-- those contents references through its storage_key. ref_count is the number of
+-- versions referencing a blob; the blob and its contents are deleted when it drops
+-- to zero.
+CREATE TABLE IF NOT EXISTS blobs (
+    storage_key TEXT PRIMARY KEY,
+    sha256 TEXT NOT NULL DEFAULT '',
+    size BIGINT NOT NULL,
+    ref_count INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Contents stored before checksums were recorded have none and are never shared
+CREATE UNIQUE INDEX IF NOT EXISTS blobs_sha256_idx ON blobs (sha256) WHERE sha256 <> '';
+
+CREATE INDEX IF NOT EXISTS blobs_unreferenced_idx ON blobs (storage_key) WHERE ref_count <= 0;
+
+-- Existing contents become blobs. Where the same contents were stored more than
+-- once, the oldest copy is the one found by its checksum.
+INSERT INTO blobs (storage_key, sha256, size, ref_count, created_at)
+SELECT storage_key,
+       CASE WHEN ROW_NUMBER() OVER (PARTITION BY sha256 ORDER BY created_at, storage_key) = 1 THEN sha256 ELSE '' END,
+       size, refs, created_at
+FROM (SELECT storage_key, MAX(sha256) AS sha256, MAX(size) AS size, COUNT(*) AS refs, MIN(created_at) AS created_at
+      FROM file_versions GROUP BY storage_key) AS stored
+ON CONFLICT (storage_key) DO NOTHING;
@@ -0,0 +1,22 @@
+-- The content type detected from the first bytes of the contents, kept next to
+-- the extension in file_type. Contents stored before detection have none.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS mime_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS mime_type TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS files_mime_type_idx ON files (mime_type text_pattern_ops);
+
+-- Content types an organization, or a user for their personal files, accepts in
+-- uploads. Entries are MIME types like application/pdf or wildcards like image/*.
+-- An empty allow list accepts every type that is not denied.
+CREATE TABLE IF NOT EXISTS content_policies (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+    allowed_types TEXT[] NOT NULL DEFAULT '{}',
+    denied_types TEXT[] NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CHECK ((user_id IS NULL) <> (org_id IS NULL))
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS content_policies_user_id_idx ON content_policies (user_id) WHERE org_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS content_policies_org_id_idx ON content_policies (org_id) WHERE org_id IS NOT NULL;
@@ -0,0 +1,14 @@
+-- Contents are scanned for malware once per blob. Until a scan finds them clean
+-- they are not served, so existing contents start out pending like new uploads.
+-- Infected contents are moved under the quarantine/ prefix of the storage backend.
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS scan_status TEXT NOT NULL DEFAULT 'pending';
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS scan_signature TEXT NOT NULL DEFAULT '';
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS scanned_at TIMESTAMP;
+
+-- Set when an administrator asks for contents to be scanned again, typically after
+-- the scanner's signatures were updated. The status is kept until the new verdict.
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS rescan_requested_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS blobs_scan_queue_idx ON blobs (created_at)
+    WHERE scan_status IN ('pending', 'error') OR rescan_requested_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS blobs_infected_idx ON blobs (storage_key) WHERE scan_status = 'infected';
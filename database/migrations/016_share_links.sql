@@ -0,0 +1,21 @@
+-- Links giving anyone holding their token access to a file. Only a hash of each
+-- token is stored; token_prefix identifies the link in listings. max_downloads is
+-- 0 for no limit. files.is_shared is set while a file has links that can be used.
+CREATE TABLE IF NOT EXISTS share_links (
+    id SERIAL PRIMARY KEY,
+    file_id INTEGER NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    token_prefix TEXT NOT NULL,
+    password_hash TEXT,
+    expires_at TIMESTAMP,
+    max_downloads INTEGER NOT NULL DEFAULT 0,
+    download_count INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS share_links_file_id_idx ON share_links (file_id);
+
+-- Files were flagged as shared without any link to reach them by
+UPDATE files SET is_shared = FALSE WHERE is_shared;
@@ -0,0 +1,24 @@
+-- Grants give another user, or every member of an organization, access to a file
+-- or a folder. A grant on a folder covers everything below it. Grants to a user
+-- apply to their personal requests, grants to an organization to requests made
+-- in it.
+CREATE TABLE IF NOT EXISTS file_grants (
+    id SERIAL PRIMARY KEY,
+    file_id INTEGER REFERENCES files(id) ON DELETE CASCADE,
+    folder_id INTEGER REFERENCES folders(id) ON DELETE CASCADE,
+    grantee_user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    grantee_org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+    role TEXT NOT NULL,
+    granted_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CHECK ((file_id IS NULL) <> (folder_id IS NULL)),
+    CHECK ((grantee_user_id IS NULL) <> (grantee_org_id IS NULL))
+);
+
+-- A grantee holds one grant per file or folder; granting again changes its role
+CREATE UNIQUE INDEX IF NOT EXISTS file_grants_target_grantee_idx
+    ON file_grants (COALESCE(file_id, 0), COALESCE(folder_id, 0), COALESCE(grantee_user_id, 0), COALESCE(grantee_org_id, 0));
+
+CREATE INDEX IF NOT EXISTS file_grants_grantee_user_id_idx ON file_grants (grantee_user_id);
+CREATE INDEX IF NOT EXISTS file_grants_grantee_org_id_idx ON file_grants (grantee_org_id);
+CREATE INDEX IF NOT EXISTS file_grants_folder_id_idx ON file_grants (folder_id);
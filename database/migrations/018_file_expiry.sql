@@ -0,0 +1,24 @@
+-- Files that do not expire have no expiration_date, instead of the zero date.
+-- expiry_warned_at is set once the owner was warned the file is about to expire.
+ALTER TABLE files ALTER COLUMN expiration_date DROP NOT NULL;
+ALTER TABLE files ALTER COLUMN expiration_date DROP DEFAULT;
+UPDATE files SET expiration_date = NULL WHERE expiration_date = '0001-01-01 00:00:00';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS expiry_warned_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS files_expiration_date_idx ON files (expiration_date) WHERE expiration_date IS NOT NULL;
+
+-- How long an organization, or a user for their personal files, keeps files, in
+-- seconds. 0 sets no default expiry and no limit.
+CREATE TABLE IF NOT EXISTS expiry_policies (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+    default_ttl_seconds BIGINT NOT NULL DEFAULT 0,
+    max_ttl_seconds BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CHECK ((user_id IS NULL) <> (org_id IS NULL)),
+    CHECK (default_ttl_seconds >= 0 AND max_ttl_seconds >= 0)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS expiry_policies_user_id_idx ON expiry_policies (user_id) WHERE org_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS expiry_policies_org_id_idx ON expiry_policies (org_id) WHERE org_id IS NOT NULL;
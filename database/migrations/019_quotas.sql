@@ -0,0 +1,30 @@
+-- Storage quotas of organizations, and of users for their personal files. Usage
+-- counts every version of a tenant's files, trashed ones included. NULL limits
+-- fall back to the defaults set in the environment; 0 is unlimited. A tenant's
+-- row is created the first time it stores a file, and is locked while space is
+-- reserved so concurrent uploads cannot overshoot the limits. updated_at is set
+-- when an administrator sets the limits.
+CREATE TABLE IF NOT EXISTS quotas (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    org_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+    max_bytes BIGINT,
+    max_files BIGINT,
+    updated_at TIMESTAMP,
+    CHECK ((user_id IS NULL) <> (org_id IS NULL))
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS quotas_user_id_idx ON quotas (user_id) WHERE org_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS quotas_org_id_idx ON quotas (org_id) WHERE org_id IS NOT NULL;
+
+-- Space held for uploads being written. A reservation is released once its file
+-- is registered, and stops counting at expires_at if the upload never finishes.
+CREATE TABLE IF NOT EXISTS quota_reservations (
+    id SERIAL PRIMARY KEY,
+    quota_id INTEGER NOT NULL REFERENCES quotas(id) ON DELETE CASCADE,
+    bytes BIGINT NOT NULL,
+    files INTEGER NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS quota_reservations_quota_id_idx ON quota_reservations (quota_id);
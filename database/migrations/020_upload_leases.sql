@@ -0,0 +1,4 @@
+-- A PATCH request leases its resumable upload until locked_until rather than
+-- holding a row lock while the chunk arrives
+ALTER TABLE resumable_uploads ADD COLUMN IF NOT EXISTS locked_by TEXT;
+ALTER TABLE resumable_uploads ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
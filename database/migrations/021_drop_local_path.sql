@@ -0,0 +1,3 @@
+-- Files are downloaded from /files/{id}/content; the stored /uploads/ URLs only
+-- worked while that directory was served without a signature
+ALTER TABLE files DROP COLUMN IF EXISTS local_path;
@@ -0,0 +1,3 @@
+-- Time step of the last TOTP code accepted for each user. Codes of that step or
+-- an earlier one are refused, so a code cannot be used twice.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT;
@@ -32,6 +32,11 @@ func InitDB() {
 		log.Fatalf("Failed to connect to the database: %v", err)
 	}
 
+	err = Migrate(DB)
+	if err != nil {
+		log.Fatalf("Failed to apply database migrations: %v", err)
+	}
+
 	RedisClient = redisconnection.NewRedisClient()
 	if RedisClient == nil {
 		log.Fatal("Failed to initialize Redis client")
@@ -0,0 +1,41 @@
+package fileupload
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// maxClaimAttempts bounds the retries of claimBlob when the blob it found is
+// deleted before it could be referenced
+const maxClaimAttempts = 3
+
+var errBlobReleased = errors.New("blob was deleted while it was being referenced")
+
+// claimBlob adds a reference to the blob holding contents stored under key with
+// the given checksum and returns the storage key of that blob. It is key itself
+// if key is already a blob or the contents are new; otherwise the same contents
+// were stored before under the returned key, and the copy under key is not needed
+// once the transaction commits. It also reports whether the blob was created, i.e.
+// the contents are new and still have to be scanned.
+func claimBlob(tx *sql.Tx, key, sha256 string, size int64) (string, bool, error) {
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		result, err := tx.Exec("INSERT INTO blobs (storage_key, sha256, size) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", key, sha256, size)
+		if err != nil {
+			return "", false, err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			return key, true, nil
+		}
+
+		// The key or the checksum is taken
+		var blobKey string
+		err = tx.QueryRow(`UPDATE blobs SET ref_count = ref_count + 1
+			WHERE storage_key = COALESCE((SELECT storage_key FROM blobs WHERE storage_key = $1),
+				(SELECT storage_key FROM blobs WHERE sha256 = $2 AND sha256 <> ''))
+			RETURNING storage_key`, key, sha256).Scan(&blobKey)
+		if err != sql.ErrNoRows {
+			return blobKey, false, err
+		}
+	}
+	return "", false, errBlobReleased
+}
@@ -0,0 +1,339 @@
+package fileupload
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"go_backend_legalForce/models"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// sniffLen is how many leading bytes of the contents are inspected, as many as
+// http.DetectContentType considers
+const sniffLen = 512
+
+const (
+	maxPolicyTypes       = 100
+	defaultBinaryType    = "application/octet-stream"
+	oleStorageType       = "application/x-ole-storage"
+	codeTypeMismatch     = "content_type_mismatch"
+	codeTypeNotAllowed   = "content_type_not_allowed"
+	contentPolicyColumns = "allowed_types, denied_types, updated_at"
+)
+
+// Signatures http.DetectContentType does not know. Executables are told apart so
+// that one renamed to a document is caught.
+var extraSignatures = []struct {
+	prefix   string
+	mimeType string
+}{
+	{"MZ", "application/vnd.microsoft.portable-executable"},
+	{"\x7fELF", "application/x-elf"},
+	{"\xfe\xed\xfa\xce", "application/x-mach-binary"},
+	{"\xfe\xed\xfa\xcf", "application/x-mach-binary"},
+	{"\xce\xfa\xed\xfe", "application/x-mach-binary"},
+	{"\xcf\xfa\xed\xfe", "application/x-mach-binary"},
+	{"#!", "text/x-shellscript"},
+	{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", oleStorageType},
+	{"II*\x00", "image/tiff"},
+	{"MM\x00*", "image/tiff"},
+}
+
+// extensionTypes are the types file extensions stand for, beyond the few the mime
+// package knows on every system
+var extensionTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".doc":  "application/msword",
+	".dot":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".msg":  "application/vnd.ms-outlook",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".epub": "application/epub+zip",
+	".rtf":  "text/rtf",
+	".txt":  "text/plain",
+	".csv":  "text/csv",
+	".md":   "text/markdown",
+	".eml":  "message/rfc822",
+	".json": "application/json",
+	".xml":  "text/xml",
+	".zip":  "application/zip",
+	".gz":   "application/x-gzip",
+	".rar":  "application/x-rar-compressed",
+	".7z":   "application/x-7z-compressed",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".bmp":  "image/bmp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".mp3":  "audio/mpeg",
+	".wav":  "audio/wave",
+	".mp4":  "video/mp4",
+	".exe":  "application/vnd.microsoft.portable-executable",
+	".dll":  "application/vnd.microsoft.portable-executable",
+	".sh":   "text/x-shellscript",
+}
+
+// containerTypes are sniffed types that several formats share, with the types of
+// the extensions they hold. Those cannot be told apart from the first bytes, so the
+// type of the extension is taken.
+var containerTypes = map[string][]string{
+	"application/zip": {
+		extensionTypes[".docx"], extensionTypes[".xlsx"], extensionTypes[".pptx"],
+		extensionTypes[".odt"], extensionTypes[".ods"], extensionTypes[".odp"], extensionTypes[".epub"],
+	},
+	oleStorageType: {extensionTypes[".doc"], extensionTypes[".xls"], extensionTypes[".ppt"], extensionTypes[".msg"]},
+}
+
+// contentTypeError explains why contents were refused. Code is one of
+// content_type_mismatch, when they are not what the file name says, and
+// content_type_not_allowed, when the tenant's policy does not accept them.
+type contentTypeError struct {
+	Code         string `json:"code"`
+	Message      string `json:"error"`
+	DetectedType string `json:"detected_type"`
+}
+
+func (e *contentTypeError) Error() string {
+	return e.Message
+}
+
+// writeContentTypeError refuses a request whose contents are not accepted
+func writeContentTypeError(w http.ResponseWriter, err *contentTypeError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnsupportedMediaType)
+	json.NewEncoder(w).Encode(err)
+}
+
+// sniffContent returns the first sniffLen bytes of src, or all of it if it is
+// shorter, along with a reader that still yields the whole of src
+func sniffContent(src io.Reader) (io.Reader, []byte, error) {
+	buffered := bufio.NewReaderSize(src, sniffLen)
+	head, err := buffered.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	return buffered, bytes.Clone(head), nil
+}
+
+// sniffType detects the MIME type of contents starting with head
+func sniffType(head []byte) string {
+	if len(head) == 0 {
+		return defaultBinaryType
+	}
+	for _, sig := range extraSignatures {
+		if bytes.HasPrefix(head, []byte(sig.prefix)) {
+			return sig.mimeType
+		}
+	}
+	return baseType(http.DetectContentType(head))
+}
+
+// extensionType is the MIME type a file extension such as ".pdf" stands for, or
+// "" for unknown extensions
+func extensionType(ext string) string {
+	ext = strings.ToLower(ext)
+	if t, ok := extensionTypes[ext]; ok {
+		return t
+	}
+	return baseType(mime.TypeByExtension(ext))
+}
+
+// baseType strips the parameters from a MIME type
+func baseType(mimeType string) string {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	return strings.TrimSpace(strings.ToLower(mimeType))
+}
+
+// detectType returns the MIME type of contents starting with head, and whether the
+// contents contradict the extension of name. Contents the first bytes say nothing
+// about never do.
+func detectType(name string, head []byte) (string, bool) {
+	sniffed := sniffType(head)
+	claimed := extensionType(filepath.Ext(name))
+	switch {
+	case claimed == "" || sniffed == claimed || sniffed == defaultBinaryType:
+		return sniffed, false
+	case sniffed == "text/plain" && isTextType(claimed):
+		return claimed, false
+	case sniffed == "text/xml" && (strings.HasSuffix(claimed, "/xml") || strings.HasSuffix(claimed, "+xml")):
+		return claimed, false
+	}
+	for _, t := range containerTypes[sniffed] {
+		if t == claimed {
+			return claimed, false
+		}
+	}
+	return sniffed, true
+}
+
+// isTextType reports whether files of a MIME type are plain text
+func isTextType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "text/") || mimeType == "application/json" ||
+		strings.HasSuffix(mimeType, "+xml") || strings.HasSuffix(mimeType, "/xml")
+}
+
+// typeMatches reports whether a MIME type matches a policy entry, which may be a
+// wildcard like image/* or */*
+func typeMatches(pattern, mimeType string) bool {
+	if pattern == "*/*" || pattern == mimeType {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(pattern, "*")
+	return ok && strings.HasSuffix(prefix, "/") && strings.HasPrefix(mimeType, prefix)
+}
+
+func matchesAny(patterns []string, mimeType string) bool {
+	for _, pattern := range patterns {
+		if typeMatches(pattern, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkContent detects the type of contents starting with head for a file called
+// name, and refuses them if they contradict the name or the policy does not
+// accept them
+func checkContent(policy models.ContentPolicy, name string, head []byte) (string, *contentTypeError) {
+	mimeType, mismatch := detectType(name, head)
+	if mismatch {
+		return mimeType, &contentTypeError{Code: codeTypeMismatch, DetectedType: mimeType,
+			Message: "File contents (" + mimeType + ") do not match the file extension"}
+	}
+	if matchesAny(policy.DeniedTypes, mimeType) || (len(policy.AllowedTypes) > 0 && !matchesAny(policy.AllowedTypes, mimeType)) {
+		return mimeType, &contentTypeError{Code: codeTypeNotAllowed, DetectedType: mimeType,
+			Message: "Files of type " + mimeType + " are not allowed"}
+	}
+	return mimeType, nil
+}
+
+// loadContentPolicy returns the content policy of the tenant, which is empty and
+// accepts everything if none was set
+func loadContentPolicy(db *sql.DB, t tenant) (models.ContentPolicy, error) {
+	policy := models.ContentPolicy{AllowedTypes: []string{}, DeniedTypes: []string{}}
+	scope, scopeArg := t.condition(1)
+	err := db.QueryRow("SELECT "+contentPolicyColumns+" FROM content_policies WHERE "+scope, scopeArg).
+		Scan(pq.Array(&policy.AllowedTypes), pq.Array(&policy.DeniedTypes), &policy.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return policy, nil
+	}
+	return policy, err
+}
+
+// GetContentPolicy returns the content policy of the tenant
+func GetContentPolicy(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	policy, err := loadContentPolicy(db, t)
+	if err != nil {
+		log.Printf("Failed to load content policy: %v", err)
+		http.Error(w, "Failed to retrieve content policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(policy)
+}
+
+// SetContentPolicy replaces the content policy of the tenant. Only owners and
+// admins set the policy of an organization.
+func SetContentPolicy(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !managesTenant(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var policy models.ContentPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	allowed, validAllowed := normalizeTypes(policy.AllowedTypes)
+	denied, validDenied := normalizeTypes(policy.DeniedTypes)
+	if !validAllowed || !validDenied {
+		http.Error(w, "Types must be MIME types like application/pdf or image/*, at most "+
+			strconv.Itoa(maxPolicyTypes)+" per list", http.StatusBadRequest)
+		return
+	}
+	policy.AllowedTypes, policy.DeniedTypes = allowed, denied
+
+	// A tenant has a single policy, keyed like its files
+	column, conflict, owner := "user_id", "(user_id) WHERE org_id IS NULL", t.userID
+	if t.orgID != 0 {
+		column, conflict, owner = "org_id", "(org_id) WHERE org_id IS NOT NULL", t.orgID
+	}
+	err := db.QueryRow(`INSERT INTO content_policies (`+column+`, allowed_types, denied_types) VALUES ($1, $2, $3)
+		ON CONFLICT `+conflict+` DO UPDATE SET allowed_types = EXCLUDED.allowed_types, denied_types = EXCLUDED.denied_types, updated_at = NOW()
+		RETURNING updated_at`, owner, pq.Array(policy.AllowedTypes), pq.Array(policy.DeniedTypes)).Scan(&policy.UpdatedAt)
+	if err != nil {
+		log.Printf("Failed to save content policy: %v", err)
+		http.Error(w, "Failed to save content policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(policy)
+}
+
+// normalizeTypes lowercases and deduplicates the entries of a policy list, and
+// reports whether all of them are MIME types or wildcards
+func normalizeTypes(types []string) ([]string, bool) {
+	if len(types) > maxPolicyTypes {
+		return nil, false
+	}
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, entry := range types {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if !isMediaRange(entry) {
+			return nil, false
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			normalized = append(normalized, entry)
+		}
+	}
+	return normalized, true
+}
+
+// isMediaRange reports whether entry is a MIME type without parameters, type/* or */*
+func isMediaRange(entry string) bool {
+	mediaType, params, err := mime.ParseMediaType(entry)
+	if err != nil || len(params) > 0 || mediaType != entry {
+		return false
+	}
+	major, minor, found := strings.Cut(entry, "/")
+	if !found || major == "" || minor == "" || strings.Contains(minor, "/") {
+		return false
+	}
+	if major == "*" {
+		return minor == "*"
+	}
+	return !strings.Contains(major, "*") && (minor == "*" || !strings.Contains(minor, "*"))
+}
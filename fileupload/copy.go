@@ -0,0 +1,113 @@
+package fileupload
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"go_backend_legalForce/models"
+	"go_backend_legalForce/storage"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// CopyFile makes a new file with the current contents of a file. The copy goes
+// to folder_id, or the folder of the file when it is left out, and is named
+// file_name, or like the file. Its history starts over with a single version,
+// which shares the contents with the file instead of storing them again. The copy
+// still counts against the tenant's quota, and is refused with 413 if it does
+// not fit.
+func CopyFile(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client, fileID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		FolderID *int   `json:"folder_id"`
+		FileName string `json:"file_name"`
+	}
+	// The body is optional
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	var source models.File
+	var sha256 string
+	scope, scopeArg := t.condition(2)
+	err := db.QueryRow(`SELECT f.file_name, f.original_name, f.storage_key, f.size, f.file_type, f.description, COALESCE(f.folder_id, 0), f.mime_type, f.expiration_date, v.sha256
+		FROM files f JOIN file_versions v ON v.file_id = f.id AND v.version = f.current_version
+		WHERE f.id = $1 AND f.deleted_at IS NULL AND `+notExpired("f")+` AND `+scope, fileID, scopeArg).Scan(&source.FileName, &source.OriginalName,
+		&source.StorageKey, &source.Size, &source.FileType, &source.Description, &source.FolderID, &source.MimeType, &source.Expiration, &sha256)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to retrieve file %d: %v", fileID, err)
+		http.Error(w, "Failed to retrieve file", http.StatusInternalServerError)
+		return
+	}
+
+	copied := models.File{
+		UserID:       t.userID,
+		OrgID:        t.orgID,
+		FileName:     source.FileName,
+		OriginalName: source.OriginalName,
+		StorageKey:   source.StorageKey,
+		UploadDate:   time.Now(),
+		Size:         source.Size,
+		S3URL:        storage.Location(storage.Default(), source.StorageKey),
+		FileType:     source.FileType,
+		MimeType:     source.MimeType,
+		Description:  source.Description,
+		FolderID:     source.FolderID,
+		Expiration:   source.Expiration, // a copy does not outlive the file
+	}
+	if strings.TrimSpace(req.FileName) != "" {
+		copied.FileName = sanitizeFileName(req.FileName)
+	}
+	if req.FolderID != nil {
+		copied.FolderID = *req.FolderID
+	}
+	if copied.FolderID != source.FolderID && copied.FolderID != 0 {
+		if _, err := loadFolder(db, t, copied.FolderID); err == sql.ErrNoRows {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Failed to retrieve folder %d: %v", copied.FolderID, err)
+			http.Error(w, "Failed to copy file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	reservation, err := reserveQuota(db, t, copied.Size, copied.Size, 1)
+	var exceeded *quotaError
+	if errors.As(err, &exceeded) {
+		writeQuotaError(w, exceeded)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to reserve quota: %v", err)
+		http.Error(w, "Failed to copy file", http.StatusInternalServerError)
+		return
+	}
+	err = insertFileMetadata(db, redisClient, t, &copied, sha256, nil)
+	reservation.release(db)
+	if err != nil {
+		log.Printf("Failed to save file metadata: %v", err)
+		http.Error(w, "Failed to save file metadata", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d copied file %d to file %d", t.userID, fileID, copied.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(copied)
+}
@@ -0,0 +1,195 @@
+package fileupload
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits of DiffVersions. Finding a shortest diff takes memory quadratic in the
+// number of changed lines, so very different versions are not compared.
+const (
+	maxDiffFileSize = 2 << 20 // 2 MB
+	maxDiffEdits    = 1000
+	diffContext     = 3 // unchanged lines shown around each change
+)
+
+var errTooManyChanges = errors.New("versions differ in too many lines to compare")
+
+// diffLine is a line of a diff: ' ' if both versions have it, '-' if only the
+// old one does and '+' if only the new one does
+type diffLine struct {
+	op   byte
+	text string // including the line break, if any
+}
+
+// isText reports whether contents look like text that can be compared line by line
+func isText(content []byte) bool {
+	return utf8.Valid(content) && bytes.IndexByte(content, 0) < 0
+}
+
+// splitLines splits text after each line break. The last line may lack one.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns a shortest edit script turning a into b, using Myers' O(ND)
+// algorithm. It gives up with errTooManyChanges past maxDiffEdits edits.
+func diffLines(a, b []string) ([]diffLine, error) {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1) // v[offset+k] is the furthest x reached on diagonal k
+	var trace [][]int            // trace[d] holds v[-d..d] as it was before round d
+
+	for d := 0; d <= n+m; d++ {
+		if d > maxDiffEdits {
+			return nil, errTooManyChanges
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // a line of b inserted
+			} else {
+				x = v[offset+k-1] + 1 // a line of a deleted
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x == n && y == m {
+				return backtrackDiff(trace, a, b), nil
+			}
+		}
+	}
+	return nil, errTooManyChanges // not reached
+}
+
+// backtrackDiff walks the trace of diffLines back from the end of both inputs
+func backtrackDiff(trace [][]int, a, b []string) []diffLine {
+	x, y := len(a), len(b)
+	var lines []diffLine
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = at(prevK)
+		}
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY && x > 0 && y > 0 {
+			lines = append(lines, diffLine{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			lines = append(lines, diffLine{'+', b[y-1]})
+		} else {
+			lines = append(lines, diffLine{'-', a[x-1]})
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// unifiedDiff formats the differences between two texts in the unified format
+// read by patch and git apply. It is empty if the texts are the same.
+func unifiedDiff(from, to, fromLabel, toLabel string) (string, error) {
+	lines, err := diffLines(splitLines(from), splitLines(to))
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	oldLine, newLine := 0, 0 // lines of each text before lines[i]
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			oldLine, newLine = oldLine+1, newLine+1
+			i++
+			continue
+		}
+
+		// A hunk starts with context before the change and extends while the
+		// next change is close enough for their context to overlap
+		start := i
+		for start > 0 && i-start < diffContext {
+			start--
+		}
+		end := i
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			same := end
+			for same < len(lines) && lines[same].op == ' ' {
+				same++
+			}
+			if same == len(lines) || same-end > 2*diffContext {
+				end += min(same-end, diffContext)
+				break
+			}
+			end = same
+		}
+
+		oldStart, newStart := oldLine-(i-start), newLine-(i-start)
+		oldCount, newCount := 0, 0
+		for _, l := range lines[start:end] {
+			if l.op != '+' {
+				oldCount++
+			}
+			if l.op != '-' {
+				newCount++
+			}
+		}
+
+		if sb.Len() == 0 {
+			sb.WriteString("--- " + fromLabel + "\n+++ " + toLabel + "\n")
+		}
+		sb.WriteString("@@ -" + hunkRange(oldStart, oldCount) + " +" + hunkRange(newStart, newCount) + " @@\n")
+		for _, l := range lines[start:end] {
+			sb.WriteByte(l.op)
+			sb.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		oldLine, newLine = oldStart+oldCount, newStart+newCount
+		i = end
+	}
+	return sb.String(), nil
+}
+
+// hunkRange formats the lines of one side of a hunk, given the number of lines
+// before it and its length
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return strconv.Itoa(before) + ",0"
+	}
+	if count == 1 {
+		return strconv.Itoa(before + 1)
+	}
+	return strconv.Itoa(before+1) + "," + strconv.Itoa(count)
+}
@@ -0,0 +1,145 @@
+package fileupload
+
+import (
+	"database/sql"
+	"go_backend_legalForce/models"
+	"go_backend_legalForce/storage"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DownloadFile streams the contents of a file from storage. The file must belong
+// to the request's tenant or be granted to it; files shared by link are reached
+// through their links, see ServeShareLink. Byte ranges and conditional requests
+// (If-None-Match, If-Modified-Since, If-Range) are answered by http.ServeContent.
+func DownloadFile(w http.ResponseWriter, r *http.Request, db *sql.DB, fileID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var file models.File
+	scope, scopeArg := t.access("files", 2, models.GrantViewer)
+	err := db.QueryRow("SELECT file_name, storage_key, file_type, mime_type, upload_date, "+scanStatusColumn+" FROM files WHERE id = $1 AND deleted_at IS NULL AND "+notExpired("files")+" AND "+scope,
+		fileID, scopeArg).Scan(&file.FileName, &file.StorageKey, &file.FileType, &file.MimeType, &file.UploadDate, &file.ScanStatus)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve file", http.StatusInternalServerError)
+		return
+	}
+	if !requireClean(w, file.ScanStatus) {
+		return
+	}
+
+	content, obj, ok := openStoredFile(w, r, file.StorageKey)
+	if !ok {
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.FileName}))
+	w.Header().Set("Cache-Control", "private")
+	serveStoredContent(w, r, content, obj, file.MimeType, file.UploadDate)
+
+	log.Printf("User %d downloaded file %d", t.userID, fileID)
+}
+
+// contentURL is where DownloadFile serves a file
+func contentURL(fileID int) string {
+	return "http://localhost:8080/files/" + strconv.Itoa(fileID) + "/content"
+}
+
+// ServePresignedFile serves a file below /uploads/ to anyone holding a presigned
+// URL for it, as handed out by the storage backend. It only serves the local storage
+// backend; other backends presign URLs of their own. Contents found infected after
+// the link was handed out, or whose files have all expired, are no longer served.
+// Like DownloadFile it serves the contents as an attachment, never inline.
+func ServePresignedFile(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	key := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	local, ok := storage.Default().(*storage.LocalBackend)
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if !local.VerifyPresigned(key, r.URL.Query()) {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+	// Contents only expired files hold are out of reach like the files. Versions
+	// sharing the contents were detected as the same type.
+	var status, mimeType, fileName string
+	var live bool
+	err := db.QueryRow(`SELECT COALESCE((SELECT scan_status FROM blobs WHERE storage_key = $1), 'pending'),
+		EXISTS(SELECT 1 FROM file_versions v JOIN files ON files.id = v.file_id WHERE v.storage_key = $1 AND `+notExpired("files")+`),
+		COALESCE((SELECT v.mime_type FROM file_versions v WHERE v.storage_key = $1 LIMIT 1), ''),
+		COALESCE((SELECT v.original_name FROM file_versions v WHERE v.storage_key = $1 LIMIT 1), '')`, key).
+		Scan(&status, &live, &mimeType, &fileName)
+	if err != nil {
+		http.Error(w, "Failed to retrieve file", http.StatusInternalServerError)
+		return
+	}
+	if !live {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if !requireClean(w, status) {
+		return
+	}
+
+	content, obj, ok := openStoredFile(w, r, key)
+	if !ok {
+		return
+	}
+	defer content.Close()
+
+	if fileName == "" {
+		fileName = path.Base(key)
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	serveStoredContent(w, r, content, obj, mimeType, time.Time{})
+}
+
+// openStoredFile opens a stored file, answering the request itself if it cannot
+func openStoredFile(w http.ResponseWriter, r *http.Request, key string) (*storage.ObjectReader, storage.Object, bool) {
+	content, obj, err := storage.Open(r.Context(), storage.Default(), key)
+	if err == storage.ErrNotFound || err == storage.ErrInvalidKey {
+		log.Printf("Stored file %q is missing", key)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return nil, obj, false
+	}
+	if err != nil {
+		log.Printf("Failed to open stored file %q: %v", key, err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return nil, obj, false
+	}
+	return content, obj, true
+}
+
+// serveStoredContent writes a stored file with its validators. It is served as
+// mimeType, the type detected from the contents when they were uploaded, and
+// browsers are told not to guess another one. Contents stored before types were
+// detected have none and are served as binary data. modTime is used when the
+// backend does not report when the object was written.
+func serveStoredContent(w http.ResponseWriter, r *http.Request, content *storage.ObjectReader, obj storage.Object, mimeType string, modTime time.Time) {
+	if mimeType == "" {
+		mimeType = defaultBinaryType
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if obj.ETag != "" {
+		w.Header().Set("ETag", obj.ETag)
+	}
+	if !obj.ModTime.IsZero() {
+		modTime = obj.ModTime
+	}
+	http.ServeContent(w, r, "", modTime, content)
+}
@@ -0,0 +1,222 @@
+package fileupload
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"go_backend_legalForce/models"
+	"log"
+	"net/http"
+	"time"
+)
+
+// notExpired is the condition that a file of table, the name or alias of files in
+// the query, has not expired. Expired files are out of reach as soon as they
+// expire, before the cleanup job deletes them.
+func notExpired(table string) string {
+	return "(" + table + ".expiration_date IS NULL OR " + table + ".expiration_date > NOW())"
+}
+
+// parseExpiry returns the expiry asked for as an absolute expiresAt or a TTL like
+// "72h" in expiresIn, or nil if neither is set
+func parseExpiry(expiresAt *time.Time, expiresIn string) (*time.Time, error) {
+	switch {
+	case expiresAt != nil && expiresIn != "":
+		return nil, errors.New("Set either expires_at or expires_in")
+	case expiresIn != "":
+		ttl, err := time.ParseDuration(expiresIn)
+		if err != nil || ttl <= 0 {
+			return nil, errors.New("Invalid expires_in")
+		}
+		expiry := time.Now().Add(ttl)
+		return &expiry, nil
+	case expiresAt != nil:
+		if !expiresAt.After(time.Now()) {
+			return nil, errors.New("expires_at must be in the future")
+		}
+		return expiresAt, nil
+	}
+	return nil, nil
+}
+
+// parseExpiryValues parses the expiry asked for as text, in expiresAt as RFC 3339
+// or in expiresIn as a TTL, the way uploads take it
+func parseExpiryValues(expiresAt, expiresIn string) (*time.Time, error) {
+	if expiresAt == "" {
+		return parseExpiry(nil, expiresIn)
+	}
+	at, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return nil, errors.New("Invalid expires_at")
+	}
+	return parseExpiry(&at, expiresIn)
+}
+
+// optionalTime is a time in a request body that can be cleared with null, unlike
+// a field left out of the body
+type optionalTime struct {
+	Set   bool
+	Value *time.Time
+}
+
+func (o *optionalTime) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	return json.Unmarshal(data, &o.Value)
+}
+
+// expiryPolicy is an ExpiryPolicy with its durations parsed, 0 where none is set
+type expiryPolicy struct {
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+}
+
+// expiry returns when a file the tenant asked to keep until requested, nil for
+// ever, expires under the policy. Files without an expiry get the default TTL, or
+// the longest one allowed if there is no default.
+func (p expiryPolicy) expiry(requested *time.Time) (*time.Time, error) {
+	if requested == nil {
+		ttl := p.defaultTTL
+		if ttl == 0 {
+			ttl = p.maxTTL
+		}
+		if ttl == 0 {
+			return nil, nil
+		}
+		expiry := time.Now().Add(ttl)
+		return &expiry, nil
+	}
+	if p.maxTTL > 0 && requested.After(time.Now().Add(p.maxTTL)) {
+		return nil, errors.New("Files cannot be kept longer than " + p.maxTTL.String() + " under the expiry policy")
+	}
+	return requested, nil
+}
+
+// loadExpiryPolicy returns the expiry policy of the tenant, which sets no default
+// and no limit if none was set
+func loadExpiryPolicy(db *sql.DB, t tenant) (expiryPolicy, error) {
+	policy, err := loadExpiryPolicySettings(db, t)
+	if err != nil {
+		return expiryPolicy{}, err
+	}
+	defaultTTL, _ := parseTTL(policy.DefaultTTL)
+	maxTTL, _ := parseTTL(policy.MaxTTL)
+	return expiryPolicy{defaultTTL: defaultTTL, maxTTL: maxTTL}, nil
+}
+
+func loadExpiryPolicySettings(db *sql.DB, t tenant) (models.ExpiryPolicy, error) {
+	var policy models.ExpiryPolicy
+	var defaultSeconds, maxSeconds int64
+	scope, scopeArg := t.condition(1)
+	err := db.QueryRow("SELECT default_ttl_seconds, max_ttl_seconds, updated_at FROM expiry_policies WHERE "+scope, scopeArg).
+		Scan(&defaultSeconds, &maxSeconds, &policy.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return policy, nil
+	}
+	policy.DefaultTTL = formatTTL(defaultSeconds)
+	policy.MaxTTL = formatTTL(maxSeconds)
+	return policy, err
+}
+
+// parseTTL parses a policy duration, which is empty for none
+func parseTTL(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, true
+	}
+	ttl, err := time.ParseDuration(value)
+	return ttl.Truncate(time.Second), err == nil && ttl >= time.Second
+}
+
+func formatTTL(seconds int64) string {
+	if seconds == 0 {
+		return ""
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+// GetExpiryPolicy returns the expiry policy of the tenant
+func GetExpiryPolicy(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	policy, err := loadExpiryPolicySettings(db, t)
+	if err != nil {
+		log.Printf("Failed to load expiry policy: %v", err)
+		http.Error(w, "Failed to retrieve expiry policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(policy)
+}
+
+// SetExpiryPolicy replaces the expiry policy of the tenant. It applies to files
+// uploaded and expiries changed from then on. Only owners and admins set the
+// policy of an organization.
+func SetExpiryPolicy(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !managesTenant(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var policy models.ExpiryPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	defaultTTL, validDefault := parseTTL(policy.DefaultTTL)
+	maxTTL, validMax := parseTTL(policy.MaxTTL)
+	if !validDefault || !validMax {
+		http.Error(w, "TTLs must be durations of at least a second like \"720h\", or empty for none", http.StatusBadRequest)
+		return
+	}
+	if maxTTL > 0 && defaultTTL > maxTTL {
+		http.Error(w, "default_ttl cannot be longer than max_ttl", http.StatusBadRequest)
+		return
+	}
+
+	// A tenant has a single policy, keyed like its files
+	column, conflict, owner := "user_id", "(user_id) WHERE org_id IS NULL", t.userID
+	if t.orgID != 0 {
+		column, conflict, owner = "org_id", "(org_id) WHERE org_id IS NOT NULL", t.orgID
+	}
+	defaultSeconds, maxSeconds := int64(defaultTTL/time.Second), int64(maxTTL/time.Second)
+	err := db.QueryRow(`INSERT INTO expiry_policies (`+column+`, default_ttl_seconds, max_ttl_seconds) VALUES ($1, $2, $3)
+		ON CONFLICT `+conflict+` DO UPDATE SET default_ttl_seconds = EXCLUDED.default_ttl_seconds, max_ttl_seconds = EXCLUDED.max_ttl_seconds, updated_at = NOW()
+		RETURNING updated_at`, owner, defaultSeconds, maxSeconds).Scan(&policy.UpdatedAt)
+	if err != nil {
+		log.Printf("Failed to save expiry policy: %v", err)
+		http.Error(w, "Failed to save expiry policy", http.StatusInternalServerError)
+		return
+	}
+	policy.DefaultTTL, policy.MaxTTL = formatTTL(defaultSeconds), formatTTL(maxSeconds)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(policy)
+}
+
+// cacheTTL is how long a cached listing of files stays valid: until the first of
+// them expires, or for ever if none expires
+func cacheTTL(files []models.File) time.Duration {
+	var ttl time.Duration
+	for _, file := range files {
+		if file.Expiration == nil {
+			continue
+		}
+		until := time.Until(*file.Expiration)
+		if until < time.Millisecond {
+			until = time.Millisecond
+		}
+		if ttl == 0 || until < ttl {
+			ttl = until
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,430 @@
+package fileupload
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"go_backend_legalForce/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// folderColumns are the columns of folders read by scanFolder
+const folderColumns = "id, user_id, COALESCE(org_id, 0), COALESCE(parent_id, 0), name, path, created_at"
+
+// Classes of the advisory locks taken by lockFolders, one per kind of tenant
+const (
+	folderLockUser = 1
+	folderLockOrg  = 2
+)
+
+var (
+	errParentNotFound = errors.New("parent folder not found")
+	errFolderExists   = errors.New("a folder with this name already exists")
+	errFolderCycle    = errors.New("folder cannot be moved below itself")
+)
+
+// FolderContents is a folder along with the way to it and what it holds
+type FolderContents struct {
+	Folder      *models.Folder  `json:"folder"`      // nil at the top of the tree
+	Breadcrumbs []models.Folder `json:"breadcrumbs"` // the folders from the top of the tree down to this one
+	Folders     []models.Folder `json:"folders"`
+	Files       []models.File   `json:"files"`
+}
+
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// scanFolder reads the folderColumns of a row, followed by any extra columns into extra
+func scanFolder(row rowScanner, folder *models.Folder, extra ...interface{}) error {
+	return row.Scan(append([]interface{}{&folder.ID, &folder.UserID, &folder.OrgID, &folder.ParentID, &folder.Name, &folder.Path, &folder.CreatedAt}, extra...)...)
+}
+
+// nullID stores an optional reference, where 0 means none
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// loadFolder returns a folder of the tenant
+func loadFolder(q rowQuerier, t tenant, folderID int) (models.Folder, error) {
+	var folder models.Folder
+	scope, scopeArg := t.condition(2)
+	err := scanFolder(q.QueryRow("SELECT "+folderColumns+" FROM folders WHERE id = $1 AND "+scope, folderID, scopeArg), &folder)
+	return folder, err
+}
+
+// queryFolders returns the folders selected by a query on folderColumns
+func queryFolders(db *sql.DB, query string, args ...interface{}) ([]models.Folder, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []models.Folder{}
+	for rows.Next() {
+		var folder models.Folder
+		if err := scanFolder(rows, &folder); err != nil {
+			return nil, err
+		}
+		folders = append(folders, folder)
+	}
+	return folders, rows.Err()
+}
+
+// lockFolders serializes changes to the tenant's tree until tx ends, so that
+// concurrent moves cannot form a cycle or leave stale paths behind
+func lockFolders(tx *sql.Tx, t tenant) error {
+	class, id := folderLockUser, t.userID
+	if t.orgID != 0 {
+		class, id = folderLockOrg, t.orgID
+	}
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock($1, $2)", class, id)
+	return err
+}
+
+// checkFolderName fails with errFolderExists if another folder of the parent
+// already has the name
+func checkFolderName(tx *sql.Tx, t tenant, parentID int, name string, folderID int) error {
+	var taken bool
+	scope, scopeArg := t.condition(4)
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM folders WHERE COALESCE(parent_id, 0) = $1 AND name = $2 AND id <> $3 AND "+scope+")",
+		parentID, name, folderID, scopeArg).Scan(&taken)
+	if err == nil && taken {
+		err = errFolderExists
+	}
+	return err
+}
+
+// writeFolderError answers a request whose change to the tree failed with err
+func writeFolderError(w http.ResponseWriter, err error, failure string) {
+	switch err {
+	case sql.ErrNoRows:
+		http.Error(w, "Folder not found", http.StatusNotFound)
+	case errParentNotFound:
+		http.Error(w, "Parent folder not found", http.StatusNotFound)
+	case errFolderExists:
+		http.Error(w, "A folder with this name already exists", http.StatusConflict)
+	case errFolderCycle:
+		http.Error(w, "A folder cannot be moved into itself or one of its subfolders", http.StatusConflict)
+	default:
+		log.Printf("%s: %v", failure, err)
+		http.Error(w, failure, http.StatusInternalServerError)
+	}
+}
+
+// CreateFolder creates a folder at the top of the tree or in the folder given as parent_id
+func CreateFolder(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name     string `json:"name"`
+		ParentID int    `json:"parent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "Folder name cannot be empty", http.StatusBadRequest)
+		return
+	}
+
+	folder, err := createFolder(db, t, req.ParentID, sanitizeFileName(req.Name))
+	if err != nil {
+		writeFolderError(w, err, "Failed to create folder")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(folder)
+}
+
+func createFolder(db *sql.DB, t tenant, parentID int, name string) (models.Folder, error) {
+	folder := models.Folder{UserID: t.userID, OrgID: t.orgID, ParentID: parentID, Name: name}
+	tx, err := db.Begin()
+	if err != nil {
+		return folder, err
+	}
+	defer tx.Rollback()
+
+	if err := lockFolders(tx, t); err != nil {
+		return folder, err
+	}
+	parentPath := "/"
+	if parentID != 0 {
+		parent, err := loadFolder(tx, t, parentID)
+		if err == sql.ErrNoRows {
+			return folder, errParentNotFound
+		}
+		if err != nil {
+			return folder, err
+		}
+		parentPath = parent.Path
+	}
+	if err := checkFolderName(tx, t, parentID, name, 0); err != nil {
+		return folder, err
+	}
+
+	// The path ends with the id of the folder, so the id is taken first
+	err = tx.QueryRow(`WITH new AS (SELECT nextval(pg_get_serial_sequence('folders', 'id')) AS id)
+		INSERT INTO folders (id, user_id, org_id, parent_id, name, path)
+		SELECT id, $1, $2, $3, $4, $5 || id || '/' FROM new RETURNING id, path, created_at`,
+		t.userID, t.orgValue(), nullID(parentID), name, parentPath).Scan(&folder.ID, &folder.Path, &folder.CreatedAt)
+	if err != nil {
+		return folder, err
+	}
+	return folder, tx.Commit()
+}
+
+// ListFolder lists the folders and files in a folder, or at the top of the tree
+// for folder 0, along with the breadcrumbs leading to it. Folders granted to the
+// tenant are listed like its own, with the breadcrumbs it has access to.
+func ListFolder(w http.ResponseWriter, r *http.Request, db *sql.DB, folderID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	contents := FolderContents{Breadcrumbs: []models.Folder{}}
+	scope, scopeArg := t.condition(2)
+	fileScope, orgID := scope, t.orgID
+	if folderID != 0 {
+		// Everything below a granted folder is granted along with it
+		scope, _ = t.folderAccess(2, models.GrantViewer)
+		fileScope, _ = t.access("files", 2, models.GrantViewer)
+
+		var folder models.Folder
+		err := scanFolder(db.QueryRow("SELECT "+folderColumns+" FROM folders WHERE id = $1 AND "+scope, folderID, scopeArg), &folder)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to retrieve folder %d: %v", folderID, err)
+			http.Error(w, "Failed to retrieve folder", http.StatusInternalServerError)
+			return
+		}
+		contents.Folder = &folder
+		orgID = folder.OrgID
+
+		// The folders on the way are those whose path starts this one's
+		contents.Breadcrumbs, err = queryFolders(db, "SELECT "+folderColumns+" FROM folders WHERE $1 LIKE path || '%' AND "+scope+" ORDER BY length(path)",
+			folder.Path, scopeArg)
+		if err != nil {
+			log.Printf("Failed to retrieve breadcrumbs of folder %d: %v", folderID, err)
+			http.Error(w, "Failed to retrieve folder", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var err error
+	contents.Folders, err = queryFolders(db, "SELECT "+folderColumns+" FROM folders WHERE COALESCE(parent_id, 0) = $1 AND "+scope+" ORDER BY name",
+		folderID, scopeArg)
+	if err != nil {
+		log.Printf("Failed to list subfolders of folder %d: %v", folderID, err)
+		http.Error(w, "Failed to retrieve folder", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query("SELECT "+fileColumns+" FROM files WHERE COALESCE(folder_id, 0) = $1 AND "+fileScope+" AND deleted_at IS NULL AND "+notExpired("files")+" ORDER BY file_name",
+		folderID, scopeArg)
+	if err != nil {
+		log.Printf("Failed to list files of folder %d: %v", folderID, err)
+		http.Error(w, "Failed to retrieve files", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	contents.Files = []models.File{}
+	for rows.Next() {
+		var file models.File
+		if err := scanFile(rows, &file); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			http.Error(w, "Failed to scan file", http.StatusInternalServerError)
+			return
+		}
+		file.OrgID = orgID
+		contents.Files = append(contents.Files, file)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(contents)
+}
+
+// UpdateFolder renames a folder and/or moves it, along with everything in it, to
+// another parent. A parent_id of 0 moves it to the top of the tree.
+func UpdateFolder(w http.ResponseWriter, r *http.Request, db *sql.DB, folderID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name     *string `json:"name"`
+		ParentID *int    `json:"parent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if req.Name == nil && req.ParentID == nil {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+	if req.Name != nil {
+		if strings.TrimSpace(*req.Name) == "" {
+			http.Error(w, "Folder name cannot be empty", http.StatusBadRequest)
+			return
+		}
+		name := sanitizeFileName(*req.Name)
+		req.Name = &name
+	}
+
+	folder, err := updateFolder(db, t, folderID, req.Name, req.ParentID)
+	if err != nil {
+		writeFolderError(w, err, "Failed to update folder")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(folder)
+}
+
+func updateFolder(db *sql.DB, t tenant, folderID int, name *string, parentID *int) (models.Folder, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return models.Folder{}, err
+	}
+	defer tx.Rollback()
+
+	if err := lockFolders(tx, t); err != nil {
+		return models.Folder{}, err
+	}
+	folder, err := loadFolder(tx, t, folderID)
+	if err != nil {
+		return folder, err
+	}
+	oldPath := folder.Path
+	if name != nil {
+		folder.Name = *name
+	}
+
+	if parentID != nil && *parentID != folder.ParentID {
+		parentPath := "/"
+		if *parentID != 0 {
+			parent, err := loadFolder(tx, t, *parentID)
+			if err == sql.ErrNoRows {
+				return folder, errParentNotFound
+			}
+			if err != nil {
+				return folder, err
+			}
+			// A folder's own path starts every path below it
+			if strings.HasPrefix(parent.Path, folder.Path) {
+				return folder, errFolderCycle
+			}
+			parentPath = parent.Path
+		}
+		folder.ParentID = *parentID
+		folder.Path = parentPath + strconv.Itoa(folder.ID) + "/"
+	}
+	if err := checkFolderName(tx, t, folder.ParentID, folder.Name, folder.ID); err != nil {
+		return folder, err
+	}
+
+	_, err = tx.Exec("UPDATE folders SET name = $1, parent_id = $2 WHERE id = $3", folder.Name, nullID(folder.ParentID), folder.ID)
+	if err != nil {
+		return folder, err
+	}
+	if folder.Path != oldPath {
+		// The folder and every folder below it get the new beginning of the path
+		_, err = tx.Exec("UPDATE folders SET path = $1 || substr(path, $2) WHERE path LIKE $3 || '%'",
+			folder.Path, len(oldPath)+1, oldPath)
+		if err != nil {
+			return folder, err
+		}
+	}
+	return folder, tx.Commit()
+}
+
+// DeleteFolder deletes a folder and every folder below it. The files in them are
+// moved to the trash, and go back to the top of the tree if they are restored.
+func DeleteFolder(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client, folderID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	fileIDs, err := deleteFolder(db, t, folderID)
+	if err != nil {
+		writeFolderError(w, err, "Failed to delete folder")
+		return
+	}
+
+	if redisClient != nil {
+		redisClient.Del(ctx, t.filesCacheKey())
+	}
+	log.Printf("User %d deleted folder %d, moving %d files to the trash", t.userID, folderID, len(fileIDs))
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Folder deleted", "trashed_files": len(fileIDs)})
+}
+
+// deleteFolder deletes a folder with everything below it and returns the ids of
+// the files moved to the trash
+func deleteFolder(db *sql.DB, t tenant, folderID int) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockFolders(tx, t); err != nil {
+		return nil, err
+	}
+	folder, err := loadFolder(tx, t, folderID)
+	if err != nil {
+		return nil, err
+	}
+
+	scope, scopeArg := t.condition(2)
+	rows, err := tx.Query(`UPDATE files SET deleted_at = NOW()
+		WHERE folder_id IN (SELECT id FROM folders WHERE path LIKE $1 || '%') AND deleted_at IS NULL AND `+scope+` RETURNING id`,
+		folder.Path, scopeArg)
+	if err != nil {
+		return nil, err
+	}
+	var fileIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		fileIDs = append(fileIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Subfolders are deleted along with their parent, and files lose their folder
+	if _, err := tx.Exec("DELETE FROM folders WHERE id = $1", folderID); err != nil {
+		return nil, err
+	}
+	return fileIDs, tx.Commit()
+}
@@ -0,0 +1,315 @@
+package fileupload
+
+import (
+	"database/sql"
+	"encoding/json"
+	"go_backend_legalForce/models"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// grantColumns are the columns of file_grants g read by scanGrant, along with the
+// email of the user granted access from users u
+const grantColumns = "g.id, COALESCE(g.file_id, 0), COALESCE(g.folder_id, 0), COALESCE(g.grantee_user_id, 0), COALESCE(u.email, ''), " +
+	"COALESCE(g.grantee_org_id, 0), g.role, COALESCE(g.granted_by, 0), g.created_at"
+
+func scanGrant(row rowScanner, grant *models.Grant) error {
+	return row.Scan(&grant.ID, &grant.FileID, &grant.FolderID, &grant.UserID, &grant.Email, &grant.OrgID, &grant.Role, &grant.GrantedBy, &grant.CreatedAt)
+}
+
+// grantTarget is the file or folder a grant is made on
+type grantTarget struct {
+	column string // of file_grants
+	table  string
+	name   string
+	id     int
+}
+
+func fileTarget(fileID int) grantTarget {
+	return grantTarget{column: "file_id", table: "files", name: "File", id: fileID}
+}
+
+func folderTarget(folderID int) grantTarget {
+	return grantTarget{column: "folder_id", table: "folders", name: "Folder", id: folderID}
+}
+
+// loadOwner returns the tenant the target belongs to, if the tenant has at least
+// role on it. Files in the trash cannot be granted.
+func (g grantTarget) loadOwner(db *sql.DB, t tenant, role string) (tenant, error) {
+	var owner tenant
+	scope, scopeArg := t.folderAccess(2, role)
+	if g.table == "files" {
+		scope, scopeArg = t.access("files", 2, role)
+		scope = "deleted_at IS NULL AND " + notExpired("files") + " AND " + scope
+	}
+	err := db.QueryRow("SELECT user_id, COALESCE(org_id, 0) FROM "+g.table+" WHERE id = $1 AND "+scope, g.id, scopeArg).
+		Scan(&owner.userID, &owner.orgID)
+	return owner, err
+}
+
+// SharedFile is a file granted to the tenant
+type SharedFile struct {
+	models.File
+	Role     string    `json:"role"`
+	SharedBy int       `json:"shared_by"` // 0 once the granting account is deleted
+	SharedAt time.Time `json:"shared_at"`
+}
+
+// SharedFolder is a folder granted to the tenant, along with everything below it
+type SharedFolder struct {
+	models.Folder
+	Role     string    `json:"role"`
+	SharedBy int       `json:"shared_by"`
+	SharedAt time.Time `json:"shared_at"`
+}
+
+// SharedWithMe is what other users and organizations granted the tenant access to
+type SharedWithMe struct {
+	Folders []SharedFolder `json:"folders"`
+	Files   []SharedFile   `json:"files"`
+}
+
+// CreateFileGrant gives a user or an organization access to a file
+func CreateFileGrant(w http.ResponseWriter, r *http.Request, db *sql.DB, fileID int) {
+	createGrant(w, r, db, fileTarget(fileID))
+}
+
+// CreateFolderGrant gives a user or an organization access to a folder and
+// everything below it
+func CreateFolderGrant(w http.ResponseWriter, r *http.Request, db *sql.DB, folderID int) {
+	createGrant(w, r, db, folderTarget(folderID))
+}
+
+// createGrant grants the user with the given email, or the organization org_id,
+// a role on the target. Granting a grantee again changes its role. The owner
+// and co-owners of the target can grant access to it.
+func createGrant(w http.ResponseWriter, r *http.Request, db *sql.DB, target grantTarget) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+		OrgID int    `json:"org_id"`
+		Role  string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if (req.Email == "") == (req.OrgID == 0) {
+		http.Error(w, "Set either email or org_id", http.StatusBadRequest)
+		return
+	}
+	if !isGrantRole(req.Role) {
+		http.Error(w, "Invalid role, expected one of "+strings.Join(models.GrantRoles, ", "), http.StatusBadRequest)
+		return
+	}
+
+	owner, err := target.loadOwner(db, t, models.GrantCoOwner)
+	if err == sql.ErrNoRows {
+		http.Error(w, target.name+" not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to retrieve %s %d: %v", target.table, target.id, err)
+		http.Error(w, "Failed to grant access", http.StatusInternalServerError)
+		return
+	}
+
+	grant := models.Grant{OrgID: req.OrgID, Role: req.Role, GrantedBy: t.userID}
+	if target.table == "files" {
+		grant.FileID = target.id
+	} else {
+		grant.FolderID = target.id
+	}
+	if req.Email != "" {
+		err = db.QueryRow("SELECT id, email FROM users WHERE email = $1 AND disabled = FALSE", req.Email).Scan(&grant.UserID, &grant.Email)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+	} else {
+		var exists bool
+		err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM organizations WHERE id = $1)", req.OrgID).Scan(&exists)
+		if err == nil && !exists {
+			http.Error(w, "Organization not found", http.StatusNotFound)
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to look up the grantee: %v", err)
+		http.Error(w, "Failed to grant access", http.StatusInternalServerError)
+		return
+	}
+	if (owner.orgID == 0 && grant.UserID == owner.userID) || (owner.orgID != 0 && grant.OrgID == owner.orgID) {
+		http.Error(w, "The "+strings.ToLower(target.name)+" already belongs to the grantee", http.StatusBadRequest)
+		return
+	}
+
+	err = db.QueryRow(`INSERT INTO file_grants (file_id, folder_id, grantee_user_id, grantee_org_id, role, granted_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (COALESCE(file_id, 0), COALESCE(folder_id, 0), COALESCE(grantee_user_id, 0), COALESCE(grantee_org_id, 0))
+		DO UPDATE SET role = EXCLUDED.role, granted_by = EXCLUDED.granted_by
+		RETURNING id, created_at`,
+		nullID(grant.FileID), nullID(grant.FolderID), nullID(grant.UserID), nullID(grant.OrgID), grant.Role, t.userID).Scan(&grant.ID, &grant.CreatedAt)
+	if err != nil {
+		log.Printf("Failed to grant access to %s %d: %v", target.table, target.id, err)
+		http.Error(w, "Failed to grant access", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d granted %s access to %s %d", t.userID, grant.Role, target.table, target.id)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(grant)
+}
+
+// isGrantRole reports whether role is one of models.GrantRoles
+func isGrantRole(role string) bool {
+	for _, r := range models.GrantRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ListFileGrants lists who was granted access to a file
+func ListFileGrants(w http.ResponseWriter, r *http.Request, db *sql.DB, fileID int) {
+	listGrants(w, r, db, fileTarget(fileID))
+}
+
+// ListFolderGrants lists who was granted access to a folder. Grants on the
+// folders above it are not listed.
+func ListFolderGrants(w http.ResponseWriter, r *http.Request, db *sql.DB, folderID int) {
+	listGrants(w, r, db, folderTarget(folderID))
+}
+
+// listGrants lists the grants on the target, oldest first, to its owner and co-owners
+func listGrants(w http.ResponseWriter, r *http.Request, db *sql.DB, target grantTarget) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := target.loadOwner(db, t, models.GrantCoOwner); err == sql.ErrNoRows {
+		http.Error(w, target.name+" not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to retrieve %s %d: %v", target.table, target.id, err)
+		http.Error(w, "Failed to retrieve grants", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`SELECT `+grantColumns+` FROM file_grants g LEFT JOIN users u ON u.id = g.grantee_user_id
+		WHERE g.`+target.column+` = $1 ORDER BY g.created_at, g.id`, target.id)
+	if err != nil {
+		log.Printf("Failed to list grants of %s %d: %v", target.table, target.id, err)
+		http.Error(w, "Failed to retrieve grants", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	grants := []models.Grant{}
+	for rows.Next() {
+		var grant models.Grant
+		if err := scanGrant(rows, &grant); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			http.Error(w, "Failed to scan grant", http.StatusInternalServerError)
+			return
+		}
+		grants = append(grants, grant)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(grants)
+}
+
+// DeleteGrant takes access away. The owner and co-owners of the file or folder
+// can delete its grants, and grantees can give up their own.
+func DeleteGrant(w http.ResponseWriter, r *http.Request, db *sql.DB, grantID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	fileScope, scopeArg := t.access("files", 2, models.GrantCoOwner)
+	folderScope, _ := t.folderAccess(2, models.GrantCoOwner)
+	result, err := db.Exec(`DELETE FROM file_grants WHERE id = $1 AND (`+t.granteeColumn()+` = $2
+		OR file_id IN (SELECT id FROM files WHERE `+fileScope+`)
+		OR folder_id IN (SELECT id FROM folders WHERE `+folderScope+`))`, grantID, scopeArg)
+	if err != nil {
+		log.Printf("Failed to delete grant %d: %v", grantID, err)
+		http.Error(w, "Failed to remove access", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Grant not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("User %d deleted grant %d", t.userID, grantID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Access removed"})
+}
+
+// ListSharedWithMe lists the folders and files granted to the tenant, most
+// recently shared first. The contents of shared folders are listed with
+// ListFolder.
+func ListSharedWithMe(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	_, grantee := t.condition(1)
+	shared := SharedWithMe{Folders: []SharedFolder{}, Files: []SharedFile{}}
+	rows, err := db.Query(`SELECT `+folderColumns+`, shared.role, shared.granted_by, shared.shared_at FROM folders
+		JOIN (SELECT folder_id, role, COALESCE(granted_by, 0) AS granted_by, created_at AS shared_at FROM file_grants WHERE `+t.granteeColumn()+` = $1) shared
+		ON shared.folder_id = folders.id ORDER BY shared.shared_at DESC`, grantee)
+	if err != nil {
+		log.Printf("Failed to list shared folders: %v", err)
+		http.Error(w, "Failed to retrieve shared files", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var folder SharedFolder
+		if err := scanFolder(rows, &folder.Folder, &folder.Role, &folder.SharedBy, &folder.SharedAt); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			http.Error(w, "Failed to scan folder", http.StatusInternalServerError)
+			return
+		}
+		shared.Folders = append(shared.Folders, folder)
+	}
+
+	rows, err = db.Query(`SELECT `+fileColumns+`, user_id, COALESCE(org_id, 0), shared.role, shared.granted_by, shared.shared_at FROM files
+		JOIN (SELECT file_id, role, COALESCE(granted_by, 0) AS granted_by, created_at AS shared_at FROM file_grants WHERE `+t.granteeColumn()+` = $1) shared
+		ON shared.file_id = files.id WHERE files.deleted_at IS NULL AND `+notExpired("files")+` ORDER BY shared.shared_at DESC`, grantee)
+	if err != nil {
+		log.Printf("Failed to list shared files: %v", err)
+		http.Error(w, "Failed to retrieve shared files", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var file SharedFile
+		if err := scanFile(rows, &file.File, &file.UserID, &file.OrgID, &file.Role, &file.SharedBy, &file.SharedAt); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			http.Error(w, "Failed to scan file", http.StatusInternalServerError)
+			return
+		}
+		shared.Files = append(shared.Files, file)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(shared)
+}
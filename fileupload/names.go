@@ -0,0 +1,67 @@
+package fileupload
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameBytes  = 255 // the limit of most filesystems, so downloads can be saved as named
+	maxOriginalNameBytes = 1024
+	defaultDisplayName   = "untitled"
+)
+
+// sanitizeFileName turns a client supplied file name into a display name: the
+// last path element, without control characters or characters that are invalid
+// in file names on common systems, with whitespace collapsed and at most
+// maxDisplayNameBytes long. The extension is kept when the name is shortened.
+func sanitizeFileName(name string) string {
+	// Browsers on Windows may send the full path
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var sb strings.Builder
+	space := false
+	for _, r := range name {
+		switch {
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		case r == utf8.RuneError || unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r):
+			continue
+		}
+		if space && sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		space = false
+		sb.WriteRune(r)
+	}
+
+	// Leading dots would hide the file, trailing dots are dropped by Windows
+	name = strings.Trim(sb.String(), ". ")
+	if len(name) > maxDisplayNameBytes {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = truncateUTF8(strings.TrimSuffix(name, ext), maxDisplayNameBytes-len(ext)) + ext
+	}
+	if name == "" {
+		return defaultDisplayName
+	}
+	return name
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
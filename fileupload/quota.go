@@ -0,0 +1,357 @@
+package fileupload
+
+import (
+	"database/sql"
+	"encoding/json"
+	"go_backend_legalForce/models"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	codeQuotaExceeded = "quota_exceeded"
+
+	// reservationTTL is how long space reserved for an upload counts against the
+	// quota if the upload neither finishes nor fails, e.g. when the server stops
+	reservationTTL = time.Hour
+)
+
+// defaultQuota returns the limits of a tenant without limits of its own:
+// USER_QUOTA_BYTES and USER_QUOTA_FILES for personal files, ORG_QUOTA_BYTES and
+// ORG_QUOTA_FILES for organizations. Unset limits are unlimited.
+func defaultQuota(t tenant) (maxBytes, maxFiles int64) {
+	prefix := "USER_QUOTA_"
+	if t.orgID != 0 {
+		prefix = "ORG_QUOTA_"
+	}
+	return envLimit(prefix + "BYTES"), envLimit(prefix + "FILES")
+}
+
+func envLimit(name string) int64 {
+	if limit, err := strconv.ParseInt(os.Getenv(name), 10, 64); err == nil && limit > 0 {
+		return limit
+	}
+	return 0
+}
+
+// quotaOwner returns the column of quotas naming the tenant, the conflict target
+// of its row and the value of the column. A tenant has a single quota, keyed like
+// its files.
+func quotaOwner(t tenant) (column, conflict string, owner int) {
+	if t.orgID != 0 {
+		return "org_id", "(org_id) WHERE org_id IS NOT NULL", t.orgID
+	}
+	return "user_id", "(user_id) WHERE org_id IS NULL", t.userID
+}
+
+// quotaLimits returns the limits of a quota row, where NULL stands for the default
+func quotaLimits(t tenant, maxBytes, maxFiles sql.NullInt64) (int64, int64) {
+	defaultBytes, defaultFiles := defaultQuota(t)
+	if maxBytes.Valid {
+		defaultBytes = maxBytes.Int64
+	}
+	if maxFiles.Valid {
+		defaultFiles = maxFiles.Int64
+	}
+	return defaultBytes, defaultFiles
+}
+
+// quotaError explains why the quota refused an upload, with the usage and limits
+// of the tenant at the time
+type quotaError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"error"`
+	Quota   models.Usage `json:"quota"`
+}
+
+func (e *quotaError) Error() string {
+	return e.Message
+}
+
+// exceededBytes is the error of an upload that does not fit in the bytes left
+func exceededBytes(usage models.Usage) *quotaError {
+	return &quotaError{Code: codeQuotaExceeded, Quota: usage,
+		Message: "Storage quota of " + strconv.FormatInt(usage.MaxBytes, 10) + " bytes exceeded"}
+}
+
+// writeQuotaError refuses a request that does not fit in the tenant's quota
+func writeQuotaError(w http.ResponseWriter, err *quotaError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(err)
+}
+
+// quotaReservation is space held for an upload until its file is registered.
+// bytes is how much the upload may write.
+type quotaReservation struct {
+	id    int // 0 if nothing had to be held, when the quota is unlimited
+	bytes int64
+	usage models.Usage
+}
+
+// exceeded is the error of an upload that wrote more than was reserved for it
+func (q quotaReservation) exceeded() *quotaError {
+	return exceededBytes(q.usage)
+}
+
+// release gives back the space once the upload is registered or has failed. A
+// reservation that cannot be released stops counting when it expires.
+func (q quotaReservation) release(db *sql.DB) {
+	if q.id == 0 {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM quota_reservations WHERE id = $1", q.id); err != nil {
+		log.Printf("Failed to release quota reservation %d: %v", q.id, err)
+	}
+}
+
+// lockQuota returns the id of the tenant's quota, creating it if needed, and its
+// usage including space reserved by uploads in progress. The quota stays locked
+// until tx ends, so concurrent uploads of the tenant reserve one after the other.
+// The usage is only counted when a limit applies.
+func lockQuota(tx *sql.Tx, t tenant) (int, models.Usage, error) {
+	var id int
+	var usage models.Usage
+	var maxBytes, maxFiles sql.NullInt64
+	column, conflict, owner := quotaOwner(t)
+	// The update changes nothing but takes the row lock, which DO NOTHING does not
+	err := tx.QueryRow(`INSERT INTO quotas (`+column+`) VALUES ($1)
+		ON CONFLICT `+conflict+` DO UPDATE SET `+column+` = EXCLUDED.`+column+`
+		RETURNING id, max_bytes, max_files`, owner).Scan(&id, &maxBytes, &maxFiles)
+	if err != nil {
+		return 0, usage, err
+	}
+	usage.MaxBytes, usage.MaxFiles = quotaLimits(t, maxBytes, maxFiles)
+	if usage.MaxBytes == 0 && usage.MaxFiles == 0 {
+		return id, usage, nil
+	}
+
+	scope, scopeArg := t.condition(1)
+	err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM files WHERE `+scope+`) + COALESCE(SUM(r.files), 0),
+			(SELECT COALESCE(SUM(v.size), 0) FROM file_versions v JOIN files ON files.id = v.file_id WHERE `+scope+`) + COALESCE(SUM(r.bytes), 0)
+		FROM quota_reservations r WHERE r.quota_id = $2 AND r.expires_at > NOW()`, scopeArg, id).Scan(&usage.Files, &usage.Bytes)
+	return id, usage, err
+}
+
+// fitQuota returns how many bytes, between minBytes and maxBytes, an upload of
+// files new files may write within usage, or the reason it does not fit
+func fitQuota(usage models.Usage, minBytes, maxBytes, files int64) (int64, *quotaError) {
+	if files > 0 && usage.MaxFiles > 0 && usage.Files+files > usage.MaxFiles {
+		return 0, &quotaError{Code: codeQuotaExceeded, Quota: usage,
+			Message: "File quota of " + strconv.FormatInt(usage.MaxFiles, 10) + " files exceeded"}
+	}
+	if usage.MaxBytes == 0 {
+		return maxBytes, nil
+	}
+	available := usage.MaxBytes - usage.Bytes
+	if available < 0 {
+		available = 0
+	}
+	if available < minBytes {
+		return 0, exceededBytes(usage)
+	}
+	if available < maxBytes {
+		return available, nil
+	}
+	return maxBytes, nil
+}
+
+// reserveQuota holds space in the tenant's quota for an upload of files new files
+// taking at least minBytes and at most maxBytes, before anything is written. The
+// reservation holds as many bytes as fit, up to maxBytes; if fewer than minBytes
+// fit, a *quotaError is returned. The caller releases the reservation.
+func reserveQuota(db *sql.DB, t tenant, minBytes, maxBytes, files int64) (quotaReservation, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return quotaReservation{}, err
+	}
+	defer tx.Rollback()
+
+	quotaID, usage, err := lockQuota(tx, t)
+	if err != nil {
+		return quotaReservation{}, err
+	}
+	bytes, refused := fitQuota(usage, minBytes, maxBytes, files)
+	if refused != nil {
+		return quotaReservation{}, refused
+	}
+	reservation := quotaReservation{bytes: bytes, usage: usage}
+	if usage.MaxBytes == 0 && usage.MaxFiles == 0 {
+		return reservation, nil
+	}
+
+	err = tx.QueryRow("INSERT INTO quota_reservations (quota_id, bytes, files, expires_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		quotaID, bytes, files, time.Now().Add(reservationTTL)).Scan(&reservation.id)
+	if err != nil {
+		return quotaReservation{}, err
+	}
+	return reservation, tx.Commit()
+}
+
+// checkQuota returns a *quotaError if an upload of bytes in files new files does
+// not fit in the tenant's quota now, without holding space for it
+func checkQuota(db *sql.DB, t tenant, bytes, files int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, usage, err := lockQuota(tx, t)
+	if err != nil {
+		return err
+	}
+	if _, refused := fitQuota(usage, bytes, bytes, files); refused != nil {
+		return refused
+	}
+	return nil
+}
+
+// loadQuota returns the limits set for the tenant, and its usage of them by
+// content type. Space reserved by uploads in progress is not included.
+func loadQuota(db *sql.DB, t tenant) (models.Quota, error) {
+	var quota models.Quota
+	var maxBytes, maxFiles sql.NullInt64
+	scope, scopeArg := t.condition(1)
+	err := db.QueryRow("SELECT max_bytes, max_files, updated_at FROM quotas WHERE "+scope, scopeArg).
+		Scan(&maxBytes, &maxFiles, &quota.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return quota, err
+	}
+	if maxBytes.Valid {
+		quota.MaxBytes = &maxBytes.Int64
+	}
+	if maxFiles.Valid {
+		quota.MaxFiles = &maxFiles.Int64
+	}
+	quota.Usage.MaxBytes, quota.Usage.MaxFiles = quotaLimits(t, maxBytes, maxFiles)
+
+	rows, err := db.Query(`SELECT files.mime_type, COALESCE(SUM(v.size), 0), COUNT(DISTINCT files.id)
+		FROM files JOIN file_versions v ON v.file_id = files.id WHERE `+scope+`
+		GROUP BY files.mime_type ORDER BY 2 DESC, 1`, scopeArg)
+	if err != nil {
+		return quota, err
+	}
+	defer rows.Close()
+
+	quota.Usage.ByType = []models.TypeUsage{}
+	for rows.Next() {
+		var usage models.TypeUsage
+		if err := rows.Scan(&usage.MimeType, &usage.Bytes, &usage.Files); err != nil {
+			return quota, err
+		}
+		quota.Usage.Bytes += usage.Bytes
+		quota.Usage.Files += usage.Files
+		quota.Usage.ByType = append(quota.Usage.ByType, usage)
+	}
+	return quota, rows.Err()
+}
+
+// GetUsage returns the storage the tenant takes up, in total and by content type,
+// along with the limits of its quota
+func GetUsage(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	quota, err := loadQuota(db, t)
+	if err != nil {
+		log.Printf("Failed to load usage: %v", err)
+		http.Error(w, "Failed to retrieve usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(quota.Usage)
+}
+
+// quotaTenant returns the tenant of an administrator's request on the quota of
+// user userID, or of organization orgID when it is not 0, or writes 404 if there
+// is no such account
+func quotaTenant(w http.ResponseWriter, db *sql.DB, userID, orgID int) (tenant, bool) {
+	t, table, message := tenant{userID: userID}, "users", "User not found"
+	if orgID != 0 {
+		t, table, message = tenant{orgID: orgID}, "organizations", "Organization not found"
+	}
+	_, _, owner := quotaOwner(t)
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM "+table+" WHERE id = $1)", owner).Scan(&exists); err != nil {
+		log.Printf("Failed to check existence of %s %d: %v", table, owner, err)
+		http.Error(w, "Failed to retrieve quota", http.StatusInternalServerError)
+		return t, false
+	}
+	if !exists {
+		http.Error(w, message, http.StatusNotFound)
+		return t, false
+	}
+	return t, true
+}
+
+// GetQuota returns the limits set for the personal files of user userID, or for
+// organization orgID when it is not 0, along with their usage. It is meant for
+// administrators.
+func GetQuota(w http.ResponseWriter, r *http.Request, db *sql.DB, userID, orgID int) {
+	t, ok := quotaTenant(w, db, userID, orgID)
+	if !ok {
+		return
+	}
+
+	quota, err := loadQuota(db, t)
+	if err != nil {
+		log.Printf("Failed to load quota: %v", err)
+		http.Error(w, "Failed to retrieve quota", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(quota)
+}
+
+// SetQuota replaces the limits of the personal files of user userID, or of
+// organization orgID when it is not 0. A limit that is null or left out falls
+// back to the default, and 0 is unlimited. Lowering a limit below the usage
+// keeps the files but refuses further uploads. It is meant for administrators.
+func SetQuota(w http.ResponseWriter, r *http.Request, db *sql.DB, userID, orgID int) {
+	var req struct {
+		MaxBytes *int64 `json:"max_bytes"`
+		MaxFiles *int64 `json:"max_files"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if (req.MaxBytes != nil && *req.MaxBytes < 0) || (req.MaxFiles != nil && *req.MaxFiles < 0) {
+		http.Error(w, "Limits cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	t, ok := quotaTenant(w, db, userID, orgID)
+	if !ok {
+		return
+	}
+	column, conflict, owner := quotaOwner(t)
+	_, err := db.Exec(`INSERT INTO quotas (`+column+`, max_bytes, max_files, updated_at) VALUES ($1, $2, $3, NOW())
+		ON CONFLICT `+conflict+` DO UPDATE SET max_bytes = EXCLUDED.max_bytes, max_files = EXCLUDED.max_files, updated_at = NOW()`,
+		owner, req.MaxBytes, req.MaxFiles)
+	if err != nil {
+		log.Printf("Failed to save quota: %v", err)
+		http.Error(w, "Failed to save quota", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Quota of %s %d set", column, owner)
+
+	quota, err := loadQuota(db, t)
+	if err != nil {
+		log.Printf("Failed to load quota: %v", err)
+		http.Error(w, "Failed to retrieve quota", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(quota)
+}
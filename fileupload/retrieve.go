@@ -11,12 +11,45 @@ import (
 	"github.com/go-redis/redis/v8"
 )
 
+// fileColumns are the columns of files read by scanFile
+const fileColumns = "id, file_name, original_name, upload_date, size, file_type, s3_url, description, is_shared, expiration_date, COALESCE(folder_id, 0), mime_type, " + scanStatusColumn
+
+// scanFile reads the fileColumns of a row, followed by any extra columns into extra
+func scanFile(row rowScanner, file *models.File, extra ...interface{}) error {
+	err := row.Scan(append([]interface{}{&file.ID, &file.FileName, &file.OriginalName, &file.UploadDate, &file.Size,
+		&file.FileType, &file.S3URL, &file.Description, &file.IsShared, &file.Expiration, &file.FolderID, &file.MimeType, &file.ScanStatus}, extra...)...)
+	file.LocalPath = contentURL(file.ID)
+	return err
+}
+
+// RetrieveFiles lists the files of the tenant. With ?folder_id= only the files
+// directly in that folder are listed, or those outside any folder for 0.
 func RetrieveFiles(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client) {
-	userID := 3                                      // for my own account -> ameytrips0307@gmail It will be dynamic
-	cacheKey := "user_files:" + strconv.Itoa(userID) // Define it here, outside the if block
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	cacheKey := t.filesCacheKey() // Define it here, outside the if block
+
+	scope, scopeArg := t.condition(1)
+	query := "SELECT " + fileColumns + " FROM files WHERE " + scope + " AND deleted_at IS NULL AND " + notExpired("files")
+	args := []interface{}{scopeArg}
+
+	// Only the complete listing is cached
+	if folder := r.URL.Query().Get("folder_id"); folder != "" {
+		folderID, err := strconv.Atoi(folder)
+		if err != nil || folderID < 0 {
+			http.Error(w, "Invalid folder_id", http.StatusBadRequest)
+			return
+		}
+		query += " AND COALESCE(folder_id, 0) = $2"
+		args = append(args, folderID)
+		cacheKey = ""
+	}
 
 	// Check Redis cache first
-	if redisClient != nil {
+	if redisClient != nil && cacheKey != "" {
 
 		cachedFiles, err := redisClient.Get(ctx, cacheKey).Result()
 		if err == nil && redisClient != nil {
@@ -27,7 +60,7 @@ func RetrieveFiles(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClie
 	}
 
 	// If cache miss, retrieve from database
-	rows, err := db.Query("SELECT id, file_name, upload_date, size, local_path, file_type, s3_url, description, is_shared, expiration_date FROM files WHERE user_id = $1", userID)
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		http.Error(w, "Failed to retrieve files", http.StatusInternalServerError)
 		log.Print(err)
@@ -38,53 +71,22 @@ func RetrieveFiles(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClie
 	var files []models.File
 	for rows.Next() {
 		var file models.File
-		if err := rows.Scan(&file.ID, &file.FileName, &file.UploadDate, &file.Size, &file.LocalPath,
-			&file.FileType, &file.S3URL, &file.Description, &file.IsShared, &file.Expiration); err != nil {
+		if err := scanFile(rows, &file); err != nil {
 			log.Printf("Error scanning row: %v", err)
 			http.Error(w, "Failed to scan file", http.StatusInternalServerError)
 			return
 		}
+		file.OrgID = t.orgID
 		files = append(files, file)
 	}
 
 	// Cache the result in Redis if redisClient is not nil
-	if redisClient != nil {
+	if redisClient != nil && cacheKey != "" {
 		cachedData, _ := json.Marshal(files)
-		redisClient.Set(ctx, cacheKey, cachedData, 0)
+		redisClient.Set(ctx, cacheKey, cachedData, cacheTTL(files))
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(files)
 }
 
-func ShareFile(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client, fileID int) {
-	var err error
-
-	cacheKey := "shared_file:" + strconv.Itoa(fileID)
-
-	if redisClient != nil {
-		cachedURL, err := redisClient.Get(ctx, cacheKey).Result()
-		if err == nil {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(cachedURL))
-			return
-		}
-	}
-
-	var file models.File
-	err = db.QueryRow("SELECT file_name, local_path, is_shared FROM files WHERE id = $1", fileID).Scan(&file.FileName, &file.LocalPath, &file.IsShared)
-	if err != nil {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
-	}
-
-	// Construct the public URL -> this is the demo
-	publicURL := "http://localhost:8080/" + file.LocalPath
-
-	if redisClient != nil {
-		redisClient.Set(ctx, cacheKey, publicURL, 3600)
-	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(publicURL))
-}
@@ -0,0 +1,108 @@
+package fileupload
+
+import (
+	"database/sql"
+	"encoding/json"
+	"go_backend_legalForce/models"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// scanStatusColumn is the scan status of the contents of a files row, read with
+// fileColumns and returningFile. Contents without a blob were never scanned.
+const scanStatusColumn = "COALESCE((SELECT scan_status FROM blobs WHERE blobs.storage_key = files.storage_key), 'pending')"
+
+// versionScanStatusColumn is scanStatusColumn for a file_versions row v
+const versionScanStatusColumn = "COALESCE((SELECT scan_status FROM blobs WHERE blobs.storage_key = v.storage_key), 'pending')"
+
+// requireClean answers the request itself unless contents with the given scan
+// status can be served. Only contents a scan found clean are.
+func requireClean(w http.ResponseWriter, status string) bool {
+	switch status {
+	case models.ScanClean:
+		return true
+	case models.ScanInfected:
+		http.Error(w, "File is quarantined because malware was found in it", http.StatusForbidden)
+	case models.ScanError:
+		http.Error(w, "File could not be scanned for malware yet, try again later", http.StatusConflict)
+	default:
+		http.Error(w, "File is waiting for a malware scan, try again later", http.StatusConflict)
+	}
+	return false
+}
+
+// QuarantinedFile is a version of a file whose contents were found infected
+type QuarantinedFile struct {
+	FileID    int       `json:"file_id"`
+	Version   int       `json:"version"`
+	UserID    int       `json:"user_id"`
+	OrgID     int       `json:"org_id,omitempty"`
+	FileName  string    `json:"file_name"`
+	Signature string    `json:"signature"` // the malware found
+	ScannedAt time.Time `json:"scanned_at"`
+}
+
+// ListQuarantine lists the versions of files whose contents are quarantined,
+// most recently found first
+func ListQuarantine(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	rows, err := db.Query(`SELECT f.id, v.version, f.user_id, COALESCE(f.org_id, 0), f.file_name, b.scan_signature, b.scanned_at
+		FROM blobs b JOIN file_versions v ON v.storage_key = b.storage_key JOIN files f ON f.id = v.file_id
+		WHERE b.scan_status = 'infected' ORDER BY b.scanned_at DESC, f.id, v.version`)
+	if err != nil {
+		log.Printf("Failed to list quarantined files: %v", err)
+		http.Error(w, "Failed to retrieve quarantined files", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	files := []QuarantinedFile{}
+	for rows.Next() {
+		var file QuarantinedFile
+		if err := rows.Scan(&file.FileID, &file.Version, &file.UserID, &file.OrgID, &file.FileName, &file.Signature, &file.ScannedAt); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			http.Error(w, "Failed to scan quarantined file", http.StatusInternalServerError)
+			return
+		}
+		files = append(files, file)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(files)
+}
+
+// RescanFiles asks for stored contents to be scanned again, typically after the
+// scanner's signatures were updated. The body may list file_ids to rescan every
+// version of; without it all contents are rescanned. Contents keep their status
+// until the scan worker records the new verdict.
+func RescanFiles(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		FileIDs []int64 `json:"file_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var result sql.Result
+	var err error
+	if len(req.FileIDs) > 0 {
+		result, err = db.Exec(`UPDATE blobs SET rescan_requested_at = NOW()
+			WHERE storage_key IN (SELECT storage_key FROM file_versions WHERE file_id = ANY($1))`, pq.Array(req.FileIDs))
+	} else {
+		result, err = db.Exec("UPDATE blobs SET rescan_requested_at = NOW() WHERE ref_count > 0")
+	}
+	if err != nil {
+		log.Printf("Failed to request a rescan: %v", err)
+		http.Error(w, "Failed to schedule rescan", http.StatusInternalServerError)
+		return
+	}
+	queued, _ := result.RowsAffected()
+	log.Printf("Rescan of %d stored contents requested", queued)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Rescan scheduled", "queued": queued})
+}
@@ -6,21 +6,43 @@ import (
 	"go_backend_legalForce/models"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
-// SearchFiles handles the search functionality for files based on metadata
+// SearchFiles handles the search functionality for files based on metadata. Files
+// granted to the tenant are searched along with its own. With ?folder_id= only the
+// files in that folder and the folders below it are searched.
+// ?file_type= matches the type detected from the contents: a MIME type, a wildcard
+// like image/*, or an extension like pdf standing for its type.
 func SearchFiles(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client) {
-	userID := 3 // Replace with actual user ID from context this is for ameytrips0307@gmail.com
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
 	name := r.URL.Query().Get("name")
 	uploadDate := r.URL.Query().Get("upload_date")
-	fileType := r.URL.Query().Get("file_type")
+	mimeType, ok := searchType(r.URL.Query().Get("file_type"))
+	if !ok {
+		http.Error(w, "Invalid file_type", http.StatusBadRequest)
+		return
+	}
+	folderID := 0
+	if folder := r.URL.Query().Get("folder_id"); folder != "" {
+		var err error
+		if folderID, err = strconv.Atoi(folder); err != nil || folderID < 0 {
+			http.Error(w, "Invalid folder_id", http.StatusBadRequest)
+			return
+		}
+	}
 
-	query := "SELECT id, file_name, upload_date, size, local_path FROM files WHERE user_id = $1"
-	args := []interface{}{userID}
+	scope, scopeArg := t.access("files", 1, models.GrantViewer)
+	query := "SELECT id, file_name, original_name, upload_date, size, mime_type FROM files WHERE " + scope + " AND deleted_at IS NULL AND " + notExpired("files")
+	args := []interface{}{scopeArg}
 
 	if name != "" {
 		query += " AND file_name ILIKE $" + strconv.Itoa(len(args)+1) // ILIKE for case-insensitive search
@@ -33,9 +55,17 @@ func SearchFiles(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient
 			args = append(args, date)
 		}
 	}
-	if fileType != "" {
-		query += " AND file_name ILIKE $" + strconv.Itoa(len(args)+1)
-		args = append(args, "%."+fileType)
+	if prefix, wildcard := strings.CutSuffix(mimeType, "*"); wildcard {
+		query += " AND mime_type LIKE $" + strconv.Itoa(len(args)+1)
+		args = append(args, prefix+"%")
+	} else if mimeType != "" {
+		query += " AND mime_type = $" + strconv.Itoa(len(args)+1)
+		args = append(args, mimeType)
+	}
+	if folderID != 0 {
+		// The paths of the folders below it contain its id
+		query += " AND folder_id IN (SELECT id FROM folders WHERE path LIKE '%/' || $" + strconv.Itoa(len(args)+1) + " || '/%')"
+		args = append(args, strconv.Itoa(folderID))
 	}
 
 	rows, err := db.Query(query, args...)
@@ -48,13 +78,28 @@ func SearchFiles(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient
 	var files []models.File
 	for rows.Next() {
 		var file models.File
-		if err := rows.Scan(&file.ID, &file.FileName, &file.UploadDate, &file.Size, &file.LocalPath); err != nil {
+		if err := rows.Scan(&file.ID, &file.FileName, &file.OriginalName, &file.UploadDate, &file.Size, &file.MimeType); err != nil {
 			http.Error(w, "Failed to scan file", http.StatusInternalServerError)
 			return
 		}
+		file.LocalPath = contentURL(file.ID)
 		files = append(files, file)
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(files)
 }
+
+// searchType returns the MIME type or wildcard a file_type search parameter stands
+// for, and false if it is neither one nor a known extension
+func searchType(fileType string) (string, bool) {
+	fileType = strings.ToLower(strings.TrimSpace(fileType))
+	if fileType == "" {
+		return "", true
+	}
+	if strings.Contains(fileType, "/") {
+		return fileType, isMediaRange(fileType)
+	}
+	mimeType := extensionType("." + strings.TrimPrefix(fileType, "."))
+	return mimeType, mimeType != ""
+}
@@ -0,0 +1,360 @@
+package fileupload
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/job"
+	"go_backend_legalForce/models"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// shareTokenPrefixLength is how much of a share token is kept to tell links apart
+const shareTokenPrefixLength = 8
+
+// maxSharePasswordLength is the longest password bcrypt can hash, in bytes
+const maxSharePasswordLength = 72
+
+// sharePasswordLimiter locks a password protected link out after 5 wrong
+// passwords, so the password cannot be guessed
+var sharePasswordLimiter = auth.FailureLimiter{Prefix: "share_password", Threshold: 5}
+
+// newShareToken returns a random, unguessable share token
+func newShareToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Only a hash of each token is stored, so a database leak reveals no links
+func shareTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// shareLinkURL is where ServeShareLink serves a link
+func shareLinkURL(token string) string {
+	return "http://localhost:8080/s/" + token
+}
+
+// ShareFile creates a link to a file that works without an account. The body may
+// set an expiry, as expires_at or expires_in (like "72h"), a password and
+// max_downloads; a link without them works until it is revoked. The token is
+// only returned here.
+func ShareFile(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client, fileID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ExpiresAt    *time.Time `json:"expires_at"`
+		ExpiresIn    string     `json:"expires_in"`
+		Password     string     `json:"password"`
+		MaxDownloads int        `json:"max_downloads"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	expiresAt, err := parseExpiry(req.ExpiresAt, req.ExpiresIn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	link := models.ShareLink{FileID: fileID, CreatedBy: t.userID, ExpiresAt: expiresAt, MaxDownloads: req.MaxDownloads}
+	if req.MaxDownloads < 0 {
+		http.Error(w, "max_downloads cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) > maxSharePasswordLength {
+		http.Error(w, "Password is too long", http.StatusBadRequest)
+		return
+	}
+
+	var passwordHash sql.NullString
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Failed to share file", http.StatusInternalServerError)
+			return
+		}
+		passwordHash = sql.NullString{String: string(hash), Valid: true}
+		link.HasPassword = true
+	}
+
+	// Only contents found clean can be shared
+	var status string
+	scope, scopeArg := t.condition(2)
+	err = db.QueryRow("SELECT file_name, "+scanStatusColumn+" FROM files WHERE id = $1 AND deleted_at IS NULL AND "+notExpired("files")+" AND "+scope, fileID, scopeArg).
+		Scan(&link.FileName, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve file", http.StatusInternalServerError)
+		return
+	}
+	if !requireClean(w, status) {
+		return
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		http.Error(w, "Failed to share file", http.StatusInternalServerError)
+		return
+	}
+	link.Token = token
+	link.TokenPrefix = token[:shareTokenPrefixLength]
+	link.URL = shareLinkURL(token)
+
+	// The file is flagged as shared by the same statement, which creates no link if
+	// the file was deleted in the meantime
+	scope, scopeArg = t.condition(8)
+	err = db.QueryRow(`WITH shared AS (UPDATE files SET is_shared = TRUE WHERE id = $1 AND deleted_at IS NULL AND `+notExpired("files")+` AND `+scope+` RETURNING id)
+		INSERT INTO share_links (file_id, created_by, token_hash, token_prefix, password_hash, expires_at, max_downloads)
+		SELECT id, $2, $3, $4, $5, $6, $7 FROM shared RETURNING id, created_at`,
+		fileID, t.userID, shareTokenHash(token), link.TokenPrefix, passwordHash, link.ExpiresAt, link.MaxDownloads, scopeArg).
+		Scan(&link.ID, &link.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create a share link for file %d: %v", fileID, err)
+		http.Error(w, "Failed to share file", http.StatusInternalServerError)
+		return
+	}
+
+	if redisClient != nil {
+		redisClient.Del(ctx, t.filesCacheKey())
+	}
+	log.Printf("User %d created share link %d for file %d", t.userID, link.ID, fileID)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(link)
+}
+
+// ListShareLinks lists the links to the tenant's files that can still be used,
+// newest first. With ?file_id= only the links to that file are listed.
+func ListShareLinks(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scope, scopeArg := t.condition(1)
+	query := `SELECT l.id, l.file_id, f.file_name, COALESCE(l.created_by, 0), l.token_prefix, l.password_hash IS NOT NULL,
+			l.expires_at, l.max_downloads, l.download_count, l.created_at
+		FROM share_links l JOIN files f ON f.id = l.file_id
+		WHERE ` + scope + ` AND f.deleted_at IS NULL AND ` + notExpired("f") + ` AND ` + job.ActiveShareLink
+	args := []interface{}{scopeArg}
+	if param := r.URL.Query().Get("file_id"); param != "" {
+		fileID, err := strconv.Atoi(param)
+		if err != nil {
+			http.Error(w, "Invalid file_id", http.StatusBadRequest)
+			return
+		}
+		query += " AND l.file_id = $2"
+		args = append(args, fileID)
+	}
+
+	rows, err := db.Query(query+" ORDER BY l.created_at DESC", args...)
+	if err != nil {
+		log.Printf("Failed to list share links: %v", err)
+		http.Error(w, "Failed to retrieve share links", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	links := []models.ShareLink{}
+	for rows.Next() {
+		var link models.ShareLink
+		var expiresAt sql.NullTime
+		err := rows.Scan(&link.ID, &link.FileID, &link.FileName, &link.CreatedBy, &link.TokenPrefix, &link.HasPassword,
+			&expiresAt, &link.MaxDownloads, &link.DownloadCount, &link.CreatedAt)
+		if err != nil {
+			log.Printf("Error scanning row: %v", err)
+			http.Error(w, "Failed to scan share link", http.StatusInternalServerError)
+			return
+		}
+		if expiresAt.Valid {
+			link.ExpiresAt = &expiresAt.Time
+		}
+		links = append(links, link)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(links)
+}
+
+// RevokeShareLink stops a link to one of the tenant's files from working
+func RevokeShareLink(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client, linkID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var fileID int
+	scope, scopeArg := t.condition(2)
+	err := db.QueryRow(`UPDATE share_links SET revoked_at = NOW()
+		WHERE id = $1 AND revoked_at IS NULL AND file_id IN (SELECT id FROM files WHERE `+scope+`)
+		RETURNING file_id`, linkID, scopeArg).Scan(&fileID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to revoke share link %d: %v", linkID, err)
+		http.Error(w, "Failed to revoke share link", http.StatusInternalServerError)
+		return
+	}
+
+	// The file stays flagged as shared only while other links to it can be used
+	_, err = db.Exec(`UPDATE files SET is_shared = EXISTS (SELECT 1 FROM share_links l WHERE l.file_id = files.id AND `+job.ActiveShareLink+`)
+		WHERE id = $1`, fileID)
+	if err != nil {
+		log.Printf("Failed to update the shared flag of file %d: %v", fileID, err)
+	}
+	if redisClient != nil {
+		redisClient.Del(ctx, t.filesCacheKey())
+	}
+	log.Printf("User %d revoked share link %d of file %d", t.userID, linkID, fileID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Share link revoked"})
+}
+
+// ServeShareLink serves the file a share link points to, to anyone holding its
+// token. A password protected link takes the password in the X-Share-Password
+// header, or in a password form field when posted. Every GET that can receive
+// the last byte of the file counts as a download; see countsAsDownload.
+func ServeShareLink(w http.ResponseWriter, r *http.Request, db *sql.DB, token string) {
+	var link models.ShareLink
+	var file models.File
+	var passwordHash sql.NullString
+	var expiresAt, revokedAt sql.NullTime
+	err := db.QueryRow(`SELECT l.id, l.file_id, l.password_hash, l.expires_at, l.max_downloads, l.download_count, l.revoked_at,
+			files.file_name, files.storage_key, files.file_type, files.mime_type, files.upload_date, files.expiration_date, `+scanStatusColumn+`
+		FROM share_links l JOIN files ON files.id = l.file_id
+		WHERE l.token_hash = $1 AND files.deleted_at IS NULL`, shareTokenHash(token)).
+		Scan(&link.ID, &link.FileID, &passwordHash, &expiresAt, &link.MaxDownloads, &link.DownloadCount, &revokedAt,
+			&file.FileName, &file.StorageKey, &file.FileType, &file.MimeType, &file.UploadDate, &file.Expiration, &file.ScanStatus)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve link", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case revokedAt.Valid:
+		http.Error(w, "Link was revoked", http.StatusGone)
+		return
+	case expiresAt.Valid && !expiresAt.Time.After(time.Now()):
+		http.Error(w, "Link has expired", http.StatusGone)
+		return
+	case link.MaxDownloads > 0 && link.DownloadCount >= link.MaxDownloads:
+		http.Error(w, "Download limit reached", http.StatusGone)
+		return
+	case file.Expiration != nil && !file.Expiration.After(time.Now()):
+		http.Error(w, "File has expired", http.StatusGone)
+		return
+	}
+
+	if passwordHash.Valid {
+		if wait := sharePasswordLimiter.LockedFor(strconv.Itoa(link.ID)); wait > 0 {
+			auth.WriteLockedOut(w, wait, "Too many password attempts, try again later")
+			return
+		}
+		password := r.Header.Get("X-Share-Password")
+		if password == "" && r.Method == http.MethodPost {
+			password = r.PostFormValue("password")
+		}
+		if password == "" {
+			http.Error(w, "Password required", http.StatusUnauthorized)
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(passwordHash.String), []byte(password)) != nil {
+			sharePasswordLimiter.RecordFailure(strconv.Itoa(link.ID))
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return
+		}
+		sharePasswordLimiter.Clear(strconv.Itoa(link.ID))
+	}
+	if !requireClean(w, file.ScanStatus) {
+		return
+	}
+
+	content, obj, ok := openStoredFile(w, r, file.StorageKey)
+	if !ok {
+		return
+	}
+	defer content.Close()
+
+	// Counted in a single statement, so concurrent downloads cannot pass the limit
+	if r.Method != http.MethodHead && countsAsDownload(r, obj.Size) {
+		result, err := db.Exec(`UPDATE share_links l SET download_count = l.download_count + 1 WHERE l.id = $1 AND `+job.ActiveShareLink, link.ID)
+		if err != nil {
+			http.Error(w, "Failed to retrieve link", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Link is no longer available", http.StatusGone)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.FileName}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	serveStoredContent(w, r, content, obj, file.MimeType, file.UploadDate)
+
+	log.Printf("Share link %d served file %d", link.ID, link.FileID)
+}
+
+// countsAsDownload reports whether r can receive the last byte of a file of size
+// bytes. Only a single range ending before it does not, so a file fetched in
+// pieces is counted once, for the piece holding its end. Suffix, open-ended,
+// multiple and malformed ranges always count, and so does any conditional range,
+// which may get the whole file.
+func countsAsDownload(r *http.Request, size int64) bool {
+	requested := r.Header.Get("Range")
+	if requested == "" || r.Header.Get("If-Range") != "" {
+		return true
+	}
+	spec, ok := strings.CutPrefix(strings.TrimSpace(requested), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return true
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return true
+	}
+	if _, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64); err != nil {
+		return true
+	}
+	end, err := strconv.ParseInt(strings.TrimSpace(last), 10, 64)
+	return err != nil || end >= size-1
+}
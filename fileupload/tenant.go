@@ -0,0 +1,105 @@
+package fileupload
+
+import (
+	"database/sql"
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/job"
+	"go_backend_legalForce/models"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// tenant is the file space a request acts in: the organization selected with the
+// X-Org-ID header, or otherwise the user's personal files. Every query on files
+// must be restricted with condition.
+type tenant struct {
+	userID int
+	orgID  int
+}
+
+// requestTenant returns the tenant of an authenticated request
+func requestTenant(r *http.Request) (tenant, bool) {
+	user, ok := auth.UserFromContext(r.Context())
+	if !ok {
+		return tenant{}, false
+	}
+	t := tenant{userID: user.ID}
+	if membership, ok := auth.MembershipFromContext(r.Context()); ok {
+		t.orgID = membership.OrgID
+	}
+	return t, true
+}
+
+// managesTenant reports whether the caller may change the settings of the tenant
+// and delete its files for good: always for personal files, and for the owners
+// and admins of an organization
+func managesTenant(r *http.Request) bool {
+	membership, ok := auth.MembershipFromContext(r.Context())
+	return !ok || membership.Role == models.OrgRoleOwner || membership.Role == models.OrgRoleAdmin
+}
+
+// condition returns the SQL condition that limits files to the tenant, using
+// placeholder $n, and the argument for it
+func (t tenant) condition(n int) (string, interface{}) {
+	if t.orgID != 0 {
+		return "org_id = $" + strconv.Itoa(n), t.orgID
+	}
+	return "user_id = $" + strconv.Itoa(n) + " AND org_id IS NULL", t.userID
+}
+
+// granteeColumn is the column of file_grants naming the tenant: grants to a user
+// apply to their personal files' space, grants to an organization to requests
+// made in it
+func (t tenant) granteeColumn() string {
+	if t.orgID != 0 {
+		return "grantee_org_id"
+	}
+	return "grantee_user_id"
+}
+
+// access is condition widened to the files granted to the tenant with at least
+// role, directly or through a folder above them. table names the files table in
+// the query. Like condition it uses placeholder $n.
+func (t tenant) access(table string, n int, role string) (string, interface{}) {
+	scope, scopeArg := t.condition(n)
+	return "(" + scope + " OR EXISTS (SELECT 1 FROM file_grants g WHERE g." + t.granteeColumn() + " = $" + strconv.Itoa(n) +
+		" AND g.role IN " + grantRolesFrom(role) + " AND (g.file_id = " + table + ".id OR g.folder_id IN (SELECT gf.id FROM folders gf" +
+		" JOIN folders ff ON ff.path LIKE gf.path || '%' WHERE ff.id = " + table + ".folder_id))))", scopeArg
+}
+
+// folderAccess is access for the folders table: the tenant's folders and those
+// granted to it with at least role, directly or through a folder above them
+func (t tenant) folderAccess(n int, role string) (string, interface{}) {
+	scope, scopeArg := t.condition(n)
+	return "(" + scope + " OR EXISTS (SELECT 1 FROM file_grants g JOIN folders gf ON gf.id = g.folder_id WHERE g." + t.granteeColumn() +
+		" = $" + strconv.Itoa(n) + " AND g.role IN " + grantRolesFrom(role) + " AND folders.path LIKE gf.path || '%'))", scopeArg
+}
+
+// grantRolesFrom lists the grant roles giving at least role, as an SQL list
+func grantRolesFrom(role string) string {
+	for i, r := range models.GrantRoles {
+		if r == role {
+			return "('" + strings.Join(models.GrantRoles[i:], "', '") + "')"
+		}
+	}
+	panic("unknown grant role " + role)
+}
+
+// orgValue is the value stored in files.org_id for new files
+func (t tenant) orgValue() sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(t.orgID), Valid: t.orgID != 0}
+}
+
+// cacheKey prefixes a cache key with the tenant so cached data never crosses tenants
+func (t tenant) cacheKey(prefix string) string {
+	if t.orgID != 0 {
+		return prefix + ":org:" + strconv.Itoa(t.orgID)
+	}
+	return prefix + ":" + strconv.Itoa(t.userID)
+}
+
+// filesCacheKey is the key of the cached file listing
+func (t tenant) filesCacheKey() string {
+	return job.FilesCacheKey(t.userID, t.orgID)
+}
@@ -0,0 +1,176 @@
+package fileupload
+
+import (
+	"database/sql"
+	"encoding/json"
+	"go_backend_legalForce/job"
+	"go_backend_legalForce/models"
+	"log"
+	"net/http"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DeleteFile moves a file to the trash. It disappears from listings, searches and
+// downloads right away but can be restored until the trash is purged. Co-owners
+// of a file granted to the tenant may delete it too; it goes to the owner's trash.
+func DeleteFile(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client, fileID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var owner tenant
+	scope, scopeArg := t.access("files", 2, models.GrantCoOwner)
+	err := db.QueryRow("UPDATE files SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL AND "+scope+" RETURNING user_id, COALESCE(org_id, 0)",
+		fileID, scopeArg).Scan(&owner.userID, &owner.orgID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete file %d: %v", fileID, err)
+		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+		return
+	}
+
+	if redisClient != nil {
+		redisClient.Del(ctx, owner.filesCacheKey())
+	}
+	log.Printf("User %d moved file %d to the trash", t.userID, fileID)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "File moved to trash"})
+}
+
+// ListTrash lists the files in the trash, most recently deleted first
+func ListTrash(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scope, scopeArg := t.condition(1)
+	rows, err := db.Query(`SELECT id, user_id, file_name, original_name, upload_date, size, file_type, description, deleted_at
+		FROM files WHERE `+scope+` AND deleted_at IS NOT NULL ORDER BY deleted_at DESC`, scopeArg)
+	if err != nil {
+		log.Printf("Failed to list trash: %v", err)
+		http.Error(w, "Failed to retrieve files", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	files := []models.File{}
+	for rows.Next() {
+		var file models.File
+		if err := rows.Scan(&file.ID, &file.UserID, &file.FileName, &file.OriginalName, &file.UploadDate, &file.Size,
+			&file.FileType, &file.Description, &file.DeletedAt); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			http.Error(w, "Failed to scan file", http.StatusInternalServerError)
+			return
+		}
+		file.OrgID = t.orgID
+		files = append(files, file)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(files)
+}
+
+// RestoreFile takes a file out of the trash
+func RestoreFile(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client, fileID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var file models.File
+	scope, scopeArg := t.condition(2)
+	err := scanReturnedFile(db.QueryRow("UPDATE files SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL AND "+scope+" "+returningFile,
+		fileID, scopeArg), &file)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found in trash", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to restore file %d: %v", fileID, err)
+		http.Error(w, "Failed to restore file", http.StatusInternalServerError)
+		return
+	}
+
+	if redisClient != nil {
+		redisClient.Del(ctx, t.filesCacheKey())
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(file)
+}
+
+// PurgeFile permanently deletes a file in the trash along with the contents of its
+// versions that no other file shares. Only owners and admins purge the files of
+// an organization.
+func PurgeFile(w http.ResponseWriter, r *http.Request, db *sql.DB, fileID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !managesTenant(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	scope, scopeArg := t.condition(2)
+	deleted, keys, err := job.DeleteFiles(db, "DELETE FROM files WHERE id = $1 AND deleted_at IS NOT NULL AND "+scope+" RETURNING id, storage_key",
+		fileID, scopeArg)
+	if err != nil {
+		log.Printf("Failed to purge file %d: %v", fileID, err)
+		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+		return
+	}
+	if deleted == 0 {
+		http.Error(w, "File not found in trash", http.StatusNotFound)
+		return
+	}
+	for _, key := range keys {
+		job.RemoveStoredFile(key)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "File deleted permanently"})
+}
+
+// EmptyTrash permanently deletes every file in the trash. Only owners and admins
+// empty the trash of an organization.
+func EmptyTrash(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !managesTenant(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	scope, scopeArg := t.condition(1)
+	deleted, keys, err := job.DeleteFiles(db, "DELETE FROM files WHERE "+scope+" AND deleted_at IS NOT NULL RETURNING id, storage_key", scopeArg)
+	if err != nil {
+		log.Printf("Failed to empty trash: %v", err)
+		http.Error(w, "Failed to empty trash", http.StatusInternalServerError)
+		return
+	}
+
+	// Contents are removed only once the rows are gone
+	for _, key := range keys {
+		job.RemoveStoredFile(key)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Trash emptied", "deleted": deleted})
+}
@@ -0,0 +1,583 @@
+package fileupload
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"go_backend_legalForce/job"
+	"go_backend_legalForce/models"
+	"go_backend_legalForce/storage"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads implement the tus 1.0 core protocol with the creation,
+// termination and expiration extensions. See https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+
+	defaultTusMaxSize   = 5 << 30 // 5 GB
+	defaultTusUploadTTL = 24 * time.Hour
+)
+
+// TusPath is where resumable uploads are created. Each upload lives at TusPath/{id}.
+const TusPath = "/upload/tus"
+
+// A PATCH request leases its upload for tusLeaseDuration, so chunks sent to any
+// instance cannot interleave and the cleanup job leaves the upload alone. The
+// chunk must arrive tusLeaseMargin before the lease runs out, which leaves time
+// to record it and complete the upload.
+const (
+	tusLeaseDuration = 15 * time.Minute
+	tusLeaseMargin   = 5 * time.Minute
+)
+
+// resumableUpload is the persisted state of one upload
+type resumableUpload struct {
+	ID        string
+	UserID    int
+	OrgID     sql.NullInt64
+	FileName  string
+	Metadata  string
+	Length    int64
+	Offset    int64
+	FileID    sql.NullInt64
+	ExpiresAt time.Time
+}
+
+func tusMaxSize() int64 {
+	if size, err := strconv.ParseInt(os.Getenv("TUS_MAX_SIZE"), 10, 64); err == nil && size > 0 {
+		return size
+	}
+	return defaultTusMaxSize
+}
+
+func tusUploadTTL() time.Duration {
+	if ttl, err := time.ParseDuration(os.Getenv("TUS_UPLOAD_TTL")); err == nil && ttl > 0 {
+		return ttl
+	}
+	return defaultTusUploadTTL
+}
+
+// checkTusVersion sets the Tus-Resumable response header and rejects clients
+// speaking another protocol version
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma-separated pairs of a
+// key and an optional base64 value
+func parseUploadMetadata(header string) (map[string]string, bool) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, true
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, false
+		}
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, false
+			}
+			value = string(decoded)
+		}
+		metadata[parts[0]] = value
+	}
+	return metadata, true
+}
+
+// TusOptions advertises the supported protocol version, extensions and maximum size
+func TusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateResumableUpload starts a new upload of Upload-Length bytes in the caller's
+// tenant. The file name is taken from the filename key of Upload-Metadata, and an
+// expiry for the file from its expires_in or expires_at key, like in UploadFile.
+// An upload that would not fit in the tenant's quota is refused up front with 413;
+// the space is only reserved when the upload completes.
+func CreateResumableUpload(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > tusMaxSize() {
+		http.Error(w, "Upload exceeds the maximum size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, ok := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if !ok {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	if name := metadata["filename"]; name != "" {
+		metadata["filename"] = filepath.Base(name)
+	}
+	if requested, err := parseExpiryValues(metadata["expires_at"], metadata["expires_in"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if requested != nil {
+		// Checked up front so the upload is not refused once complete
+		policy, err := loadExpiryPolicy(db, t)
+		if err != nil {
+			log.Printf("Failed to load expiry policy: %v", err)
+			http.Error(w, "Failed to retrieve expiry policy", http.StatusInternalServerError)
+			return
+		}
+		if _, err := policy.expiry(requested); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := checkQuota(db, t, length, 1); err != nil {
+		var exceeded *quotaError
+		if errors.As(err, &exceeded) {
+			writeQuotaError(w, exceeded)
+			return
+		}
+		log.Printf("Failed to check quota: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	upload := resumableUpload{
+		ID:        uuid.New().String(),
+		UserID:    t.userID,
+		OrgID:     t.orgValue(),
+		FileName:  metadata["filename"],
+		Metadata:  r.Header.Get("Upload-Metadata"),
+		Length:    length,
+		ExpiresAt: time.Now().Add(tusUploadTTL()),
+	}
+
+	if err := os.MkdirAll(job.PartialUploadDir(), os.ModePerm); err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	part, err := os.Create(job.PartialUploadPath(upload.ID))
+	if err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	part.Close()
+
+	_, err = db.Exec(`INSERT INTO resumable_uploads (id, user_id, org_id, file_name, metadata, upload_length, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		upload.ID, upload.UserID, upload.OrgID, upload.FileName, upload.Metadata, upload.Length, upload.ExpiresAt)
+	if err != nil {
+		log.Printf("Failed to save upload state: %v", err)
+		os.Remove(job.PartialUploadPath(upload.ID))
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", TusPath+"/"+upload.ID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// loadResumableUpload returns the caller's upload or writes 404, or 410 once an
+// unfinished upload has expired
+func loadResumableUpload(w http.ResponseWriter, r *http.Request, db *sql.DB, uploadID string) (resumableUpload, bool) {
+	upload := resumableUpload{ID: uploadID}
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return upload, false
+	}
+
+	err := db.QueryRow(`SELECT user_id, org_id, file_name, metadata, upload_length, upload_offset, file_id, expires_at
+		FROM resumable_uploads WHERE id = $1 AND user_id = $2`, uploadID, t.userID).
+		Scan(&upload.UserID, &upload.OrgID, &upload.FileName, &upload.Metadata, &upload.Length, &upload.Offset,
+			&upload.FileID, &upload.ExpiresAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return upload, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to look up upload", http.StatusInternalServerError)
+		return upload, false
+	}
+	if !upload.FileID.Valid && time.Now().After(upload.ExpiresAt) {
+		http.Error(w, "Upload expired", http.StatusGone)
+		return upload, false
+	}
+	return upload, true
+}
+
+// leaseResumableUpload leases the caller's upload to this request and returns it
+// along with the lease, which must be released once done. Like
+// loadResumableUpload it writes 404 or 410, and 409 if another request holds it.
+func leaseResumableUpload(w http.ResponseWriter, r *http.Request, db *sql.DB, uploadID string) (resumableUpload, string, bool) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return resumableUpload{}, "", false
+	}
+
+	lease := uuid.New().String()
+	result, err := db.Exec(`UPDATE resumable_uploads SET locked_by = $1, locked_until = $2
+		WHERE id = $3 AND user_id = $4 AND (locked_until IS NULL OR locked_until < NOW())`,
+		lease, time.Now().Add(tusLeaseDuration), uploadID, t.userID)
+	if err != nil {
+		http.Error(w, "Failed to look up upload", http.StatusInternalServerError)
+		return resumableUpload{}, "", false
+	}
+	leased, _ := result.RowsAffected()
+
+	upload, ok := loadResumableUpload(w, r, db, uploadID)
+	if !ok {
+		if leased > 0 {
+			releaseResumableUpload(db, uploadID, lease)
+		}
+		return upload, "", false
+	}
+	if leased == 0 {
+		http.Error(w, "Upload is already being written", http.StatusConflict)
+		return upload, "", false
+	}
+	return upload, lease, true
+}
+
+// releaseResumableUpload ends a lease taken by leaseResumableUpload
+func releaseResumableUpload(db *sql.DB, uploadID, lease string) {
+	_, err := db.Exec("UPDATE resumable_uploads SET locked_by = NULL, locked_until = NULL WHERE id = $1 AND locked_by = $2",
+		uploadID, lease)
+	if err != nil {
+		log.Printf("Failed to release upload %s: %v", uploadID, err)
+	}
+}
+
+func writeUploadState(w http.ResponseWriter, upload resumableUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	if upload.FileID.Valid {
+		w.Header().Set("X-File-ID", strconv.FormatInt(upload.FileID.Int64, 10))
+	}
+}
+
+// ResumableUploadStatus answers HEAD requests with the offset to resume from
+func ResumableUploadStatus(w http.ResponseWriter, r *http.Request, db *sql.DB, uploadID string) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	upload, ok := loadResumableUpload(w, r, db, uploadID)
+	if !ok {
+		return
+	}
+
+	writeUploadState(w, upload)
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchResumableUpload appends a chunk at Upload-Offset. Bytes received before a
+// dropped connection are kept, so the client can resume from the new offset. When
+// the last byte arrives the file is registered like a regular upload.
+func PatchResumableUpload(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client, uploadID string) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	upload, lease, ok := leaseResumableUpload(w, r, db, uploadID)
+	if !ok {
+		return
+	}
+	defer releaseResumableUpload(db, upload.ID, lease)
+	if upload.FileID.Valid || offset != upload.Offset {
+		writeUploadState(w, upload)
+		http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+		return
+	}
+
+	part, err := os.OpenFile(job.PartialUploadPath(upload.ID), os.O_WRONLY, 0)
+	if err != nil {
+		http.Error(w, "Failed to open upload", http.StatusInternalServerError)
+		return
+	}
+	// Drop any bytes written after the last recorded offset, e.g. before a crash
+	err = part.Truncate(upload.Offset)
+	if err == nil {
+		_, err = part.Seek(upload.Offset, io.SeekStart)
+	}
+	if err != nil {
+		part.Close()
+		http.Error(w, "Failed to open upload", http.StatusInternalServerError)
+		return
+	}
+	// A chunk still arriving when the lease is about to run out is cut short
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Now().Add(tusLeaseDuration - tusLeaseMargin))
+	written, copyErr := io.Copy(part, io.LimitReader(r.Body, upload.Length-upload.Offset))
+	controller.SetReadDeadline(time.Time{})
+	closeErr := part.Close()
+	if closeErr != nil {
+		http.Error(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+
+	// Refused contents are turned away as soon as their first bytes are in rather
+	// than once the whole file was received. Completing checks them again.
+	previous := upload.Offset
+	upload.Offset += written
+	if previous < sniffLen && upload.Offset >= sniffLen && upload.Offset < upload.Length {
+		err := checkUploadHead(db, upload)
+		var refused *contentTypeError
+		if errors.As(err, &refused) {
+			rejectResumableUpload(w, db, upload.ID, refused, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to check contents of upload %s: %v", upload.ID, err)
+			http.Error(w, "Failed to check upload contents", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	upload.ExpiresAt = time.Now().Add(tusUploadTTL())
+	result, err := db.Exec("UPDATE resumable_uploads SET upload_offset = $1, expires_at = $2 WHERE id = $3 AND locked_by = $4",
+		upload.Offset, upload.ExpiresAt, upload.ID, lease)
+	if err != nil {
+		http.Error(w, "Failed to save upload state", http.StatusInternalServerError)
+		return
+	}
+	if saved, _ := result.RowsAffected(); saved == 0 {
+		// The upload was terminated, or the lease ran out and another request took it
+		http.Error(w, "Upload is no longer held by this request", http.StatusConflict)
+		return
+	}
+	if copyErr != nil {
+		log.Printf("Upload %s interrupted at offset %d: %v", upload.ID, upload.Offset, copyErr)
+	}
+
+	if upload.Offset == upload.Length {
+		file, err := completeResumableUpload(db, redisClient, upload, lease)
+		var refused *contentTypeError
+		var exceeded *quotaError
+		if errors.As(err, &refused) || errors.As(err, &exceeded) {
+			// The contents will not change, so the upload cannot be completed
+			rejectResumableUpload(w, db, upload.ID, refused, exceeded)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to complete upload %s: %v", upload.ID, err)
+			// The bytes received are kept so completing can be retried
+			http.Error(w, "Failed to save file metadata", http.StatusInternalServerError)
+			return
+		}
+		upload.FileID = sql.NullInt64{Int64: int64(file.ID), Valid: true}
+		w.Header().Set("X-File-SHA256", file.SHA256)
+	}
+
+	writeUploadState(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkUploadHead checks the first bytes received of an upload against the
+// file name and the content policy, returning a *contentTypeError if refused
+func checkUploadHead(db *sql.DB, upload resumableUpload) error {
+	policy, err := loadContentPolicy(db, tenant{userID: upload.UserID, orgID: int(upload.OrgID.Int64)})
+	if err != nil {
+		return err
+	}
+	part, err := os.Open(job.PartialUploadPath(upload.ID))
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	_, head, err := sniffContent(part)
+	if err != nil {
+		return err
+	}
+	if _, refused := checkContent(policy, sanitizeFileName(upload.FileName), head); refused != nil {
+		return refused
+	}
+	return nil
+}
+
+// rejectResumableUpload discards an upload whose contents were refused for their
+// type or for the quota and writes the refusal
+func rejectResumableUpload(w http.ResponseWriter, db *sql.DB, uploadID string, refused *contentTypeError, exceeded *quotaError) {
+	if err := discardResumableUpload(db, uploadID); err != nil {
+		log.Printf("Failed to discard upload %s: %v", uploadID, err)
+	}
+	if refused != nil {
+		writeContentTypeError(w, refused)
+	} else {
+		writeQuotaError(w, exceeded)
+	}
+}
+
+// completeResumableUpload moves the assembled file into storage and registers it
+// through the same metadata insert as UploadFile. Contents that do not match the
+// file name or the content policy are refused with a *contentTypeError, and those
+// no longer fitting in the tenant's quota with a *quotaError. An expiry
+// the expiry policy no longer allows when the upload completes gives way to the
+// policy's default. The file is only registered while lease still holds the upload.
+func completeResumableUpload(db *sql.DB, redisClient *redis.Client, upload resumableUpload, lease string) (models.File, error) {
+	t := tenant{userID: upload.UserID, orgID: int(upload.OrgID.Int64)}
+	policy, err := loadContentPolicy(db, t)
+	if err != nil {
+		return models.File{}, err
+	}
+	expiryPolicy, err := loadExpiryPolicy(db, t)
+	if err != nil {
+		return models.File{}, err
+	}
+	// The metadata was checked when the upload was created
+	metadata, _ := parseUploadMetadata(upload.Metadata)
+	requested, _ := parseExpiryValues(metadata["expires_at"], metadata["expires_in"])
+	expiration, err := expiryPolicy.expiry(requested)
+	if err != nil {
+		expiration, _ = expiryPolicy.expiry(nil)
+	}
+
+	fileName := sanitizeFileName(upload.FileName)
+	storageKey := uuid.New().String() + filepath.Ext(fileName)
+	part, err := os.Open(job.PartialUploadPath(upload.ID))
+	if err != nil {
+		return models.File{}, err
+	}
+	content, head, err := sniffContent(part)
+	if err != nil {
+		part.Close()
+		return models.File{}, err
+	}
+	mimeType, refused := checkContent(policy, fileName, head)
+	if refused != nil {
+		part.Close()
+		return models.File{}, refused
+	}
+	reservation, err := reserveQuota(db, t, upload.Length, upload.Length, 1)
+	if err != nil {
+		part.Close()
+		return models.File{}, err
+	}
+	// The file counts against the quota once registered, or not at all
+	defer reservation.release(db)
+
+	backend := storage.Default()
+	sha := sha256.New()
+	err = backend.Put(ctx, storageKey, io.TeeReader(content, sha), upload.Length, "")
+	part.Close()
+	if err != nil {
+		return models.File{}, err
+	}
+
+	fileMetadata := models.File{
+		UserID:       upload.UserID,
+		OrgID:        t.orgID,
+		FileName:     fileName,
+		OriginalName: truncateUTF8(upload.FileName, maxOriginalNameBytes),
+		StorageKey:   storageKey,
+		UploadDate:   time.Now(),
+		Size:         upload.Length,
+		FileType:     filepath.Ext(fileName),
+		MimeType:     mimeType,
+		S3URL:        storage.Location(backend, storageKey),
+		Expiration:   expiration,
+	}
+	// The upload records its file in the same transaction that registers it, so
+	// a failure leaves neither and completing can be retried from the part file
+	register := func(tx *sql.Tx, fileID int) error {
+		result, err := tx.Exec("UPDATE resumable_uploads SET file_id = $1 WHERE id = $2 AND locked_by = $3",
+			fileID, upload.ID, lease)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errUploadReleased
+		}
+		return nil
+	}
+	err = insertFileMetadata(db, redisClient, t, &fileMetadata, hex.EncodeToString(sha.Sum(nil)), register)
+	if err != nil {
+		backend.Delete(ctx, storageKey)
+		return fileMetadata, err
+	}
+	if err := os.Remove(job.PartialUploadPath(upload.ID)); err != nil {
+		log.Printf("Failed to delete part file of upload %s: %v", upload.ID, err)
+	}
+	return fileMetadata, nil
+}
+
+// errUploadReleased is returned when an upload is completed after its lease ran out
+var errUploadReleased = errors.New("upload is no longer leased by this request")
+
+// TerminateResumableUpload discards an upload and the bytes received so far
+func TerminateResumableUpload(w http.ResponseWriter, r *http.Request, db *sql.DB, uploadID string) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	upload, ok := loadResumableUpload(w, r, db, uploadID)
+	if !ok {
+		return
+	}
+
+	if err := discardResumableUpload(db, upload.ID); err != nil {
+		http.Error(w, "Failed to terminate upload", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// discardResumableUpload deletes an upload along with the bytes received so far
+func discardResumableUpload(db *sql.DB, uploadID string) error {
+	if _, err := db.Exec("DELETE FROM resumable_uploads WHERE id = $1", uploadID); err != nil {
+		return err
+	}
+	if err := os.Remove(job.PartialUploadPath(uploadID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to delete part file of upload %s: %v", uploadID, err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package fileupload
+
+import (
+	"database/sql"
+	"encoding/json"
+	"go_backend_legalForce/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// maxDescriptionLength is the longest description a file can have, in characters
+const maxDescriptionLength = 2000
+
+// returningFile ends a statement that changes a file with the columns read by scanReturnedFile
+const returningFile = "RETURNING id, user_id, COALESCE(org_id, 0), file_name, original_name, upload_date, size, file_type, s3_url, description, is_shared, expiration_date, COALESCE(folder_id, 0), mime_type, " + scanStatusColumn
+
+// scanReturnedFile reads the file returned by a statement ending in returningFile
+func scanReturnedFile(row *sql.Row, file *models.File) error {
+	err := row.Scan(&file.ID, &file.UserID, &file.OrgID, &file.FileName, &file.OriginalName, &file.UploadDate,
+		&file.Size, &file.FileType, &file.S3URL, &file.Description, &file.IsShared, &file.Expiration, &file.FolderID, &file.MimeType, &file.ScanStatus)
+	file.LocalPath = contentURL(file.ID)
+	return err
+}
+
+// UpdateFile renames a file, changes its description and/or moves it to another
+// folder, or to the top of the tree for folder_id 0. Fields left out of the
+// request body are not changed. The new name is sanitized like an uploaded one.
+// expires_in or expires_at sets a new expiry within the tenant's expiry policy,
+// and expires_at null keeps the file for ever if the policy allows it.
+// Editors of a file granted to the tenant may rename it and change its
+// description; only the owner moves it between its folders and changes its expiry.
+func UpdateFile(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client, fileID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		FileName    *string      `json:"file_name"`
+		Description *string      `json:"description"`
+		FolderID    *int         `json:"folder_id"`
+		ExpiresAt   optionalTime `json:"expires_at"`
+		ExpiresIn   string       `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	changeExpiry := req.ExpiresAt.Set || req.ExpiresIn != ""
+	if req.FileName == nil && req.Description == nil && req.FolderID == nil && !changeExpiry {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+
+	var fileName, description sql.NullString
+	if req.FileName != nil {
+		if strings.TrimSpace(*req.FileName) == "" {
+			http.Error(w, "File name cannot be empty", http.StatusBadRequest)
+			return
+		}
+		fileName = sql.NullString{String: sanitizeFileName(*req.FileName), Valid: true}
+	}
+	if req.Description != nil {
+		if utf8.RuneCountInString(*req.Description) > maxDescriptionLength {
+			http.Error(w, "Description is too long", http.StatusBadRequest)
+			return
+		}
+		description = sql.NullString{String: *req.Description, Valid: true}
+	}
+
+	query := "UPDATE files SET file_name = COALESCE($1, file_name), description = COALESCE($2, description)"
+	args := []interface{}{fileName, description}
+	if req.FolderID != nil {
+		if *req.FolderID != 0 {
+			if _, err := loadFolder(db, t, *req.FolderID); err == sql.ErrNoRows {
+				http.Error(w, "Folder not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				log.Printf("Failed to retrieve folder %d: %v", *req.FolderID, err)
+				http.Error(w, "Failed to update file", http.StatusInternalServerError)
+				return
+			}
+		}
+		query += ", folder_id = $3"
+		args = append(args, nullID(*req.FolderID))
+	}
+
+	if changeExpiry {
+		if req.ExpiresAt.Set && req.ExpiresAt.Value == nil && req.ExpiresIn != "" {
+			http.Error(w, "Set either expires_at or expires_in", http.StatusBadRequest)
+			return
+		}
+		expiration, err := parseExpiry(req.ExpiresAt.Value, req.ExpiresIn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		policy, err := loadExpiryPolicy(db, t)
+		if err != nil {
+			log.Printf("Failed to load expiry policy: %v", err)
+			http.Error(w, "Failed to update file", http.StatusInternalServerError)
+			return
+		}
+		if expiration == nil && policy.maxTTL > 0 {
+			http.Error(w, "Files must expire within "+policy.maxTTL.String()+" under the expiry policy", http.StatusBadRequest)
+			return
+		}
+		if expiration != nil {
+			if _, err := policy.expiry(expiration); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		// The owner is warned again before the new expiry
+		query += ", expiration_date = $" + strconv.Itoa(len(args)+1) + ", expiry_warned_at = NULL"
+		args = append(args, expiration)
+	}
+
+	var file models.File
+	scope, scopeArg := t.access("files", len(args)+2, models.GrantEditor)
+	if req.FolderID != nil || changeExpiry {
+		// Only the owner moves a file between its folders or changes its expiry
+		scope, scopeArg = t.condition(len(args) + 2)
+	}
+	query += " WHERE id = $" + strconv.Itoa(len(args)+1) + " AND deleted_at IS NULL AND " + notExpired("files") + " AND " + scope + " " + returningFile
+	err := scanReturnedFile(db.QueryRow(query, append(args, fileID, scopeArg)...), &file)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to update file %d: %v", fileID, err)
+		http.Error(w, "Failed to update file", http.StatusInternalServerError)
+		return
+	}
+
+	if redisClient != nil {
+		// Cached listings of the owner show the old name and description
+		owner := tenant{userID: file.UserID, orgID: file.OrgID}
+		redisClient.Del(ctx, owner.filesCacheKey())
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(file)
+}
@@ -2,12 +2,17 @@ package fileupload
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"go_backend_legalForce/job"
 	"go_backend_legalForce/models"
+	"go_backend_legalForce/storage"
 	"io"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -20,114 +25,357 @@ import (
 
 var ctx = context.Background()
 
-// UploadFile handles the file upload
+// Upload limits. The per-file size can be changed with UPLOAD_MAX_SIZE (bytes).
+const (
+	defaultMaxUploadSize = 10 << 20 // 10 MB
+	maxFilesPerUpload    = 20
+)
+
+var errFileTooLarge = errors.New("file exceeds the maximum upload size")
+
+// UploadResult describes one file of an upload request
+type UploadResult struct {
+	ID         int           `json:"id,omitempty"`
+	Name       string        `json:"name"` // display name, the sanitized name sent by the client
+	FileURL    string        `json:"file_url,omitempty"`
+	Size       int64         `json:"size"`
+	MimeType   string        `json:"mime_type,omitempty"` // detected from the contents
+	SHA256     string        `json:"sha256,omitempty"`
+	MD5        string        `json:"md5,omitempty"`
+	Expiration *time.Time    `json:"expiration_date,omitempty"` // when the file expires, if it does
+	Error      string        `json:"error,omitempty"`
+	Code       string        `json:"code,omitempty"`  // why the file was refused, see contentTypeError and quotaError
+	Quota      *models.Usage `json:"quota,omitempty"` // the tenant's usage, when the quota refused the file
+}
+
+// storedFile is a file written to storage along with what was measured on the way
+type storedFile struct {
+	Location string // where the backend keeps it, if it is not on the local disk
+	Size     int64
+	SHA256   string
+	MD5      string
+}
+
+func maxUploadSize() int64 {
+	if size, err := strconv.ParseInt(os.Getenv("UPLOAD_MAX_SIZE"), 10, 64); err == nil && size > 0 {
+		return size
+	}
+	return defaultMaxUploadSize
+}
+
+// UploadFile handles the file upload. The multipart body is streamed part by part
+// straight to storage, so a request can carry several files and none of them is
+// buffered in memory or temp files. The response has one result per file.
+// ?folder_id= puts the files in a folder instead of at the top of the tree.
+// ?expires_in= (a TTL like "720h") or ?expires_at= (RFC 3339) sets when the files
+// expire, within the tenant's expiry policy, which may also set a default.
+// Files whose contents do not match their extension or the tenant's content
+// policy are refused with 415 and skipped; the others are still stored. Space is
+// reserved in the tenant's quota before each file is written; the first file
+// that does not fit is refused with 413 and ends the upload.
 func UploadFile(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client) {
-	err := r.ParseMultipartForm(10 << 20) // 10 MB maximum file size
-	if err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	userID := t.userID
+
+	folderID := 0
+	if folder := r.URL.Query().Get("folder_id"); folder != "" {
+		var err error
+		if folderID, err = strconv.Atoi(folder); err != nil || folderID < 0 {
+			http.Error(w, "Invalid folder_id", http.StatusBadRequest)
+			return
+		}
+	}
 
-	// Get the file from the request
-	file, fileHeader, err := r.FormFile("file")
+	requestedExpiry, err := parseExpiryValues(r.URL.Query().Get("expires_at"), r.URL.Query().Get("expires_in"))
 	if err != nil {
-		http.Error(w, "Unable to get file", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
-
-	// Generate a unique file name
-	fileName := uuid.New().String() + filepath.Ext(fileHeader.Filename) // Keep the original file extension
 
-	// Save the file locally and get the public URL
-	publicURL, err := saveFileLocally(file, fileName)
+	maxSize := maxUploadSize()
+	r.Body = http.MaxBytesReader(w, r.Body, maxFilesPerUpload*maxSize+1<<20)
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Failed to save file locally", http.StatusInternalServerError)
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
 
-	// Prepare file metadata
-	// Retrieve the user ID from the context or session
+	if folderID != 0 {
+		if _, err := loadFolder(db, t, folderID); err == sql.ErrNoRows {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to retrieve folder", http.StatusInternalServerError)
+			return
+		}
+	}
 
-	//get user id from context
-	userID := 3
+	policy, err := loadContentPolicy(db, t)
+	if err != nil {
+		log.Printf("Failed to load content policy: %v", err)
+		http.Error(w, "Failed to retrieve content policy", http.StatusInternalServerError)
+		return
+	}
 
-	// Check if the user exists in the users table
-	var exists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists)
+	expiryPolicy, err := loadExpiryPolicy(db, t)
 	if err != nil {
-		http.Error(w, "Failed to check user existence", http.StatusInternalServerError)
+		log.Printf("Failed to load expiry policy: %v", err)
+		http.Error(w, "Failed to retrieve expiry policy", http.StatusInternalServerError)
 		return
 	}
+	expiration, err := expiryPolicy.expiry(requestedExpiry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := []UploadResult{}
+	status := http.StatusOK
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			status = http.StatusBadRequest
+			break
+		}
+		// Form values other than files are skipped
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		if len(results) == maxFilesPerUpload {
+			part.Close()
+			http.Error(w, "Too many files in one request", http.StatusBadRequest)
+			return
+		}
+
+		result := UploadResult{Name: sanitizeFileName(part.FileName())}
+
+		// The type is checked before anything is stored
+		content, head, err := sniffContent(part)
+		if err != nil {
+			part.Close()
+			status = http.StatusBadRequest
+			break
+		}
+		mimeType, refused := checkContent(policy, result.Name, head)
+		result.MimeType = mimeType
+		if refused != nil {
+			part.Close()
+			result.Error, result.Code = refused.Message, refused.Code
+			results = append(results, result)
+			status = http.StatusUnsupportedMediaType
+			continue
+		}
+
+		// Contents are stored under a unique key, the names are only metadata
+		storageKey := uuid.New().String() + filepath.Ext(result.Name) // Keep the original file extension
+
+		// Hold space for the file, as much as the body can still carry
+		want := maxSize
+		if r.ContentLength > 0 && r.ContentLength < want {
+			want = r.ContentLength
+		}
+		reservation, err := reserveQuota(db, t, 0, want, 1)
+		var exceeded *quotaError
+		if errors.As(err, &exceeded) {
+			part.Close()
+			result.Error, result.Code, result.Quota = exceeded.Message, exceeded.Code, &exceeded.Quota
+			results = append(results, result)
+			status = http.StatusRequestEntityTooLarge
+			w.Header().Set("Connection", "close")
+			break
+		}
+		if err != nil {
+			part.Close()
+			log.Printf("Failed to reserve quota: %v", err)
+			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+
+		// Stream the file to storage, measuring it on the way
+		stored, err := storeFile(content, storageKey, reservation.bytes)
+		part.Close()
+		if err != nil {
+			reservation.release(db)
+		}
+		if err == errFileTooLarge && reservation.bytes < want {
+			exceeded = reservation.exceeded()
+			result.Error, result.Code, result.Quota = exceeded.Message, exceeded.Code, &exceeded.Quota
+			results = append(results, result)
+			status = http.StatusRequestEntityTooLarge
+			w.Header().Set("Connection", "close")
+			break
+		}
+		if err == errFileTooLarge {
+			// Stop reading instead of draining the rest of an oversized body
+			result.Error = "File exceeds the maximum size of " + strconv.FormatInt(maxSize, 10) + " bytes"
+			results = append(results, result)
+			status = http.StatusRequestEntityTooLarge
+			w.Header().Set("Connection", "close")
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to save file %q: %v", result.Name, err)
+			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+
+		// Prepare file metadata
+		fileMetadata := models.File{
+			UserID:       userID,
+			OrgID:        t.orgID,
+			FileName:     result.Name,
+			OriginalName: truncateUTF8(part.FileName(), maxOriginalNameBytes),
+			StorageKey:   storageKey,
+			UploadDate:   time.Now(),
+			Size:         stored.Size,
+			FileType:     filepath.Ext(result.Name), // Get the file type from the file extension
+			MimeType:     mimeType,
+			S3URL:        stored.Location, // Set when the storage backend is S3
+			Description:  "",              // Leave empty for now
+			IsShared:     false,           // Default to false
+			Expiration:   expiration,
+			FolderID:     folderID,
+		}
+
+		// Insert file metadata into the database
+		err = insertFileMetadata(db, redisClient, t, &fileMetadata, stored.SHA256, nil)
+		// The file counts against the quota once registered
+		reservation.release(db)
+		if err != nil {
+			storage.Default().Delete(ctx, storageKey)
+			log.Printf("Failed to save file metadata: %v", err) // Log the actual error
+			http.Error(w, "Failed to save file metadata", http.StatusInternalServerError)
+			return
+		}
+
+		result.ID = fileMetadata.ID
+		result.FileURL = contentURL(fileMetadata.ID)
+		result.Size = stored.Size
+		result.SHA256 = stored.SHA256
+		result.MD5 = stored.MD5
+		result.Expiration = fileMetadata.Expiration
+		results = append(results, result)
+	}
 
-	if !exists {
-		http.Error(w, "User  not found", http.StatusNotFound)
+	if len(results) == 0 {
+		http.Error(w, "Unable to get file", http.StatusBadRequest)
 		return
 	}
 
-	// Prepare file metadata
-	fileMetadata := models.File{
-		UserID:      userID,
-		FileName:    fileName,
-		UploadDate:  time.Now(),
-		Size:        fileHeader.Size,
-		LocalPath:   publicURL,                         // Store the public URL instead of local path
-		FileType:    filepath.Ext(fileHeader.Filename), // Get the file type from the file extension
-		S3URL:       "",                                // Leave empty since we're not using S3
-		Description: "",                                // Leave empty for now
-		IsShared:    false,                             // Default to false
-		Expiration:  time.Time{},                       // No expiration set
+	// Respond with a result per file. Files stored before a failure are kept and listed.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]UploadResult{"files": results})
+}
+
+// insertFileMetadata stores the metadata of a newly stored file for the tenant,
+// along with its first version, and updates the caches. Every upload path
+// registers its files through here. If the same contents were stored before, the
+// file shares them and the copy under fileMetadata.StorageKey is deleted; new
+// contents are queued for a malware scan. A non-nil register is called with the
+// new file's ID in the same transaction, so the file is only kept if it succeeds.
+func insertFileMetadata(db *sql.DB, redisClient *redis.Client, t tenant, fileMetadata *models.File, sha256 string,
+	register func(tx *sql.Tx, fileID int) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	// Insert file metadata into the database
-	query := `INSERT INTO files (user_id, file_name, upload_date, size, local_path, file_type, s3_url, description, is_shared, expiration_date) 
-          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
-	err = db.QueryRow(query, fileMetadata.UserID, fileMetadata.FileName, fileMetadata.UploadDate, fileMetadata.Size,
-		fileMetadata.LocalPath, fileMetadata.FileType, fileMetadata.S3URL, fileMetadata.Description,
-		fileMetadata.IsShared, fileMetadata.Expiration).Scan(&fileMetadata.ID)
+	file := *fileMetadata
+	file.SHA256 = sha256
+	var created bool
+	file.StorageKey, created, err = claimBlob(tx, fileMetadata.StorageKey, sha256, fileMetadata.Size)
+	if err != nil {
+		return err
+	}
+	if file.StorageKey != fileMetadata.StorageKey {
+		file.S3URL = storage.Location(storage.Default(), file.StorageKey)
+	}
 
+	query := `WITH inserted AS (
+            INSERT INTO files (user_id, file_name, upload_date, size, file_type, s3_url, description, is_shared, expiration_date, org_id, original_name, storage_key, folder_id, mime_type)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $14, $15) RETURNING id, user_id, storage_key, size, original_name, upload_date, mime_type)
+          INSERT INTO file_versions (file_id, version, uploaded_by, storage_key, size, sha256, original_name, created_at, mime_type)
+          SELECT id, 1, user_id, storage_key, size, $13, original_name, upload_date, mime_type FROM inserted RETURNING file_id`
+	err = tx.QueryRow(query, file.UserID, file.FileName, file.UploadDate, file.Size,
+		file.FileType, file.S3URL, file.Description,
+		file.IsShared, file.Expiration, t.orgValue(), file.OriginalName,
+		file.StorageKey, sha256, nullID(file.FolderID), file.MimeType).Scan(&file.ID)
 	if err != nil {
-		log.Printf("Failed to save file metadata: %v", err) // Log the actual error
-		http.Error(w, "Failed to save file metadata", http.StatusInternalServerError)
-		return
+		return err
+	}
+	file.LocalPath = contentURL(file.ID)
+	if register != nil {
+		if err := register(tx, file.ID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
 	}
 
-	//clear cache
-	// redisClient.Del(ctx, "user_files:14")
+	if file.StorageKey != fileMetadata.StorageKey {
+		log.Printf("File %d has the same contents as %s, deleting the new copy", file.ID, file.StorageKey)
+		storage.Default().Delete(ctx, fileMetadata.StorageKey)
+	}
+	if created {
+		// New contents cannot be downloaded until they are scanned
+		job.QueueScan(file.StorageKey)
+	}
+	*fileMetadata = file
 
 	if redisClient != nil {
-		cachedData, _ := json.Marshal(fileMetadata)
-		redisClient.Set(ctx, "file_metadata:"+strconv.Itoa(fileMetadata.ID), cachedData, 0) // Cache with no expiration
+		// The tenant's cached listing no longer includes every file
+		redisClient.Del(ctx, t.filesCacheKey())
 	}
-
-	// Respond with the public URL
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"file_url": publicURL})
+	return nil
 }
 
-// saveFileLocally saves the uploaded file to the local filesystem
-func saveFileLocally(file multipart.File, fileName string) (string, error) {
-	// Create a directory for uploads if it doesn't exist
-	uploadDir := "uploads"
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-		return "", err
-	}
+// storeFile streams a file to the storage backend under fileName, computing its
+// size and checksums as it is written. A file larger than maxSize is not stored
+// and errFileTooLarge returned as soon as the limit is crossed.
+func storeFile(src io.Reader, fileName string, maxSize int64) (storedFile, error) {
+	sha := sha256.New()
+	md := md5.New()
+	limited := &limitedReader{r: io.TeeReader(src, io.MultiWriter(sha, md)), remaining: maxSize}
 
-	// Create the file on the local filesystem
-	localFilePath := filepath.Join(uploadDir, fileName)
-	outFile, err := os.Create(localFilePath)
-	if err != nil {
-		return "", err
+	backend := storage.Default()
+	if err := backend.Put(ctx, fileName, limited, -1, ""); err != nil {
+		return storedFile{}, err
 	}
-	defer outFile.Close()
 
-	// Copy the uploaded file to the local file
-	if _, err := io.Copy(outFile, file); err != nil {
-		return "", err
-	}
+	return storedFile{
+		Location: storage.Location(backend, fileName),
+		Size:     maxSize - limited.remaining,
+		SHA256:   hex.EncodeToString(sha.Sum(nil)),
+		MD5:      hex.EncodeToString(md.Sum(nil)),
+	}, nil
+}
 
-	// Construct the public URL
-	publicURL := "http://localhost:8080/" + uploadDir + "/" + fileName
+// limitedReader fails with errFileTooLarge once more than remaining bytes are read,
+// so the backend discards the object instead of storing a truncated file
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
 
-	return publicURL, nil
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, errFileTooLarge
+	}
+	return n, err
 }
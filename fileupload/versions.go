@@ -0,0 +1,472 @@
+package fileupload
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"go_backend_legalForce/job"
+	"go_backend_legalForce/models"
+	"go_backend_legalForce/storage"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// versionColumns are the columns of file_versions read by scanVersion
+const versionColumns = "v.version, COALESCE(v.uploaded_by, 0), v.storage_key, v.size, v.sha256, v.mime_type, " + versionScanStatusColumn + ", v.original_name, v.created_at, v.version = f.current_version"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanVersion reads the versionColumns of a row, followed by any extra columns into extra
+func scanVersion(row rowScanner, version *models.FileVersion, extra ...interface{}) error {
+	return row.Scan(append([]interface{}{&version.Version, &version.UploadedBy, &version.StorageKey, &version.Size,
+		&version.SHA256, &version.MimeType, &version.ScanStatus, &version.OriginalName, &version.CreatedAt, &version.Current}, extra...)...)
+}
+
+// loadVersion returns a version of a file the tenant can view, along with the
+// file's display name and type. Files in the trash have no versions to offer.
+func loadVersion(db *sql.DB, t tenant, fileID, number int) (models.File, models.FileVersion, error) {
+	file := models.File{ID: fileID}
+	var version models.FileVersion
+	scope, scopeArg := t.access("f", 3, models.GrantViewer)
+	err := scanVersion(db.QueryRow(`SELECT `+versionColumns+`, f.file_name, f.file_type
+		FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE v.file_id = $1 AND v.version = $2 AND f.deleted_at IS NULL AND `+notExpired("f")+` AND `+scope, fileID, number, scopeArg),
+		&version, &file.FileName, &file.FileType)
+	return file, version, err
+}
+
+// UploadVersion stores new contents for an existing file. The upload becomes the
+// current version; earlier versions stay available until the file is deleted.
+// Versions count against the tenant's quota like files, and one that does not fit
+// is refused with 413.
+func UploadVersion(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client, fileID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Refuse before reading the body if there is no such file
+	var exists bool
+	scope, scopeArg := t.condition(2)
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM files WHERE id = $1 AND deleted_at IS NULL AND "+notExpired("files")+" AND "+scope+")", fileID, scopeArg).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Failed to retrieve file", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	policy, err := loadContentPolicy(db, t)
+	if err != nil {
+		log.Printf("Failed to load content policy: %v", err)
+		http.Error(w, "Failed to retrieve content policy", http.StatusInternalServerError)
+		return
+	}
+
+	maxSize := maxUploadSize()
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	var part io.ReadCloser
+	var name string
+	for {
+		p, err := reader.NextPart()
+		if err != nil {
+			http.Error(w, "Unable to get file", http.StatusBadRequest)
+			return
+		}
+		if p.FileName() != "" {
+			part, name = p, p.FileName()
+			break
+		}
+		p.Close()
+	}
+
+	content, head, err := sniffContent(part)
+	if err != nil {
+		part.Close()
+		http.Error(w, "Unable to get file", http.StatusBadRequest)
+		return
+	}
+	mimeType, refused := checkContent(policy, sanitizeFileName(name), head)
+	if refused != nil {
+		part.Close()
+		writeContentTypeError(w, refused)
+		return
+	}
+
+	want := maxSize
+	if r.ContentLength > 0 && r.ContentLength < want {
+		want = r.ContentLength
+	}
+	reservation, err := reserveQuota(db, t, 0, want, 0)
+	var exceeded *quotaError
+	if errors.As(err, &exceeded) {
+		part.Close()
+		w.Header().Set("Connection", "close")
+		writeQuotaError(w, exceeded)
+		return
+	}
+	if err != nil {
+		part.Close()
+		log.Printf("Failed to reserve quota: %v", err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	// The version counts against the quota once added, or not at all
+	defer reservation.release(db)
+
+	storageKey := uuid.New().String() + filepath.Ext(sanitizeFileName(name))
+	stored, err := storeFile(content, storageKey, reservation.bytes)
+	part.Close()
+	if err == errFileTooLarge && reservation.bytes < want {
+		w.Header().Set("Connection", "close")
+		writeQuotaError(w, reservation.exceeded())
+		return
+	}
+	if err == errFileTooLarge {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "File exceeds the maximum size of "+strconv.FormatInt(maxSize, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save version of file %d: %v", fileID, err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+
+	version := models.FileVersion{
+		UploadedBy:   t.userID,
+		StorageKey:   storageKey,
+		Size:         stored.Size,
+		SHA256:       stored.SHA256,
+		MimeType:     mimeType,
+		OriginalName: truncateUTF8(name, maxOriginalNameBytes),
+		Current:      true,
+	}
+	if _, err := addVersion(db, t, fileID, &version, stored); err != nil {
+		storage.Default().Delete(ctx, storageKey)
+		if err == sql.ErrNoRows {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to save version of file %d: %v", fileID, err)
+		http.Error(w, "Failed to save file metadata", http.StatusInternalServerError)
+		return
+	}
+	cacheChangedFile(redisClient, t)
+	log.Printf("User %d uploaded version %d of file %d", t.userID, version.Version, fileID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(version)
+}
+
+// addVersion records stored contents as the next version of a file and makes it
+// the current one. The file row is locked so concurrent uploads get distinct numbers.
+// If the same contents were stored before, the version shares them and the copy
+// under version.StorageKey is deleted; new contents are queued for a malware scan.
+func addVersion(db *sql.DB, t tenant, fileID int, version *models.FileVersion, stored storedFile) (models.File, error) {
+	var file models.File
+	tx, err := db.Begin()
+	if err != nil {
+		return file, err
+	}
+	defer tx.Rollback()
+
+	scope, scopeArg := t.condition(2)
+	var id int
+	err = tx.QueryRow("SELECT id FROM files WHERE id = $1 AND deleted_at IS NULL AND "+notExpired("files")+" AND "+scope+" FOR UPDATE", fileID, scopeArg).Scan(&id)
+	if err != nil {
+		return file, err
+	}
+
+	storageKey, created, err := claimBlob(tx, version.StorageKey, version.SHA256, version.Size)
+	if err != nil {
+		return file, err
+	}
+	if storageKey != version.StorageKey {
+		stored.Location = storage.Location(storage.Default(), storageKey)
+	}
+
+	err = tx.QueryRow(`INSERT INTO file_versions (file_id, version, uploaded_by, storage_key, size, sha256, original_name, mime_type)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5, $6, $7 FROM file_versions WHERE file_id = $1
+		RETURNING version, created_at`,
+		fileID, version.UploadedBy, storageKey, version.Size, version.SHA256, version.OriginalName, version.MimeType).Scan(&version.Version, &version.CreatedAt)
+	if err != nil {
+		return file, err
+	}
+
+	err = scanReturnedFile(tx.QueryRow(`UPDATE files SET storage_key = $1, size = $2, original_name = $3, s3_url = $4, current_version = $5, mime_type = $6
+		WHERE id = $7 `+returningFile,
+		storageKey, version.Size, version.OriginalName, stored.Location, version.Version, version.MimeType, fileID), &file)
+	if err != nil {
+		return file, err
+	}
+	if err := tx.Commit(); err != nil {
+		return file, err
+	}
+
+	if storageKey != version.StorageKey {
+		log.Printf("Version %d of file %d has the same contents as %s, deleting the new copy", version.Version, fileID, storageKey)
+		storage.Default().Delete(ctx, version.StorageKey)
+		version.StorageKey = storageKey
+	}
+	if created {
+		job.QueueScan(storageKey)
+	}
+	version.ScanStatus = file.ScanStatus
+	return file, nil
+}
+
+// ListVersions lists the versions of a file, newest first, along with the storage
+// they take up together
+func ListVersions(w http.ResponseWriter, r *http.Request, db *sql.DB, fileID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scope, scopeArg := t.access("f", 2, models.GrantViewer)
+	rows, err := db.Query(`SELECT `+versionColumns+`
+		FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE v.file_id = $1 AND f.deleted_at IS NULL AND `+notExpired("f")+` AND `+scope+` ORDER BY v.version DESC`, fileID, scopeArg)
+	if err != nil {
+		log.Printf("Failed to list versions of file %d: %v", fileID, err)
+		http.Error(w, "Failed to retrieve versions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	versions := []models.FileVersion{}
+	var totalSize int64
+	for rows.Next() {
+		var version models.FileVersion
+		if err := scanVersion(rows, &version); err != nil {
+			log.Printf("Error scanning row: %v", err)
+			http.Error(w, "Failed to scan version", http.StatusInternalServerError)
+			return
+		}
+		totalSize += version.Size
+		versions = append(versions, version)
+	}
+	// Every file has at least one version
+	if len(versions) == 0 {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file_id":    fileID,
+		"total_size": totalSize,
+		"versions":   versions,
+	})
+}
+
+// DownloadVersion streams the contents of a version of a file, like DownloadFile
+func DownloadVersion(w http.ResponseWriter, r *http.Request, db *sql.DB, fileID, number int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	file, version, err := loadVersion(db, t, fileID, number)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve file", http.StatusInternalServerError)
+		return
+	}
+	if !requireClean(w, version.ScanStatus) {
+		return
+	}
+
+	content, obj, ok := openStoredFile(w, r, version.StorageKey)
+	if !ok {
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.FileName}))
+	w.Header().Set("Cache-Control", "private")
+	serveStoredContent(w, r, content, obj, version.MimeType, version.CreatedAt)
+
+	log.Printf("User %d downloaded version %d of file %d", t.userID, number, fileID)
+}
+
+// RestoreVersion makes an earlier version the current one. No version is removed,
+// so the restore can be undone by restoring the version that was current.
+func RestoreVersion(w http.ResponseWriter, r *http.Request, db *sql.DB, redisClient *redis.Client, fileID, number int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	_, version, err := loadVersion(db, t, fileID, number)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve file", http.StatusInternalServerError)
+		return
+	}
+
+	var file models.File
+	scope, scopeArg := t.condition(8)
+	err = scanReturnedFile(db.QueryRow(`UPDATE files SET storage_key = $1, size = $2, original_name = $3, s3_url = $4, current_version = $5, mime_type = $6
+		WHERE id = $7 AND deleted_at IS NULL AND `+notExpired("files")+` AND `+scope+` `+returningFile,
+		version.StorageKey, version.Size, version.OriginalName,
+		storage.Location(storage.Default(), version.StorageKey), version.Version, version.MimeType, fileID, scopeArg), &file)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to restore version %d of file %d: %v", number, fileID, err)
+		http.Error(w, "Failed to restore version", http.StatusInternalServerError)
+		return
+	}
+	cacheChangedFile(redisClient, t)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(file)
+}
+
+// DiffVersions compares two versions of a text file and returns a unified diff.
+// The from query parameter is required; to defaults to the current version.
+func DiffVersions(w http.ResponseWriter, r *http.Request, db *sql.DB, fileID int) {
+	t, ok := requestTenant(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil {
+		http.Error(w, "Invalid from version", http.StatusBadRequest)
+		return
+	}
+	to := 0
+	if param := r.URL.Query().Get("to"); param != "" {
+		if to, err = strconv.Atoi(param); err != nil {
+			http.Error(w, "Invalid to version", http.StatusBadRequest)
+			return
+		}
+	} else {
+		scope, scopeArg := t.access("files", 2, models.GrantViewer)
+		err := db.QueryRow("SELECT current_version FROM files WHERE id = $1 AND deleted_at IS NULL AND "+notExpired("files")+" AND "+scope, fileID, scopeArg).Scan(&to)
+		if err == sql.ErrNoRows {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to retrieve file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var texts [2]string
+	var file models.File
+	for i, number := range []int{from, to} {
+		var version models.FileVersion
+		file, version, err = loadVersion(db, t, fileID, number)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Version "+strconv.Itoa(number)+" not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to retrieve file", http.StatusInternalServerError)
+			return
+		}
+		if version.Size > maxDiffFileSize {
+			http.Error(w, "File is too large to compare", http.StatusUnprocessableEntity)
+			return
+		}
+		content, ok := readVersion(w, version)
+		if !ok {
+			return
+		}
+		if !isText(content) {
+			http.Error(w, "Only text files can be compared", http.StatusUnsupportedMediaType)
+			return
+		}
+		texts[i] = string(content)
+	}
+
+	diff, err := unifiedDiff(texts[0], texts[1],
+		file.FileName+" (version "+strconv.Itoa(from)+")", file.FileName+" (version "+strconv.Itoa(to)+")")
+	if err == errTooManyChanges {
+		http.Error(w, "Versions differ too much to compare", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to compare versions %d and %d of file %d: %v", from, to, fileID, err)
+		http.Error(w, "Failed to compare versions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(diff))
+}
+
+// readVersion reads the contents of a version into memory, answering the request
+// with an error if it cannot
+func readVersion(w http.ResponseWriter, version models.FileVersion) ([]byte, bool) {
+	if !requireClean(w, version.ScanStatus) {
+		return nil, false
+	}
+	body, _, err := storage.Default().Get(ctx, version.StorageKey, 0, -1)
+	if err == storage.ErrNotFound {
+		http.Error(w, "File content not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to read %s: %v", version.StorageKey, err)
+		http.Error(w, "Failed to retrieve file", http.StatusInternalServerError)
+		return nil, false
+	}
+	defer body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(body, maxDiffFileSize+1))
+	if err != nil {
+		log.Printf("Failed to read %s: %v", version.StorageKey, err)
+		http.Error(w, "Failed to retrieve file", http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(content) > maxDiffFileSize {
+		http.Error(w, "File is too large to compare", http.StatusUnprocessableEntity)
+		return nil, false
+	}
+	return content, true
+}
+
+// cacheChangedFile drops the cached listing after the contents of a file changed,
+// since it shows their size
+func cacheChangedFile(redisClient *redis.Client, t tenant) {
+	if redisClient == nil {
+		return
+	}
+	redisClient.Del(ctx, t.filesCacheKey())
+}
@@ -0,0 +1,66 @@
+package job
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain-text email, like auth.Mailer
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// ExpiryWarning is how long before a file expires its owner is warned,
+// FILE_EXPIRY_WARNING as a duration like "48h", 24 hours by default
+func ExpiryWarning() time.Duration {
+	if warning, err := time.ParseDuration(os.Getenv("FILE_EXPIRY_WARNING")); err == nil && warning > 0 {
+		return warning
+	}
+	return 24 * time.Hour
+}
+
+// WarnExpiringFiles emails the owners of files expiring within warning, with one
+// message per owner listing their files, and returns how many files they were
+// warned about. Each file is marked as it is picked up, so its owner is warned
+// once even if sending fails.
+func WarnExpiringFiles(db *sql.DB, mailer Mailer, warning time.Duration) (int, error) {
+	rows, err := db.Query(`UPDATE files SET expiry_warned_at = NOW() FROM users u
+		WHERE u.id = files.user_id AND files.expiry_warned_at IS NULL AND files.deleted_at IS NULL
+			AND files.expiration_date > NOW() AND files.expiration_date <= $1
+		RETURNING u.email, files.id, files.file_name, files.expiration_date`, time.Now().Add(warning))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	warned := 0
+	lines := map[string][]string{}
+	for rows.Next() {
+		var email, name string
+		var id int
+		var expiration time.Time
+		if err := rows.Scan(&email, &id, &name, &expiration); err != nil {
+			return warned, err
+		}
+		lines[email] = append(lines[email], "- "+name+" (file "+strconv.Itoa(id)+"), expires "+expiration.UTC().Format(time.RFC1123))
+		warned++
+	}
+	if err := rows.Err(); err != nil {
+		return warned, err
+	}
+
+	for email, files := range lines {
+		sort.Strings(files)
+		body := "The following files will be deleted when they expire:\n\n" + strings.Join(files, "\n") +
+			"\n\nChange their expiry to keep them longer."
+		if err := mailer.Send(email, "Your files are about to expire", body); err != nil {
+			log.Printf("Failed to send expiry warning to %s: %v", email, err)
+		}
+	}
+	return warned, nil
+}
@@ -1,17 +1,18 @@
 package job
 
 import (
+	"context"
 	"database/sql"
+	"go_backend_legalForce/storage"
 	"log"
-	"os"
-	"path/filepath"
 	"time"
 
-	_ "github.com/lib/pq" // PostgreSQL driver
+	"github.com/lib/pq"
 )
 
-// StartFileCleanup initiates a background routine that periodically checks for and deletes expired files
-func StartFileCleanup(db *sql.DB) {
+// StartFileCleanup initiates a background routine that periodically checks for and deletes expired files.
+// The owners of files about to expire are warned by mail first.
+func StartFileCleanup(db *sql.DB, mailer Mailer) {
 	// Check if db is nil before proceeding
 	if db == nil {
 		log.Println("ERROR: Database connection is nil, file cleanup service cannot start")
@@ -21,6 +22,13 @@ func StartFileCleanup(db *sql.DB) {
 	log.Println("Starting file cleanup service")
 
 	for {
+		warned, err := WarnExpiringFiles(db, mailer, ExpiryWarning())
+		if err != nil {
+			log.Printf("Error during expiry warnings: %v", err)
+		} else {
+			log.Printf("Expiry warnings completed: owners of %d files warned", warned)
+		}
+
 		// Check for expired files
 		filesDeleted, err := deleteExpiredFiles(db)
 		if err != nil {
@@ -29,85 +37,147 @@ func StartFileCleanup(db *sql.DB) {
 			log.Printf("File cleanup completed: %d expired files removed", filesDeleted)
 		}
 
+		uploadsDeleted, err := deleteExpiredUploads(db)
+		if err != nil {
+			log.Printf("Error during upload cleanup: %v", err)
+		} else {
+			log.Printf("Upload cleanup completed: %d expired resumable uploads removed", uploadsDeleted)
+		}
+
+		reservationsDeleted, err := deleteExpiredReservations(db)
+		if err != nil {
+			log.Printf("Error during quota reservation cleanup: %v", err)
+		} else {
+			log.Printf("Quota reservation cleanup completed: %d expired reservations removed", reservationsDeleted)
+		}
+
+		trashPurged, err := purgeTrash(db, TrashRetention())
+		if err != nil {
+			log.Printf("Error during trash cleanup: %v", err)
+		} else {
+			log.Printf("Trash cleanup completed: %d files purged", trashPurged)
+		}
+
+		unshared, err := unshareFiles(db)
+		if err != nil {
+			log.Printf("Error during share link cleanup: %v", err)
+		} else {
+			log.Printf("Share link cleanup completed: %d files no longer shared", unshared)
+		}
+
+		blobsDeleted, err := deleteUnreferencedBlobs(db)
+		if err != nil {
+			log.Printf("Error during blob cleanup: %v", err)
+		} else {
+			log.Printf("Blob cleanup completed: %d unreferenced blobs removed", blobsDeleted)
+		}
+
 		// Wait for a specified interval before checking again (e.g., every hour)
 		log.Println("Next file cleanup scheduled in 1 hour")
 		time.Sleep(1 * time.Hour)
 	}
 }
 
-// deleteExpiredFiles removes files whose expiration date has passed
+// deleteExpiredFiles removes files whose expiration date has passed. They were out
+// of reach since they expired; this releases their contents.
 // Returns the number of files deleted and any error encountered
 func deleteExpiredFiles(db *sql.DB) (int, error) {
-	// Query to find expired files
-	query := `SELECT id, local_path FROM files WHERE expiration_date < NOW() AND expiration_date != '0001-01-01 00:00:00'`
-	rows, err := db.Query(query)
+	deletedFiles, keys, err := DeleteFiles(db, "DELETE FROM files WHERE expiration_date <= NOW() RETURNING id, storage_key")
 	if err != nil {
 		return 0, err
 	}
-	defer rows.Close()
 
-	// Count of successfully deleted files
-	deletedFiles := 0
+	// The rows are gone, so contents no other file shares can go too
+	for _, key := range keys {
+		log.Printf("Processing expired file contents: %s", key)
+		RemoveStoredFile(key)
+	}
+	return deletedFiles, nil
+}
 
-	// Loop through all expired files
-	for rows.Next() {
-		var fileID int
-		var localPath string
+// Querier runs queries on a database or in a transaction
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
 
-		if err := rows.Scan(&fileID, &localPath); err != nil {
-			log.Printf("Error scanning expired file row: %v", err)
-			continue
+// DeleteFiles runs deleteQuery, a DELETE on files returning id, and returns how
+// many files it deleted along with the storage keys of the blobs no file version
+// references any more. Version rows are removed with their file, so this is the
+// only chance to release the blobs they reference. The caller removes the contents
+// with RemoveStoredFile once the deletion is committed.
+func DeleteFiles(q Querier, deleteQuery string, args ...interface{}) (int, []string, error) {
+	rows, err := q.Query(`WITH deleted AS (`+deleteQuery+`),
+		refs AS (SELECT storage_key, COUNT(*) AS n FROM file_versions WHERE file_id IN (SELECT id FROM deleted) GROUP BY storage_key),
+		released AS (UPDATE blobs b SET ref_count = b.ref_count - refs.n FROM refs WHERE b.storage_key = refs.storage_key
+			RETURNING b.storage_key, b.ref_count)
+		SELECT (SELECT COUNT(*) FROM deleted), ARRAY(SELECT storage_key FROM released WHERE ref_count <= 0)`, args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	var deleted int
+	var unreferenced []string
+	for rows.Next() {
+		if err := rows.Scan(&deleted, pq.Array(&unreferenced)); err != nil {
+			rows.Close()
+			return 0, nil, err
 		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(unreferenced) == 0 {
+		return deleted, nil, err
+	}
 
-		log.Printf("Processing expired file: %s (ID: %d)", localPath, fileID)
-
-		// Make sure the path is properly formatted
-		// If the localPath is a URL, extract just the file path portion
-		if filepath.IsAbs(localPath) == false && localPath != "" {
-			// Handle case where localPath is stored as a URL
-			if filepath.HasPrefix(localPath, "http://") || filepath.HasPrefix(localPath, "https://") {
-				localPath = filepath.Join("uploads", filepath.Base(localPath))
-				log.Printf("Converted URL to local path: %s", localPath)
-			} else {
-				// Ensure it's a full path
-				localPath = filepath.Join("uploads", localPath)
-			}
-		}
+	// A blob is deleted in a statement of its own since it was just updated. One
+	// referenced again in between is kept.
+	keys, err := blobKeys(q, "DELETE FROM blobs WHERE storage_key = ANY($1) AND ref_count <= 0 RETURNING storage_key", pq.Array(unreferenced))
+	return deleted, keys, err
+}
 
-		// Check if file exists before attempting deletion
-		if _, err := os.Stat(localPath); os.IsNotExist(err) {
-			log.Printf("File %s does not exist on disk, but will remove database entry", localPath)
-		} else {
-			// Delete the file from local storage
-			if err := os.Remove(localPath); err != nil {
-				log.Printf("Error deleting file %s: %v", localPath, err)
-				// Continue with metadata deletion even if file deletion fails
-			} else {
-				log.Printf("Successfully deleted file from disk: %s", localPath)
-			}
-		}
+// deleteUnreferencedBlobs deletes the blobs left without references by a deletion
+// that did not get to delete them, along with their contents
+func deleteUnreferencedBlobs(db *sql.DB) (int, error) {
+	keys, err := blobKeys(db, "DELETE FROM blobs WHERE ref_count <= 0 RETURNING storage_key")
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		RemoveStoredFile(key)
+	}
+	return len(keys), nil
+}
 
-		// Remove the corresponding metadata from the database
-		result, err := db.Exec("DELETE FROM files WHERE id = $1", fileID)
-		if err != nil {
-			log.Printf("Error deleting metadata for file ID %d: %v", fileID, err)
-			continue
-		}
+// blobKeys runs query, a statement on blobs returning storage_key, and returns
+// the storage keys of the blobs it returned
+func blobKeys(q Querier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		rowsAffected, _ := result.RowsAffected()
-		if rowsAffected > 0 {
-			deletedFiles++
-			log.Printf("Successfully deleted metadata for file ID %d", fileID)
-		} else {
-			log.Printf("No rows affected when deleting metadata for file ID %d", fileID)
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
 		}
+		keys = append(keys, key)
 	}
+	return keys, rows.Err()
+}
 
-	// Check for any errors that occurred during iteration
-	if err = rows.Err(); err != nil {
-		log.Printf("Error iterating over rows: %v", err)
-		return deletedFiles, err
+// RemoveStoredFile deletes the contents of a file, kept under files.storage_key,
+// from the storage backend, along with their quarantined copy if malware was
+// found in them. A missing file is not an error since the caller is removing its
+// metadata anyway.
+func RemoveStoredFile(storageKey string) {
+	if err := storage.Default().Delete(context.Background(), quarantineKey(storageKey)); err != nil {
+		log.Printf("Error deleting quarantined file %s: %v", storageKey, err)
+	}
+	if err := storage.Default().Delete(context.Background(), storageKey); err != nil {
+		log.Printf("Error deleting stored file %s: %v", storageKey, err)
+		// Continue with metadata deletion even if file deletion fails
+	} else {
+		log.Printf("Successfully deleted stored file: %s", storageKey)
 	}
-
-	return deletedFiles, nil
 }
@@ -0,0 +1,228 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"go_backend_legalForce/models"
+	"go_backend_legalForce/scanner"
+	"go_backend_legalForce/storage"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// quarantinePrefix is where infected contents are kept in the storage backend, out
+// of reach of the keys files and presigned links refer to
+const quarantinePrefix = "quarantine/"
+
+// scanSweepInterval is how often the scan worker looks for contents the queue
+// missed, failed scans and requested rescans
+const scanSweepInterval = time.Minute
+
+// scanBatchSize bounds the contents scanned by one sweep
+const scanBatchSize = 100
+
+// scanQueue holds the storage keys of new contents, so they are scanned as soon
+// as they are stored rather than at the next sweep
+var scanQueue = make(chan string, 1000)
+
+// QueueScan asks the scan worker to scan the blob stored under key. When the
+// queue is full the blob is left to the next sweep.
+func QueueScan(key string) {
+	select {
+	case scanQueue <- key:
+	default:
+	}
+}
+
+// StartScanWorker scans queued contents as they come in, and periodically sweeps
+// for contents that are still pending, failed to scan or are to be rescanned.
+// Cached file listings are dropped as verdicts come in, if redisClient is not nil.
+func StartScanWorker(db *sql.DB, redisClient *redis.Client, s scanner.Scanner) {
+	if db == nil {
+		log.Println("ERROR: Database connection is nil, malware scan service cannot start")
+		return
+	}
+
+	log.Println("Starting malware scan service")
+
+	sweep := time.NewTicker(scanSweepInterval)
+	defer sweep.Stop()
+	for {
+		scanned, err := scanPending(db, redisClient, s)
+		if err != nil {
+			log.Printf("Error during malware scan sweep: %v", err)
+		} else if scanned > 0 {
+			log.Printf("Malware scan sweep completed: %d contents scanned", scanned)
+		}
+
+	wait:
+		for {
+			select {
+			case key := <-scanQueue:
+				if _, err := ScanBlob(db, redisClient, s, key); err != nil {
+					log.Printf("Error scanning %s: %v", key, err)
+				}
+			case <-sweep.C:
+				break wait
+			}
+		}
+	}
+}
+
+// scanPending scans the oldest contents waiting for a scan. It stops at the first
+// failure, as the scanner is then likely unavailable.
+func scanPending(db *sql.DB, redisClient *redis.Client, s scanner.Scanner) (int, error) {
+	keys, err := blobKeys(db, `SELECT storage_key FROM blobs
+		WHERE (scan_status IN ('pending', 'error') OR rescan_requested_at IS NOT NULL) AND ref_count > 0
+		ORDER BY created_at LIMIT $1`, scanBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if _, err := ScanBlob(db, redisClient, s, key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// ScanBlob scans the contents of the blob stored under key, records the verdict
+// and returns the new scan status. Infected contents are moved to quarantine, and
+// quarantined contents a later scan finds clean are moved back. When the scanner
+// fails, contents that had no verdict yet are marked as failed and retried later.
+// The cached listings of the files with those contents are dropped with each
+// verdict, since they show the scan status.
+func ScanBlob(db *sql.DB, redisClient *redis.Client, s scanner.Scanner, key string) (string, error) {
+	var status string
+	err := db.QueryRow("SELECT scan_status FROM blobs WHERE storage_key = $1", key).Scan(&status)
+	if err == sql.ErrNoRows {
+		// Deleted since it was queued
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	location := key
+	if status == models.ScanInfected {
+		location = quarantineKey(key)
+	}
+	ctx := context.Background()
+	content, _, err := storage.Default().Get(ctx, location, 0, -1)
+	if err != nil {
+		return status, err
+	}
+	result, scanErr := s.Scan(ctx, content)
+	content.Close()
+
+	switch {
+	case scanErr != nil:
+		_, err = db.Exec("UPDATE blobs SET scan_status = 'error', scanned_at = NOW() WHERE storage_key = $1 AND scan_status IN ('pending', 'error')", key)
+		if err != nil {
+			log.Printf("Failed to record the failed scan of %s: %v", key, err)
+		}
+		return status, scanErr
+
+	case result.Infected:
+		// Recorded first, so the contents are refused even if moving them fails
+		updated, err := recordVerdict(db, redisClient, key, models.ScanInfected, result.Signature)
+		if err != nil || !updated {
+			return models.ScanInfected, err
+		}
+		log.Printf("Malware %s found in %s", result.Signature, key)
+		if status != models.ScanInfected {
+			if err := moveStored(ctx, key, quarantineKey(key)); err != nil {
+				return models.ScanInfected, err
+			}
+			log.Printf("Quarantined %s", key)
+		}
+		return models.ScanInfected, nil
+
+	default:
+		// Moved back first, so the contents are where files expect them once served
+		if status == models.ScanInfected {
+			if err := moveStored(ctx, quarantineKey(key), key); err != nil {
+				return status, err
+			}
+			log.Printf("Released %s from quarantine", key)
+		}
+		_, err := recordVerdict(db, redisClient, key, models.ScanClean, "")
+		return models.ScanClean, err
+	}
+}
+
+// recordVerdict stores the result of a scan of the blob stored under key and
+// drops the cached listings showing it. It reports false if the blob was deleted
+// in the meantime.
+func recordVerdict(db *sql.DB, redisClient *redis.Client, key, status, signature string) (bool, error) {
+	result, err := db.Exec(`UPDATE blobs SET scan_status = $2, scan_signature = $3, scanned_at = NOW(), rescan_requested_at = NULL
+		WHERE storage_key = $1`, key, status, signature)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		return false, nil
+	}
+	if err := forgetListings(db, redisClient, key); err != nil {
+		log.Printf("Failed to drop cached listings of %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// forgetListings drops the cached listings of the users and organizations whose
+// files currently have the contents stored under key
+func forgetListings(db *sql.DB, redisClient *redis.Client, key string) error {
+	if redisClient == nil {
+		return nil
+	}
+	rows, err := db.Query("SELECT DISTINCT user_id, COALESCE(org_id, 0) FROM files WHERE storage_key = $1", key)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var userID, orgID int
+		if err := rows.Scan(&userID, &orgID); err != nil {
+			return err
+		}
+		keys = append(keys, FilesCacheKey(userID, orgID))
+	}
+	if err := rows.Err(); err != nil || len(keys) == 0 {
+		return err
+	}
+	return redisClient.Del(context.Background(), keys...).Err()
+}
+
+// FilesCacheKey is the key of the cached listing of a user's personal files, or
+// of the files of organization orgID when it is not 0
+func FilesCacheKey(userID, orgID int) string {
+	if orgID != 0 {
+		return "org_files:" + strconv.Itoa(orgID)
+	}
+	return "user_files:" + strconv.Itoa(userID)
+}
+
+// quarantineKey is where the contents stored under key are kept while quarantined
+func quarantineKey(key string) string {
+	return quarantinePrefix + key
+}
+
+// moveStored moves contents to another key of the storage backend
+func moveStored(ctx context.Context, from, to string) error {
+	backend := storage.Default()
+	content, obj, err := backend.Get(ctx, from, 0, -1)
+	if err != nil {
+		return err
+	}
+	err = backend.Put(ctx, to, content, obj.Size, "")
+	content.Close()
+	if err != nil {
+		return err
+	}
+	return backend.Delete(ctx, from)
+}
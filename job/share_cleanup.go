@@ -0,0 +1,19 @@
+package job
+
+import "database/sql"
+
+// ActiveShareLink is the condition on a share_links row l that its token can
+// still be used: it is not revoked, has not expired and has downloads left
+const ActiveShareLink = "l.revoked_at IS NULL AND (l.expires_at IS NULL OR l.expires_at > NOW()) AND (l.max_downloads = 0 OR l.download_count < l.max_downloads)"
+
+// unshareFiles clears is_shared on files whose share links have all expired or
+// run out of downloads, and returns how many there were
+func unshareFiles(db *sql.DB) (int, error) {
+	result, err := db.Exec(`UPDATE files SET is_shared = FALSE
+		WHERE is_shared AND NOT EXISTS (SELECT 1 FROM share_links l WHERE l.file_id = files.id AND ` + ActiveShareLink + `)`)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
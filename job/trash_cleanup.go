@@ -0,0 +1,30 @@
+package job
+
+import (
+	"database/sql"
+	"os"
+	"strconv"
+	"time"
+)
+
+// TrashRetention is how long deleted files stay in the trash before they are
+// purged, TRASH_RETENTION_DAYS or 30 days
+func TrashRetention() time.Duration {
+	if days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS")); err == nil && days > 0 {
+		return time.Duration(days) * 24 * time.Hour
+	}
+	return 30 * 24 * time.Hour
+}
+
+// purgeTrash permanently deletes files that have been in the trash longer than
+// the retention period, along with their contents
+func purgeTrash(db *sql.DB, retention time.Duration) (int, error) {
+	purged, keys, err := DeleteFiles(db, "DELETE FROM files WHERE deleted_at < $1 RETURNING id, storage_key", time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		RemoveStoredFile(key)
+	}
+	return purged, nil
+}
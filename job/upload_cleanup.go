@@ -0,0 +1,59 @@
+package job
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// PartialUploadDir is where resumable uploads are assembled, TUS_UPLOAD_DIR or
+// "upload_parts". It is kept apart from the uploads directory so incomplete files
+// are never served.
+func PartialUploadDir() string {
+	if dir := os.Getenv("TUS_UPLOAD_DIR"); dir != "" {
+		return dir
+	}
+	return "upload_parts"
+}
+
+// PartialUploadPath is the part file of a resumable upload
+func PartialUploadPath(uploadID string) string {
+	return filepath.Join(PartialUploadDir(), uploadID+".part")
+}
+
+// deleteExpiredUploads removes resumable uploads past their expiration along with
+// the bytes received so far. Completed uploads only lose their state record.
+// Uploads a PATCH request holds leased are being written to and left alone.
+func deleteExpiredUploads(db *sql.DB) (int, error) {
+	rows, err := db.Query(`DELETE FROM resumable_uploads
+		WHERE expires_at < NOW() AND (locked_until IS NULL OR locked_until < NOW()) RETURNING id`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	deleted := 0
+	for rows.Next() {
+		var uploadID string
+		if err := rows.Scan(&uploadID); err != nil {
+			log.Printf("Error scanning expired upload row: %v", err)
+			continue
+		}
+		if err := os.Remove(PartialUploadPath(uploadID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error deleting part file of upload %s: %v", uploadID, err)
+		}
+		deleted++
+	}
+	return deleted, rows.Err()
+}
+
+// deleteExpiredReservations removes the quota reservations of uploads that never
+// finished. They stopped counting against the quota when they expired.
+func deleteExpiredReservations(db *sql.DB) (int64, error) {
+	result, err := db.Exec("DELETE FROM quota_reservations WHERE expires_at <= NOW()")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -1,28 +1,62 @@
 package middleware
 
 import (
+	"go_backend_legalForce/auth"
 	"net/http"
-	"os"
-
-	"github.com/dgrijalva/jwt-go"
+	"strings"
 )
 
+// AuthMiddleware authenticates the request from the Authorization header, which
+// holds either a JWT access token or a personal API key. JWTs on the denylist are
+// rejected. The resolved user is stored in the request context, together with the
+// token claims or the API key that was used.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
+		tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 		if tokenString == "" {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte(os.Getenv("JWT_SECRET_KEY")), nil
-		})
-		if err != nil || !token.Valid {
+		if strings.HasPrefix(tokenString, auth.APIKeyPrefix) {
+			user, key, err := auth.AuthenticateAPIKey(tokenString)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if user.Disabled {
+				http.Error(w, "Account disabled", http.StatusForbidden)
+				return
+			}
+
+			ctx := auth.WithAPIKey(auth.WithUser(r.Context(), user), key)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		claims, err := auth.ParseToken(tokenString)
+		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		denied, err := auth.IsTokenDenied(claims.ID)
+		if err != nil || denied {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		user, err := auth.GetUserByID(claims.UserID)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if user.Disabled {
+			http.Error(w, "Account disabled", http.StatusForbidden)
+			return
+		}
+
+		ctx := auth.WithClaims(auth.WithUser(r.Context(), user), claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
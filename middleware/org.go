@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"database/sql"
+	"go_backend_legalForce/auth"
+	"net/http"
+	"strconv"
+)
+
+// OrgHeader selects the organization a request acts in. Without it, file endpoints
+// work on the user's personal files.
+const OrgHeader = "X-Org-ID"
+
+// OrgScope resolves the organization named by the X-Org-ID header and stores the
+// user's membership in the request context. Users who are not members are refused.
+// It must be registered after AuthMiddleware.
+func OrgScope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get(OrgHeader)
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, ok := auth.UserFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		orgID, err := strconv.Atoi(header)
+		if err != nil || orgID <= 0 {
+			http.Error(w, "Invalid "+OrgHeader+" header", http.StatusBadRequest)
+			return
+		}
+
+		membership, err := auth.GetMembership(orgID, user.ID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not a member of this organization", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to look up membership", http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(auth.WithMembership(r.Context(), membership)))
+	})
+}
@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"go_backend_legalForce/auth"
+	"net/http"
+)
+
+// RequireScope limits requests authenticated with an API key to keys that were
+// granted scope. Requests from a login session are always allowed through.
+// It must be registered after AuthMiddleware.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key, ok := auth.APIKeyFromContext(r.Context()); ok && !key.HasScope(scope) {
+				http.Error(w, "API key lacks the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SessionOnly rejects requests authenticated with an API key, for endpoints such as
+// key management and MFA that need an interactive login.
+// It must be registered after AuthMiddleware.
+func SessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := auth.APIKeyFromContext(r.Context()); ok {
+			http.Error(w, "This endpoint requires a login session", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"go_backend_legalForce/auth"
+	"net/http"
+)
+
+// RequireVerifiedEmail blocks users who have not verified their email address.
+// It must be registered after AuthMiddleware.
+func RequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := auth.UserFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !user.EmailVerified {
+			http.Error(w, "Email not verified", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Scopes an API key can be granted. Sessions from a password login have all of them.
+const (
+	ScopeRead   = "read"
+	ScopeUpload = "upload"
+	ScopeShare  = "share"
+	ScopeDelete = "delete"
+)
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Label      string     `json:"label"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// HasScope reports whether the key was granted scope
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -2,16 +2,149 @@ package models
 
 import "time"
 
+// Scan statuses of stored contents. Only clean contents are served.
+const (
+	ScanPending  = "pending"  // not scanned yet
+	ScanClean    = "clean"    // no malware found
+	ScanInfected = "infected" // malware found, the contents are quarantined
+	ScanError    = "error"    // the scanner failed, the scan is retried
+)
+
 type File struct {
-	ID          int       `json:"id"`
-	UserID      int       `json:"user_id"`
-	FileName    string    `json:"file_name"`
-	UploadDate  time.Time `json:"upload_date"`
-	Size        int64     `json:"size"`
-	LocalPath   string    `json:"local_path"`      
-	FileType    string    `json:"file_type"`      
-	S3URL       string    `json:"s3_url"`          
-	Description string    `json:"description"`     
-	IsShared    bool      `json:"is_shared"`       
-	Expiration  time.Time `json:"expiration_date"` 
+	ID           int        `json:"id"`
+	UserID       int        `json:"user_id"`
+	OrgID        int        `json:"org_id,omitempty"` // 0 for files in the uploader's personal space
+	FileName     string     `json:"file_name"`        // display name, sanitized and editable
+	OriginalName string     `json:"original_name"`    // name the file was uploaded with
+	StorageKey   string     `json:"-"`                // key of the contents in the storage backend
+	UploadDate   time.Time  `json:"upload_date"`
+	Size         int64      `json:"size"`
+	LocalPath    string     `json:"local_path"`  // download endpoint of the file
+	FileType     string     `json:"file_type"`   // extension of the file name
+	MimeType     string     `json:"mime_type"`   // detected from the contents, empty for files stored before detection
+	ScanStatus   string     `json:"scan_status"` // malware scan of the contents, one of the Scan constants
+	S3URL        string     `json:"s3_url"`
+	Description  string     `json:"description"`
+	IsShared     bool       `json:"is_shared"`
+	Expiration   *time.Time `json:"expiration_date"`      // nil for files that do not expire
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"` // set while the file is in the trash
+	FolderID     int        `json:"folder_id,omitempty"`  // 0 for files at the top of the tree
+	SHA256       string     `json:"sha256,omitempty"`     // SHA-256 of the contents, returned when they are stored
+}
+
+// FileVersion is one uploaded revision of a file's contents
+type FileVersion struct {
+	Version      int       `json:"version"`
+	UploadedBy   int       `json:"uploaded_by"` // 0 once the uploader's account is deleted
+	StorageKey   string    `json:"-"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
+	MimeType     string    `json:"mime_type"`
+	ScanStatus   string    `json:"scan_status"`
+	OriginalName string    `json:"original_name"`
+	CreatedAt    time.Time `json:"created_at"`
+	Current      bool      `json:"current"`
+}
+
+// Folder holds files and other folders. Path is its materialized path, the ids
+// of the folders from the top of the tree down to this one, like /1/5/12/.
+type Folder struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"` // who created it
+	OrgID     int       `json:"org_id,omitempty"`
+	ParentID  int       `json:"parent_id,omitempty"` // 0 at the top of the tree
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ContentPolicy lists the content types a tenant accepts in uploads, as MIME types
+// like application/pdf or wildcards like image/*. Denied types are refused even
+// when allowed; an empty allow list accepts every type that is not denied.
+type ContentPolicy struct {
+	AllowedTypes []string   `json:"allowed_types"`
+	DeniedTypes  []string   `json:"denied_types"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"` // nil until a policy is set
+}
+
+// ExpiryPolicy bounds how long a tenant's files are kept, as durations like
+// "720h". Files uploaded without an expiry get DefaultTTL; none may be kept longer
+// than MaxTTL. Empty durations set no default and no limit.
+type ExpiryPolicy struct {
+	DefaultTTL string     `json:"default_ttl"`
+	MaxTTL     string     `json:"max_ttl"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"` // nil until a policy is set
+}
+
+// Quota holds the limits set for a tenant by an administrator. Nil limits fall
+// back to the defaults; 0 is unlimited.
+type Quota struct {
+	MaxBytes  *int64     `json:"max_bytes"`
+	MaxFiles  *int64     `json:"max_files"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"` // nil until limits are set
+	Usage     Usage      `json:"usage"`
+}
+
+// Usage is the storage a tenant takes up and the limits that apply to it. Bytes
+// counts every version of its files, trashed ones included. Limits of 0 are
+// unlimited.
+type Usage struct {
+	Bytes    int64       `json:"bytes"`
+	Files    int64       `json:"files"`
+	MaxBytes int64       `json:"max_bytes"`
+	MaxFiles int64       `json:"max_files"`
+	ByType   []TypeUsage `json:"by_type,omitempty"`
+}
+
+// TypeUsage is the part of a tenant's usage taken by files of one content type.
+// MimeType is empty for files stored before types were detected.
+type TypeUsage struct {
+	MimeType string `json:"mime_type"`
+	Bytes    int64  `json:"bytes"`
+	Files    int64  `json:"files"`
+}
+
+// ShareLink gives anyone holding its token access to a file, within its limits.
+// Only a hash of the token is kept, so Token and URL are only set when the link
+// is created.
+type ShareLink struct {
+	ID            int        `json:"id"`
+	FileID        int        `json:"file_id"`
+	FileName      string     `json:"file_name,omitempty"`
+	CreatedBy     int        `json:"created_by"` // 0 once the creator's account is deleted
+	Token         string     `json:"token,omitempty"`
+	URL           string     `json:"url,omitempty"`
+	TokenPrefix   string     `json:"token_prefix"` // first characters of the token, to tell links apart
+	HasPassword   bool       `json:"has_password"`
+	ExpiresAt     *time.Time `json:"expires_at"`    // nil for links that do not expire
+	MaxDownloads  int        `json:"max_downloads"` // 0 for no limit
+	DownloadCount int        `json:"download_count"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Roles of grants, from the least to the most access. Each role can do what the
+// roles before it can.
+const (
+	GrantViewer    = "viewer"    // lists, searches and downloads
+	GrantCommenter = "commenter" // the access of a viewer, for reviewers
+	GrantEditor    = "editor"    // also renames files and changes their descriptions
+	GrantCoOwner   = "co-owner"  // also deletes files and manages grants
+)
+
+// GrantRoles are the roles of grants in increasing order of access
+var GrantRoles = []string{GrantViewer, GrantCommenter, GrantEditor, GrantCoOwner}
+
+// Grant gives a user, or the members of an organization, access to a file or a
+// folder and everything below it. Exactly one of FileID and FolderID is set, and
+// one of UserID and OrgID.
+type Grant struct {
+	ID        int       `json:"id"`
+	FileID    int       `json:"file_id,omitempty"`
+	FolderID  int       `json:"folder_id,omitempty"`
+	UserID    int       `json:"user_id,omitempty"` // the user granted access
+	Email     string    `json:"email,omitempty"`   // of the user granted access
+	OrgID     int       `json:"org_id,omitempty"`  // the organization granted access
+	Role      string    `json:"role"`
+	GrantedBy int       `json:"granted_by"` // 0 once the granting account is deleted
+	CreatedAt time.Time `json:"created_at"`
 }
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// Roles a user can hold within an organization
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+type Organization struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role,omitempty"` // the requesting user's role
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Membership is a user's role in one organization
+type Membership struct {
+	OrgID  int    `json:"org_id"`
+	UserID int    `json:"user_id"`
+	Email  string `json:"email,omitempty"`
+	Role   string `json:"role"`
+}
+
+type Invitation struct {
+	ID        int       `json:"id"`
+	OrgID     int       `json:"org_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy int       `json:"invited_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,126 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// chunkSize is the size of the chunks contents are streamed to clamd in
+const chunkSize = 64 << 10
+
+// Clamd scans contents with a ClamAV daemon using the INSTREAM command of its
+// protocol, over TCP or a unix socket
+type Clamd struct {
+	Network string // "tcp" or "unix"
+	Address string // host:port, or the path of the socket
+	Timeout time.Duration
+}
+
+// NewClamd returns a Clamd for an address like tcp://host:port or
+// unix:///path/to/socket
+func NewClamd(address string) (*Clamd, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid clamd address %q: %v", address, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid clamd address %q: missing host", address)
+		}
+		return &Clamd{Network: "tcp", Address: u.Host, Timeout: time.Minute}, nil
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid clamd address %q: missing socket path", address)
+		}
+		return &Clamd{Network: "unix", Address: u.Path, Timeout: time.Minute}, nil
+	default:
+		return nil, fmt.Errorf("invalid clamd address %q: scheme must be tcp or unix", address)
+	}
+}
+
+// Scan streams r to clamd in length-prefixed chunks, ended by an empty chunk, and
+// reads its verdict
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	dialer := net.Dialer{Timeout: c.Timeout}
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return Result{}, fmt.Errorf("clamd: %v", err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if c.Timeout > 0 && (!ok || time.Until(deadline) > c.Timeout) {
+		deadline = time.Now().Add(c.Timeout)
+	}
+	conn.SetDeadline(deadline)
+
+	// clamd stops reading when the stream is over its size limit and answers right
+	// away, so a failed write is followed by reading the reply. Contents that could
+	// not be read completely get no verdict.
+	sendErr := sendStream(conn, r)
+	if sendErr != nil && !errors.Is(sendErr, errWrite) {
+		return Result{}, sendErr
+	}
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		if sendErr != nil {
+			return Result{}, fmt.Errorf("clamd: %v", sendErr)
+		}
+		return Result{}, fmt.Errorf("clamd: reading reply: %v", err)
+	}
+	return parseReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+var errWrite = errors.New("writing to clamd")
+
+// sendStream sends the INSTREAM command followed by the contents of r
+func sendStream(conn net.Conn, r io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return fmt.Errorf("%w: %v", errWrite, err)
+	}
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return fmt.Errorf("%w: %v", errWrite, err)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("reading contents to scan: %v", readErr)
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return fmt.Errorf("%w: %v", errWrite, err)
+	}
+	return nil
+}
+
+// parseReply reads a reply like "stream: OK", "stream: Eicar-Signature FOUND" or
+// "INSTREAM size limit exceeded. ERROR"
+func parseReply(reply string) (Result, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return Result{}, fmt.Errorf("clamd: %s", strings.TrimSuffix(reply, " ERROR"))
+	default:
+		return Result{}, fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+}
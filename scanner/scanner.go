@@ -0,0 +1,41 @@
+package scanner
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Result is the verdict of a scan
+type Result struct {
+	Infected  bool
+	Signature string // name of the malware found, empty when clean
+}
+
+// Scanner scans contents for malware
+type Scanner interface {
+	// Scan reads r to the end and reports whether it holds malware. An error
+	// means no verdict could be reached.
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// NewScannerFromEnv returns a Clamd scanner for the daemon at CLAMD_ADDRESS, like
+// tcp://localhost:3310 or unix:///var/run/clamav/clamd.ctl, waiting at most
+// CLAMD_TIMEOUT_SECONDS (default 60) for a verdict. It returns nil when
+// CLAMD_ADDRESS is not set.
+func NewScannerFromEnv() (Scanner, error) {
+	address := os.Getenv("CLAMD_ADDRESS")
+	if address == "" {
+		return nil, nil
+	}
+	clamd, err := NewClamd(address)
+	if err != nil {
+		return nil, err
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("CLAMD_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		clamd.Timeout = time.Duration(seconds) * time.Second
+	}
+	return clamd, nil
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ObjectReader reads a stored object and can seek within it, fetching only the
+// bytes that are read. It lets http.ServeContent answer range requests.
+type ObjectReader struct {
+	ctx     context.Context
+	backend Backend
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser // open stream positioned at offset, if any
+}
+
+// Open returns a reader of the object stored under key along with its description
+func Open(ctx context.Context, b Backend, key string) (*ObjectReader, Object, error) {
+	obj, err := b.Stat(ctx, key)
+	if err != nil {
+		return nil, Object{}, err
+	}
+	return &ObjectReader{ctx: ctx, backend: b, key: key, size: obj.Size}, obj, nil
+}
+
+// Read implements io.Reader
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, _, err := r.backend.Get(r.ctx, r.key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker. The next Read starts a new request unless the
+// position is unchanged.
+func (r *ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("storage: seek before start of object")
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close releases the open stream, if any
+func (r *ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,524 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Backend keeps objects in a bucket of an S3-compatible service such as AWS S3
+// or MinIO. Requests are signed with AWS Signature Version 4.
+type S3Backend struct {
+	// Endpoint is the service URL, e.g. http://localhost:9000 for a local MinIO.
+	// Defaults to the AWS endpoint of Region.
+	Endpoint        string
+	Region          string // defaults to us-east-1
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// PathStyle addresses the bucket as the first path segment instead of a
+	// subdomain, as MinIO and most other S3-compatible services expect
+	PathStyle bool
+
+	// PartSize is how much of an upload of unknown size is buffered per
+	// request. Defaults to 8 MB; S3 requires at least 5 MB.
+	PartSize int64
+
+	Client *http.Client
+}
+
+const (
+	s3DefaultPartSize  = 8 << 20
+	s3MaxSinglePut     = 5 << 30 // the largest object a single PUT may create
+	s3MaxPresignExpiry = 7 * 24 * time.Hour
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+)
+
+// s3Error is the error document returned by S3
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// s3RequestError is a request S3 refused
+type s3RequestError struct {
+	Method string
+	Key    string
+	s3Error
+}
+
+func (e *s3RequestError) Error() string {
+	return fmt.Sprintf("storage: s3 %s %q: %s %s", e.Method, e.Key, e.Code, e.Message)
+}
+
+func (b *S3Backend) region() string {
+	if b.Region == "" {
+		return "us-east-1"
+	}
+	return b.Region
+}
+
+func (b *S3Backend) client() *http.Client {
+	if b.Client == nil {
+		return http.DefaultClient
+	}
+	return b.Client
+}
+
+// objectURL returns the URL of key, or of the bucket when key is empty
+func (b *S3Backend) objectURL(key string, query url.Values) (*url.URL, error) {
+	endpoint := b.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + b.region() + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	p := "/"
+	if b.PathStyle {
+		p += b.Bucket
+		if key != "" {
+			p += "/"
+		}
+	} else {
+		u.Host = b.Bucket + "." + u.Host
+	}
+	u.Path = p + key
+	u.RawPath = uriEncode(p, false) + uriEncode(key, false)
+	u.RawQuery = canonicalQuery(query)
+	return u, nil
+}
+
+// do sends a signed request and returns the response if its status is 2xx. A
+// missing key is reported as ErrNotFound, other failures by the S3 error code.
+func (b *S3Backend) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64, payloadHash string, header http.Header) (*http.Response, error) {
+	u, err := b.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	b.sign(req, payloadHash, time.Now())
+
+	resp, err := b.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var s3Err s3Error
+	xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&s3Err)
+	if resp.StatusCode == http.StatusNotFound && (s3Err.Code == "NoSuchKey" || (method == "HEAD" && key != "")) {
+		return nil, ErrNotFound
+	}
+	if s3Err.Code == "" {
+		s3Err.Code = resp.Status
+	}
+	return nil, &s3RequestError{Method: method, Key: key, s3Error: s3Err}
+}
+
+// Put implements Backend. Objects of known size are streamed in a single
+// request; others are sent as a multipart upload, PartSize bytes at a time.
+func (b *S3Backend) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	// A failed read aborts the request; report it instead of the transport error
+	src := &errReader{r: r}
+
+	if size >= 0 && size <= s3MaxSinglePut {
+		resp, err := b.do(ctx, "PUT", key, nil, src, size, s3UnsignedPayload, header)
+		if src.err != nil {
+			return src.err
+		}
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	partSize := b.PartSize
+	if partSize <= 0 {
+		partSize = s3DefaultPartSize
+	}
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(src, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Small enough for one request after all
+		return b.putBytes(ctx, key, buf[:n], header)
+	}
+	if err != nil {
+		return err
+	}
+	return b.putMultipart(ctx, key, src, buf, header)
+}
+
+func (b *S3Backend) putBytes(ctx context.Context, key string, data []byte, header http.Header) error {
+	resp, err := b.do(ctx, "PUT", key, nil, bytes.NewReader(data), int64(len(data)), sha256Hex(data), header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// putMultipart uploads buf, which is already full, followed by the rest of src
+func (b *S3Backend) putMultipart(ctx context.Context, key string, src io.Reader, buf []byte, header http.Header) error {
+	resp, err := b.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil, 0, sha256Hex(nil), header)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	parts, err := b.uploadParts(ctx, key, initiated.UploadID, src, buf)
+	if err == nil {
+		err = b.completeMultipart(ctx, key, initiated.UploadID, parts)
+	}
+	if err != nil {
+		// Free the parts stored so far; the error that matters is err
+		if resp, abortErr := b.do(ctx, "DELETE", key, url.Values{"uploadId": {initiated.UploadID}}, nil, 0, sha256Hex(nil), nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (b *S3Backend) uploadParts(ctx context.Context, key, uploadID string, src io.Reader, buf []byte) ([]completedPart, error) {
+	var parts []completedPart
+	n := len(buf)
+	for n > 0 {
+		query := url.Values{"partNumber": {strconv.Itoa(len(parts) + 1)}, "uploadId": {uploadID}}
+		resp, err := b.do(ctx, "PUT", key, query, bytes.NewReader(buf[:n]), int64(n), sha256Hex(buf[:n]), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: len(parts) + 1, ETag: resp.Header.Get("ETag")})
+
+		n, err = io.ReadFull(src, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+func (b *S3Backend) completeMultipart(ctx context.Context, key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(ctx, "POST", key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body), int64(len(body)), sha256Hex(body), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 may report a failed completion in the body of a 200 response
+	var result struct {
+		XMLName xml.Name
+		s3Error
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("storage: s3 complete upload %q: %s %s", key, result.Code, result.Message)
+	}
+	return nil
+}
+
+// Get implements Backend
+func (b *S3Backend) Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, Object, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, Object{}, err
+	}
+	if length == 0 {
+		obj, err := b.Stat(ctx, key)
+		return io.NopCloser(strings.NewReader("")), obj, err
+	}
+
+	header := http.Header{}
+	if offset > 0 || length > 0 {
+		rng := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+		if length > 0 {
+			rng += strconv.FormatInt(offset+length-1, 10)
+		}
+		header.Set("Range", rng)
+	}
+
+	resp, err := b.do(ctx, "GET", key, nil, nil, 0, s3UnsignedPayload, header)
+	if err != nil {
+		// Reading past the end yields nothing, as it does from a file
+		var reqErr *s3RequestError
+		if errors.As(err, &reqErr) && reqErr.Code == "InvalidRange" {
+			obj, err := b.Stat(ctx, key)
+			return io.NopCloser(strings.NewReader("")), obj, err
+		}
+		return nil, Object{}, err
+	}
+
+	obj := s3Object(key, resp.Header)
+	obj.Size = resp.ContentLength
+	// A partial response carries the full size in Content-Range: bytes a-b/size
+	if cr := resp.Header.Get("Content-Range"); cr != "" {
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			obj.Size, _ = strconv.ParseInt(cr[i+1:], 10, 64)
+		}
+	}
+	return resp.Body, obj, nil
+}
+
+// Delete implements Backend
+func (b *S3Backend) Delete(ctx context.Context, key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(ctx, "DELETE", key, nil, nil, 0, sha256Hex(nil), nil)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Stat implements Backend
+func (b *S3Backend) Stat(ctx context.Context, key string) (Object, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return Object{}, err
+	}
+	resp, err := b.do(ctx, "HEAD", key, nil, nil, 0, sha256Hex(nil), nil)
+	if err != nil {
+		return Object{}, err
+	}
+	resp.Body.Close()
+	obj := s3Object(key, resp.Header)
+	obj.Size = resp.ContentLength
+	return obj, nil
+}
+
+// List implements Backend
+func (b *S3Backend) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects := []Object{}
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := b.do(ctx, "GET", "", query, nil, 0, sha256Hex(nil), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			Contents              []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+				ETag         string    `xml:"ETag"`
+				Size         int64     `xml:"Size"`
+			} `xml:"Contents"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range page.Contents {
+			objects = append(objects, Object{Key: c.Key, Size: c.Size, ModTime: c.LastModified, ETag: c.ETag})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// PresignGet implements Backend. S3 accepts expiries of up to 7 days.
+func (b *S3Backend) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	if expiry > s3MaxPresignExpiry {
+		expiry = s3MaxPresignExpiry
+	}
+	if expiry < time.Second {
+		expiry = time.Second
+	}
+	return b.presign(key, expiry, time.Now())
+}
+
+func (b *S3Backend) presign(key string, expiry time.Duration, now time.Time) (string, error) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := b.credentialScope(amzDate[:8])
+	u, err := b.objectURL(key, url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {b.AccessKeyID + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	canonical := strings.Join([]string{"GET", u.EscapedPath(), u.RawQuery, "host:" + u.Host + "\n", "host", s3UnsignedPayload}, "\n")
+	u.RawQuery += "&X-Amz-Signature=" + b.signature(amzDate, scope, canonical)
+	return u.String(), nil
+}
+
+// sign adds the Signature Version 4 Authorization header to req
+func (b *S3Backend) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+
+	scope := b.credentialScope(amzDate[:8])
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+b.signature(amzDate, scope, canonical))
+}
+
+func (b *S3Backend) credentialScope(date string) string {
+	return date + "/" + b.region() + "/s3/aws4_request"
+}
+
+// signature signs a canonical request with the key derived for the scope's day
+func (b *S3Backend) signature(amzDate, scope, canonicalRequest string) string {
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + b.SecretAccessKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// uriEncode escapes everything but unreserved characters, as Signature Version 4
+// requires. Slashes are kept when encoding a path.
+func uriEncode(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// canonicalQuery encodes query sorted by name, the form it is signed in
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3Object(key string, header http.Header) Object {
+	obj := Object{Key: key, ETag: header.Get("ETag")}
+	obj.ModTime, _ = http.ParseTime(header.Get("Last-Modified"))
+	return obj
+}
+
+// errReader remembers the first error, other than EOF, returned by r
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
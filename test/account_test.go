@@ -0,0 +1,265 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/middleware"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+type sentMail struct {
+	to, subject, body string
+}
+
+// recordingMailer keeps every message instead of delivering it
+type recordingMailer struct {
+	sent []sentMail
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.sent = append(m.sent, sentMail{to, subject, body})
+	return nil
+}
+
+// mailedToken extracts the token line from a verification or reset email
+func mailedToken(t *testing.T, body string) string {
+	t.Helper()
+	for _, line := range strings.Split(body, "\n") {
+		if len(line) == 43 && !strings.Contains(line, " ") {
+			return line
+		}
+	}
+	t.Fatalf("No token in mail body: %q", body)
+	return ""
+}
+
+func useMailer(t *testing.T) *recordingMailer {
+	t.Helper()
+	m := &recordingMailer{}
+	auth.SetMailer(m)
+	t.Cleanup(func() { auth.SetMailer(nil) })
+	return m
+}
+
+func jsonBody(v interface{}) *bytes.Reader {
+	data, _ := json.Marshal(v)
+	return bytes.NewReader(data)
+}
+
+func TestRegisterRejectsInvalidEmail(t *testing.T) {
+	log.Println("--- Starting TestRegisterRejectsInvalidEmail ---")
+	for _, email := range []string{"", "not-an-email", "Name <a@example.com>", "a@localhost"} {
+		rr := httptest.NewRecorder()
+		auth.RegisterUser(rr, httptest.NewRequest("POST", "/register",
+			jsonBody(map[string]string{"email": email, "password": "secure_password"})))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Email %q: got status %v, want %v", email, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRegisterSendsVerificationEmail(t *testing.T) {
+	log.Println("--- Starting TestRegisterSendsVerificationEmail ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+	mailer := useMailer(t)
+
+	mock.ExpectQuery("INSERT INTO users \\(email, password\\) VALUES \\(\\$1, \\$2\\) RETURNING id").
+		WithArgs("new@example.com", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec("INSERT INTO user_tokens").
+		WithArgs(7, "verify_email", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rr := httptest.NewRecorder()
+	auth.RegisterUser(rr, httptest.NewRequest("POST", "/register",
+		jsonBody(map[string]string{"email": "new@example.com", "password": "secure_password"})))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusCreated)
+	}
+
+	if len(mailer.sent) != 1 || mailer.sent[0].to != "new@example.com" {
+		t.Fatalf("Expected one verification mail to new@example.com, got %+v", mailer.sent)
+	}
+	mailedToken(t, mailer.sent[0].body)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	log.Println("--- Starting TestVerifyEmail ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET used_at = NOW\\(\\)").
+		WithArgs(sqlmock.AnyArg(), "verify_email").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(7))
+	mock.ExpectExec("UPDATE users SET email_verified = TRUE WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	auth.VerifyEmail(rr, httptest.NewRequest("POST", "/verify-email", jsonBody(map[string]string{"token": "abc"})))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	// A used or expired token matches no row
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET used_at = NOW\\(\\)").
+		WithArgs(sqlmock.AnyArg(), "verify_email").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	mock.ExpectRollback()
+
+	rr = httptest.NewRecorder()
+	auth.VerifyEmail(rr, httptest.NewRequest("POST", "/verify-email", jsonBody(map[string]string{"token": "abc"})))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Reused token returned wrong status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestForgotPasswordDoesNotRevealAccounts(t *testing.T) {
+	log.Println("--- Starting TestForgotPasswordDoesNotRevealAccounts ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+	mailer := useMailer(t)
+
+	mock.ExpectQuery("SELECT id FROM users WHERE email = \\$1").
+		WithArgs("a@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(userA.ID))
+	mock.ExpectExec("INSERT INTO user_tokens").
+		WithArgs(userA.ID, "password_reset", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT id FROM users WHERE email = \\$1").
+		WithArgs("nobody@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	var bodies []string
+	for _, email := range []string{"a@example.com", "nobody@example.com"} {
+		rr := httptest.NewRecorder()
+		auth.ForgotPassword(rr, httptest.NewRequest("POST", "/password/forgot", jsonBody(map[string]string{"email": email})))
+		if rr.Code != http.StatusOK {
+			t.Errorf("Email %q: got status %v, want %v", email, rr.Code, http.StatusOK)
+		}
+		bodies = append(bodies, rr.Body.String())
+	}
+	if bodies[0] != bodies[1] {
+		t.Errorf("Responses differ for existing and unknown accounts: %q vs %q", bodies[0], bodies[1])
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].to != "a@example.com" {
+		t.Errorf("Expected exactly one reset mail to a@example.com, got %+v", mailer.sent)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	log.Println("--- Starting TestResetPassword ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+
+	rr := httptest.NewRecorder()
+	auth.ResetPassword(rr, httptest.NewRequest("POST", "/password/reset",
+		jsonBody(map[string]string{"token": "abc", "password": "short"})))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Short password returned wrong status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET used_at = NOW\\(\\)").
+		WithArgs(sqlmock.AnyArg(), "password_reset").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(userA.ID))
+	mock.ExpectExec("UPDATE users SET password = \\$1, email_verified = TRUE WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), userA.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE user_tokens SET used_at = NOW\\(\\) WHERE user_id = \\$1").
+		WithArgs(userA.ID, "password_reset").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	rr = httptest.NewRecorder()
+	auth.ResetPassword(rr, httptest.NewRequest("POST", "/password/reset",
+		jsonBody(map[string]string{"token": "abc", "password": "a-new-password"})))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	log.Println("--- Starting TestRequireVerifiedEmail ---")
+	handler := middleware.RequireVerifiedEmail(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tc := range []struct {
+		verified bool
+		want     int
+	}{{true, http.StatusOK}, {false, http.StatusForbidden}} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, requestAs("POST", "/upload", models.User{ID: 1, EmailVerified: tc.verified}))
+		if rr.Code != tc.want {
+			t.Errorf("verified=%v: got status %v, want %v", tc.verified, rr.Code, tc.want)
+		}
+	}
+}
+
+func TestOutboxMailer(t *testing.T) {
+	log.Println("--- Starting TestOutboxMailer ---")
+	dir := t.TempDir()
+	m := &auth.OutboxMailer{Dir: dir, From: "no-reply@example.com"}
+	if err := m.Send("a@example.com", "Hello", "Body text"); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one message in outbox, got %d", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	for _, want := range []string{"To: a@example.com", "Subject: Hello", "Body text"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Message missing %q: %s", want, data)
+		}
+	}
+}
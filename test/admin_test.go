@@ -0,0 +1,244 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/middleware"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestRequireRole(t *testing.T) {
+	log.Println("--- Starting TestRequireRole ---")
+	handler := middleware.RequireRole(models.RoleAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	admin := models.User{ID: 9, Email: "admin@example.com", Role: models.RoleAdmin}
+	member := models.User{ID: 1, Email: "a@example.com", Role: models.RoleMember}
+
+	for _, tc := range []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"admin", requestAs("GET", "/admin/users", admin), http.StatusOK},
+		{"member", requestAs("GET", "/admin/users", member), http.StatusForbidden},
+		{"anonymous", httptest.NewRequest("GET", "/admin/users", nil), http.StatusUnauthorized},
+	} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, tc.req)
+		if rr.Code != tc.want {
+			t.Errorf("%s: got status %v, want %v", tc.name, rr.Code, tc.want)
+		}
+	}
+}
+
+func TestListUsersPaginates(t *testing.T) {
+	log.Println("--- Starting TestListUsersPaginates ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM users").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery("SELECT id, email, role, disabled, email_verified, created_at FROM users ORDER BY id LIMIT \\$1 OFFSET \\$2").
+		WithArgs(2, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "disabled", "email_verified", "created_at"}).
+			AddRow(3, "c@example.com", models.RoleMember, false, true, time.Now()))
+
+	rr := httptest.NewRecorder()
+	auth.ListUsers(rr, httptest.NewRequest("GET", "/admin/users?page=2&per_page=2", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	var page auth.UserPage
+	if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if page.Total != 3 || page.Page != 2 || len(page.Users) != 1 || page.Users[0].ID != 3 {
+		t.Errorf("Unexpected page: %+v", page)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDisableUser(t *testing.T) {
+	log.Println("--- Starting TestDisableUser ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+
+	admin := models.User{ID: 9, Role: models.RoleAdmin}
+
+	mock.ExpectExec("UPDATE users SET disabled = \\$1 WHERE id = \\$2").
+		WithArgs(true, userA.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := httptest.NewRecorder()
+	auth.SetUserDisabled(rr, requestAs("POST", "/admin/users/1/disable", admin), userA.ID, true)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	// An admin cannot lock themselves out
+	rr = httptest.NewRecorder()
+	auth.SetUserDisabled(rr, requestAs("POST", "/admin/users/9/disable", admin), admin.ID, true)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Self-disable returned wrong status code: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDisabledUserIsRejected(t *testing.T) {
+	log.Println("--- Starting TestDisabledUserIsRejected ---")
+	t.Setenv("JWT_SECRET_KEY", "test-secret")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+
+	token, _, err := auth.GenerateToken(userA, "")
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	mock.ExpectQuery("SELECT id, email, role, disabled, email_verified FROM users WHERE id = \\$1").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "disabled", "email_verified"}).AddRow(userA.ID, userA.Email, models.RoleMember, true, true))
+
+	if code := callProtected(token); code != http.StatusForbidden {
+		t.Errorf("Disabled user got status %v, want %v", code, http.StatusForbidden)
+	}
+}
+
+// expectOrgFilesHandedOver expects the organization files and folders of a deleted
+// user to pass to another member, with none left behind
+func expectOrgFilesHandedOver(mock sqlmock.Sqlmock, userID int, orgIDs ...int) {
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM files WHERE user_id = \\$1 AND org_id IS NOT NULL AND \\(SELECT m.user_id FROM org_members m").
+		WithArgs(userID, models.OrgRoleOwner, models.OrgRoleAdmin).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE folders SET user_id = \\(SELECT m.user_id FROM org_members m WHERE m.org_id = folders.org_id AND m.user_id <> \\$1").
+		WithArgs(userID, models.OrgRoleOwner, models.OrgRoleAdmin).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"org_id"})
+	for _, orgID := range orgIDs {
+		rows.AddRow(orgID)
+	}
+	mock.ExpectQuery("UPDATE files SET user_id = \\(SELECT m.user_id FROM org_members m WHERE m.org_id = files.org_id AND m.user_id <> \\$1 .*\\) WHERE user_id = \\$1 AND org_id IS NOT NULL RETURNING org_id").
+		WithArgs(userID, models.OrgRoleOwner, models.OrgRoleAdmin).
+		WillReturnRows(rows)
+}
+
+func TestDeleteUser(t *testing.T) {
+	log.Println("--- Starting TestDeleteUser ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+
+	admin := models.User{ID: 9, Role: models.RoleAdmin}
+
+	mock.ExpectBegin()
+	expectOrgFilesHandedOver(mock, userA.ID)
+	mock.ExpectQuery("DELETE FROM files WHERE user_id = \\$1 AND org_id IS NULL RETURNING id, storage_key\\).*file_versions").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows(deletedFilesColumns).AddRow(1, "{missing.txt}"))
+	mock.ExpectQuery("DELETE FROM blobs WHERE storage_key = ANY").
+		WillReturnRows(sqlmock.NewRows([]string{"storage_key"}).AddRow("missing.txt"))
+	mock.ExpectExec("DELETE FROM users WHERE id = \\$1").
+		WithArgs(userA.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	auth.DeleteUser(rr, requestAs("DELETE", "/admin/users/1", admin), userA.ID)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteUserKeepsOrganizationFiles(t *testing.T) {
+	log.Println("--- Starting TestDeleteUserKeepsOrganizationFiles ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+	auth.SetDB(db, redisClient)
+	defer auth.SetDB(nil, nil)
+
+	admin := models.User{ID: 9, Role: models.RoleAdmin}
+	backend.Put(context.Background(), "org-brief.pdf", strings.NewReader("%PDF"), 4, "")
+	mr.Set("org_files:5", "[listing with the member's upload]")
+
+	// The member's upload to organization 5 passes to another member and is not deleted
+	mock.ExpectBegin()
+	expectOrgFilesHandedOver(mock, userB.ID, 5)
+	mock.ExpectQuery("DELETE FROM files WHERE user_id = \\$1 AND org_id IS NULL RETURNING id, storage_key").
+		WithArgs(userB.ID).
+		WillReturnRows(sqlmock.NewRows(deletedFilesColumns).AddRow(0, "{}"))
+	mock.ExpectExec("DELETE FROM users WHERE id = \\$1").
+		WithArgs(userB.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	rr := httptest.NewRecorder()
+	auth.DeleteUser(rr, requestAs("DELETE", "/admin/users/2", admin), userB.ID)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if _, err := backend.Stat(context.Background(), "org-brief.pdf"); err != nil {
+		t.Errorf("Organization file contents were removed: %v", err)
+	}
+	if mr.Exists("org_files:5") {
+		t.Error("Cached organization listing still shows the deleted uploader")
+	}
+
+	// Users whose organization has nobody left to take over its files are not deleted
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM files WHERE user_id = \\$1 AND org_id IS NOT NULL").
+		WithArgs(userB.ID, models.OrgRoleOwner, models.OrgRoleAdmin).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+	rr = httptest.NewRecorder()
+	auth.DeleteUser(rr, requestAs("DELETE", "/admin/users/2", admin), userB.ID)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Only member: got %v, want %v", rr.Code, http.StatusConflict)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,181 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/middleware"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func createAPIKey(t *testing.T, mock sqlmock.Sqlmock, scopes []string) string {
+	t.Helper()
+	mock.ExpectQuery("INSERT INTO api_keys \\(user_id, label, prefix, key_hash, scopes\\)").
+		WithArgs(userA.ID, "ci", sqlmock.AnyArg(), sqlmock.AnyArg(), strings.Join(scopes, ",")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(4, time.Now()))
+
+	req := httptest.NewRequest("POST", "/api-keys", jsonBody(map[string]interface{}{"label": "ci", "scopes": scopes}))
+	rr := httptest.NewRecorder()
+	auth.CreateAPIKey(rr, req.WithContext(auth.WithUser(req.Context(), userA)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("CreateAPIKey returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+
+	var created struct {
+		models.APIKey
+		Key string `json:"key"`
+	}
+	json.NewDecoder(rr.Body).Decode(&created)
+	if !strings.HasPrefix(created.Key, auth.APIKeyPrefix+created.Prefix+"_") {
+		t.Fatalf("Key %q does not start with its prefix %q", created.Key, created.Prefix)
+	}
+	return created.Key
+}
+
+func TestCreateAPIKeyValidatesScopes(t *testing.T) {
+	log.Println("--- Starting TestCreateAPIKeyValidatesScopes ---")
+	for _, scopes := range [][]string{nil, {"admin"}} {
+		req := httptest.NewRequest("POST", "/api-keys", jsonBody(map[string]interface{}{"label": "ci", "scopes": scopes}))
+		rr := httptest.NewRecorder()
+		auth.CreateAPIKey(rr, req.WithContext(auth.WithUser(req.Context(), userA)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Scopes %v: got status %v, want %v", scopes, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	log.Println("--- Starting TestAPIKeyAuthentication ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+
+	key := createAPIKey(t, mock, []string{models.ScopeRead})
+	prefix := strings.SplitN(strings.TrimPrefix(key, auth.APIKeyPrefix), "_", 2)[0]
+
+	// The lookup returns the hash that was stored when the key was created
+	expectKeyLookup := func(hash string) {
+		mock.ExpectQuery("SELECT id, user_id, label, prefix, key_hash, scopes FROM api_keys WHERE prefix = \\$1 AND revoked_at IS NULL").
+			WithArgs(prefix).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "label", "prefix", "key_hash", "scopes"}).
+				AddRow(4, userA.ID, "ci", prefix, hash, models.ScopeRead))
+	}
+
+	var gotUser models.User
+	var gotKey models.APIKey
+	handler := middleware.AuthMiddleware(middleware.RequireScope(models.ScopeRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, _ = auth.UserFromContext(r.Context())
+		gotKey, _ = auth.APIKeyFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})))
+	call := func(h http.Handler, rawKey string) int {
+		req := httptest.NewRequest("GET", "/files", nil)
+		req.Header.Set("Authorization", "Bearer "+rawKey)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	expectKeyLookup(sha256Hex(key))
+	expectUserLookup(mock)
+	mock.ExpectExec("UPDATE api_keys SET last_used_at = \\$1 WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), 4, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if code := call(handler, key); code != http.StatusOK {
+		t.Fatalf("Valid key returned %v, want %v", code, http.StatusOK)
+	}
+	if gotUser.ID != userA.ID || gotKey.ID != 4 || gotKey.LastUsedAt == nil {
+		t.Errorf("Unexpected context: user %+v, key %+v", gotUser, gotKey)
+	}
+
+	// Same prefix, wrong secret
+	expectKeyLookup(sha256Hex(key))
+	if code := call(handler, key[:len(key)-1]+"x"); code != http.StatusUnauthorized {
+		t.Errorf("Tampered key returned %v, want %v", code, http.StatusUnauthorized)
+	}
+
+	// A read-only key cannot upload
+	expectKeyLookup(sha256Hex(key))
+	expectUserLookup(mock)
+	mock.ExpectExec("UPDATE api_keys SET last_used_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	upload := middleware.AuthMiddleware(middleware.RequireScope(models.ScopeUpload)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	if code := call(upload, key); code != http.StatusForbidden {
+		t.Errorf("Read-only key on upload returned %v, want %v", code, http.StatusForbidden)
+	}
+
+	// Revoked keys are filtered out by the lookup
+	mock.ExpectQuery("SELECT id, user_id, label, prefix, key_hash, scopes FROM api_keys").
+		WithArgs(prefix).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "label", "prefix", "key_hash", "scopes"}))
+	if code := call(handler, key); code != http.StatusUnauthorized {
+		t.Errorf("Revoked key returned %v, want %v", code, http.StatusUnauthorized)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSessionOnlyRejectsAPIKeys(t *testing.T) {
+	log.Println("--- Starting TestSessionOnlyRejectsAPIKeys ---")
+	handler := middleware.SessionOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := requestAs("POST", "/api-keys", userA)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Session request returned %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	req = req.WithContext(auth.WithAPIKey(req.Context(), models.APIKey{ID: 4, Scopes: []string{models.ScopeRead}}))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("API key request returned %v, want %v", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestRevokeAPIKeyScopedToOwner(t *testing.T) {
+	log.Println("--- Starting TestRevokeAPIKeyScopedToOwner ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+
+	mock.ExpectExec("UPDATE api_keys SET revoked_at = NOW\\(\\) WHERE id = \\$1 AND user_id = \\$2").
+		WithArgs(4, userB.ID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rr := httptest.NewRecorder()
+	auth.RevokeAPIKey(rr, requestAs("DELETE", "/api-keys/4", userB), 4)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Revoking another user's key returned %v, want %v", rr.Code, http.StatusNotFound)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,81 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/storage"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// deletedFilesColumns is what job.DeleteFiles reads: the number of deleted files and
+// the storage keys of the blobs left without references
+var deletedFilesColumns = []string{"deleted", "unreferenced"}
+
+// expectNewBlob expects the metadata transaction of an upload to begin and its
+// contents to be stored as a new blob
+func expectNewBlob(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO blobs \\(storage_key, sha256, size\\) VALUES \\(\\$1, \\$2, \\$3\\) ON CONFLICT DO NOTHING").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestUploadDeduplicatesContents(t *testing.T) {
+	log.Println("--- Starting TestUploadDeduplicatesContents ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	content := "%PDF-1.4 exhibit A"
+	backend.Put(context.Background(), "first.pdf", strings.NewReader(content), int64(len(content)), "")
+
+	// The contents were uploaded before, so the file references the existing blob
+	var key string
+	expectNoContentPolicy(mock)
+	expectNoExpiryPolicy(mock)
+	expectNoQuota(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO blobs").
+		WithArgs(captureArg{&key}, sha256Hex(content), int64(len(content))).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("UPDATE blobs SET ref_count = ref_count \\+ 1").
+		WithArgs(sqlmock.AnyArg(), sha256Hex(content)).
+		WillReturnRows(sqlmock.NewRows([]string{"storage_key"}).AddRow("first.pdf"))
+	mock.ExpectQuery("INSERT INTO files .* RETURNING id").
+		WithArgs(userA.ID, "copy.pdf", sqlmock.AnyArg(), int64(len(content)),
+			".pdf", "", "", false, sqlmock.AnyArg(), nil, "copy.pdf", "first.pdf", sha256Hex(content), nil, "application/pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(21))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	fileupload.UploadFile(rr, multipartUpload(t, map[string][]byte{"copy.pdf": []byte(content)}, []string{"copy.pdf"}), db, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Upload returned %v: %s", rr.Code, rr.Body.String())
+	}
+	results := decodeUploadResults(t, rr.Body)
+	if results[0].ID != 21 || results[0].SHA256 != sha256Hex(content) {
+		t.Errorf("Unexpected result: %+v", results[0])
+	}
+
+	// Only one copy of the contents is kept
+	if _, err := backend.Stat(context.Background(), key); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Duplicate contents kept under %q: %v", key, err)
+	}
+	if _, err := backend.Stat(context.Background(), "first.pdf"); err != nil {
+		t.Errorf("Existing contents removed: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
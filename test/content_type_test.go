@@ -0,0 +1,238 @@
+package test
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var contentPolicyColumns = []string{"allowed_types", "denied_types", "updated_at"}
+
+// expectNoContentPolicy expects the content policy of the tenant to be looked up
+// and none to be set
+func expectNoContentPolicy(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT allowed_types, denied_types, updated_at FROM content_policies WHERE").
+		WillReturnRows(sqlmock.NewRows(contentPolicyColumns))
+}
+
+// expectContentPolicy expects the content policy of the personal files of userA to
+// be looked up, with the lists given as PostgreSQL array literals
+func expectContentPolicy(mock sqlmock.Sqlmock, allowed, denied string) {
+	mock.ExpectQuery("SELECT allowed_types, denied_types, updated_at FROM content_policies WHERE user_id = \\$1 AND org_id IS NULL").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows(contentPolicyColumns).AddRow(allowed, denied, time.Now()))
+}
+
+func TestUploadRejectsMismatchedContent(t *testing.T) {
+	log.Println("--- Starting TestUploadRejectsMismatchedContent ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	files := map[string][]byte{
+		"exhibit.pdf": []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff"), // an executable
+		"notes.txt":   []byte("Call opposing counsel"),
+	}
+	expectNoContentPolicy(mock)
+	expectNoExpiryPolicy(mock)
+	expectNoQuota(mock)
+	expectNewBlob(mock)
+	mock.ExpectQuery("INSERT INTO files .* RETURNING id").
+		WithArgs(userA.ID, "notes.txt", sqlmock.AnyArg(), int64(len(files["notes.txt"])),
+			".txt", "", "", false, sqlmock.AnyArg(), nil, "notes.txt", sqlmock.AnyArg(), sqlmock.AnyArg(), nil, "text/plain").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(30))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	fileupload.UploadFile(rr, multipartUpload(t, files, []string{"exhibit.pdf", "notes.txt"}), db, nil)
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusUnsupportedMediaType)
+	}
+
+	// The executable is refused before it is stored, the next file is still stored
+	results := decodeUploadResults(t, rr.Body)
+	if len(results) != 2 || results[0].Code != "content_type_mismatch" || results[0].ID != 0 ||
+		results[0].MimeType != "application/vnd.microsoft.portable-executable" {
+		t.Errorf("Unexpected result for the executable: %+v", results)
+	}
+	if len(results) == 2 && (results[1].ID != 30 || results[1].MimeType != "text/plain" || results[1].Code != "") {
+		t.Errorf("Unexpected result for the text file: %+v", results[1])
+	}
+	if stored, _ := filepath.Glob(filepath.Join(backend.Dir, "*")); len(stored) != 1 {
+		t.Errorf("Expected only the text file to be stored, got %v", stored)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUploadEnforcesContentPolicy(t *testing.T) {
+	log.Println("--- Starting TestUploadEnforcesContentPolicy ---")
+	useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	for _, tc := range []struct {
+		allowed, denied string
+	}{
+		{"{}", "{image/*}"},
+		{"{application/pdf,text/*}", "{}"},
+	} {
+		expectContentPolicy(mock, tc.allowed, tc.denied)
+		expectNoExpiryPolicy(mock)
+
+		rr := httptest.NewRecorder()
+		fileupload.UploadFile(rr, multipartUpload(t, map[string][]byte{"scan.png": png}, []string{"scan.png"}), db, nil)
+		results := decodeUploadResults(t, rr.Body)
+		if rr.Code != http.StatusUnsupportedMediaType || len(results) != 1 ||
+			results[0].Code != "content_type_not_allowed" || results[0].MimeType != "image/png" {
+			t.Errorf("Policy %s/%s: got %v %+v", tc.allowed, tc.denied, rr.Code, results)
+		}
+	}
+
+	// A new version is refused the same way
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM files WHERE id = \\$1").
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	expectContentPolicy(mock, "{}", "{image/png}")
+	rr := httptest.NewRecorder()
+	fileupload.UploadVersion(rr, versionUpload("scan.png", string(png)), db, nil, 7)
+	var refused struct {
+		Code         string `json:"code"`
+		DetectedType string `json:"detected_type"`
+	}
+	json.NewDecoder(rr.Body).Decode(&refused)
+	if rr.Code != http.StatusUnsupportedMediaType || refused.Code != "content_type_not_allowed" || refused.DetectedType != "image/png" {
+		t.Errorf("Version: got %v %+v", rr.Code, refused)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSetContentPolicy(t *testing.T) {
+	log.Println("--- Starting TestSetContentPolicy ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Entries are normalized and deduplicated
+	mock.ExpectQuery("INSERT INTO content_policies \\(user_id, allowed_types, denied_types\\) VALUES \\(\\$1, \\$2, \\$3\\)\\s+ON CONFLICT \\(user_id\\) WHERE org_id IS NULL DO UPDATE").
+		WithArgs(userA.ID, "{\"application/pdf\",\"image/*\"}", "{\"application/x-elf\"}").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(time.Now()))
+	rr := httptest.NewRecorder()
+	fileupload.SetContentPolicy(rr, jsonRequest("PUT", "/content-policy",
+		`{"allowed_types": ["Application/PDF", " image/* ", "application/pdf"], "denied_types": ["application/x-elf"]}`, userA), db)
+	var policy models.ContentPolicy
+	json.NewDecoder(rr.Body).Decode(&policy)
+	if rr.Code != http.StatusOK || len(policy.AllowedTypes) != 2 || policy.UpdatedAt == nil {
+		t.Errorf("Set policy: got %v %+v", rr.Code, policy)
+	}
+
+	for _, body := range []string{
+		`{"allowed_types": ["pdf"]}`,
+		`{"allowed_types": ["image/png; q=1"]}`,
+		`{"denied_types": ["*/png"]}`,
+		`{"denied_types": ["image/p*"]}`,
+	} {
+		rr = httptest.NewRecorder()
+		fileupload.SetContentPolicy(rr, jsonRequest("PUT", "/content-policy", body, userA), db)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Policy %s: got %v, want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Only owners and admins set the policy of an organization
+	req := jsonRequest("PUT", "/content-policy", `{"denied_types": ["video/*"]}`, userB)
+	req = req.WithContext(auth.WithMembership(req.Context(), models.Membership{OrgID: 5, UserID: userB.ID, Role: models.OrgRoleMember}))
+	rr = httptest.NewRecorder()
+	fileupload.SetContentPolicy(rr, req, db)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Member setting the org policy: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	mock.ExpectQuery("INSERT INTO content_policies \\(org_id, allowed_types, denied_types\\) .* ON CONFLICT \\(org_id\\) WHERE org_id IS NOT NULL").
+		WithArgs(5, "{}", "{\"video/*\"}").
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(time.Now()))
+	req = jsonRequest("PUT", "/content-policy", `{"denied_types": ["video/*"]}`, userB)
+	req = req.WithContext(auth.WithMembership(req.Context(), models.Membership{OrgID: 5, UserID: userB.ID, Role: models.OrgRoleAdmin}))
+	rr = httptest.NewRecorder()
+	fileupload.SetContentPolicy(rr, req, db)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Admin setting the org policy: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	// Without a policy everything is accepted
+	expectNoContentPolicy(mock)
+	rr = httptest.NewRecorder()
+	fileupload.GetContentPolicy(rr, requestAs("GET", "/content-policy", userA), db)
+	policy = models.ContentPolicy{}
+	json.NewDecoder(rr.Body).Decode(&policy)
+	if rr.Code != http.StatusOK || policy.AllowedTypes == nil || len(policy.AllowedTypes) != 0 || policy.UpdatedAt != nil {
+		t.Errorf("Get policy: got %v %+v", rr.Code, policy)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSearchByDetectedType(t *testing.T) {
+	log.Println("--- Starting TestSearchByDetectedType ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	searchColumns := []string{"id", "file_name", "original_name", "upload_date", "size", "mime_type"}
+	for _, tc := range []struct {
+		fileType, condition, arg string
+	}{
+		{"pdf", "mime_type = \\$2", "application/pdf"},
+		{"Application/PDF", "mime_type = \\$2", "application/pdf"},
+		{"image/*", "mime_type LIKE \\$2", "image/%"},
+	} {
+		mock.ExpectQuery("SELECT .* FROM files WHERE "+withGrants("user_id = \\$1 AND org_id IS NULL")+" AND deleted_at IS NULL AND "+notExpired("files")+" AND "+tc.condition+"$").
+			WithArgs(userA.ID, tc.arg).
+			WillReturnRows(sqlmock.NewRows(searchColumns).AddRow(7, "brief.pdf", "brief.pdf", time.Now(), 100, tc.arg))
+		rr := httptest.NewRecorder()
+		fileupload.SearchFiles(rr, requestAs("GET", "/search?file_type="+tc.fileType, userA), db, nil)
+		if rr.Code != http.StatusOK {
+			t.Errorf("file_type=%s: got %v, want %v", tc.fileType, rr.Code, http.StatusOK)
+		}
+	}
+
+	for _, fileType := range []string{"unknownext", "image/p*"} {
+		rr := httptest.NewRecorder()
+		fileupload.SearchFiles(rr, requestAs("GET", "/search?file_type="+fileType, userA), db, nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("file_type=%s: got %v, want %v", fileType, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,210 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/storage"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var downloadQuery = "SELECT file_name, storage_key, file_type, mime_type, upload_date, COALESCE\\(\\(SELECT scan_status FROM blobs WHERE blobs.storage_key = files.storage_key\\), 'pending'\\) FROM files WHERE id = \\$1 AND deleted_at IS NULL AND " + notExpired("files") + " AND " +
+	withGrants("user_id = \\$2 AND org_id IS NULL") + "$"
+
+// useLocalStorage stores files in a temporary directory for the rest of the test
+func useLocalStorage(t *testing.T) *storage.LocalBackend {
+	backend := &storage.LocalBackend{Dir: t.TempDir(), SigningKey: []byte("test-signing-key")}
+	previous := storage.Default()
+	storage.SetDefault(backend)
+	t.Cleanup(func() { storage.SetDefault(previous) })
+	return backend
+}
+
+// expectDownload expects a file whose contents were scanned and found clean to be
+// looked up for a download
+func expectDownload(mock sqlmock.Sqlmock, fileID, userID int, key string) {
+	expectScannedDownload(mock, fileID, userID, key, "clean")
+}
+
+func expectScannedDownload(mock sqlmock.Sqlmock, fileID, userID int, key, scanStatus string) {
+	mock.ExpectQuery(downloadQuery).
+		WithArgs(fileID, userID).
+		WillReturnRows(sqlmock.NewRows([]string{"file_name", "storage_key", "file_type", "mime_type", "upload_date", "scan_status"}).
+			AddRow("Smith v Jones – Complaint.pdf", key, ".pdf", "application/pdf", time.Now(), scanStatus))
+}
+
+// expectScanStatus expects the scan status of the contents stored under key to be
+// looked up for a presigned link, along with whether a file that has not expired
+// holds them
+func expectScanStatus(mock sqlmock.Sqlmock, key, scanStatus string) {
+	expectPresignedLookup(mock, key, scanStatus, true)
+}
+
+func expectPresignedLookup(mock sqlmock.Sqlmock, key, scanStatus string, live bool) {
+	mock.ExpectQuery("SELECT COALESCE\\(\\(SELECT scan_status FROM blobs WHERE storage_key = \\$1\\), 'pending'\\),\\s+" +
+		"EXISTS\\(SELECT 1 FROM file_versions v JOIN files ON files.id = v.file_id WHERE v.storage_key = \\$1 AND " + notExpired("files") + "\\),\\s+" +
+		"COALESCE\\(\\(SELECT v.mime_type FROM file_versions v WHERE v.storage_key = \\$1 LIMIT 1\\), ''\\),\\s+" +
+		"COALESCE\\(\\(SELECT v.original_name FROM file_versions v WHERE v.storage_key = \\$1 LIMIT 1\\), ''\\)").
+		WithArgs(key).
+		WillReturnRows(sqlmock.NewRows([]string{"scan_status", "live", "mime_type", "original_name"}).AddRow(scanStatus, live, "application/pdf", "Complaint.pdf"))
+}
+
+func TestDownloadFile(t *testing.T) {
+	log.Println("--- Starting TestDownloadFile ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	content := "%PDF-1.4 settlement agreement"
+	backend.Put(context.Background(), "f3a1.pdf", strings.NewReader(content), int64(len(content)), "")
+
+	// Full download with validators and the file name
+	expectDownload(mock, 7, userA.ID, "f3a1.pdf")
+	rr := httptest.NewRecorder()
+	fileupload.DownloadFile(rr, requestAs("GET", "/files/7/content", userA), db, 7)
+	if rr.Code != http.StatusOK || rr.Body.String() != content {
+		t.Fatalf("Download: got %v %q", rr.Code, rr.Body.String())
+	}
+	header := rr.Header()
+	etag := header.Get("ETag")
+	if header.Get("Content-Type") != "application/pdf" || header.Get("X-Content-Type-Options") != "nosniff" || header.Get("Content-Disposition") != `attachment; filename*=utf-8''Smith%20v%20Jones%20%E2%80%93%20Complaint.pdf` ||
+		etag == "" || header.Get("Last-Modified") == "" || header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Unexpected headers: %v", header)
+	}
+
+	// The type detected on upload is served, whatever the file is named
+	mock.ExpectQuery(downloadQuery).
+		WithArgs(8, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"file_name", "storage_key", "file_type", "mime_type", "upload_date", "scan_status"}).
+			AddRow("scan.png", "f3a1.pdf", ".png", "text/plain; charset=utf-8", time.Now(), "clean"))
+	rr = httptest.NewRecorder()
+	fileupload.DownloadFile(rr, requestAs("GET", "/files/8/content", userA), db, 8)
+	if rr.Header().Get("Content-Type") != "text/plain; charset=utf-8" || rr.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Served with the extension's type: %v", rr.Header())
+	}
+
+	// Byte ranges
+	expectDownload(mock, 7, userA.ID, "f3a1.pdf")
+	rr = httptest.NewRecorder()
+	req := requestAs("GET", "/files/7/content", userA)
+	req.Header.Set("Range", "bytes=9-")
+	fileupload.DownloadFile(rr, req, db, 7)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "settlement agreement" ||
+		rr.Header().Get("Content-Range") != "bytes 9-28/29" {
+		t.Errorf("Range: got %v %q %q", rr.Code, rr.Body.String(), rr.Header().Get("Content-Range"))
+	}
+
+	expectDownload(mock, 7, userA.ID, "f3a1.pdf")
+	rr = httptest.NewRecorder()
+	req = requestAs("GET", "/files/7/content", userA)
+	req.Header.Set("Range", "bytes=100-")
+	fileupload.DownloadFile(rr, req, db, 7)
+	if rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Unsatisfiable range: got %v, want %v", rr.Code, http.StatusRequestedRangeNotSatisfiable)
+	}
+
+	// Conditional requests
+	expectDownload(mock, 7, userA.ID, "f3a1.pdf")
+	rr = httptest.NewRecorder()
+	req = requestAs("GET", "/files/7/content", userA)
+	req.Header.Set("If-None-Match", etag)
+	fileupload.DownloadFile(rr, req, db, 7)
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("If-None-Match: got %v, want %v", rr.Code, http.StatusNotModified)
+	}
+
+	// A stale If-Range sends the whole file
+	expectDownload(mock, 7, userA.ID, "f3a1.pdf")
+	rr = httptest.NewRecorder()
+	req = requestAs("GET", "/files/7/content", userA)
+	req.Header.Set("Range", "bytes=0-3")
+	req.Header.Set("If-Range", `"stale"`)
+	fileupload.DownloadFile(rr, req, db, 7)
+	if rr.Code != http.StatusOK || rr.Body.String() != content {
+		t.Errorf("If-Range: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	// Files of other users do not exist for the caller, even shared ones
+	mock.ExpectQuery(downloadQuery).WithArgs(7, userB.ID).WillReturnError(sql.ErrNoRows)
+	rr = httptest.NewRecorder()
+	fileupload.DownloadFile(rr, requestAs("GET", "/files/7/content", userB), db, 7)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Other user's file: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Metadata without stored content
+	expectDownload(mock, 8, userA.ID, "gone.pdf")
+	rr = httptest.NewRecorder()
+	fileupload.DownloadFile(rr, requestAs("GET", "/files/8/content", userA), db, 8)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Missing content: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUploadsServeOnlyPresignedLinks(t *testing.T) {
+	log.Println("--- Starting TestUploadsServeOnlyPresignedLinks ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	backend.Put(context.Background(), "f3a1.pdf", strings.NewReader("%PDF-1.4"), 8, "")
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		fileupload.ServePresignedFile(rr, httptest.NewRequest("GET", target, nil), db)
+		return rr
+	}
+
+	// Knowing the stored name is no longer enough
+	if rr := serve("/uploads/f3a1.pdf"); rr.Code != http.StatusForbidden {
+		t.Errorf("Unsigned request: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	signed, err := backend.PresignGet(context.Background(), "f3a1.pdf", time.Hour)
+	link, _ := url.Parse(signed)
+	if err != nil || link.Path != "/uploads/f3a1.pdf" {
+		t.Fatalf("PresignGet returned %q %v", signed, err)
+	}
+
+	// Contents are served as an attachment under the name they were uploaded with,
+	// so an uploaded HTML or SVG page never runs on the service's origin
+	expectScanStatus(mock, "f3a1.pdf", "clean")
+	rr := serve(link.RequestURI())
+	if rr.Code != http.StatusOK || rr.Body.String() != "%PDF-1.4" || rr.Header().Get("Content-Type") != "application/pdf" ||
+		rr.Header().Get("Content-Disposition") != "attachment; filename=Complaint.pdf" {
+		t.Errorf("Presigned link: got %v %q with headers %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	// The signature covers the file and the expiry
+	query := link.Query()
+	if rr := serve("/uploads/other.pdf?" + query.Encode()); rr.Code != http.StatusForbidden {
+		t.Errorf("Signature reused for another file: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+	query.Set("expires", "9999999999")
+	if rr := serve("/uploads/f3a1.pdf?" + query.Encode()); rr.Code != http.StatusForbidden {
+		t.Errorf("Extended expiry: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,365 @@
+package test
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/job"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// expiryPolicyColumns are the columns of expiry_policies read by loadExpiryPolicy
+var expiryPolicyColumns = []string{"default_ttl_seconds", "max_ttl_seconds", "updated_at"}
+
+// notExpired matches the condition that a file of table has not expired
+func notExpired(table string) string {
+	return "\\(" + table + "\\.expiration_date IS NULL OR " + table + "\\.expiration_date > NOW\\(\\)\\)"
+}
+
+// expectNoExpiryPolicy expects the expiry policy of the tenant to be looked up,
+// with none set
+func expectNoExpiryPolicy(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT default_ttl_seconds, max_ttl_seconds, updated_at FROM expiry_policies WHERE").
+		WillReturnRows(sqlmock.NewRows(expiryPolicyColumns))
+}
+
+// expectExpiryPolicy expects the expiry policy of the personal files of userA to
+// be looked up, with TTLs in seconds
+func expectExpiryPolicy(mock sqlmock.Sqlmock, defaultTTL, maxTTL int64) {
+	mock.ExpectQuery("SELECT default_ttl_seconds, max_ttl_seconds, updated_at FROM expiry_policies WHERE user_id = \\$1 AND org_id IS NULL").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows(expiryPolicyColumns).AddRow(defaultTTL, maxTTL, time.Now()))
+}
+
+// expiresIn matches a time about ttl from now
+type expiresIn time.Duration
+
+func (e expiresIn) Match(v driver.Value) bool {
+	expiry, ok := v.(time.Time)
+	want := time.Now().Add(time.Duration(e))
+	return ok && expiry.After(want.Add(-time.Minute)) && expiry.Before(want.Add(time.Minute))
+}
+
+// expectUploadExpiring expects a file of userA expiring at expiry to be inserted
+func expectUploadExpiring(mock sqlmock.Sqlmock, expiry driver.Value) {
+	expectNoQuota(mock)
+	expectNewBlob(mock)
+	mock.ExpectQuery("INSERT INTO files .* RETURNING id").
+		WithArgs(userA.ID, "brief.pdf", sqlmock.AnyArg(), sqlmock.AnyArg(), ".pdf", sqlmock.AnyArg(), "", false,
+			expiry, nil, "brief.pdf", sqlmock.AnyArg(), sqlmock.AnyArg(), nil, "application/pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectCommit()
+}
+
+func TestUploadSetsExpiry(t *testing.T) {
+	log.Println("--- Starting TestUploadSetsExpiry ---")
+	useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	files := map[string][]byte{"brief.pdf": []byte("%PDF-1.4 brief")}
+	upload := func(query string) *httptest.ResponseRecorder {
+		req := multipartUpload(t, files, []string{"brief.pdf"})
+		req.URL.RawQuery = query
+		rr := httptest.NewRecorder()
+		fileupload.UploadFile(rr, req, db, nil)
+		return rr
+	}
+	expectUser := func() {
+		expectNoContentPolicy(mock)
+	}
+
+	// A TTL counts from the upload
+	expectUser()
+	expectNoExpiryPolicy(mock)
+	expectUploadExpiring(mock, expiresIn(48*time.Hour))
+	rr := upload("expires_in=48h")
+	results := decodeUploadResults(t, rr.Body)
+	if rr.Code != http.StatusOK || len(results) != 1 || results[0].Expiration == nil ||
+		time.Until(*results[0].Expiration) < 47*time.Hour {
+		t.Errorf("Upload with expires_in: got %v %+v", rr.Code, results)
+	}
+
+	// An absolute expiry is kept as is
+	expiresAt := time.Now().Add(10 * 24 * time.Hour).UTC().Truncate(time.Second)
+	expectUser()
+	expectNoExpiryPolicy(mock)
+	expectUploadExpiring(mock, expiresAt)
+	if rr := upload("expires_at=" + url.QueryEscape(expiresAt.Format(time.RFC3339))); rr.Code != http.StatusOK {
+		t.Errorf("Upload with expires_at: got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// Without an expiry the file keeps for ever, or gets the policy's default
+	expectUser()
+	expectNoExpiryPolicy(mock)
+	expectUploadExpiring(mock, nil)
+	if rr := upload(""); rr.Code != http.StatusOK {
+		t.Errorf("Upload without expiry: got %v %s", rr.Code, rr.Body.String())
+	}
+	expectUser()
+	expectExpiryPolicy(mock, 72*3600, 0)
+	expectUploadExpiring(mock, expiresIn(72*time.Hour))
+	if rr := upload(""); rr.Code != http.StatusOK {
+		t.Errorf("Upload with a default expiry: got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// Files cannot be kept longer than the policy allows
+	expectUser()
+	expectExpiryPolicy(mock, 0, 24*3600)
+	if rr := upload("expires_in=48h"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Upload past the policy's limit: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Invalid expiries are refused before anything is read
+	for _, query := range []string{"expires_in=soon", "expires_in=-1h", "expires_at=yesterday",
+		"expires_at=2001-01-01T00:00:00Z", "expires_in=1h&expires_at=" + url.QueryEscape(expiresAt.Format(time.RFC3339))} {
+		if rr := upload(query); rr.Code != http.StatusBadRequest {
+			t.Errorf("Upload with %s: got %v, want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateFileExpiry(t *testing.T) {
+	log.Println("--- Starting TestUpdateFileExpiry ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+
+	// Only the owner changes the expiry, and is warned again before the new one
+	mr.Set("user_files:1", "[listing without expiry]")
+	expiry := time.Now().Add(24 * time.Hour)
+	expectExpiryPolicy(mock, 0, 30*24*3600)
+	mock.ExpectQuery("UPDATE files SET file_name = COALESCE\\(\\$1, file_name\\), description = COALESCE\\(\\$2, description\\), "+
+		"expiration_date = \\$3, expiry_warned_at = NULL WHERE id = \\$4 AND deleted_at IS NULL AND "+notExpired("files")+" AND user_id = \\$5 AND org_id IS NULL RETURNING").
+		WithArgs(nil, nil, expiresIn(24*time.Hour), 7, userA.ID).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns).AddRow(7, userA.ID, 0, "brief.pdf", "brief.pdf",
+			time.Now(), 100, ".pdf", "", "", false, expiry, 0, "application/pdf", "clean"))
+	rr := httptest.NewRecorder()
+	fileupload.UpdateFile(rr, patchFile(`{"expires_in": "24h"}`, userA), db, redisClient, 7)
+	var file models.File
+	json.NewDecoder(rr.Body).Decode(&file)
+	if rr.Code != http.StatusOK || file.Expiration == nil {
+		t.Fatalf("Set expiry: got %v %+v", rr.Code, file)
+	}
+	if mr.Exists("user_files:1") {
+		t.Errorf("Cached listing still shows the old expiry")
+	}
+
+	// Clearing the expiry keeps the file for ever, unless the policy sets a limit
+	expectExpiryPolicy(mock, 0, 30*24*3600)
+	rr = httptest.NewRecorder()
+	fileupload.UpdateFile(rr, patchFile(`{"expires_at": null}`, userA), db, redisClient, 7)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Clear expiry under a limit: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+	expectNoExpiryPolicy(mock)
+	mock.ExpectQuery("UPDATE files SET .*, expiration_date = \\$3, expiry_warned_at = NULL WHERE").
+		WithArgs(nil, nil, nil, 7, userA.ID).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns).AddRow(7, userA.ID, 0, "brief.pdf", "brief.pdf",
+			time.Now(), 100, ".pdf", "", "", false, nil, 0, "application/pdf", "clean"))
+	rr = httptest.NewRecorder()
+	fileupload.UpdateFile(rr, patchFile(`{"expires_at": null}`, userA), db, redisClient, 7)
+	file = models.File{}
+	json.NewDecoder(rr.Body).Decode(&file)
+	if rr.Code != http.StatusOK || file.Expiration != nil {
+		t.Errorf("Clear expiry: got %v %+v", rr.Code, file)
+	}
+
+	// Expiries past the policy's limit or in the past are refused
+	expectExpiryPolicy(mock, 0, 30*24*3600)
+	rr = httptest.NewRecorder()
+	fileupload.UpdateFile(rr, patchFile(`{"expires_in": "1000h"}`, userA), db, redisClient, 7)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expiry past the limit: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+	for _, body := range []string{`{"expires_at": "2001-01-01T00:00:00Z"}`, `{"expires_in": "forever"}`, `{"expires_at": null, "expires_in": "1h"}`} {
+		rr = httptest.NewRecorder()
+		fileupload.UpdateFile(rr, patchFile(body, userA), db, redisClient, 7)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Update with %s: got %v, want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSetExpiryPolicy(t *testing.T) {
+	log.Println("--- Starting TestSetExpiryPolicy ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("INSERT INTO expiry_policies \\(user_id, default_ttl_seconds, max_ttl_seconds\\) VALUES \\(\\$1, \\$2, \\$3\\)\\s+ON CONFLICT \\(user_id\\) WHERE org_id IS NULL DO UPDATE").
+		WithArgs(userA.ID, int64(7*24*3600), int64(90*24*3600)).
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(time.Now()))
+	rr := httptest.NewRecorder()
+	fileupload.SetExpiryPolicy(rr, jsonRequest("PUT", "/expiry-policy", `{"default_ttl": "168h", "max_ttl": "2160h"}`, userA), db)
+	var policy models.ExpiryPolicy
+	json.NewDecoder(rr.Body).Decode(&policy)
+	if rr.Code != http.StatusOK || policy.DefaultTTL != "168h0m0s" || policy.MaxTTL != "2160h0m0s" || policy.UpdatedAt == nil {
+		t.Errorf("Set policy: got %v %+v", rr.Code, policy)
+	}
+
+	for _, body := range []string{`{"max_ttl": "soon"}`, `{"default_ttl": "-1h"}`, `{"default_ttl": "48h", "max_ttl": "24h"}`} {
+		rr = httptest.NewRecorder()
+		fileupload.SetExpiryPolicy(rr, jsonRequest("PUT", "/expiry-policy", body, userA), db)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Set policy %s: got %v, want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Members of an organization cannot set its policy
+	req := jsonRequest("PUT", "/expiry-policy", `{"max_ttl": "24h"}`, userB)
+	req = req.WithContext(auth.WithMembership(req.Context(), models.Membership{OrgID: 5, UserID: userB.ID, Role: models.OrgRoleMember}))
+	rr = httptest.NewRecorder()
+	fileupload.SetExpiryPolicy(rr, req, db)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Member setting the org policy: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Without a policy files keep for ever
+	expectNoExpiryPolicy(mock)
+	rr = httptest.NewRecorder()
+	fileupload.GetExpiryPolicy(rr, requestAs("GET", "/expiry-policy", userA), db)
+	policy = models.ExpiryPolicy{}
+	json.NewDecoder(rr.Body).Decode(&policy)
+	if rr.Code != http.StatusOK || policy.DefaultTTL != "" || policy.MaxTTL != "" || policy.UpdatedAt != nil {
+		t.Errorf("Get policy: got %v %+v", rr.Code, policy)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestExpiredFilesAreOutOfReach(t *testing.T) {
+	log.Println("--- Starting TestExpiredFilesAreOutOfReach ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+
+	backend.Put(context.Background(), "f3a1.pdf", strings.NewReader("%PDF-1.4"), 8, "")
+
+	// A cached listing is dropped when its first file expires
+	mock.ExpectQuery("SELECT .* FROM files WHERE user_id = \\$1 AND org_id IS NULL AND deleted_at IS NULL AND " + notExpired("files") + "$").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows(fileColumns).
+			AddRow(7, "brief.pdf", "brief.pdf", time.Now(), 8, ".pdf", "", "", false, time.Now().Add(2*time.Hour), 0, "application/pdf", "clean").
+			AddRow(8, "notes.txt", "notes.txt", time.Now(), 8, ".txt", "", "", false, nil, 0, "text/plain", "clean"))
+	rr := httptest.NewRecorder()
+	fileupload.RetrieveFiles(rr, requestAs("GET", "/files", userA), db, redisClient)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"expiration_date":null`) {
+		t.Errorf("Listing: got %v %s", rr.Code, rr.Body.String())
+	}
+	if ttl := mr.TTL("user_files:1"); ttl <= time.Hour || ttl > 2*time.Hour {
+		t.Errorf("Cached listing should expire with the first file, TTL %v", ttl)
+	}
+
+	// A share link to an expired file is gone
+	mock.ExpectQuery(shareLinkQuery).
+		WithArgs(sha256Hex("open")).
+		WillReturnRows(sqlmock.NewRows(shareLinkColumns).
+			AddRow(4, 7, nil, nil, 0, 0, nil, "brief.pdf", "f3a1.pdf", ".pdf", "application/pdf", time.Now(), time.Now().Add(-time.Minute), "clean"))
+	rr = httptest.NewRecorder()
+	fileupload.ServeShareLink(rr, httptest.NewRequest("GET", "/s/open", nil), db, "open")
+	if rr.Code != http.StatusGone {
+		t.Errorf("Link to an expired file: got %v, want %v", rr.Code, http.StatusGone)
+	}
+
+	// So is a presigned link to contents only expired files hold
+	signed, _ := backend.PresignGet(context.Background(), "f3a1.pdf", time.Hour)
+	link, _ := url.Parse(signed)
+	expectPresignedLookup(mock, "f3a1.pdf", "clean", false)
+	rr = httptest.NewRecorder()
+	fileupload.ServePresignedFile(rr, httptest.NewRequest("GET", link.RequestURI(), nil), db)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Presigned link to expired contents: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestWarnExpiringFiles(t *testing.T) {
+	log.Println("--- Starting TestWarnExpiringFiles ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Each file is marked as its owner is warned, so the warning goes out once
+	expiry := time.Date(2026, 10, 20, 9, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("UPDATE files SET expiry_warned_at = NOW\\(\\) FROM users u\\s+WHERE u.id = files.user_id AND files.expiry_warned_at IS NULL AND files.deleted_at IS NULL\\s+" +
+		"AND files.expiration_date > NOW\\(\\) AND files.expiration_date <= \\$1\\s+RETURNING u.email, files.id, files.file_name, files.expiration_date").
+		WithArgs(expiresIn(48 * time.Hour)).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "id", "file_name", "expiration_date"}).
+			AddRow("a@example.com", 7, "brief.pdf", expiry).
+			AddRow("b@example.com", 9, "contract.docx", expiry).
+			AddRow("a@example.com", 8, "notes.txt", expiry))
+
+	mailer := &recordingMailer{}
+	warned, err := job.WarnExpiringFiles(db, mailer, 48*time.Hour)
+	if err != nil || warned != 3 {
+		t.Fatalf("WarnExpiringFiles returned %d %v", warned, err)
+	}
+	if len(mailer.sent) != 2 {
+		t.Fatalf("Expected one message per owner, got %+v", mailer.sent)
+	}
+	for _, mail := range mailer.sent {
+		switch mail.to {
+		case "a@example.com":
+			if !strings.Contains(mail.body, "brief.pdf (file 7)") || !strings.Contains(mail.body, "notes.txt (file 8)") ||
+				strings.Contains(mail.body, "contract.docx") {
+				t.Errorf("Unexpected warning to %s: %q", mail.to, mail.body)
+			}
+		case "b@example.com":
+			if !strings.Contains(mail.body, "contract.docx (file 9), expires Tue, 20 Oct 2026 09:00:00 UTC") {
+				t.Errorf("Unexpected warning to %s: %q", mail.to, mail.body)
+			}
+		default:
+			t.Errorf("Unexpected warning to %s", mail.to)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,174 @@
+package test
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+var updateFileQuery = "UPDATE files SET file_name = COALESCE\\(\\$1, file_name\\), description = COALESCE\\(\\$2, description\\)\\s+WHERE id = \\$3 AND deleted_at IS NULL AND " + notExpired("files") + " AND " +
+	withGrants("user_id = \\$4 AND org_id IS NULL")
+
+var updatedFileColumns = append([]string{"id", "user_id", "org_id"}, fileColumns[1:]...)
+
+func patchFile(body string, user models.User) *http.Request {
+	req := httptest.NewRequest("PATCH", "/files/7", strings.NewReader(body))
+	return req.WithContext(auth.WithUser(req.Context(), user))
+}
+
+func TestUploadKeepsOriginalName(t *testing.T) {
+	log.Println("--- Starting TestUploadKeepsOriginalName ---")
+	useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	original := "Smith_v_Jones  <Complaint>.pdf"
+	var key string
+	expectNoContentPolicy(mock)
+	expectNoExpiryPolicy(mock)
+	expectNoQuota(mock)
+	expectNewBlob(mock)
+	mock.ExpectQuery("INSERT INTO files .* RETURNING id").
+		WithArgs(userA.ID, "Smith_v_Jones Complaint.pdf", sqlmock.AnyArg(), int64(8),
+			".pdf", "", "", false, sqlmock.AnyArg(), nil, original, captureArg{&key}, sha256Hex("%PDF-1.7"), nil, "application/pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	fileupload.UploadFile(rr, multipartUpload(t, map[string][]byte{original: []byte("%PDF-1.7")}, []string{original}), db, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Upload returned %v: %s", rr.Code, rr.Body.String())
+	}
+	results := decodeUploadResults(t, rr.Body)
+	if results[0].Name != "Smith_v_Jones Complaint.pdf" {
+		t.Errorf("Result name = %q", results[0].Name)
+	}
+	// The storage key is unrelated to the names
+	if !strings.HasSuffix(key, ".pdf") || strings.Contains(key, "Smith") {
+		t.Errorf("Storage key = %q", key)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateFile(t *testing.T) {
+	log.Println("--- Starting TestUpdateFile ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+
+	mr.Set("user_files:1", "[stale listing]")
+	mr.Set("user_files:2", "[other user's listing]")
+
+	mock.ExpectQuery(updateFileQuery).
+		WithArgs("Complaint (amended).pdf", "Filed 2026-10-01", 7, userA.ID).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns).AddRow(7, userA.ID, 0, "Complaint (amended).pdf", "complaint.pdf",
+			time.Now(), 100, ".pdf", "", "Filed 2026-10-01", false, nil, 0, "application/pdf", "clean"))
+
+	rr := httptest.NewRecorder()
+	fileupload.UpdateFile(rr, patchFile(`{"file_name": "  Complaint\t(amended).pdf ", "description": "Filed 2026-10-01"}`, userA), db, redisClient, 7)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var file models.File
+	json.NewDecoder(rr.Body).Decode(&file)
+	if file.FileName != "Complaint (amended).pdf" || file.OriginalName != "complaint.pdf" || file.Description != "Filed 2026-10-01" {
+		t.Errorf("Unexpected file: %+v", file)
+	}
+
+	// Only the owner's listing is invalidated
+	if mr.Exists("user_files:1") || !mr.Exists("user_files:2") {
+		t.Errorf("Wrong listings invalidated: %v", mr.Keys())
+	}
+
+	// Fields left out keep their value
+	mock.ExpectQuery(updateFileQuery).
+		WithArgs(nil, "", 7, userA.ID).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns).AddRow(7, userA.ID, 0, "Complaint (amended).pdf", "complaint.pdf",
+			time.Now(), 100, ".pdf", "", "", false, nil, 0, "application/pdf", "clean"))
+	rr = httptest.NewRecorder()
+	fileupload.UpdateFile(rr, patchFile(`{"description": ""}`, userA), db, redisClient, 7)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Clearing the description: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	// Names are sanitized like uploads
+	for body, name := range map[string]string{
+		`{"file_name": "../../etc/passwd"}`:                     "passwd",
+		`{"file_name": "C:\\Users\\a\\brief.docx"}`:             "brief.docx",
+		`{"file_name": ".hidden\u0000 name?.txt."}`:             "hidden name.txt",
+		`{"file_name": "` + strings.Repeat("é", 200) + `.pdf"}`: strings.Repeat("é", 125) + ".pdf",
+		`{"file_name": "<>"}`:                                   "untitled",
+	} {
+		mock.ExpectQuery(updateFileQuery).
+			WithArgs(name, nil, 7, userA.ID).
+			WillReturnRows(sqlmock.NewRows(updatedFileColumns).AddRow(7, userA.ID, 0, name, "", time.Now(), 1, "", "", "", false, nil, 0, "", "clean"))
+		rr = httptest.NewRecorder()
+		fileupload.UpdateFile(rr, patchFile(body, userA), db, nil, 7)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Rename with %s: got %v: %s", body, rr.Code, rr.Body.String())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateFileRejectsInvalidInput(t *testing.T) {
+	log.Println("--- Starting TestUpdateFileRejectsInvalidInput ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	for body, want := range map[string]int{
+		`not json`:           http.StatusBadRequest,
+		`{}`:                 http.StatusBadRequest,
+		`{"file_name": " "}`: http.StatusBadRequest,
+		`{"description": "` + strings.Repeat("x", 2001) + `"}`: http.StatusBadRequest,
+	} {
+		rr := httptest.NewRecorder()
+		fileupload.UpdateFile(rr, patchFile(body, userA), db, nil, 7)
+		if rr.Code != want {
+			t.Errorf("Body %.40s: got %v, want %v", body, rr.Code, want)
+		}
+	}
+
+	// Another user's file is not found
+	mock.ExpectQuery(updateFileQuery).
+		WithArgs("mine.pdf", nil, 7, userB.ID).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns))
+	rr := httptest.NewRecorder()
+	fileupload.UpdateFile(rr, patchFile(`{"file_name": "mine.pdf"}`, userB), db, nil, 7)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Other user's file: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
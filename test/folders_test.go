@@ -0,0 +1,454 @@
+package test
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+const loadFolderQuery = "SELECT .* FROM folders WHERE id = \\$1 AND user_id = \\$2 AND org_id IS NULL"
+
+// listFolderQuery loads a folder of the tenant or granted to it
+var listFolderQuery = "SELECT .* FROM folders WHERE id = \\$1 AND " + withGrants("user_id = \\$2 AND org_id IS NULL")
+
+var folderColumns = []string{"id", "user_id", "org_id", "parent_id", "name", "path", "created_at"}
+
+func jsonRequest(method, target, body string, user models.User) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	return req.WithContext(auth.WithUser(req.Context(), user))
+}
+
+func expectFolderLock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("SELECT pg_advisory_xact_lock\\(\\$1, \\$2\\)").
+		WithArgs(1, userA.ID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func expectFolder(mock sqlmock.Sqlmock, id, parentID int, name, path string) {
+	mock.ExpectQuery(loadFolderQuery).
+		WithArgs(id, userA.ID).
+		WillReturnRows(sqlmock.NewRows(folderColumns).AddRow(id, userA.ID, 0, parentID, name, path, time.Now()))
+}
+
+func expectFolderName(mock sqlmock.Sqlmock, parentID int, name string, folderID int, taken bool) {
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM folders WHERE COALESCE\\(parent_id, 0\\) = \\$1 AND name = \\$2 AND id <> \\$3").
+		WithArgs(parentID, name, folderID, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(taken))
+}
+
+func TestCreateFolder(t *testing.T) {
+	log.Println("--- Starting TestCreateFolder ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	// A folder at the top of the tree
+	mock.ExpectBegin()
+	expectFolderLock(mock)
+	expectFolderName(mock, 0, "Pleadings", 0, false)
+	mock.ExpectQuery("INSERT INTO folders \\(id, user_id, org_id, parent_id, name, path\\)").
+		WithArgs(userA.ID, nil, nil, "Pleadings", "/").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "created_at"}).AddRow(5, "/5/", time.Now()))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	fileupload.CreateFolder(rr, jsonRequest("POST", "/folders", `{"name": " Pleadings "}`, userA), db)
+	var folder models.Folder
+	json.NewDecoder(rr.Body).Decode(&folder)
+	if rr.Code != http.StatusCreated || folder.ID != 5 || folder.Path != "/5/" || folder.Name != "Pleadings" {
+		t.Fatalf("Create: got %v %+v", rr.Code, folder)
+	}
+
+	// One inside it takes the path of its parent
+	mock.ExpectBegin()
+	expectFolderLock(mock)
+	expectFolder(mock, 5, 0, "Pleadings", "/5/")
+	expectFolderName(mock, 5, "Drafts", 0, false)
+	mock.ExpectQuery("INSERT INTO folders").
+		WithArgs(userA.ID, nil, 5, "Drafts", "/5/").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "path", "created_at"}).AddRow(9, "/5/9/", time.Now()))
+	mock.ExpectCommit()
+
+	rr = httptest.NewRecorder()
+	fileupload.CreateFolder(rr, jsonRequest("POST", "/folders", `{"name": "Drafts", "parent_id": 5}`, userA), db)
+	json.NewDecoder(rr.Body).Decode(&folder)
+	if rr.Code != http.StatusCreated || folder.ParentID != 5 || folder.Path != "/5/9/" {
+		t.Errorf("Create in folder: got %v %+v", rr.Code, folder)
+	}
+
+	// Names are unique within a parent
+	mock.ExpectBegin()
+	expectFolderLock(mock)
+	expectFolderName(mock, 0, "Pleadings", 0, true)
+	mock.ExpectRollback()
+	rr = httptest.NewRecorder()
+	fileupload.CreateFolder(rr, jsonRequest("POST", "/folders", `{"name": "Pleadings"}`, userA), db)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Duplicate name: got %v, want %v", rr.Code, http.StatusConflict)
+	}
+
+	// Folders of other users cannot be used as parents
+	mock.ExpectBegin()
+	expectFolderLock(mock)
+	mock.ExpectQuery(loadFolderQuery).
+		WithArgs(77, userA.ID).
+		WillReturnRows(sqlmock.NewRows(folderColumns))
+	mock.ExpectRollback()
+	rr = httptest.NewRecorder()
+	fileupload.CreateFolder(rr, jsonRequest("POST", "/folders", `{"name": "Drafts", "parent_id": 77}`, userA), db)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Unknown parent: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	rr = httptest.NewRecorder()
+	fileupload.CreateFolder(rr, jsonRequest("POST", "/folders", `{"name": "  "}`, userA), db)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Empty name: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMoveFolder(t *testing.T) {
+	log.Println("--- Starting TestMoveFolder ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Moving a folder rewrites the paths of everything below it
+	mock.ExpectBegin()
+	expectFolderLock(mock)
+	expectFolder(mock, 9, 5, "Drafts", "/5/9/")
+	expectFolder(mock, 12, 0, "Archive", "/12/")
+	expectFolderName(mock, 12, "Old drafts", 9, false)
+	mock.ExpectExec("UPDATE folders SET name = \\$1, parent_id = \\$2 WHERE id = \\$3").
+		WithArgs("Old drafts", 12, 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE folders SET path = \\$1 \\|\\| substr\\(path, \\$2\\) WHERE path LIKE \\$3 \\|\\| '%'").
+		WithArgs("/12/9/", len("/5/9/")+1, "/5/9/").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	fileupload.UpdateFolder(rr, jsonRequest("PATCH", "/folders/9", `{"name": "Old drafts", "parent_id": 12}`, userA), db, 9)
+	var folder models.Folder
+	json.NewDecoder(rr.Body).Decode(&folder)
+	if rr.Code != http.StatusOK || folder.Path != "/12/9/" || folder.ParentID != 12 || folder.Name != "Old drafts" {
+		t.Fatalf("Move: got %v %+v", rr.Code, folder)
+	}
+
+	// A folder cannot go below itself
+	for _, parent := range []struct {
+		body string
+		path string
+	}{{`{"parent_id": 5}`, "/5/"}, {`{"parent_id": 14}`, "/5/9/14/"}} {
+		mock.ExpectBegin()
+		expectFolderLock(mock)
+		expectFolder(mock, 5, 0, "Pleadings", "/5/")
+		if parent.path == "/5/" {
+			expectFolder(mock, 5, 0, "Pleadings", "/5/")
+		} else {
+			expectFolder(mock, 14, 9, "Exhibits", parent.path)
+		}
+		mock.ExpectRollback()
+
+		rr = httptest.NewRecorder()
+		fileupload.UpdateFolder(rr, jsonRequest("PATCH", "/folders/5", parent.body, userA), db, 5)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("Moving into %s: got %v, want %v", parent.path, rr.Code, http.StatusConflict)
+		}
+	}
+
+	// Renaming alone leaves the paths as they are
+	mock.ExpectBegin()
+	expectFolderLock(mock)
+	expectFolder(mock, 5, 0, "Pleadings", "/5/")
+	expectFolderName(mock, 0, "Motions", 5, false)
+	mock.ExpectExec("UPDATE folders SET name = \\$1, parent_id = \\$2 WHERE id = \\$3").
+		WithArgs("Motions", nil, 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	rr = httptest.NewRecorder()
+	fileupload.UpdateFolder(rr, jsonRequest("PATCH", "/folders/5", `{"name": "Motions"}`, userA), db, 5)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Rename: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListFolder(t *testing.T) {
+	log.Println("--- Starting TestListFolder ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(listFolderQuery).
+		WithArgs(9, userA.ID).
+		WillReturnRows(sqlmock.NewRows(folderColumns).AddRow(9, userA.ID, 0, 5, "Drafts", "/5/9/", now))
+	mock.ExpectQuery("SELECT .* FROM folders WHERE \\$1 LIKE path \\|\\| '%' AND "+withGrants("user_id = \\$2 AND org_id IS NULL")+" ORDER BY length\\(path\\)").
+		WithArgs("/5/9/", userA.ID).
+		WillReturnRows(sqlmock.NewRows(folderColumns).
+			AddRow(5, userA.ID, 0, 0, "Pleadings", "/5/", now).
+			AddRow(9, userA.ID, 0, 5, "Drafts", "/5/9/", now))
+	mock.ExpectQuery("SELECT .* FROM folders WHERE COALESCE\\(parent_id, 0\\) = \\$1 AND "+withGrants("user_id = \\$2 AND org_id IS NULL")+" ORDER BY name").
+		WithArgs(9, userA.ID).
+		WillReturnRows(sqlmock.NewRows(folderColumns).AddRow(14, userA.ID, 0, 9, "Exhibits", "/5/9/14/", now))
+	mock.ExpectQuery("SELECT .* FROM files WHERE COALESCE\\(folder_id, 0\\) = \\$1 AND "+withGrants("user_id = \\$2 AND org_id IS NULL")+" AND deleted_at IS NULL AND "+notExpired("files")).
+		WithArgs(9, userA.ID).
+		WillReturnRows(sqlmock.NewRows(fileColumns).
+			AddRow(7, "brief.pdf", "brief.pdf", now, 100, ".pdf", "", "", false, nil, 9, "application/pdf", "clean"))
+
+	rr := httptest.NewRecorder()
+	fileupload.ListFolder(rr, requestAs("GET", "/folders/9", userA), db, 9)
+	var contents fileupload.FolderContents
+	json.NewDecoder(rr.Body).Decode(&contents)
+	if rr.Code != http.StatusOK || contents.Folder == nil || contents.Folder.ID != 9 {
+		t.Fatalf("List: got %v %+v", rr.Code, contents)
+	}
+	if len(contents.Breadcrumbs) != 2 || contents.Breadcrumbs[0].Name != "Pleadings" || contents.Breadcrumbs[1].Name != "Drafts" {
+		t.Errorf("Unexpected breadcrumbs: %+v", contents.Breadcrumbs)
+	}
+	if len(contents.Folders) != 1 || contents.Folders[0].Name != "Exhibits" || len(contents.Files) != 1 || contents.Files[0].FolderID != 9 {
+		t.Errorf("Unexpected contents: %+v %+v", contents.Folders, contents.Files)
+	}
+	// Files link to their download endpoint, not to where their contents are stored
+	if len(contents.Files) == 1 && contents.Files[0].LocalPath != "http://localhost:8080/files/7/content" {
+		t.Errorf("local_path = %q, want the download endpoint", contents.Files[0].LocalPath)
+	}
+
+	// The top of the tree has no folder and no breadcrumbs
+	mock.ExpectQuery("SELECT .* FROM folders WHERE COALESCE\\(parent_id, 0\\) = \\$1").
+		WithArgs(0, userA.ID).
+		WillReturnRows(sqlmock.NewRows(folderColumns).AddRow(5, userA.ID, 0, 0, "Pleadings", "/5/", now))
+	mock.ExpectQuery("SELECT .* FROM files WHERE COALESCE\\(folder_id, 0\\) = \\$1").
+		WithArgs(0, userA.ID).
+		WillReturnRows(sqlmock.NewRows(fileColumns))
+	rr = httptest.NewRecorder()
+	fileupload.ListFolder(rr, requestAs("GET", "/folders", userA), db, 0)
+	contents = fileupload.FolderContents{}
+	json.NewDecoder(rr.Body).Decode(&contents)
+	if rr.Code != http.StatusOK || contents.Folder != nil || len(contents.Breadcrumbs) != 0 || len(contents.Folders) != 1 || contents.Files == nil {
+		t.Errorf("List top: got %v %+v", rr.Code, contents)
+	}
+
+	// Folders of other users are not found unless they were granted
+	mock.ExpectQuery(listFolderQuery).
+		WithArgs(9, userB.ID).
+		WillReturnRows(sqlmock.NewRows(folderColumns))
+	rr = httptest.NewRecorder()
+	fileupload.ListFolder(rr, requestAs("GET", "/folders/9", userB), db, 9)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Other user's folder: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteFolder(t *testing.T) {
+	log.Println("--- Starting TestDeleteFolder ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+
+	mr.Set("user_files:1", "[listing with files 7 and 8]")
+
+	// Files anywhere below the folder go to the trash
+	mock.ExpectBegin()
+	expectFolderLock(mock)
+	expectFolder(mock, 5, 0, "Pleadings", "/5/")
+	mock.ExpectQuery("UPDATE files SET deleted_at = NOW\\(\\)\\s+WHERE folder_id IN \\(SELECT id FROM folders WHERE path LIKE \\$1 \\|\\| '%'\\) AND deleted_at IS NULL AND user_id = \\$2 AND org_id IS NULL RETURNING id").
+		WithArgs("/5/", userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7).AddRow(8))
+	mock.ExpectExec("DELETE FROM folders WHERE id = \\$1").
+		WithArgs(5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	fileupload.DeleteFolder(rr, requestAs("DELETE", "/folders/5", userA), db, redisClient, 5)
+	var resp struct {
+		TrashedFiles int `json:"trashed_files"`
+	}
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if rr.Code != http.StatusOK || resp.TrashedFiles != 2 {
+		t.Fatalf("Delete: got %v, %d files trashed", rr.Code, resp.TrashedFiles)
+	}
+	if mr.Exists("user_files:1") {
+		t.Error("Cached listing of the trashed files was not invalidated")
+	}
+
+	mock.ExpectBegin()
+	expectFolderLock(mock)
+	mock.ExpectQuery(loadFolderQuery).
+		WithArgs(5, userA.ID).
+		WillReturnRows(sqlmock.NewRows(folderColumns))
+	mock.ExpectRollback()
+	rr = httptest.NewRecorder()
+	fileupload.DeleteFolder(rr, requestAs("DELETE", "/folders/5", userA), db, redisClient, 5)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Deleted folder: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFolderScopedListingAndSearch(t *testing.T) {
+	log.Println("--- Starting TestFolderScopedListingAndSearch ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+
+	// A listing of one folder neither comes from nor replaces the cached listing
+	mr.Set("user_files:1", "[complete listing]")
+	mock.ExpectQuery("SELECT .* FROM files WHERE user_id = \\$1 AND org_id IS NULL AND deleted_at IS NULL AND "+notExpired("files")+" AND COALESCE\\(folder_id, 0\\) = \\$2").
+		WithArgs(userA.ID, 9).
+		WillReturnRows(sqlmock.NewRows(fileColumns).
+			AddRow(7, "brief.pdf", "brief.pdf", time.Now(), 100, ".pdf", "", "", false, nil, 9, "application/pdf", "clean"))
+	rr := httptest.NewRecorder()
+	fileupload.RetrieveFiles(rr, requestAs("GET", "/files?folder_id=9", userA), db, redisClient)
+	var files []models.File
+	json.NewDecoder(rr.Body).Decode(&files)
+	if rr.Code != http.StatusOK || len(files) != 1 || files[0].FolderID != 9 {
+		t.Errorf("Folder listing: got %v %+v", rr.Code, files)
+	}
+	if cached, _ := mr.Get("user_files:1"); cached != "[complete listing]" {
+		t.Errorf("Cached listing changed to %q", cached)
+	}
+
+	// Searches cover the folders below too
+	mock.ExpectQuery("SELECT .* FROM files WHERE "+withGrants("user_id = \\$1 AND org_id IS NULL")+" AND deleted_at IS NULL AND "+notExpired("files")+" AND file_name ILIKE \\$2 AND folder_id IN \\(SELECT id FROM folders WHERE path LIKE '%/' \\|\\| \\$3 \\|\\| '/%'\\)").
+		WithArgs(userA.ID, "%brief%", "5").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "file_name", "original_name", "upload_date", "size", "mime_type"}).
+			AddRow(7, "brief.pdf", "brief.pdf", time.Now(), 100, "application/pdf"))
+	rr = httptest.NewRecorder()
+	fileupload.SearchFiles(rr, requestAs("GET", "/search?name=brief&folder_id=5", userA), db, redisClient)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Folder search: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	for _, target := range []string{"/files?folder_id=x", "/search?folder_id=-1"} {
+		rr = httptest.NewRecorder()
+		if strings.HasPrefix(target, "/files") {
+			fileupload.RetrieveFiles(rr, requestAs("GET", target, userA), db, redisClient)
+		} else {
+			fileupload.SearchFiles(rr, requestAs("GET", target, userA), db, redisClient)
+		}
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %v, want %v", target, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMoveAndCopyFile(t *testing.T) {
+	log.Println("--- Starting TestMoveAndCopyFile ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Moving a file into a folder
+	expectFolder(mock, 9, 5, "Drafts", "/5/9/")
+	mock.ExpectQuery("UPDATE files SET file_name = COALESCE\\(\\$1, file_name\\), description = COALESCE\\(\\$2, description\\), folder_id = \\$3 WHERE id = \\$4 AND deleted_at IS NULL AND "+notExpired("files")+" AND user_id = \\$5 AND org_id IS NULL").
+		WithArgs(nil, nil, 9, 7, userA.ID).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns).AddRow(7, userA.ID, 0, "brief.pdf", "brief.pdf",
+			time.Now(), 100, ".pdf", "", "", false, nil, 9, "application/pdf", "clean"))
+	rr := httptest.NewRecorder()
+	fileupload.UpdateFile(rr, patchFile(`{"folder_id": 9}`, userA), db, nil, 7)
+	var file models.File
+	json.NewDecoder(rr.Body).Decode(&file)
+	if rr.Code != http.StatusOK || file.FolderID != 9 {
+		t.Errorf("Move: got %v %+v", rr.Code, file)
+	}
+
+	// and into a folder of another user
+	mock.ExpectQuery(loadFolderQuery).
+		WithArgs(40, userA.ID).
+		WillReturnRows(sqlmock.NewRows(folderColumns))
+	rr = httptest.NewRecorder()
+	fileupload.UpdateFile(rr, patchFile(`{"folder_id": 40}`, userA), db, nil, 7)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Move to unknown folder: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// A copy shares the contents of the file instead of storing them again
+	content := "%PDF-1.4 brief"
+	mock.ExpectQuery("SELECT f.file_name, f.original_name, f.storage_key, f.size, f.file_type, f.description, COALESCE\\(f.folder_id, 0\\), f.mime_type, f.expiration_date, v.sha256\\s+FROM files f JOIN file_versions v .* WHERE f.id = \\$1 AND f.deleted_at IS NULL AND "+notExpired("f")+" AND user_id = \\$2 AND org_id IS NULL").
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"file_name", "original_name", "storage_key", "size", "file_type", "description", "folder_id", "mime_type", "expiration_date", "sha256"}).
+			AddRow("brief.pdf", "brief.pdf", "f3a1.pdf", len(content), ".pdf", "Final", 9, "application/pdf", nil, sha256Hex(content)))
+	expectFolder(mock, 12, 0, "Archive", "/12/")
+	expectNoQuota(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO blobs").
+		WithArgs("f3a1.pdf", sha256Hex(content), int64(len(content))).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("UPDATE blobs SET ref_count = ref_count \\+ 1").
+		WithArgs("f3a1.pdf", sha256Hex(content)).
+		WillReturnRows(sqlmock.NewRows([]string{"storage_key"}).AddRow("f3a1.pdf"))
+	mock.ExpectQuery("INSERT INTO files .* RETURNING id").
+		WithArgs(userA.ID, "brief (copy).pdf", sqlmock.AnyArg(), int64(len(content)),
+			".pdf", "", "Final", false, sqlmock.AnyArg(), nil, "brief.pdf", "f3a1.pdf", sha256Hex(content), 12, "application/pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+	mock.ExpectCommit()
+
+	rr = httptest.NewRecorder()
+	fileupload.CopyFile(rr, jsonRequest("POST", "/files/7/copy", `{"folder_id": 12, "file_name": "brief (copy).pdf"}`, userA), db, nil, 7)
+	file = models.File{}
+	json.NewDecoder(rr.Body).Decode(&file)
+	if rr.Code != http.StatusCreated || file.ID != 8 || file.FolderID != 12 || file.SHA256 != sha256Hex(content) ||
+		file.LocalPath != "http://localhost:8080/files/8/content" {
+		t.Fatalf("Copy: got %v %+v", rr.Code, file)
+	}
+	if stored, _ := filepath.Glob(filepath.Join(backend.Dir, "*")); len(stored) != 0 {
+		t.Errorf("Copy stored contents: %v", stored)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,273 @@
+package test
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// withGrants matches the condition limiting files or folders to those of a tenant,
+// matched by scope, widened to those granted to the tenant
+func withGrants(scope string) string {
+	return "\\(" + scope + " OR EXISTS \\(SELECT 1 FROM file_grants g .*\\)\\)"
+}
+
+// grantedTo matches the grants to a tenant with one of roles
+func grantedTo(column string, n int, roles string) string {
+	return regexp.QuoteMeta("g." + column + " = $" + strconv.Itoa(n) + " AND g.role IN " + roles)
+}
+
+var grantColumns = []string{"id", "file_id", "folder_id", "user_id", "email", "org_id", "role", "granted_by", "created_at"}
+
+func TestCreateGrant(t *testing.T) {
+	log.Println("--- Starting TestCreateGrant ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Only the owner and co-owners grant access
+	ownerQuery := "SELECT user_id, COALESCE\\(org_id, 0\\) FROM files WHERE id = \\$1 AND deleted_at IS NULL AND " + notExpired("files") + " AND " +
+		"\\(user_id = \\$2 AND org_id IS NULL OR EXISTS .*" + grantedTo("grantee_user_id", 2, "('co-owner')")
+	mock.ExpectQuery(ownerQuery).
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "org_id"}).AddRow(userA.ID, 0))
+	mock.ExpectQuery("SELECT id, email FROM users WHERE email = \\$1 AND disabled = FALSE").
+		WithArgs("b@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email"}).AddRow(userB.ID, "b@example.com"))
+	mock.ExpectQuery("INSERT INTO file_grants \\(file_id, folder_id, grantee_user_id, grantee_org_id, role, granted_by\\)\\s+VALUES .*\\s+ON CONFLICT .* DO UPDATE SET role = EXCLUDED.role").
+		WithArgs(7, nil, userB.ID, nil, "editor", userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, time.Now()))
+
+	rr := httptest.NewRecorder()
+	fileupload.CreateFileGrant(rr, jsonRequest("POST", "/files/7/grants", `{"email": " b@example.com ", "role": "editor"}`, userA), db, 7)
+	var grant models.Grant
+	json.NewDecoder(rr.Body).Decode(&grant)
+	if rr.Code != http.StatusCreated || grant.ID != 3 || grant.FileID != 7 || grant.UserID != userB.ID || grant.Role != models.GrantEditor {
+		t.Errorf("Grant: got %v %+v", rr.Code, grant)
+	}
+
+	// Folders are granted to organizations along with everything below them
+	mock.ExpectQuery("SELECT user_id, COALESCE\\(org_id, 0\\) FROM folders WHERE id = \\$1 AND "+withGrants("user_id = \\$2 AND org_id IS NULL")).
+		WithArgs(9, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "org_id"}).AddRow(userA.ID, 0))
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM organizations WHERE id = \\$1\\)").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("INSERT INTO file_grants").
+		WithArgs(nil, 9, nil, 5, "viewer", userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(4, time.Now()))
+	rr = httptest.NewRecorder()
+	fileupload.CreateFolderGrant(rr, jsonRequest("POST", "/folders/9/grants", `{"org_id": 5, "role": "viewer"}`, userA), db, 9)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Folder grant: got %v, want %v", rr.Code, http.StatusCreated)
+	}
+
+	for _, body := range []string{
+		`{"role": "viewer"}`,
+		`{"email": "b@example.com", "org_id": 5, "role": "viewer"}`,
+		`{"email": "b@example.com", "role": "owner"}`,
+		`not json`,
+	} {
+		rr = httptest.NewRecorder()
+		fileupload.CreateFileGrant(rr, jsonRequest("POST", "/files/7/grants", body, userA), db, 7)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Grant with %s: got %v, want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Files the caller neither owns nor co-owns are not found
+	mock.ExpectQuery(ownerQuery).WithArgs(7, userB.ID).WillReturnRows(sqlmock.NewRows([]string{"user_id", "org_id"}))
+	rr = httptest.NewRecorder()
+	fileupload.CreateFileGrant(rr, jsonRequest("POST", "/files/7/grants", `{"email": "a@example.com", "role": "co-owner"}`, userB), db, 7)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Grant by a viewer: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	mock.ExpectQuery(ownerQuery).WithArgs(7, userA.ID).WillReturnRows(sqlmock.NewRows([]string{"user_id", "org_id"}).AddRow(userA.ID, 0))
+	mock.ExpectQuery("SELECT id, email FROM users").WithArgs("nobody@example.com").WillReturnRows(sqlmock.NewRows([]string{"id", "email"}))
+	rr = httptest.NewRecorder()
+	fileupload.CreateFileGrant(rr, jsonRequest("POST", "/files/7/grants", `{"email": "nobody@example.com", "role": "viewer"}`, userA), db, 7)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Grant to an unknown user: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// A co-owner cannot grant the owner access to their own file
+	mock.ExpectQuery(ownerQuery).WithArgs(7, userB.ID).WillReturnRows(sqlmock.NewRows([]string{"user_id", "org_id"}).AddRow(userA.ID, 0))
+	mock.ExpectQuery("SELECT id, email FROM users").WithArgs("a@example.com").WillReturnRows(sqlmock.NewRows([]string{"id", "email"}).AddRow(userA.ID, "a@example.com"))
+	rr = httptest.NewRecorder()
+	fileupload.CreateFileGrant(rr, jsonRequest("POST", "/files/7/grants", `{"email": "a@example.com", "role": "viewer"}`, userB), db, 7)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Grant to the owner: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGrantRolesLimitFileAccess(t *testing.T) {
+	log.Println("--- Starting TestGrantRolesLimitFileAccess ---")
+	useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+
+	// Every role views, directly or through a folder above the file
+	mock.ExpectQuery("SELECT file_name, storage_key, .* FROM files WHERE id = \\$1 AND deleted_at IS NULL AND "+notExpired("files")+" AND .*"+
+		grantedTo("grantee_user_id", 2, "('viewer', 'commenter', 'editor', 'co-owner')")+
+		regexp.QuoteMeta(" AND (g.file_id = files.id OR g.folder_id IN (SELECT gf.id FROM folders gf JOIN folders ff ON ff.path LIKE gf.path || '%' WHERE ff.id = files.folder_id))")).
+		WithArgs(7, userB.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"file_name", "storage_key", "file_type", "mime_type", "upload_date", "scan_status"}))
+	rr := httptest.NewRecorder()
+	fileupload.DownloadFile(rr, requestAs("GET", "/files/7/content", userB), db, 7)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Download without a grant: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Editors rename
+	mock.ExpectQuery("UPDATE files SET .* WHERE id = \\$3 AND deleted_at IS NULL AND "+notExpired("files")+" AND \\(user_id = \\$4 AND org_id IS NULL OR EXISTS .*"+
+		grantedTo("grantee_user_id", 4, "('editor', 'co-owner')")).
+		WithArgs(nil, "Shared notes", 7, userB.ID).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns).AddRow(7, userA.ID, 0, "brief.pdf", "brief.pdf",
+			time.Now(), 100, ".pdf", "", "Shared notes", false, nil, 0, "application/pdf", "clean"))
+	mr.Set("user_files:1", "[listing]")
+	rr = httptest.NewRecorder()
+	fileupload.UpdateFile(rr, jsonRequest("PATCH", "/files/7", `{"description": "Shared notes"}`, userB), db, redisClient, 7)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Update by an editor: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	if mr.Exists("user_files:1") {
+		t.Error("The owner's cached listing was not invalidated")
+	}
+
+	// but only the owner moves files between folders
+	mock.ExpectQuery("UPDATE files SET .*, folder_id = \\$3 WHERE id = \\$4 AND deleted_at IS NULL AND "+notExpired("files")+" AND user_id = \\$5 AND org_id IS NULL RETURNING").
+		WithArgs(nil, nil, nil, 7, userB.ID).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns))
+	rr = httptest.NewRecorder()
+	fileupload.UpdateFile(rr, jsonRequest("PATCH", "/files/7", `{"folder_id": 0}`, userB), db, redisClient, 7)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Move by an editor: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Co-owners delete, to the owner's trash. Grants to an organization apply in it.
+	inOrg := requestAs("DELETE", "/files/7", userB)
+	inOrg = inOrg.WithContext(auth.WithMembership(inOrg.Context(), models.Membership{OrgID: 5, UserID: userB.ID, Role: models.OrgRoleMember}))
+	mock.ExpectQuery("UPDATE files SET deleted_at = NOW\\(\\) WHERE id = \\$1 AND deleted_at IS NULL AND "+"\\(org_id = \\$2 OR EXISTS .*"+
+		grantedTo("grantee_org_id", 2, "('co-owner')")).
+		WithArgs(7, 5).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "org_id"}).AddRow(userA.ID, 0))
+	mr.Set("user_files:1", "[listing]")
+	rr = httptest.NewRecorder()
+	fileupload.DeleteFile(rr, inOrg, db, redisClient, 7)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Delete by a co-owner: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	if mr.Exists("user_files:1") {
+		t.Error("The owner's cached listing was not invalidated")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListAndDeleteGrants(t *testing.T) {
+	log.Println("--- Starting TestListAndDeleteGrants ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT user_id, COALESCE\\(org_id, 0\\) FROM files WHERE id = \\$1").
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "org_id"}).AddRow(userA.ID, 0))
+	mock.ExpectQuery("SELECT g.id, .* FROM file_grants g LEFT JOIN users u ON u.id = g.grantee_user_id\\s+WHERE g.file_id = \\$1 ORDER BY g.created_at").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(grantColumns).
+			AddRow(3, 7, 0, userB.ID, "b@example.com", 0, "editor", userA.ID, now).
+			AddRow(4, 7, 0, 0, "", 5, "viewer", userA.ID, now))
+	rr := httptest.NewRecorder()
+	fileupload.ListFileGrants(rr, requestAs("GET", "/files/7/grants", userA), db, 7)
+	var grants []models.Grant
+	json.NewDecoder(rr.Body).Decode(&grants)
+	if rr.Code != http.StatusOK || len(grants) != 2 || grants[0].Email != "b@example.com" || grants[1].OrgID != 5 || grants[1].UserID != 0 {
+		t.Errorf("List: got %v %+v", rr.Code, grants)
+	}
+
+	// Grants are deleted by whoever manages the file or folder, or by the grantee
+	deleteQuery := "DELETE FROM file_grants WHERE id = \\$1 AND \\(grantee_user_id = \\$2\\s+OR file_id IN \\(SELECT id FROM files WHERE .*\\)\\s+OR folder_id IN \\(SELECT id FROM folders WHERE .*\\)\\)"
+	mock.ExpectExec(deleteQuery).WithArgs(3, userB.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	rr = httptest.NewRecorder()
+	fileupload.DeleteGrant(rr, requestAs("DELETE", "/grants/3", userB), db, 3)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Delete: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	mock.ExpectExec(deleteQuery).WithArgs(3, userB.ID).WillReturnResult(sqlmock.NewResult(0, 0))
+	rr = httptest.NewRecorder()
+	fileupload.DeleteGrant(rr, requestAs("DELETE", "/grants/3", userB), db, 3)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Delete of an unknown grant: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListSharedWithMe(t *testing.T) {
+	log.Println("--- Starting TestListSharedWithMe ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT .*, shared.role, shared.granted_by, shared.shared_at FROM folders\\s+JOIN \\(SELECT folder_id, .* FROM file_grants WHERE grantee_user_id = \\$1\\) shared").
+		WithArgs(userB.ID).
+		WillReturnRows(sqlmock.NewRows(append(folderColumns, "role", "granted_by", "shared_at")).
+			AddRow(9, userA.ID, 0, 5, "Drafts", "/5/9/", now, "viewer", userA.ID, now))
+	mock.ExpectQuery("SELECT .*, user_id, COALESCE\\(org_id, 0\\), shared.role, shared.granted_by, shared.shared_at FROM files\\s+JOIN \\(SELECT file_id, .* FROM file_grants WHERE grantee_user_id = \\$1\\) shared\\s+ON shared.file_id = files.id WHERE files.deleted_at IS NULL AND " + notExpired("files")).
+		WithArgs(userB.ID).
+		WillReturnRows(sqlmock.NewRows(append(fileColumns, "user_id", "org_id", "role", "granted_by", "shared_at")).
+			AddRow(7, "brief.pdf", "brief.pdf", now, 100, ".pdf", "", "", false, nil, 0, "application/pdf", "clean", userA.ID, 0, "editor", userA.ID, now))
+
+	rr := httptest.NewRecorder()
+	fileupload.ListSharedWithMe(rr, requestAs("GET", "/shared-with-me", userB), db)
+	var shared fileupload.SharedWithMe
+	json.NewDecoder(rr.Body).Decode(&shared)
+	if rr.Code != http.StatusOK || len(shared.Folders) != 1 || shared.Folders[0].Name != "Drafts" || shared.Folders[0].Role != "viewer" {
+		t.Errorf("Shared folders: got %v %+v", rr.Code, shared.Folders)
+	}
+	if len(shared.Files) != 1 || shared.Files[0].FileName != "brief.pdf" || shared.Files[0].UserID != userA.ID || shared.Files[0].Role != "editor" {
+		t.Errorf("Shared files: %+v", shared.Files)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,138 @@
+package test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	return key
+}
+
+func useKeyRing(t *testing.T, ring *auth.KeyRing) {
+	t.Helper()
+	auth.SetKeyRing(ring)
+	t.Cleanup(func() { auth.SetKeyRing(nil) })
+}
+
+func TestKeyRotationKeepsOldTokensValid(t *testing.T) {
+	log.Println("--- Starting TestKeyRotationKeepsOldTokensValid ---")
+	ring := auth.NewKeyRing()
+	if err := ring.AddHMAC("hs-1", []byte("old-secret")); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	if err := ring.SetActive("hs-1"); err != nil {
+		t.Fatalf("Failed to activate key: %v", err)
+	}
+	useKeyRing(t, ring)
+
+	oldToken, _, err := auth.GenerateToken(userA, "")
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	// Rotate to an RSA key; the HMAC key stays in the ring for verification
+	if err := ring.AddRSA("rsa-1", newTestRSAKey(t)); err != nil {
+		t.Fatalf("Failed to add key: %v", err)
+	}
+	if err := ring.SetActive("rsa-1"); err != nil {
+		t.Fatalf("Failed to activate key: %v", err)
+	}
+	newToken, _, err := auth.GenerateToken(userA, "")
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	parsed, _ := jwt.Parse(newToken, nil)
+	if parsed.Header["kid"] != "rsa-1" || parsed.Header["alg"] != "RS256" {
+		t.Errorf("New token header = %v, want kid rsa-1 and alg RS256", parsed.Header)
+	}
+
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		claims, err := auth.ParseToken(token)
+		if err != nil {
+			t.Errorf("%s token rejected after rotation: %v", name, err)
+		} else if claims.UserID != userA.ID {
+			t.Errorf("%s token subject = %d, want %d", name, claims.UserID, userA.ID)
+		}
+	}
+}
+
+func TestKeyRingPinsAlgorithm(t *testing.T) {
+	log.Println("--- Starting TestKeyRingPinsAlgorithm ---")
+	private := newTestRSAKey(t)
+	ring := auth.NewKeyRing()
+	ring.AddRSA("rsa-1", private)
+	ring.SetActive("rsa-1")
+	useKeyRing(t, ring)
+
+	// Classic confusion attack: HS256 keyed with the published RSA public key
+	publicDER, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	claims := jwt.MapClaims{"typ": "access", "sub": "1", "jti": "x", "exp": time.Now().Add(time.Hour).Unix()}
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = "rsa-1"
+	forgedToken, _ := forged.SignedString(publicPEM)
+	if _, err := auth.ParseToken(forgedToken); err == nil {
+		t.Error("HS256 token accepted for an RS256 key")
+	}
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	unknown.Header["kid"] = "rsa-unknown"
+	unknownToken, _ := unknown.SignedString(private)
+	if _, err := auth.ParseToken(unknownToken); err == nil {
+		t.Error("Token with unknown kid accepted")
+	}
+
+	noKid, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(private)
+	if _, err := auth.ParseToken(noKid); err == nil {
+		t.Error("Token without kid accepted")
+	}
+}
+
+func TestJWKSPublishesOnlyPublicKeys(t *testing.T) {
+	log.Println("--- Starting TestJWKSPublishesOnlyPublicKeys ---")
+	private := newTestRSAKey(t)
+	ring := auth.NewKeyRing()
+	ring.AddHMAC("hs-1", []byte("secret"))
+	ring.AddRSA("rsa-1", private)
+	ring.SetActive("hs-1")
+	useKeyRing(t, ring)
+
+	rr := httptest.NewRecorder()
+	auth.JWKS(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+	var doc struct {
+		Keys []auth.JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil {
+		t.Fatalf("Failed to decode JWKS: %v", err)
+	}
+	if len(doc.Keys) != 1 {
+		t.Fatalf("JWKS has %d keys, want 1: %+v", len(doc.Keys), doc.Keys)
+	}
+	key := doc.Keys[0]
+	if key.KeyID != "rsa-1" || key.KeyType != "RSA" || key.Algorithm != "RS256" || key.N == "" || key.E != "AQAB" {
+		t.Errorf("Unexpected JWK: %+v", key)
+	}
+}
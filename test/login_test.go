@@ -0,0 +1,99 @@
+package test
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const loginQuery = "SELECT id, email, password, role, disabled, totp_enabled FROM users WHERE email = \\$1"
+
+func login(email, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/login", jsonBody(map[string]string{"email": email, "password": password}))
+	req.RemoteAddr = "203.0.113.7:4000"
+	rr := httptest.NewRecorder()
+	auth.LoginUser(rr, req)
+	return rr
+}
+
+func expectLoginLookup(mock sqlmock.Sqlmock, hash []byte) {
+	mock.ExpectQuery(loginQuery).
+		WithArgs(userA.Email).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "password", "role", "disabled", "totp_enabled"}).
+			AddRow(userA.ID, userA.Email, string(hash), models.RoleMember, false, false))
+}
+
+func TestLoginFailuresAreUniform(t *testing.T) {
+	log.Println("--- Starting TestLoginFailuresAreUniform ---")
+	mock := setupSessionStore(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secure_password"), bcrypt.MinCost)
+
+	mock.ExpectQuery(loginQuery).
+		WithArgs("nobody@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "password", "role", "disabled", "totp_enabled"}))
+	unknown := login("nobody@example.com", "secure_password")
+
+	expectLoginLookup(mock, hash)
+	wrong := login(userA.Email, "wrong_password")
+
+	if unknown.Code != http.StatusUnauthorized || wrong.Code != http.StatusUnauthorized {
+		t.Errorf("Got status %v and %v, want %v for both", unknown.Code, wrong.Code, http.StatusUnauthorized)
+	}
+	if unknown.Body.String() != wrong.Body.String() {
+		t.Errorf("Unknown account and wrong password responses differ: %q vs %q", unknown.Body.String(), wrong.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLoginLockoutAndAdminClear(t *testing.T) {
+	log.Println("--- Starting TestLoginLockoutAndAdminClear ---")
+	mock := setupSessionStore(t)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secure_password"), bcrypt.MinCost)
+
+	for i := 0; i < 5; i++ {
+		expectLoginLookup(mock, hash)
+		if rr := login(userA.Email, "wrong_password"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: got status %v, want %v", i+1, rr.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// Locked out: even the right password is refused without touching the database
+	rr := login(userA.Email, "secure_password")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Locked login got status %v, want %v", rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Locked login response has no Retry-After header")
+	}
+
+	// The lockout applies to the email in any letter case
+	if rr := login(strings.ToUpper(userA.Email), "secure_password"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Upper-case email got status %v, want %v", rr.Code, http.StatusTooManyRequests)
+	}
+
+	clear := httptest.NewRecorder()
+	auth.ClearLockout(clear, httptest.NewRequest("DELETE", "/admin/lockouts?email="+userA.Email, nil))
+	if clear.Code != http.StatusOK {
+		t.Fatalf("ClearLockout got status %v, want %v", clear.Code, http.StatusOK)
+	}
+
+	expectLoginLookup(mock, hash)
+	if rr := login(userA.Email, "secure_password"); rr.Code != http.StatusOK {
+		t.Errorf("Login after clearing lockout got status %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,297 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// totpAt is an independent RFC 6238 implementation used to drive the flows
+func totpAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("Bad secret %q: %v", secret, err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(at.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// expectTOTPStepSpent expects a TOTP code of userA to be marked used, which fails
+// if a code of the same or a later time step was used before
+func expectTOTPStepSpent(mock sqlmock.Sqlmock, spent bool) {
+	affected := int64(1)
+	if !spent {
+		affected = 0
+	}
+	mock.ExpectExec("UPDATE users SET totp_last_step = \\$1 WHERE id = \\$2 AND \\(totp_last_step IS NULL OR totp_last_step < \\$1\\)").
+		WithArgs(sqlmock.AnyArg(), userA.ID).
+		WillReturnResult(sqlmock.NewResult(0, affected))
+}
+
+func TestTOTPReferenceVector(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 secret "12345678901234567890" at T=59 is 94287082
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	if got := totpAt(t, secret, time.Unix(59, 0)); got != "287082" {
+		t.Fatalf("totpAt = %s, want 287082", got)
+	}
+}
+
+func TestMFAEnrollmentAndLogin(t *testing.T) {
+	log.Println("--- Starting TestMFAEnrollmentAndLogin ---")
+	mock := setupSessionStore(t)
+
+	// Enroll
+	mock.ExpectQuery("SELECT totp_enabled FROM users WHERE id = \\$1").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_enabled"}).AddRow(false))
+	mock.ExpectExec("UPDATE users SET totp_secret = \\$1 WHERE id = \\$2").
+		WithArgs(sqlmock.AnyArg(), userA.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := httptest.NewRecorder()
+	auth.EnrollMFA(rr, requestAs("POST", "/mfa/enroll", userA))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Enroll returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	var enrollment map[string]string
+	json.NewDecoder(rr.Body).Decode(&enrollment)
+	secret := enrollment["secret"]
+	uri, err := url.Parse(enrollment["otpauth_uri"])
+	if err != nil || uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Query().Get("secret") != secret {
+		t.Fatalf("Unexpected otpauth URI %q for secret %q", enrollment["otpauth_uri"], secret)
+	}
+
+	// Confirm with a code from the new secret
+	mock.ExpectQuery("SELECT totp_secret, totp_enabled FROM users WHERE id = \\$1").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled"}).AddRow(secret, false))
+	expectTOTPStepSpent(mock, true)
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET totp_enabled = TRUE WHERE id = \\$1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM mfa_recovery_codes WHERE user_id = \\$1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < 10; i++ {
+		mock.ExpectExec("INSERT INTO mfa_recovery_codes").
+			WithArgs(userA.ID, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/mfa/confirm", jsonBody(map[string]string{"code": totpAt(t, secret, time.Now())}))
+	auth.ConfirmMFA(rr, req.WithContext(auth.WithUser(req.Context(), userA)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Confirm returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var confirmation map[string][]string
+	json.NewDecoder(rr.Body).Decode(&confirmation)
+	if len(confirmation["recovery_codes"]) != 10 {
+		t.Errorf("Got %d recovery codes, want 10", len(confirmation["recovery_codes"]))
+	}
+
+	// Password login now only yields a challenge, which is not an access token
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secure_password"), bcrypt.MinCost)
+	mock.ExpectQuery(loginQuery).
+		WithArgs(userA.Email).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "password", "role", "disabled", "totp_enabled"}).
+			AddRow(userA.ID, userA.Email, string(hash), models.RoleMember, false, true))
+	rr = login(userA.Email, "secure_password")
+	var challenge struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		Token       string `json:"token"`
+	}
+	json.NewDecoder(rr.Body).Decode(&challenge)
+	if !challenge.MFARequired || challenge.MFAToken == "" || challenge.Token != "" {
+		t.Fatalf("Expected an MFA challenge, got %+v", challenge)
+	}
+	if code := callProtected(challenge.MFAToken); code != http.StatusUnauthorized {
+		t.Errorf("Challenge token used as access token returned %v, want %v", code, http.StatusUnauthorized)
+	}
+
+	expectMFAUser := func() {
+		mock.ExpectQuery("SELECT id, email, role, disabled, totp_secret, totp_enabled FROM users WHERE id = \\$1").
+			WithArgs(userA.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "disabled", "totp_secret", "totp_enabled"}).
+				AddRow(userA.ID, userA.Email, models.RoleMember, false, secret, true))
+	}
+	verify := func(code string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		auth.VerifyMFALogin(rr, httptest.NewRequest("POST", "/login/mfa",
+			jsonBody(map[string]string{"mfa_token": challenge.MFAToken, "code": code})))
+		return rr
+	}
+
+	// A wrong code falls through to the recovery code check and fails
+	expectMFAUser()
+	mock.ExpectExec("UPDATE mfa_recovery_codes SET used_at = NOW\\(\\)").
+		WithArgs(userA.ID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if rr := verify("000000-wrong"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong code returned %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	// The code used for confirmation was already spent
+	expectMFAUser()
+	expectTOTPStepSpent(mock, false)
+	if rr := verify(totpAt(t, secret, time.Now())); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Spent code returned %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	// The code of the next time step is accepted
+	expectMFAUser()
+	expectTOTPStepSpent(mock, true)
+	rr = verify(totpAt(t, secret, time.Now().Add(30*time.Second)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Valid code returned %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var tokens auth.TokenPair
+	json.NewDecoder(rr.Body).Decode(&tokens)
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Errorf("Expected a token pair, got %+v", tokens)
+	}
+
+	// The challenge is single use
+	if rr := verify(totpAt(t, secret, time.Now())); rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "challenge") {
+		t.Errorf("Replayed challenge returned %v %q, want %v", rr.Code, rr.Body.String(), http.StatusUnauthorized)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMFALockoutSpansChallenges(t *testing.T) {
+	log.Println("--- Starting TestMFALockoutSpansChallenges ---")
+	t.Setenv("JWT_SECRET_KEY", "test-secret")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+	auth.SetDB(db, redisClient)
+	defer auth.SetDB(nil, nil)
+
+	secret := "JBSWY3DPEHPK3PXP"
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secure_password"), bcrypt.MinCost)
+	newChallenge := func() string {
+		mock.ExpectQuery(loginQuery).
+			WithArgs(userA.Email).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "email", "password", "role", "disabled", "totp_enabled"}).
+				AddRow(userA.ID, userA.Email, string(hash), models.RoleMember, false, true))
+		var challenge struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		json.NewDecoder(login(userA.Email, "secure_password").Body).Decode(&challenge)
+		if challenge.MFAToken == "" {
+			t.Fatal("Expected an MFA challenge")
+		}
+		return challenge.MFAToken
+	}
+	expectMFAUser := func() {
+		mock.ExpectQuery("SELECT id, email, role, disabled, totp_secret, totp_enabled FROM users WHERE id = \\$1").
+			WithArgs(userA.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "disabled", "totp_secret", "totp_enabled"}).
+				AddRow(userA.ID, userA.Email, models.RoleMember, false, secret, true))
+	}
+	verify := func(token, code string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		auth.VerifyMFALogin(rr, httptest.NewRequest("POST", "/login/mfa",
+			jsonBody(map[string]string{"mfa_token": token, "code": code})))
+		return rr
+	}
+
+	// Wrong codes count against the user, not only against the challenge
+	token := newChallenge()
+	for i := 0; i < 5; i++ {
+		expectMFAUser()
+		mock.ExpectExec("UPDATE mfa_recovery_codes SET used_at = NOW\\(\\)").
+			WithArgs(userA.ID, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		if rr := verify(token, "000000-wrong"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Wrong code %d returned %v, want %v", i+1, rr.Code, http.StatusUnauthorized)
+		}
+	}
+	lockKey := fmt.Sprintf("mfa_user_lock:%d", userA.ID)
+	if !mr.Exists(lockKey) {
+		t.Fatal("User not locked out after repeated wrong codes")
+	}
+
+	// A fresh challenge does not lift the lockout, even with the right code
+	token = newChallenge()
+	if rr := verify(token, totpAt(t, secret, time.Now())); rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Locked out user returned %v, want %v", rr.Code, http.StatusTooManyRequests)
+	}
+
+	// Once the lockout ran out a correct code logs in and resets the count
+	mr.Del(lockKey)
+	expectMFAUser()
+	expectTOTPStepSpent(mock, true)
+	if rr := verify(token, totpAt(t, secret, time.Now())); rr.Code != http.StatusOK {
+		t.Fatalf("Valid code returned %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if mr.Exists(fmt.Sprintf("mfa_user_attempts:%d", userA.ID)) {
+		t.Errorf("Failure count not cleared by a valid code")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTOTPReplayRefusedWithoutRedis(t *testing.T) {
+	log.Println("--- Starting TestTOTPReplayRefusedWithoutRedis ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+	defer auth.SetDB(nil, nil)
+
+	// A code that was already spent is refused, and not tried as a recovery code
+	secret := "JBSWY3DPEHPK3PXP"
+	mock.ExpectQuery("SELECT totp_secret, totp_enabled FROM users WHERE id = \\$1").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled"}).AddRow(secret, true))
+	expectTOTPStepSpent(mock, false)
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/mfa/disable", jsonBody(map[string]string{"code": totpAt(t, secret, time.Now())}))
+	auth.DisableMFA(rr, req.WithContext(auth.WithUser(req.Context(), userA)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Replayed code returned %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,241 @@
+package test
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// mockIdP is a minimal OpenID Connect provider supporting the authorization code
+// flow with PKCE
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// mutate lets a test tamper with the ID token claims before signing
+	mutate func(jwt.MapClaims)
+	// signer, if set, signs ID tokens instead of the published key
+	signer *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]url.Values
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	idp := &mockIdP{key: newTestRSAKey(t), grants: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]auth.JWK{"keys": {{
+			KeyType: "RSA", KeyID: "idp-1", Algorithm: "RS256", Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		// Log the user in immediately and remember what the code was issued for
+		query := r.URL.Query()
+		code := "code-" + query.Get("state")[:8]
+		idp.mu.Lock()
+		idp.grants[code] = query
+		idp.mu.Unlock()
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code="+code+"&state="+query.Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		grant, ok := idp.grants[r.PostForm.Get("code")]
+		delete(idp.grants, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+
+		clientID, secret, _ := r.BasicAuth()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || clientID != "file-api" || secret != "client-secret" ||
+			grant.Get("code_challenge_method") != "S256" ||
+			grant.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		claims := jwt.MapClaims{
+			"iss":            idp.server.URL,
+			"sub":            "idp-user-42",
+			"aud":            "file-api",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"iat":            time.Now().Add(-time.Second).Unix(),
+			"nonce":          grant.Get("nonce"),
+			"email":          "sso@example.com",
+			"email_verified": true,
+		}
+		if idp.mutate != nil {
+			idp.mutate(claims)
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "idp-1"
+		signer := idp.key
+		if idp.signer != nil {
+			signer = idp.signer
+		}
+		idToken, _ := token.SignedString(signer)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	auth.SetOIDCProviders([]*auth.OIDCProvider{{
+		Name:         "corp",
+		Issuer:       idp.server.URL,
+		ClientID:     "file-api",
+		ClientSecret: "client-secret",
+		RedirectURL:  "http://localhost:8080/oidc/corp/callback",
+	}})
+	t.Cleanup(func() { auth.SetOIDCProviders(nil) })
+	return idp
+}
+
+// oidcLogin runs the browser side of the flow and returns the callback request
+func oidcLogin(t *testing.T) *http.Request {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	auth.OIDCLogin(rr, httptest.NewRequest("GET", "/oidc/corp/login", nil), "corp")
+	if rr.Code != http.StatusFound {
+		t.Fatalf("Login returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusFound, rr.Body.String())
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(rr.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Authorize request failed: %v", err)
+	}
+	resp.Body.Close()
+	return httptest.NewRequest("GET", resp.Header.Get("Location"), nil)
+}
+
+func oidcCallback(req *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	auth.OIDCCallback(rr, req, "corp")
+	return rr
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	log.Println("--- Starting TestOIDCLoginProvisionsUser ---")
+	mock := setupSessionStore(t)
+	idp := newMockIdP(t)
+
+	mock.ExpectQuery("SELECT u.id, u.email, u.role, u.disabled, u.totp_enabled FROM user_identities i").
+		WithArgs(idp.server.URL, "idp-user-42").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "disabled", "totp_enabled"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, email, role, disabled, totp_enabled FROM users WHERE email = \\$1").
+		WithArgs("sso@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "disabled", "totp_enabled"}))
+	mock.ExpectQuery("INSERT INTO users \\(email, password, email_verified\\) VALUES \\(\\$1, \\$2, TRUE\\) RETURNING id, role").
+		WithArgs("sso@example.com", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "role"}).AddRow(9, models.RoleMember))
+	mock.ExpectExec("INSERT INTO user_identities \\(user_id, issuer, subject, email\\)").
+		WithArgs(9, idp.server.URL, "idp-user-42", "sso@example.com").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	callback := oidcLogin(t)
+	rr := oidcCallback(callback)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Callback returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var tokens auth.TokenPair
+	json.NewDecoder(rr.Body).Decode(&tokens)
+	claims, err := auth.ParseToken(tokens.AccessToken)
+	if err != nil || claims.UserID != 9 {
+		t.Errorf("Expected an access token for user 9, got %+v (%v)", claims, err)
+	}
+
+	// The state cannot be replayed
+	if rr := oidcCallback(callback); rr.Code != http.StatusBadRequest {
+		t.Errorf("Replayed state returned %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestOIDCLoginUsesLinkedIdentity(t *testing.T) {
+	log.Println("--- Starting TestOIDCLoginUsesLinkedIdentity ---")
+	mock := setupSessionStore(t)
+	idp := newMockIdP(t)
+
+	// A linked account with two-factor enabled still gets the challenge
+	mock.ExpectQuery("SELECT u.id, u.email, u.role, u.disabled, u.totp_enabled FROM user_identities i").
+		WithArgs(idp.server.URL, "idp-user-42").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "disabled", "totp_enabled"}).
+			AddRow(userA.ID, userA.Email, models.RoleMember, false, true))
+
+	rr := oidcCallback(oidcLogin(t))
+	var challenge map[string]interface{}
+	json.NewDecoder(rr.Body).Decode(&challenge)
+	if rr.Code != http.StatusOK || challenge["mfa_required"] != true || challenge["token"] != nil {
+		t.Errorf("Expected an MFA challenge, got %v %v", rr.Code, challenge)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestOIDCCallbackRejectsBadIDTokens(t *testing.T) {
+	log.Println("--- Starting TestOIDCCallbackRejectsBadIDTokens ---")
+	setupSessionStore(t)
+	idp := newMockIdP(t)
+
+	for _, tc := range []struct {
+		name   string
+		mutate func(jwt.MapClaims)
+		want   int
+	}{
+		{"wrong nonce", func(c jwt.MapClaims) { c["nonce"] = "other" }, http.StatusUnauthorized},
+		{"other issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, http.StatusUnauthorized},
+		{"other audience", func(c jwt.MapClaims) { c["aud"] = []string{"another-client"} }, http.StatusUnauthorized},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, http.StatusUnauthorized},
+		{"unverified email", func(c jwt.MapClaims) { c["email_verified"] = false }, http.StatusForbidden},
+	} {
+		idp.mutate = tc.mutate
+		if rr := oidcCallback(oidcLogin(t)); rr.Code != tc.want {
+			t.Errorf("%s: got status %v, want %v", tc.name, rr.Code, tc.want)
+		}
+	}
+
+	// A token signed with a key the provider does not publish
+	idp.mutate = nil
+	idp.signer = newTestRSAKey(t)
+	if rr := oidcCallback(oidcLogin(t)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Foreign signature: got status %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	// Unknown providers are not accepted
+	rr := httptest.NewRecorder()
+	auth.OIDCLogin(rr, httptest.NewRequest("GET", "/oidc/other/login", nil), "other")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Unknown provider: got status %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,216 @@
+package test
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/middleware"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const membershipQuery = "SELECT role FROM org_members WHERE org_id = \\$1 AND user_id = \\$2"
+
+func expectMembership(mock sqlmock.Sqlmock, orgID, userID int, role string) {
+	rows := sqlmock.NewRows([]string{"role"})
+	if role != "" {
+		rows.AddRow(role)
+	}
+	mock.ExpectQuery(membershipQuery).WithArgs(orgID, userID).WillReturnRows(rows)
+}
+
+func TestOrgScopeRequiresMembership(t *testing.T) {
+	log.Println("--- Starting TestOrgScopeRequiresMembership ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+
+	var got models.Membership
+	var scoped bool
+	handler := middleware.OrgScope(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, scoped = auth.MembershipFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+	call := func(header string) int {
+		req := requestAs("GET", "/files", userB)
+		if header != "" {
+			req.Header.Set(middleware.OrgHeader, header)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// No header: personal scope, no lookup
+	if code := call(""); code != http.StatusOK || scoped {
+		t.Errorf("Without header: got %v (scoped=%v), want %v unscoped", code, scoped, http.StatusOK)
+	}
+
+	if code := call("abc"); code != http.StatusBadRequest {
+		t.Errorf("Malformed header: got %v, want %v", code, http.StatusBadRequest)
+	}
+
+	expectMembership(mock, 5, userB.ID, "")
+	if code := call("5"); code != http.StatusForbidden {
+		t.Errorf("Non-member: got %v, want %v", code, http.StatusForbidden)
+	}
+
+	expectMembership(mock, 5, userB.ID, models.OrgRoleMember)
+	if code := call("5"); code != http.StatusOK || got.OrgID != 5 || got.Role != models.OrgRoleMember {
+		t.Errorf("Member: got %v with membership %+v", code, got)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFileHandlersScopedToOrg(t *testing.T) {
+	log.Println("--- Starting TestFileHandlersScopedToOrg ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	inOrg := func(method, target string) *http.Request {
+		req := requestAs(method, target, userB)
+		return req.WithContext(auth.WithMembership(req.Context(), models.Membership{OrgID: 5, UserID: userB.ID, Role: models.OrgRoleMember}))
+	}
+
+	// Org files are listed by org, whoever uploaded them
+	mock.ExpectQuery("SELECT .* FROM files WHERE org_id = \\$1 AND deleted_at IS NULL AND " + notExpired("files") + "$").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows(fileColumns).
+			AddRow(10, "a.pdf", "a.pdf", time.Now(), 100, ".pdf", "", "", false, nil, 0, "application/pdf", "clean"))
+	rr := httptest.NewRecorder()
+	fileupload.RetrieveFiles(rr, inOrg("GET", "/files"), db, nil)
+	var files []models.File
+	json.NewDecoder(rr.Body).Decode(&files)
+	if rr.Code != http.StatusOK || len(files) != 1 || files[0].OrgID != 5 {
+		t.Errorf("Unexpected org listing: %v %+v", rr.Code, files)
+	}
+
+	mock.ExpectQuery("SELECT .* FROM files WHERE "+withGrants("org_id = \\$1")+" AND deleted_at IS NULL AND "+notExpired("files")+" AND file_name ILIKE \\$2").
+		WithArgs(5, "%memo%").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "file_name", "original_name", "upload_date", "size", "mime_type"}))
+	fileupload.SearchFiles(httptest.NewRecorder(), inOrg("GET", "/search?name=memo"), db, nil)
+
+	mock.ExpectQuery("SELECT file_name, .* FROM files WHERE id = \\$1 AND deleted_at IS NULL AND "+notExpired("files")+" AND org_id = \\$2").
+		WithArgs(10, 5).
+		WillReturnRows(sqlmock.NewRows([]string{"file_name", "scan_status"}))
+	fileupload.ShareFile(httptest.NewRecorder(), inOrg("POST", "/share/10"), db, nil, 10)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestOrgKeepsAnOwner(t *testing.T) {
+	log.Println("--- Starting TestOrgKeepsAnOwner ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+
+	// The only owner cannot step down
+	expectMembership(mock, 5, userA.ID, models.OrgRoleOwner)
+	expectMembership(mock, 5, userA.ID, models.OrgRoleOwner)
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM org_members WHERE org_id = \\$1 AND role = \\$2").
+		WithArgs(5, models.OrgRoleOwner).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	req := httptest.NewRequest("PATCH", "/orgs/5/members/1", jsonBody(map[string]string{"role": models.OrgRoleMember}))
+	rr := httptest.NewRecorder()
+	auth.UpdateMemberRole(rr, req.WithContext(auth.WithUser(req.Context(), userA)), 5, userA.ID)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Demoting the last owner: got %v, want %v", rr.Code, http.StatusConflict)
+	}
+
+	// Admins cannot hand out ownership
+	expectMembership(mock, 5, userB.ID, models.OrgRoleAdmin)
+	expectMembership(mock, 5, 3, models.OrgRoleMember)
+	req = httptest.NewRequest("PATCH", "/orgs/5/members/3", jsonBody(map[string]string{"role": models.OrgRoleOwner}))
+	rr = httptest.NewRecorder()
+	auth.UpdateMemberRole(rr, req.WithContext(auth.WithUser(req.Context(), userB)), 5, 3)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Admin granting ownership: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// The last owner cannot leave either
+	expectMembership(mock, 5, userA.ID, models.OrgRoleOwner)
+	expectMembership(mock, 5, userA.ID, models.OrgRoleOwner)
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM org_members").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	rr = httptest.NewRecorder()
+	auth.RemoveMember(rr, requestAs("DELETE", "/orgs/5/members/1", userA), 5, userA.ID)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Last owner leaving: got %v, want %v", rr.Code, http.StatusConflict)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestOrgInvitation(t *testing.T) {
+	log.Println("--- Starting TestOrgInvitation ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+	mailer := useMailer(t)
+
+	expectMembership(mock, 5, userA.ID, models.OrgRoleAdmin)
+	mock.ExpectQuery("INSERT INTO org_invitations \\(org_id, email, role, token_hash, invited_by, expires_at\\)").
+		WithArgs(5, "b@example.com", models.OrgRoleMember, sqlmock.AnyArg(), userA.ID, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "name"}).AddRow(8, time.Now(), "Litigation"))
+
+	req := httptest.NewRequest("POST", "/orgs/5/invitations", jsonBody(map[string]string{"email": "b@example.com"}))
+	rr := httptest.NewRecorder()
+	auth.CreateInvitation(rr, req.WithContext(auth.WithUser(req.Context(), userA)), 5)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("CreateInvitation returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].to != "b@example.com" {
+		t.Fatalf("Expected one invitation mail to b@example.com, got %+v", mailer.sent)
+	}
+	token := mailedToken(t, mailer.sent[0].body)
+
+	// The token is looked up by hash together with the accepting user's email
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE org_invitations SET accepted_at = NOW\\(\\)").
+		WithArgs(sqlmock.AnyArg(), "b@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"org_id", "role"}).AddRow(5, models.OrgRoleMember))
+	mock.ExpectQuery("INSERT INTO org_members \\(org_id, user_id, role\\)").
+		WithArgs(5, userB.ID, models.OrgRoleMember).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(models.OrgRoleMember))
+	mock.ExpectCommit()
+
+	invitee := models.User{ID: userB.ID, Email: "b@example.com"}
+	req = httptest.NewRequest("POST", "/invitations/accept", jsonBody(map[string]string{"token": token}))
+	rr = httptest.NewRecorder()
+	auth.AcceptInvitation(rr, req.WithContext(auth.WithUser(req.Context(), invitee)))
+	var membership models.Membership
+	json.NewDecoder(rr.Body).Decode(&membership)
+	if rr.Code != http.StatusOK || membership.OrgID != 5 || membership.Role != models.OrgRoleMember {
+		t.Errorf("AcceptInvitation: got %v with %+v", rr.Code, membership)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,247 @@
+package test
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// quotaColumns are the columns of quotas returned when a quota is locked
+var quotaColumns = []string{"id", "max_bytes", "max_files"}
+
+// expectNoQuota expects the quota of the tenant to be locked, with no limits, so
+// nothing is reserved
+func expectNoQuota(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO quotas \\((user_id|org_id)\\) VALUES \\(\\$1\\)\\s+ON CONFLICT").
+		WillReturnRows(sqlmock.NewRows(quotaColumns).AddRow(1, nil, nil))
+	mock.ExpectRollback()
+}
+
+// expectQuotaUsage expects the quota of the personal files of userA to be locked,
+// with limits maxBytes and maxFiles (nil for the default) and the usage given
+func expectQuotaUsage(mock sqlmock.Sqlmock, maxBytes, maxFiles driver.Value, usedBytes, usedFiles int64) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO quotas \\(user_id\\) VALUES \\(\\$1\\)\\s+ON CONFLICT \\(user_id\\) WHERE org_id IS NULL DO UPDATE SET user_id = EXCLUDED.user_id\\s+RETURNING id, max_bytes, max_files").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows(quotaColumns).AddRow(1, maxBytes, maxFiles))
+	mock.ExpectQuery("SELECT \\(SELECT COUNT\\(\\*\\) FROM files WHERE user_id = \\$1 AND org_id IS NULL\\) \\+ COALESCE\\(SUM\\(r.files\\), 0\\),.* FROM quota_reservations r WHERE r.quota_id = \\$2 AND r.expires_at > NOW\\(\\)").
+		WithArgs(userA.ID, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"files", "bytes"}).AddRow(usedFiles, usedBytes))
+}
+
+// expectQuotaReserved expects bytes and files to be reserved as reservation 3
+// after expectQuotaUsage
+func expectQuotaReserved(mock sqlmock.Sqlmock, bytes, files int64) {
+	mock.ExpectQuery("INSERT INTO quota_reservations \\(quota_id, bytes, files, expires_at\\) VALUES \\(\\$1, \\$2, \\$3, \\$4\\) RETURNING id").
+		WithArgs(1, bytes, files, expiresIn(time.Hour)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectCommit()
+}
+
+// expectQuotaReleased expects reservation 3 to be released
+func expectQuotaReleased(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("DELETE FROM quota_reservations WHERE id = \\$1").
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestUploadReservesQuota(t *testing.T) {
+	log.Println("--- Starting TestUploadReservesQuota ---")
+	useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	files := map[string][]byte{
+		"fits.txt":  []byte("fits"),
+		"large.txt": []byte(strings.Repeat("x", 17)),
+		"after.txt": []byte("never read"),
+	}
+
+	expectNoContentPolicy(mock)
+	expectNoExpiryPolicy(mock)
+	// 10 bytes are left, which is all the first file may write
+	expectQuotaUsage(mock, int64(100), nil, 90, 2)
+	expectQuotaReserved(mock, 10, 1)
+	expectNewBlob(mock)
+	mock.ExpectQuery("INSERT INTO files .* RETURNING id").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(50))
+	mock.ExpectCommit()
+	expectQuotaReleased(mock)
+	// The second file gets the 6 bytes left and is cut off
+	expectQuotaUsage(mock, int64(100), nil, 94, 3)
+	expectQuotaReserved(mock, 6, 1)
+	expectQuotaReleased(mock)
+
+	rr := httptest.NewRecorder()
+	fileupload.UploadFile(rr, multipartUpload(t, files, []string{"fits.txt", "large.txt", "after.txt"}), db, nil)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusRequestEntityTooLarge, rr.Body.String())
+	}
+	results := decodeUploadResults(t, rr.Body)
+	if len(results) != 2 || results[0].ID != 50 || results[1].ID != 0 {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+	if refused := results[1]; refused.Code != "quota_exceeded" || refused.Quota == nil ||
+		refused.Quota.MaxBytes != 100 || refused.Quota.Bytes != 94 {
+		t.Errorf("Over-quota file not reported: %+v", refused)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUploadRefusedOverFileQuota(t *testing.T) {
+	log.Println("--- Starting TestUploadRefusedOverFileQuota ---")
+	useLocalStorage(t)
+	t.Setenv("USER_QUOTA_FILES", "3")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Nothing is reserved, or written, once the default number of files is reached
+	expectNoContentPolicy(mock)
+	expectNoExpiryPolicy(mock)
+	expectQuotaUsage(mock, nil, nil, 2048, 3)
+	mock.ExpectRollback()
+
+	rr := httptest.NewRecorder()
+	fileupload.UploadFile(rr, multipartUpload(t, map[string][]byte{"notes.txt": []byte("notes")}, []string{"notes.txt"}), db, nil)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+	results := decodeUploadResults(t, rr.Body)
+	if len(results) != 1 || results[0].Code != "quota_exceeded" || results[0].Quota.MaxFiles != 3 || results[0].Quota.MaxBytes != 0 {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+
+	// Resumable uploads are refused before any byte is sent
+	expectQuotaUsage(mock, nil, nil, 2048, 3)
+	mock.ExpectRollback()
+	rr = httptest.NewRecorder()
+	fileupload.CreateResumableUpload(rr, tusRequest("POST", fileupload.TusPath, nil, map[string]string{"Upload-Length": "10"}), db)
+	var refused struct {
+		Code  string       `json:"code"`
+		Error string       `json:"error"`
+		Quota models.Usage `json:"quota"`
+	}
+	json.NewDecoder(rr.Body).Decode(&refused)
+	if rr.Code != http.StatusRequestEntityTooLarge || refused.Code != "quota_exceeded" || refused.Quota.Files != 3 || refused.Error == "" {
+		t.Errorf("Resumable upload over quota: got %v %+v", rr.Code, refused)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	log.Println("--- Starting TestGetUsage ---")
+	t.Setenv("USER_QUOTA_BYTES", "1000000")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT max_bytes, max_files, updated_at FROM quotas WHERE user_id = \\$1 AND org_id IS NULL").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"max_bytes", "max_files", "updated_at"}).AddRow(nil, int64(500), nil))
+	mock.ExpectQuery("SELECT files.mime_type, COALESCE\\(SUM\\(v.size\\), 0\\), COUNT\\(DISTINCT files.id\\)\\s+FROM files JOIN file_versions v ON v.file_id = files.id WHERE user_id = \\$1 AND org_id IS NULL\\s+GROUP BY files.mime_type").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"mime_type", "bytes", "files"}).
+			AddRow("application/pdf", 4096, 3).
+			AddRow("text/plain", 120, 2))
+
+	rr := httptest.NewRecorder()
+	fileupload.GetUsage(rr, requestAs("GET", "/me/usage", userA), db)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	var usage models.Usage
+	json.NewDecoder(rr.Body).Decode(&usage)
+	// The default applies to the bytes, the limit set to the files
+	if usage.Bytes != 4216 || usage.Files != 5 || usage.MaxBytes != 1000000 || usage.MaxFiles != 500 {
+		t.Errorf("Unexpected usage: %+v", usage)
+	}
+	if len(usage.ByType) != 2 || usage.ByType[0] != (models.TypeUsage{MimeType: "application/pdf", Bytes: 4096, Files: 3}) {
+		t.Errorf("Unexpected usage by type: %+v", usage.ByType)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAdminSetsQuota(t *testing.T) {
+	log.Println("--- Starting TestAdminSetsQuota ---")
+	t.Setenv("ORG_QUOTA_FILES", "10000")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	rr := httptest.NewRecorder()
+	fileupload.SetQuota(rr, jsonRequest("PUT", "/admin/quotas/orgs/5", `{"max_bytes": -1}`, userB), db, 0, 5)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Negative limit: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM users WHERE id = \\$1\\)").
+		WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	rr = httptest.NewRecorder()
+	fileupload.SetQuota(rr, jsonRequest("PUT", "/admin/quotas/users/9", `{"max_bytes": 1024}`, userB), db, 9, 0)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Unknown user: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// The file limit is left to the default
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM organizations WHERE id = \\$1\\)").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("INSERT INTO quotas \\(org_id, max_bytes, max_files, updated_at\\) VALUES \\(\\$1, \\$2, \\$3, NOW\\(\\)\\)\\s+ON CONFLICT \\(org_id\\) WHERE org_id IS NOT NULL DO UPDATE SET max_bytes = EXCLUDED.max_bytes, max_files = EXCLUDED.max_files, updated_at = NOW\\(\\)").
+		WithArgs(5, int64(1<<30), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT max_bytes, max_files, updated_at FROM quotas WHERE org_id = \\$1").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"max_bytes", "max_files", "updated_at"}).AddRow(int64(1<<30), nil, time.Now()))
+	mock.ExpectQuery("SELECT files.mime_type, .* WHERE org_id = \\$1").
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"mime_type", "bytes", "files"}).AddRow("application/pdf", 2048, 1))
+
+	rr = httptest.NewRecorder()
+	fileupload.SetQuota(rr, jsonRequest("PUT", "/admin/quotas/orgs/5", `{"max_bytes": 1073741824, "max_files": null}`, userB), db, 0, 5)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var quota models.Quota
+	json.NewDecoder(rr.Body).Decode(&quota)
+	if quota.MaxBytes == nil || *quota.MaxBytes != 1<<30 || quota.MaxFiles != nil || quota.UpdatedAt == nil {
+		t.Errorf("Unexpected quota: %+v", quota)
+	}
+	if quota.Usage.MaxBytes != 1<<30 || quota.Usage.MaxFiles != 10000 || quota.Usage.Bytes != 2048 || quota.Usage.Files != 1 {
+		t.Errorf("Unexpected usage: %+v", quota.Usage)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
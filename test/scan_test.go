@@ -0,0 +1,354 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/job"
+	"go_backend_legalForce/scanner"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// eicar is the standard antivirus test file
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers INSTREAM commands like clamd, finding the EICAR test file. It
+// records the contents it received.
+type fakeClamd struct {
+	address  string
+	received chan []byte
+}
+
+func startFakeClamd(t *testing.T, network, address string) *fakeClamd {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s %s: %v", network, address, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	clamd := &fakeClamd{address: listener.Addr().String(), received: make(chan []byte, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go clamd.serve(conn)
+		}
+	}()
+	return clamd
+}
+
+func (c *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	command := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, command); err != nil || string(command) != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var content []byte
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(conn, chunk); err != nil {
+			return
+		}
+		content = append(content, chunk...)
+	}
+	c.received <- content
+
+	switch {
+	case bytes.Contains(content, []byte(eicar)):
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+	case bytes.HasPrefix(content, []byte("oversized")):
+		conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+	default:
+		conn.Write([]byte("stream: OK\x00"))
+	}
+}
+
+// fakeScanner stands in for clamd in the scan worker
+type fakeScanner struct {
+	result  scanner.Result
+	err     error
+	scanned string
+}
+
+func (s *fakeScanner) Scan(ctx context.Context, r io.Reader) (scanner.Result, error) {
+	content, _ := io.ReadAll(r)
+	s.scanned = string(content)
+	return s.result, s.err
+}
+
+func TestClamdScanner(t *testing.T) {
+	log.Println("--- Starting TestClamdScanner ---")
+	tcp := startFakeClamd(t, "tcp", "127.0.0.1:0")
+	socket := filepath.Join(t.TempDir(), "clamd.sock")
+	unix := startFakeClamd(t, "unix", socket)
+
+	for _, tc := range []struct {
+		address string
+		clamd   *fakeClamd
+	}{
+		{"tcp://" + tcp.address, tcp},
+		{"unix://" + socket, unix},
+	} {
+		clamd, err := scanner.NewClamd(tc.address)
+		if err != nil {
+			t.Fatalf("NewClamd(%q): %v", tc.address, err)
+		}
+
+		// Contents larger than a chunk arrive whole
+		content := strings.Repeat("Motion to dismiss. ", 10000)
+		result, err := clamd.Scan(context.Background(), strings.NewReader(content))
+		if err != nil || result.Infected {
+			t.Errorf("%s clean contents: got %+v %v", tc.address, result, err)
+		}
+		if received := <-tc.clamd.received; string(received) != content {
+			t.Errorf("%s received %d bytes, want %d", tc.address, len(received), len(content))
+		}
+
+		result, err = clamd.Scan(context.Background(), strings.NewReader("exhibit "+eicar))
+		<-tc.clamd.received
+		if err != nil || !result.Infected || result.Signature != "Eicar-Test-Signature" {
+			t.Errorf("%s infected contents: got %+v %v", tc.address, result, err)
+		}
+
+		_, err = clamd.Scan(context.Background(), strings.NewReader("oversized"))
+		<-tc.clamd.received
+		if err == nil || !strings.Contains(err.Error(), "size limit exceeded") {
+			t.Errorf("%s error reply: got %v", tc.address, err)
+		}
+	}
+
+	for _, address := range []string{"localhost:3310", "http://localhost:3310", "tcp://", "unix://"} {
+		if _, err := scanner.NewClamd(address); err == nil {
+			t.Errorf("NewClamd(%q) accepted an invalid address", address)
+		}
+	}
+}
+
+func TestScanBlobQuarantinesInfectedContents(t *testing.T) {
+	log.Println("--- Starting TestScanBlobQuarantinesInfectedContents ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+
+	content := "%PDF-1.4 exhibit " + eicar
+	backend.Put(context.Background(), "a1.pdf", strings.NewReader(content), int64(len(content)), "")
+	exists := func(key string) bool {
+		_, err := backend.Stat(context.Background(), key)
+		return err == nil
+	}
+
+	// Infected contents are recorded and moved out of reach. Listings showing them
+	// as pending are dropped.
+	mr.Set("user_files:1", "[]")
+	mr.Set("org_files:5", "[]")
+	mr.Set("user_files:2", "[]")
+	infected := &fakeScanner{result: scanner.Result{Infected: true, Signature: "Eicar-Test-Signature"}}
+	mock.ExpectQuery("SELECT scan_status FROM blobs WHERE storage_key = \\$1").
+		WithArgs("a1.pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"scan_status"}).AddRow("pending"))
+	mock.ExpectExec("UPDATE blobs SET scan_status = \\$2, scan_signature = \\$3, scanned_at = NOW\\(\\), rescan_requested_at = NULL").
+		WithArgs("a1.pdf", "infected", "Eicar-Test-Signature").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT DISTINCT user_id, COALESCE\\(org_id, 0\\) FROM files WHERE storage_key = \\$1").
+		WithArgs("a1.pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "org_id"}).AddRow(1, 0).AddRow(2, 5))
+	status, err := job.ScanBlob(db, redisClient, infected, "a1.pdf")
+	if err != nil || status != "infected" || infected.scanned != content {
+		t.Fatalf("Scan of infected contents: got %q %v", status, err)
+	}
+	if exists("a1.pdf") || !exists("quarantine/a1.pdf") {
+		t.Errorf("Infected contents were not quarantined")
+	}
+	if mr.Exists("user_files:1") || mr.Exists("org_files:5") || !mr.Exists("user_files:2") {
+		t.Errorf("Cached listings not dropped after the verdict: %v", mr.Keys())
+	}
+
+	// A rescan that fails keeps the verdict
+	failing := &fakeScanner{err: errors.New("clamd: connection refused")}
+	mock.ExpectQuery("SELECT scan_status FROM blobs").
+		WithArgs("a1.pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"scan_status"}).AddRow("infected"))
+	mock.ExpectExec("UPDATE blobs SET scan_status = 'error', scanned_at = NOW\\(\\) WHERE storage_key = \\$1 AND scan_status IN \\('pending', 'error'\\)").
+		WithArgs("a1.pdf").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if status, err := job.ScanBlob(db, nil, failing, "a1.pdf"); err == nil || status != "infected" {
+		t.Errorf("Failed rescan: got %q %v", status, err)
+	}
+
+	// Contents found clean by a rescan, say after a false positive was fixed, are released
+	clean := &fakeScanner{}
+	mock.ExpectQuery("SELECT scan_status FROM blobs").
+		WithArgs("a1.pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"scan_status"}).AddRow("infected"))
+	mock.ExpectExec("UPDATE blobs SET scan_status = \\$2").
+		WithArgs("a1.pdf", "clean", "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	status, err = job.ScanBlob(db, nil, clean, "a1.pdf")
+	if err != nil || status != "clean" || clean.scanned != content {
+		t.Fatalf("Rescan: got %q %v", status, err)
+	}
+	if !exists("a1.pdf") || exists("quarantine/a1.pdf") {
+		t.Errorf("Clean contents were not released from quarantine")
+	}
+
+	// Blobs deleted since they were queued are skipped
+	mock.ExpectQuery("SELECT scan_status FROM blobs").
+		WithArgs("gone.pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"scan_status"}))
+	if status, err := job.ScanBlob(db, nil, clean, "gone.pdf"); err != nil || status != "" {
+		t.Errorf("Deleted blob: got %q %v", status, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDownloadsRequireCleanScan(t *testing.T) {
+	log.Println("--- Starting TestDownloadsRequireCleanScan ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	backend.Put(context.Background(), "f3a1.pdf", strings.NewReader("%PDF-1.4"), 8, "")
+
+	for _, tc := range []struct {
+		status string
+		want   int
+	}{
+		{"pending", http.StatusConflict},
+		{"error", http.StatusConflict},
+		{"infected", http.StatusForbidden},
+	} {
+		expectScannedDownload(mock, 7, userA.ID, "f3a1.pdf", tc.status)
+		rr := httptest.NewRecorder()
+		fileupload.DownloadFile(rr, requestAs("GET", "/files/7/content", userA), db, 7)
+		if rr.Code != tc.want || strings.Contains(rr.Body.String(), "%PDF") {
+			t.Errorf("Download of %s contents: got %v, want %v", tc.status, rr.Code, tc.want)
+		}
+
+		mock.ExpectQuery("SELECT file_name, .* FROM files WHERE id = \\$1").
+			WithArgs(7, userA.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"file_name", "scan_status"}).AddRow("brief.pdf", tc.status))
+		rr = httptest.NewRecorder()
+		fileupload.ShareFile(rr, requestAs("POST", "/share/7", userA), db, nil, 7)
+		if rr.Code != tc.want {
+			t.Errorf("Share of %s contents: got %v, want %v", tc.status, rr.Code, tc.want)
+		}
+	}
+
+	mock.ExpectQuery(loadVersionQuery).
+		WithArgs(7, 1, userA.ID).
+		WillReturnRows(sqlmock.NewRows(append(versionColumns, "file_name", "file_type")).
+			AddRow(1, userA.ID, "f3a1.pdf", 8, "", "application/pdf", "infected", "brief.pdf", time.Now(), true, "brief.pdf", ".pdf"))
+	rr := httptest.NewRecorder()
+	fileupload.DownloadVersion(rr, requestAs("GET", "/files/7/versions/1/content", userA), db, 7, 1)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Download of an infected version: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	// Links handed out before malware was found stop working
+	signed, _ := backend.PresignGet(context.Background(), "f3a1.pdf", time.Hour)
+	link, _ := url.Parse(signed)
+	expectScanStatus(mock, "f3a1.pdf", "infected")
+	rr = httptest.NewRecorder()
+	fileupload.ServePresignedFile(rr, httptest.NewRequest("GET", link.RequestURI(), nil), db)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Presigned link to infected contents: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestQuarantineAdministration(t *testing.T) {
+	log.Println("--- Starting TestQuarantineAdministration ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	scannedAt := time.Now()
+	mock.ExpectQuery("SELECT f.id, v.version, .* FROM blobs b JOIN file_versions v .* WHERE b.scan_status = 'infected'").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version", "user_id", "org_id", "file_name", "scan_signature", "scanned_at"}).
+			AddRow(7, 2, userB.ID, 5, "exhibit.pdf", "Eicar-Test-Signature", scannedAt))
+	rr := httptest.NewRecorder()
+	fileupload.ListQuarantine(rr, requestAs("GET", "/admin/quarantine", userA), db)
+	var quarantined []fileupload.QuarantinedFile
+	json.NewDecoder(rr.Body).Decode(&quarantined)
+	if rr.Code != http.StatusOK || len(quarantined) != 1 || quarantined[0].FileID != 7 || quarantined[0].Version != 2 ||
+		quarantined[0].OrgID != 5 || quarantined[0].Signature != "Eicar-Test-Signature" {
+		t.Errorf("Quarantine: got %v %+v", rr.Code, quarantined)
+	}
+
+	// Rescans of some files, then of everything stored
+	mock.ExpectExec("UPDATE blobs SET rescan_requested_at = NOW\\(\\)\\s+WHERE storage_key IN \\(SELECT storage_key FROM file_versions WHERE file_id = ANY\\(\\$1\\)\\)").
+		WithArgs("{7,8}").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	rr = httptest.NewRecorder()
+	fileupload.RescanFiles(rr, jsonRequest("POST", "/admin/scans/rescan", `{"file_ids": [7, 8]}`, userA), db)
+	var response struct {
+		Queued int `json:"queued"`
+	}
+	json.NewDecoder(rr.Body).Decode(&response)
+	if rr.Code != http.StatusAccepted || response.Queued != 3 {
+		t.Errorf("Rescan of files: got %v %+v", rr.Code, response)
+	}
+
+	mock.ExpectExec("UPDATE blobs SET rescan_requested_at = NOW\\(\\) WHERE ref_count > 0").
+		WillReturnResult(sqlmock.NewResult(0, 40))
+	rr = httptest.NewRecorder()
+	fileupload.RescanFiles(rr, requestAs("POST", "/admin/scans/rescan", userA), db)
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("Rescan of everything: got %v, want %v", rr.Code, http.StatusAccepted)
+	}
+
+	rr = httptest.NewRecorder()
+	fileupload.RescanFiles(rr, jsonRequest("POST", "/admin/scans/rescan", `{"file_ids": "all"}`, userA), db)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Invalid body: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,154 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/middleware"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// setupSessionStore wires the auth package to a mock database and an in-memory Redis
+func setupSessionStore(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	t.Setenv("JWT_SECRET_KEY", "test-secret")
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { redisClient.Close() })
+
+	auth.SetDB(db, redisClient)
+	t.Cleanup(func() { auth.SetDB(nil, nil) })
+	return mock
+}
+
+func expectUserLookup(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT id, email, role, disabled, email_verified FROM users WHERE id = \\$1").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "role", "disabled", "email_verified"}).AddRow(userA.ID, userA.Email, models.RoleMember, false, true))
+}
+
+func refresh(refreshToken string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"refresh_token": refreshToken})
+	rr := httptest.NewRecorder()
+	auth.RefreshToken(rr, httptest.NewRequest("POST", "/token/refresh", bytes.NewReader(body)))
+	return rr
+}
+
+func callProtected(token string) int {
+	handler := middleware.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	req := httptest.NewRequest("GET", "/files", nil)
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	log.Println("--- Starting TestRefreshTokenRotation ---")
+	mock := setupSessionStore(t)
+
+	first, err := auth.IssueTokens(userA)
+	if err != nil {
+		t.Fatalf("Failed to issue tokens: %v", err)
+	}
+
+	expectUserLookup(mock)
+	rr := refresh(first.RefreshToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Refresh returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	var second auth.TokenPair
+	if err := json.NewDecoder(rr.Body).Decode(&second); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Errorf("Refresh token was not rotated: %q", second.RefreshToken)
+	}
+	if second.AccessToken == "" {
+		t.Error("Refresh did not return an access token")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	log.Println("--- Starting TestRefreshTokenReuseRevokesFamily ---")
+	mock := setupSessionStore(t)
+
+	first, err := auth.IssueTokens(userA)
+	if err != nil {
+		t.Fatalf("Failed to issue tokens: %v", err)
+	}
+
+	expectUserLookup(mock)
+	rr := refresh(first.RefreshToken)
+	var second auth.TokenPair
+	json.NewDecoder(rr.Body).Decode(&second)
+
+	// Replaying the already-exchanged token must fail and kill the family
+	if rr := refresh(first.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Reused refresh token returned %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := refresh(second.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Refresh token of revoked family returned %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if code := callProtected(second.AccessToken); code != http.StatusUnauthorized {
+		t.Errorf("Access token of revoked family returned %v, want %v", code, http.StatusUnauthorized)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	log.Println("--- Starting TestLogoutRevokesSession ---")
+	mock := setupSessionStore(t)
+
+	tokens, err := auth.IssueTokens(userA)
+	if err != nil {
+		t.Fatalf("Failed to issue tokens: %v", err)
+	}
+
+	expectUserLookup(mock)
+	logout := middleware.AuthMiddleware(http.HandlerFunc(auth.LogoutUser))
+	req := httptest.NewRequest("POST", "/logout", nil)
+	req.Header.Set("Authorization", tokens.AccessToken)
+	rr := httptest.NewRecorder()
+	logout.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Logout returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	if code := callProtected(tokens.AccessToken); code != http.StatusUnauthorized {
+		t.Errorf("Access token after logout returned %v, want %v", code, http.StatusUnauthorized)
+	}
+	if rr := refresh(tokens.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Refresh token after logout returned %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
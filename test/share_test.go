@@ -0,0 +1,339 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// shareLinkColumns are what ServeShareLink reads about a link and its file
+var shareLinkColumns = []string{"id", "file_id", "password_hash", "expires_at", "max_downloads", "download_count", "revoked_at",
+	"file_name", "storage_key", "file_type", "mime_type", "upload_date", "expiration_date", "scan_status"}
+
+const shareLinkQuery = "SELECT l.id, l.file_id, .* FROM share_links l JOIN files ON files.id = l.file_id\\s+WHERE l.token_hash = \\$1 AND files.deleted_at IS NULL"
+
+// expectShareLink expects the link with the given token to be looked up
+func expectShareLink(mock sqlmock.Sqlmock, token string, passwordHash, expiresAt interface{}, maxDownloads, downloads int, revokedAt interface{}) {
+	mock.ExpectQuery(shareLinkQuery).
+		WithArgs(sha256Hex(token)).
+		WillReturnRows(sqlmock.NewRows(shareLinkColumns).
+			AddRow(4, 7, passwordHash, expiresAt, maxDownloads, downloads, revokedAt, "Settlement.pdf", "f3a1.pdf", ".pdf", "application/pdf", time.Now(), nil, "clean"))
+}
+
+func expectDownloadCounted(mock sqlmock.Sqlmock, counted bool) {
+	rows := int64(0)
+	if counted {
+		rows = 1
+	}
+	mock.ExpectExec("UPDATE share_links l SET download_count = l.download_count \\+ 1 WHERE l.id = \\$1 AND l.revoked_at IS NULL").
+		WithArgs(4).
+		WillReturnResult(sqlmock.NewResult(0, rows))
+}
+
+func TestShareFileCreatesLink(t *testing.T) {
+	log.Println("--- Starting TestShareFileCreatesLink ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	var tokenHash, passwordHash string
+	mock.ExpectQuery("SELECT file_name, .* FROM files WHERE id = \\$1 AND deleted_at IS NULL AND "+notExpired("files")+" AND user_id = \\$2 AND org_id IS NULL").
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"file_name", "scan_status"}).AddRow("Settlement.pdf", "clean"))
+	mock.ExpectQuery("WITH shared AS \\(UPDATE files SET is_shared = TRUE WHERE id = \\$1 AND deleted_at IS NULL AND "+notExpired("files")+" AND user_id = \\$8 AND org_id IS NULL RETURNING id\\)\\s+INSERT INTO share_links").
+		WithArgs(7, userA.ID, captureArg{&tokenHash}, sqlmock.AnyArg(), captureArg{&passwordHash}, sqlmock.AnyArg(), 3, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(4, time.Now()))
+
+	rr := httptest.NewRecorder()
+	fileupload.ShareFile(rr, jsonRequest("POST", "/share/7", `{"expires_in": "72h", "password": "opposing-counsel", "max_downloads": 3}`, userA), db, nil, 7)
+	var link models.ShareLink
+	json.NewDecoder(rr.Body).Decode(&link)
+	if rr.Code != http.StatusCreated || link.ID != 4 || len(link.Token) < 40 || !link.HasPassword || link.MaxDownloads != 3 {
+		t.Fatalf("Share returned %v %+v", rr.Code, link)
+	}
+	if link.URL != "http://localhost:8080/s/"+link.Token || link.TokenPrefix != link.Token[:8] {
+		t.Errorf("Unexpected link URL %q or prefix %q", link.URL, link.TokenPrefix)
+	}
+	if link.ExpiresAt == nil || time.Until(*link.ExpiresAt) < 71*time.Hour {
+		t.Errorf("Unexpected expiry %v", link.ExpiresAt)
+	}
+
+	// Neither the token nor the password is stored
+	if tokenHash != sha256Hex(link.Token) {
+		t.Errorf("Stored token hash %q", tokenHash)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte("opposing-counsel")) != nil {
+		t.Errorf("Stored password hash %q", passwordHash)
+	}
+
+	for _, body := range []string{
+		`{"expires_in": "-1h"}`,
+		`{"expires_in": "soon"}`,
+		`{"expires_at": "2001-01-01T00:00:00Z"}`,
+		`{"expires_at": "2999-01-01T00:00:00Z", "expires_in": "1h"}`,
+		`{"max_downloads": -1}`,
+		`{"password": "` + strings.Repeat("x", 73) + `"}`,
+	} {
+		rr = httptest.NewRecorder()
+		fileupload.ShareFile(rr, jsonRequest("POST", "/share/7", body, userA), db, nil, 7)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Share with %s: got %v, want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestServeShareLink(t *testing.T) {
+	log.Println("--- Starting TestServeShareLink ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	content := "%PDF-1.4 settlement agreement"
+	backend.Put(context.Background(), "f3a1.pdf", strings.NewReader(content), int64(len(content)), "")
+	hash, _ := bcrypt.GenerateFromPassword([]byte("opposing-counsel"), bcrypt.MinCost)
+	serve := func(req *http.Request, token string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		fileupload.ServeShareLink(rr, req, db, token)
+		return rr
+	}
+
+	// An open link serves the file and counts the download
+	expectShareLink(mock, "open", nil, nil, 0, 5, nil)
+	expectDownloadCounted(mock, true)
+	rr := serve(httptest.NewRequest("GET", "/s/open", nil), "open")
+	if rr.Code != http.StatusOK || rr.Body.String() != content ||
+		rr.Header().Get("Content-Disposition") != "attachment; filename=Settlement.pdf" {
+		t.Errorf("Open link: got %v %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	// HEAD requests are not counted
+	expectShareLink(mock, "open", nil, nil, 0, 6, nil)
+	if rr := serve(httptest.NewRequest("HEAD", "/s/open", nil), "open"); rr.Code != http.StatusOK {
+		t.Errorf("HEAD: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	// A range ending before the last byte is not counted, the one holding it is
+	expectShareLink(mock, "open", nil, nil, 0, 6, nil)
+	req := httptest.NewRequest("GET", "/s/open", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	if rr := serve(req, "open"); rr.Code != http.StatusPartialContent || rr.Body.String() != content[:10] {
+		t.Errorf("First range: got %v %q", rr.Code, rr.Body.String())
+	}
+	expectShareLink(mock, "open", nil, nil, 0, 6, nil)
+	expectDownloadCounted(mock, true)
+	req = httptest.NewRequest("GET", "/s/open", nil)
+	req.Header.Set("Range", "bytes=10-")
+	if rr := serve(req, "open"); rr.Code != http.StatusPartialContent || rr.Body.String() != content[10:] {
+		t.Errorf("Last range: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	// Ranges that can fetch the whole file without a range from the first byte count too
+	for _, requested := range []string{
+		"bytes=-999999999",
+		"bytes=1-",
+		"bytes=0-0,1-",
+		"bytes=5-" + strconv.Itoa(len(content)-1),
+		"bytes=0-9, 10-",
+		"items=0-9",
+	} {
+		expectShareLink(mock, "open", nil, nil, 0, 7, nil)
+		expectDownloadCounted(mock, true)
+		req = httptest.NewRequest("GET", "/s/open", nil)
+		req.Header.Set("Range", requested)
+		serve(req, "open")
+	}
+	expectShareLink(mock, "open", nil, nil, 0, 7, nil)
+	expectDownloadCounted(mock, true)
+	req = httptest.NewRequest("GET", "/s/open", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("If-Range", `"stale"`)
+	if rr := serve(req, "open"); rr.Code != http.StatusOK {
+		t.Errorf("Stale If-Range: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	mock.ExpectQuery(shareLinkQuery).WithArgs(sha256Hex("unknown")).WillReturnRows(sqlmock.NewRows(shareLinkColumns))
+	if rr := serve(httptest.NewRequest("GET", "/s/unknown", nil), "unknown"); rr.Code != http.StatusNotFound {
+		t.Errorf("Unknown token: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Links that can no longer be used
+	for _, tc := range []struct {
+		name               string
+		expiresAt          interface{}
+		max, count         int
+		revokedAt, message interface{}
+	}{
+		{"revoked", nil, 0, 0, time.Now(), "Link was revoked"},
+		{"expired", time.Now().Add(-time.Minute), 0, 0, nil, "Link has expired"},
+		{"exhausted", nil, 3, 3, nil, "Download limit reached"},
+	} {
+		expectShareLink(mock, tc.name, nil, tc.expiresAt, tc.max, tc.count, tc.revokedAt)
+		rr := serve(httptest.NewRequest("GET", "/s/"+tc.name, nil), tc.name)
+		if rr.Code != http.StatusGone || strings.TrimSpace(rr.Body.String()) != tc.message {
+			t.Errorf("%s link: got %v %q", tc.name, rr.Code, rr.Body.String())
+		}
+	}
+
+	// The last download is taken by a concurrent request
+	expectShareLink(mock, "last", nil, nil, 3, 2, nil)
+	expectDownloadCounted(mock, false)
+	if rr := serve(httptest.NewRequest("GET", "/s/last", nil), "last"); rr.Code != http.StatusGone {
+		t.Errorf("Concurrent last download: got %v, want %v", rr.Code, http.StatusGone)
+	}
+
+	// Password protected links
+	expectShareLink(mock, "locked", string(hash), time.Now().Add(time.Hour), 0, 0, nil)
+	if rr := serve(httptest.NewRequest("GET", "/s/locked", nil), "locked"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Missing password: got %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	expectShareLink(mock, "locked", string(hash), nil, 0, 0, nil)
+	req = httptest.NewRequest("GET", "/s/locked", nil)
+	req.Header.Set("X-Share-Password", "guess")
+	if rr := serve(req, "locked"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong password: got %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	expectShareLink(mock, "locked", string(hash), nil, 0, 0, nil)
+	expectDownloadCounted(mock, true)
+	req = httptest.NewRequest("GET", "/s/locked", nil)
+	req.Header.Set("X-Share-Password", "opposing-counsel")
+	if rr := serve(req, "locked"); rr.Code != http.StatusOK || rr.Body.String() != content {
+		t.Errorf("Password header: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	expectShareLink(mock, "locked", string(hash), nil, 0, 1, nil)
+	expectDownloadCounted(mock, true)
+	req = httptest.NewRequest("POST", "/s/locked", strings.NewReader(url.Values{"password": {"opposing-counsel"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if rr := serve(req, "locked"); rr.Code != http.StatusOK || rr.Body.String() != content {
+		t.Errorf("Password form: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListAndRevokeShareLinks(t *testing.T) {
+	log.Println("--- Starting TestListAndRevokeShareLinks ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Only links that can still be used are listed
+	mock.ExpectQuery("FROM share_links l JOIN files f ON f.id = l.file_id\\s+WHERE user_id = \\$1 AND org_id IS NULL AND f.deleted_at IS NULL AND "+notExpired("f")+" AND l.revoked_at IS NULL "+
+		"AND \\(l.expires_at IS NULL OR l.expires_at > NOW\\(\\)\\) AND \\(l.max_downloads = 0 OR l.download_count < l.max_downloads\\) AND l.file_id = \\$2 ORDER BY l.created_at DESC").
+		WithArgs(userA.ID, 7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "file_id", "file_name", "created_by", "token_prefix", "has_password",
+			"expires_at", "max_downloads", "download_count", "created_at"}).
+			AddRow(4, 7, "Settlement.pdf", userA.ID, "Xq3vT0aa", true, time.Now().Add(time.Hour), 3, 1, time.Now()).
+			AddRow(5, 7, "Settlement.pdf", userA.ID, "pL09aZ2c", false, nil, 0, 12, time.Now()))
+	rr := httptest.NewRecorder()
+	fileupload.ListShareLinks(rr, requestAs("GET", "/share-links?file_id=7", userA), db)
+	var links []models.ShareLink
+	json.NewDecoder(rr.Body).Decode(&links)
+	if rr.Code != http.StatusOK || len(links) != 2 || links[0].ExpiresAt == nil || links[1].ExpiresAt != nil ||
+		!links[0].HasPassword || links[0].Token != "" || links[1].DownloadCount != 12 {
+		t.Errorf("List: got %v %+v", rr.Code, links)
+	}
+
+	// Revoking the last link that can be used unflags the file
+	mock.ExpectQuery("UPDATE share_links SET revoked_at = NOW\\(\\)\\s+WHERE id = \\$1 AND revoked_at IS NULL AND file_id IN \\(SELECT id FROM files WHERE user_id = \\$2 AND org_id IS NULL\\)").
+		WithArgs(4, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"file_id"}).AddRow(7))
+	mock.ExpectExec("UPDATE files SET is_shared = EXISTS \\(SELECT 1 FROM share_links l WHERE l.file_id = files.id AND .*\\)\\s+WHERE id = \\$1").
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	rr = httptest.NewRecorder()
+	fileupload.RevokeShareLink(rr, requestAs("DELETE", "/share-links/4", userA), db, nil, 4)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Revoke: got %v, want %v", rr.Code, http.StatusOK)
+	}
+
+	// Links to other users' files, or already revoked, are not found
+	mock.ExpectQuery("UPDATE share_links SET revoked_at = NOW\\(\\)").
+		WithArgs(4, userB.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"file_id"}))
+	rr = httptest.NewRecorder()
+	fileupload.RevokeShareLink(rr, requestAs("DELETE", "/share-links/4", userB), db, nil, 4)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Revoke of another user's link: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestShareLinkPasswordLockout(t *testing.T) {
+	log.Println("--- Starting TestShareLinkPasswordLockout ---")
+	useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+	auth.SetDB(db, redisClient)
+	defer auth.SetDB(nil, nil)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("opposing-counsel"), bcrypt.MinCost)
+	serve := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/s/locked", nil)
+		req.Header.Set("X-Share-Password", password)
+		rr := httptest.NewRecorder()
+		fileupload.ServeShareLink(rr, req, db, "locked")
+		return rr
+	}
+
+	for i := 0; i < 5; i++ {
+		expectShareLink(mock, "locked", string(hash), nil, 0, 0, nil)
+		if rr := serve("guess"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: got %v, want %v", i+1, rr.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// The link is locked out, even for the right password
+	expectShareLink(mock, "locked", string(hash), nil, 0, 0, nil)
+	rr := serve("opposing-counsel")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Locked link: got %v with headers %v", rr.Code, rr.Header())
+	}
+	if !mr.Exists("share_password_lock:4") {
+		t.Errorf("Lockout is not keyed by the link: %v", mr.Keys())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,369 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/storage"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// fakeS3 is an in-memory stand-in for a MinIO server holding one bucket. It
+// implements the object, listing and multipart calls the S3 backend makes and
+// refuses requests that are not signed with the expected credentials.
+type fakeS3 struct {
+	*httptest.Server
+	mu        sync.Mutex
+	objects   map[string][]byte
+	uploads   map[string]map[int][]byte
+	requests  []string
+	pageSize  int
+	accessKey string
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}, pageSize: 1000, accessKey: "minioadmin"}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeS3) backend() *storage.S3Backend {
+	return &storage.S3Backend{
+		Endpoint:        f.URL,
+		Bucket:          "legalforce",
+		AccessKeyID:     f.accessKey,
+		SecretAccessKey: "minioadmin",
+		PathStyle:       true,
+	}
+}
+
+func s3Fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := r.URL.Query()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+f.accessKey+"/") &&
+		!strings.HasPrefix(query.Get("X-Amz-Credential"), f.accessKey+"/") {
+		s3Fail(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/legalforce") {
+		s3Fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/legalforce"), "/")
+
+	switch {
+	case key == "" && r.Method == "GET":
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, query.Get("prefix")) && k > query.Get("continuation-token") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		truncated := len(keys) > f.pageSize
+		if truncated {
+			keys = keys[:f.pageSize]
+		}
+		fmt.Fprintf(w, "<ListBucketResult><IsTruncated>%t</IsTruncated>", truncated)
+		if truncated {
+			fmt.Fprintf(w, "<NextContinuationToken>%s</NextContinuationToken>", keys[len(keys)-1])
+		}
+		for _, k := range keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>2026-10-18T10:00:00.000Z</LastModified><ETag>\"e\"</ETag><Size>%d</Size></Contents>", k, len(f.objects[k]))
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+
+	case r.Method == "POST" && query.Has("uploads"):
+		id := "upload-" + strconv.Itoa(len(f.uploads)+1)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case r.Method == "PUT" && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			s3Fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[n], _ = io.ReadAll(r.Body)
+		w.Header().Set("ETag", fmt.Sprintf("\"part-%d\"", n))
+
+	case r.Method == "POST" && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			s3Fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		xml.NewDecoder(r.Body).Decode(&complete)
+		var object []byte
+		for _, p := range complete.Parts {
+			if p.ETag != fmt.Sprintf("\"part-%d\"", p.PartNumber) {
+				s3Fail(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, parts[p.PartNumber]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+
+	case r.Method == "DELETE" && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "PUT":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		f.objects[key] = data
+		w.Header().Set("ETag", "\"e\"")
+
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := f.objects[key]
+		if !ok {
+			s3Fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", "\"e\"")
+		w.Header().Set("Last-Modified", "Sun, 18 Oct 2026 10:00:00 GMT")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}
+}
+
+// failingReader yields some bytes and then an error, like a dropped upload
+type failingReader struct{ sent bool }
+
+var errDropped = errors.New("connection dropped")
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.sent {
+		return 0, errDropped
+	}
+	r.sent = true
+	return copy(p, "partial"), nil
+}
+
+// exerciseBackend runs the same checks against any storage backend
+func exerciseBackend(t *testing.T, backend storage.Backend) {
+	ctx := context.Background()
+	content := "The quick brown fox jumps over the lazy dog"
+
+	if err := backend.Put(ctx, "cases/7/brief.txt", strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := backend.Put(ctx, "cases/7/notes.txt", strings.NewReader("notes"), -1, ""); err != nil {
+		t.Fatalf("Put of unknown size: %v", err)
+	}
+	if err := backend.Put(ctx, "other.txt", strings.NewReader("x"), -1, ""); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// Ranged reads report the size of the whole object
+	body, obj, err := backend.Get(ctx, "cases/7/brief.txt", 4, 5)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "quick" || obj.Size != int64(len(content)) {
+		t.Errorf("Get(4, 5) = %q with size %d", data, obj.Size)
+	}
+	body, _, err = backend.Get(ctx, "cases/7/brief.txt", 40, -1)
+	if err != nil {
+		t.Fatalf("Get to the end: %v", err)
+	}
+	data, _ = io.ReadAll(body)
+	body.Close()
+	if string(data) != "dog" {
+		t.Errorf("Get(40, -1) = %q", data)
+	}
+
+	obj, err = backend.Stat(ctx, "cases/7/notes.txt")
+	if err != nil || obj.Size != 5 || obj.ModTime.IsZero() || obj.ETag == "" {
+		t.Errorf("Stat = %+v, %v", obj, err)
+	}
+	if _, err := backend.Stat(ctx, "cases/7/missing.txt"); err != storage.ErrNotFound {
+		t.Errorf("Stat of a missing key: %v, want ErrNotFound", err)
+	}
+	if _, _, err := backend.Get(ctx, "cases/7/missing.txt", 0, -1); err != storage.ErrNotFound {
+		t.Errorf("Get of a missing key: %v, want ErrNotFound", err)
+	}
+
+	objects, err := backend.List(ctx, "cases/7/")
+	if err != nil || len(objects) != 2 || objects[0].Key != "cases/7/brief.txt" || objects[1].Key != "cases/7/notes.txt" {
+		t.Errorf("List = %+v, %v", objects, err)
+	}
+
+	// A failed read stores nothing
+	if err := backend.Put(ctx, "cases/7/dropped.txt", &failingReader{}, -1, ""); !errors.Is(err, errDropped) {
+		t.Errorf("Put of a failing reader: %v, want %v", err, errDropped)
+	}
+	if _, err := backend.Stat(ctx, "cases/7/dropped.txt"); err != storage.ErrNotFound {
+		t.Errorf("Failed Put left an object behind: %v", err)
+	}
+
+	if err := backend.Put(ctx, "../escape.txt", strings.NewReader("x"), 1, ""); err != storage.ErrInvalidKey {
+		t.Errorf("Put outside the store: %v, want ErrInvalidKey", err)
+	}
+
+	if err := backend.Delete(ctx, "cases/7/notes.txt"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+	if err := backend.Delete(ctx, "cases/7/notes.txt"); err != nil {
+		t.Errorf("Deleting a missing object: %v", err)
+	}
+	if _, err := backend.Stat(ctx, "cases/7/notes.txt"); err != storage.ErrNotFound {
+		t.Errorf("Stat after Delete: %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocalBackend(t *testing.T) {
+	log.Println("--- Starting TestLocalBackend ---")
+	backend := &storage.LocalBackend{Dir: t.TempDir(), BaseURL: "https://files.example.com/uploads/", SigningKey: []byte("k")}
+	exerciseBackend(t, backend)
+
+	link, err := backend.PresignGet(context.Background(), "cases/7/brief.txt", time.Hour)
+	if err != nil || !strings.HasPrefix(link, "https://files.example.com/uploads/cases/7/brief.txt?expires=") {
+		t.Fatalf("PresignGet = %q, %v", link, err)
+	}
+	parsed, _ := url.Parse(link)
+	if !backend.VerifyPresigned("cases/7/brief.txt", parsed.Query()) || backend.VerifyPresigned("cases/7/notes.txt", parsed.Query()) {
+		t.Errorf("Presigned URL %q verified for the wrong keys", link)
+	}
+	if _, err := (&storage.LocalBackend{Dir: t.TempDir()}).PresignGet(context.Background(), "a.txt", time.Hour); err == nil {
+		t.Errorf("PresignGet without a signing key succeeded")
+	}
+}
+
+func TestS3Backend(t *testing.T) {
+	log.Println("--- Starting TestS3Backend ---")
+	fake := newFakeS3(t)
+	fake.pageSize = 1 // exercise continuation tokens
+	backend := fake.backend()
+	backend.PartSize = 16
+	exerciseBackend(t, backend)
+
+	// Uploads of unknown size larger than a part go through a multipart upload
+	content := strings.Repeat("0123456789", 5)
+	if err := backend.Put(context.Background(), "big.bin", strings.NewReader(content), -1, ""); err != nil {
+		t.Fatalf("Multipart Put: %v", err)
+	}
+	if string(fake.objects["big.bin"]) != content || len(fake.uploads) != 0 {
+		t.Errorf("Multipart upload stored %q with %d uploads left open", fake.objects["big.bin"], len(fake.uploads))
+	}
+
+	// Presigned URLs work without credentials until they expire
+	link, err := backend.PresignGet(context.Background(), "big.bin", 10*time.Minute)
+	if err != nil || !strings.Contains(link, "X-Amz-Expires=600") || !strings.Contains(link, "X-Amz-Signature=") {
+		t.Fatalf("PresignGet = %q, %v", link, err)
+	}
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Fatalf("Fetching presigned URL: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != content {
+		t.Errorf("Presigned URL served %q", data)
+	}
+
+	// Requests with the wrong credentials are refused
+	wrong := fake.backend()
+	wrong.AccessKeyID = "intruder"
+	if _, _, err := wrong.Get(context.Background(), "big.bin", 0, -1); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("Get with wrong credentials: %v", err)
+	}
+}
+
+func TestUploadAndShareThroughS3Backend(t *testing.T) {
+	log.Println("--- Starting TestUploadAndShareThroughS3Backend ---")
+	fake := newFakeS3(t)
+	previous := storage.Default()
+	storage.SetDefault(fake.backend())
+	t.Cleanup(func() { storage.SetDefault(previous) })
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	files := map[string][]byte{"brief.pdf": []byte("%PDF-1.4 brief")}
+	var key string
+	expectNoContentPolicy(mock)
+	expectNoExpiryPolicy(mock)
+	expectNoQuota(mock)
+	expectNewBlob(mock)
+	mock.ExpectQuery("INSERT INTO files .* RETURNING id").
+		WithArgs(userA.ID, "brief.pdf", sqlmock.AnyArg(), int64(14),
+			".pdf", sqlmock.AnyArg(), "", false, sqlmock.AnyArg(), nil, "brief.pdf", captureArg{&key}, sqlmock.AnyArg(), nil, "application/pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(60))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	fileupload.UploadFile(rr, multipartUpload(t, files, []string{"brief.pdf"}), db, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Upload returned %v: %s", rr.Code, rr.Body.String())
+	}
+	if string(fake.objects[key]) != "%PDF-1.4 brief" {
+		t.Fatalf("Object %q not stored in the bucket: %v", key, fake.requests)
+	}
+
+	// Downloads stream from the bucket
+	mock.ExpectQuery("SELECT file_name, storage_key, file_type, mime_type, upload_date, .* FROM files WHERE id = \\$1").
+		WithArgs(60, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"file_name", "storage_key", "file_type", "mime_type", "upload_date", "scan_status"}).AddRow("brief.pdf", key, ".pdf", "application/pdf", time.Now(), "clean"))
+	rr = httptest.NewRecorder()
+	req := requestAs("GET", "/files/60/content", userA)
+	req.Header.Set("Range", "bytes=0-3")
+	fileupload.DownloadFile(rr, req, db, 60)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "%PDF" || rr.Header().Get("Content-Type") != "application/pdf" {
+		t.Errorf("Download: %v %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	// Presigned URLs point at the object in the bucket
+	link, err := storage.Default().PresignGet(context.Background(), key, time.Hour)
+	if err != nil || !strings.HasPrefix(link, fake.URL+"/legalforce/"+key+"?") || !strings.Contains(link, "X-Amz-Signature=") {
+		t.Errorf("PresignGet returned %q %v", link, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
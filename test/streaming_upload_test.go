@@ -0,0 +1,170 @@
+package test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// captureArg matches any argument and records it, to learn generated values
+type captureArg struct{ value *string }
+
+func (c captureArg) Match(v driver.Value) bool {
+	*c.value, _ = v.(string)
+	return true
+}
+
+// multipartUpload builds an upload request with one file part per entry and a
+// plain form field in between
+func multipartUpload(t *testing.T, files map[string][]byte, order []string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i, name := range order {
+		part, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatalf("Failed to create form file: %v", err)
+		}
+		part.Write(files[name])
+		if i == 0 {
+			writer.WriteField("note", "ignored")
+		}
+	}
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req.WithContext(auth.WithUser(req.Context(), userA))
+}
+
+func decodeUploadResults(t *testing.T, body io.Reader) []fileupload.UploadResult {
+	t.Helper()
+	var response struct {
+		Files []fileupload.UploadResult `json:"files"`
+	}
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return response.Files
+}
+
+func TestStreamingUploadMultipleFiles(t *testing.T) {
+	log.Println("--- Starting TestStreamingUploadMultipleFiles ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	files := map[string][]byte{
+		"brief.pdf":   []byte("%PDF-1.4 brief"),
+		"exhibit.txt": []byte("Exhibit A"),
+	}
+	order := []string{"brief.pdf", "exhibit.txt"}
+	mimeTypes := map[string]string{"brief.pdf": "application/pdf", "exhibit.txt": "text/plain"}
+
+	expectNoContentPolicy(mock)
+	expectNoExpiryPolicy(mock)
+	keys := make([]string, len(order))
+	for i, name := range order {
+		expectNoQuota(mock)
+		expectNewBlob(mock)
+		mock.ExpectQuery("INSERT INTO files .* RETURNING id").
+			WithArgs(userA.ID, name, sqlmock.AnyArg(), int64(len(files[name])),
+				filepath.Ext(name), "", "", false, sqlmock.AnyArg(), nil, name, captureArg{&keys[i]}, sha256Hex(string(files[name])), nil, mimeTypes[name]).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(40 + i))
+		mock.ExpectCommit()
+	}
+
+	rr := httptest.NewRecorder()
+	fileupload.UploadFile(rr, multipartUpload(t, files, order), db, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	results := decodeUploadResults(t, rr.Body)
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %+v", results)
+	}
+	for i, result := range results {
+		name := order[i]
+		sha := sha256Hex(string(files[name]))
+		md := md5.Sum(files[name])
+		if result.Name != name || result.ID != 40+i || result.Size != int64(len(files[name])) ||
+			result.FileURL != fmt.Sprintf("http://localhost:8080/files/%d/content", 40+i) ||
+			result.SHA256 != sha || result.MD5 != hex.EncodeToString(md[:]) {
+			t.Errorf("Unexpected result for %s: %+v", name, result)
+		}
+		stored, err := os.ReadFile(filepath.Join(backend.Dir, keys[i]))
+		if err != nil || !bytes.Equal(stored, files[name]) {
+			t.Errorf("Stored content of %s = %q (%v)", name, stored, err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStreamingUploadEnforcesMaxSize(t *testing.T) {
+	log.Println("--- Starting TestStreamingUploadEnforcesMaxSize ---")
+	backend := useLocalStorage(t)
+	t.Setenv("UPLOAD_MAX_SIZE", "16")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	files := map[string][]byte{
+		"small.txt": []byte("fits"),
+		"large.txt": []byte(strings.Repeat("x", 17)),
+		"after.txt": []byte("never read"),
+	}
+
+	expectNoContentPolicy(mock)
+	expectNoExpiryPolicy(mock)
+	expectNoQuota(mock)
+	expectNewBlob(mock)
+	mock.ExpectQuery("INSERT INTO files .* RETURNING id").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(50))
+	mock.ExpectCommit()
+	expectNoQuota(mock)
+
+	rr := httptest.NewRecorder()
+	fileupload.UploadFile(rr, multipartUpload(t, files, []string{"small.txt", "large.txt", "after.txt"}), db, nil)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	// The file before the oversized one is kept, nothing after it is read
+	results := decodeUploadResults(t, rr.Body)
+	if len(results) != 2 || results[0].ID != 50 || results[1].Name != "large.txt" || results[1].Error == "" {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+	if stored, _ := filepath.Glob(filepath.Join(backend.Dir, "*.txt")); len(stored) != 1 {
+		t.Errorf("Expected exactly one stored file, got %v", stored)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,205 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/models"
+	"go_backend_legalForce/storage"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestDeleteFileMovesToTrash(t *testing.T) {
+	log.Println("--- Starting TestDeleteFileMovesToTrash ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+
+	mr.Set("user_files:1", "[listing with file 7]")
+
+	mock.ExpectQuery("UPDATE files SET deleted_at = NOW\\(\\) WHERE id = \\$1 AND deleted_at IS NULL AND "+withGrants("user_id = \\$2 AND org_id IS NULL")+" RETURNING user_id").
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "org_id"}).AddRow(userA.ID, 0))
+
+	rr := httptest.NewRecorder()
+	fileupload.DeleteFile(rr, requestAs("DELETE", "/files/7", userA), db, redisClient, 7)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	// The listing must not show the file any more
+	if mr.Exists("user_files:1") {
+		t.Errorf("user_files:1 is still cached")
+	}
+
+	// Files already in the trash, or of other users, are not found
+	mock.ExpectQuery("UPDATE files SET deleted_at = NOW\\(\\)").
+		WithArgs(7, userB.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "org_id"}))
+	rr = httptest.NewRecorder()
+	fileupload.DeleteFile(rr, requestAs("DELETE", "/files/7", userB), db, redisClient, 7)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Other user's file: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTrashListAndRestore(t *testing.T) {
+	log.Println("--- Starting TestTrashListAndRestore ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+
+	deletedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	mock.ExpectQuery("SELECT .* FROM files WHERE user_id = \\$1 AND org_id IS NULL AND deleted_at IS NOT NULL ORDER BY deleted_at DESC").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "file_name", "original_name", "upload_date", "size", "file_type", "description", "deleted_at"}).
+			AddRow(7, userA.ID, "brief.pdf", "brief.pdf", time.Now(), 100, ".pdf", "", deletedAt))
+
+	rr := httptest.NewRecorder()
+	fileupload.ListTrash(rr, requestAs("GET", "/trash", userA), db)
+	var files []models.File
+	json.NewDecoder(rr.Body).Decode(&files)
+	if rr.Code != http.StatusOK || len(files) != 1 || files[0].DeletedAt == nil || !files[0].DeletedAt.Equal(deletedAt) {
+		t.Fatalf("Unexpected trash listing: %v %+v", rr.Code, files)
+	}
+
+	// Restoring puts the file back in the listing
+	mr.Set("user_files:1", "[listing without file 7]")
+	mock.ExpectQuery("UPDATE files SET deleted_at = NULL WHERE id = \\$1 AND deleted_at IS NOT NULL AND user_id = \\$2 AND org_id IS NULL").
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns).AddRow(7, userA.ID, 0, "brief.pdf", "brief.pdf",
+			time.Now(), 100, ".pdf", "", "", false, nil, 0, "application/pdf", "clean"))
+	rr = httptest.NewRecorder()
+	fileupload.RestoreFile(rr, requestAs("POST", "/trash/7/restore", userA), db, redisClient, 7)
+	var file models.File
+	json.NewDecoder(rr.Body).Decode(&file)
+	if rr.Code != http.StatusOK || file.ID != 7 || file.DeletedAt != nil {
+		t.Errorf("Restore: got %v %+v", rr.Code, file)
+	}
+	if mr.Exists("user_files:1") {
+		t.Error("Cached listing was not invalidated")
+	}
+
+	// Only files in the trash can be restored
+	mock.ExpectQuery("UPDATE files SET deleted_at = NULL").
+		WithArgs(8, userA.ID).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns))
+	rr = httptest.NewRecorder()
+	fileupload.RestoreFile(rr, requestAs("POST", "/trash/8/restore", userA), db, redisClient, 8)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Restoring a file not in the trash: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	log.Println("--- Starting TestPurgeTrash ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a.pdf", "a-v1.pdf", "b.pdf", "c.pdf"} {
+		backend.Put(context.Background(), key, strings.NewReader("%PDF"), 4, "")
+	}
+	stored := func(key string) bool {
+		_, err := backend.Stat(context.Background(), key)
+		return !errors.Is(err, storage.ErrNotFound)
+	}
+
+	// A single file, with the contents of all its versions
+	mock.ExpectQuery("DELETE FROM files WHERE id = \\$1 AND deleted_at IS NOT NULL AND user_id = \\$2 AND org_id IS NULL RETURNING id, storage_key").
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows(deletedFilesColumns).AddRow(1, "{a.pdf,a-v1.pdf}"))
+	mock.ExpectQuery("DELETE FROM blobs WHERE storage_key = ANY\\(\\$1\\) AND ref_count <= 0 RETURNING storage_key").
+		WillReturnRows(sqlmock.NewRows([]string{"storage_key"}).AddRow("a.pdf").AddRow("a-v1.pdf"))
+	rr := httptest.NewRecorder()
+	fileupload.PurgeFile(rr, requestAs("DELETE", "/trash/7", userA), db, 7)
+	if rr.Code != http.StatusOK || stored("a.pdf") || stored("a-v1.pdf") {
+		t.Errorf("Purge: got %v, contents stored: %v %v", rr.Code, stored("a.pdf"), stored("a-v1.pdf"))
+	}
+
+	// Files that were not deleted first cannot be purged
+	mock.ExpectQuery("DELETE FROM files WHERE id = \\$1 AND deleted_at IS NOT NULL").
+		WithArgs(8, userA.ID).
+		WillReturnRows(sqlmock.NewRows(deletedFilesColumns).AddRow(0, "{}"))
+	rr = httptest.NewRecorder()
+	fileupload.PurgeFile(rr, requestAs("DELETE", "/trash/8", userA), db, 8)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Purging a file not in the trash: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Only owners and admins delete the files of an organization for good
+	inOrg := func(target, role string) *http.Request {
+		req := requestAs("DELETE", target, userB)
+		return req.WithContext(auth.WithMembership(req.Context(), models.Membership{OrgID: 5, UserID: userB.ID, Role: role}))
+	}
+	rr = httptest.NewRecorder()
+	fileupload.PurgeFile(rr, inOrg("/trash/9", models.OrgRoleMember), db, 9)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Purge as member: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+	rr = httptest.NewRecorder()
+	fileupload.EmptyTrash(rr, inOrg("/trash", models.OrgRoleMember), db)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Empty trash as member: got %v, want %v", rr.Code, http.StatusForbidden)
+	}
+	mock.ExpectQuery("DELETE FROM files WHERE id = \\$1 AND deleted_at IS NOT NULL AND org_id = \\$2").
+		WithArgs(9, 5).
+		WillReturnRows(sqlmock.NewRows(deletedFilesColumns).AddRow(0, "{}"))
+	rr = httptest.NewRecorder()
+	fileupload.PurgeFile(rr, inOrg("/trash/9", models.OrgRoleAdmin), db, 9)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Purge as admin: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// The whole trash. Contents still used by another file are kept.
+	mock.ExpectQuery("DELETE FROM files WHERE user_id = \\$1 AND org_id IS NULL AND deleted_at IS NOT NULL RETURNING id, storage_key").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows(deletedFilesColumns).AddRow(2, "{b.pdf,c.pdf}"))
+	mock.ExpectQuery("DELETE FROM blobs WHERE storage_key = ANY").
+		WillReturnRows(sqlmock.NewRows([]string{"storage_key"}).AddRow("b.pdf"))
+	rr = httptest.NewRecorder()
+	fileupload.EmptyTrash(rr, requestAs("DELETE", "/trash", userA), db)
+	var resp struct {
+		Deleted int `json:"deleted"`
+	}
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if rr.Code != http.StatusOK || resp.Deleted != 2 || stored("b.pdf") || !stored("c.pdf") {
+		t.Errorf("Empty trash: got %v, %d deleted", rr.Code, resp.Deleted)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
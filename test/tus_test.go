@@ -0,0 +1,308 @@
+package test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const uploadStateQuery = "SELECT user_id, org_id, file_name, metadata, upload_length, upload_offset, file_id, expires_at\\s+FROM resumable_uploads WHERE id = \\$1 AND user_id = \\$2"
+
+var uploadStateColumns = []string{"user_id", "org_id", "file_name", "metadata", "upload_length", "upload_offset", "file_id", "expires_at"}
+
+func tusRequest(method, target string, body []byte, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req = req.WithContext(auth.WithUser(req.Context(), userA))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func expectUploadState(mock sqlmock.Sqlmock, id string, length, offset int64) {
+	mock.ExpectQuery(uploadStateQuery).
+		WithArgs(id, userA.ID).
+		WillReturnRows(sqlmock.NewRows(uploadStateColumns).
+			AddRow(userA.ID, nil, "deposition.mp4", "", length, offset, nil, time.Now().Add(time.Hour)))
+}
+
+// expectLeasedUploadState expects a PATCH to lease the upload and load its state
+func expectLeasedUploadState(mock sqlmock.Sqlmock, id string, length, offset int64) {
+	mock.ExpectExec("UPDATE resumable_uploads SET locked_by = \\$1, locked_until = \\$2\\s+WHERE id = \\$3 AND user_id = \\$4 AND \\(locked_until IS NULL OR locked_until < NOW\\(\\)\\)").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), id, userA.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectUploadState(mock, id, length, offset)
+}
+
+// expectLeaseReleased expects a PATCH to release its lease when done
+func expectLeaseReleased(mock sqlmock.Sqlmock, id string) {
+	mock.ExpectExec("UPDATE resumable_uploads SET locked_by = NULL, locked_until = NULL WHERE id = \\$1 AND locked_by = \\$2").
+		WithArgs(id, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func patchRequest(location string, offset string, chunk []byte) *http.Request {
+	return tusRequest("PATCH", location, chunk, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": offset,
+	})
+}
+
+func TestResumableUpload(t *testing.T) {
+	log.Println("--- Starting TestResumableUpload ---")
+	backend := useLocalStorage(t)
+	t.Setenv("TUS_UPLOAD_DIR", t.TempDir())
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	content := []byte("\x00\x00\x00\x14ftypmp42\x00\x00\x00\x00mp42") // an MP4 header
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("deposition.mp4"))
+
+	// Clients must speak tus 1.0.0
+	rr := httptest.NewRecorder()
+	req := tusRequest("POST", fileupload.TusPath, nil, map[string]string{"Upload-Length": "20"})
+	req.Header.Del("Tus-Resumable")
+	fileupload.CreateResumableUpload(rr, req, db)
+	if rr.Code != http.StatusPreconditionFailed || rr.Header().Get("Tus-Version") != "1.0.0" {
+		t.Errorf("Missing Tus-Resumable: got %v, want %v", rr.Code, http.StatusPreconditionFailed)
+	}
+
+	// Creation
+	expectNoQuota(mock)
+	mock.ExpectExec("INSERT INTO resumable_uploads").
+		WithArgs(sqlmock.AnyArg(), userA.ID, nil, "deposition.mp4", metadata, int64(len(content)), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	rr = httptest.NewRecorder()
+	fileupload.CreateResumableUpload(rr, tusRequest("POST", fileupload.TusPath, nil,
+		map[string]string{"Upload-Length": "20", "Upload-Metadata": metadata}), db)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Create returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	location := rr.Header().Get("Location")
+	id := strings.TrimPrefix(location, fileupload.TusPath+"/")
+	if id == location || rr.Header().Get("Upload-Expires") == "" {
+		t.Fatalf("Unexpected creation headers: %v", rr.Header())
+	}
+
+	patch := func(offset string, chunk []byte) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		fileupload.PatchResumableUpload(rr, patchRequest(location, offset, chunk), db, nil, id)
+		return rr
+	}
+
+	// First chunk
+	expectLeasedUploadState(mock, id, 20, 0)
+	mock.ExpectExec("UPDATE resumable_uploads SET upload_offset = \\$1, expires_at = \\$2 WHERE id = \\$3 AND locked_by = \\$4").
+		WithArgs(int64(8), sqlmock.AnyArg(), id, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLeaseReleased(mock, id)
+	if rr := patch("0", content[:8]); rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "8" {
+		t.Fatalf("First chunk: got %v with offset %q", rr.Code, rr.Header().Get("Upload-Offset"))
+	}
+
+	// A chunk at the wrong offset is refused
+	expectLeasedUploadState(mock, id, 20, 8)
+	expectLeaseReleased(mock, id)
+	if rr := patch("4", content[4:]); rr.Code != http.StatusConflict {
+		t.Errorf("Wrong offset: got %v, want %v", rr.Code, http.StatusConflict)
+	}
+
+	// HEAD reports where to resume, from the persisted state
+	expectUploadState(mock, id, 20, 8)
+	rr = httptest.NewRecorder()
+	fileupload.ResumableUploadStatus(rr, tusRequest("HEAD", location, nil, nil), db, id)
+	if rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != "8" || rr.Header().Get("Upload-Length") != "20" {
+		t.Errorf("HEAD: got %v with headers %v", rr.Code, rr.Header())
+	}
+
+	// The last chunk completes the upload and registers the file
+	expectLeasedUploadState(mock, id, 20, 8)
+	mock.ExpectExec("UPDATE resumable_uploads SET upload_offset").
+		WithArgs(int64(20), sqlmock.AnyArg(), id, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectNoContentPolicy(mock)
+	expectNoExpiryPolicy(mock)
+	expectNoQuota(mock)
+	expectNewBlob(mock)
+	mock.ExpectQuery("INSERT INTO files .* RETURNING id").
+		WithArgs(userA.ID, sqlmock.AnyArg(), sqlmock.AnyArg(), int64(20), ".mp4",
+			"", "", false, nil, nil, "deposition.mp4", sqlmock.AnyArg(), sha256Hex(string(content)), nil, "video/mp4").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(31))
+	mock.ExpectExec("UPDATE resumable_uploads SET file_id = \\$1 WHERE id = \\$2 AND locked_by = \\$3").
+		WithArgs(31, id, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectLeaseReleased(mock, id)
+	rr = patch("8", content[8:])
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "20" || rr.Header().Get("X-File-ID") != "31" {
+		t.Fatalf("Last chunk: got %v with headers %v", rr.Code, rr.Header())
+	}
+
+	// The assembled file is stored like a regular upload
+	stored, _ := filepath.Glob(filepath.Join(backend.Dir, "*.mp4"))
+	if len(stored) != 1 {
+		t.Fatalf("Expected one stored file, got %v", stored)
+	}
+	data, _ := os.ReadFile(stored[0])
+	if !bytes.Equal(data, content) {
+		t.Errorf("Stored file = %q, want %q", data, content)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestResumableUploadTermination(t *testing.T) {
+	log.Println("--- Starting TestResumableUploadTermination ---")
+	t.Setenv("TUS_UPLOAD_DIR", t.TempDir())
+	t.Setenv("TUS_MAX_SIZE", "100")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	rr := httptest.NewRecorder()
+	fileupload.CreateResumableUpload(rr, tusRequest("POST", fileupload.TusPath, nil, map[string]string{"Upload-Length": "101"}), db)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Oversized upload: got %v, want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	expectNoQuota(mock)
+	mock.ExpectExec("INSERT INTO resumable_uploads").WillReturnResult(sqlmock.NewResult(0, 1))
+	rr = httptest.NewRecorder()
+	fileupload.CreateResumableUpload(rr, tusRequest("POST", fileupload.TusPath, nil, map[string]string{"Upload-Length": "10"}), db)
+	id := strings.TrimPrefix(rr.Header().Get("Location"), fileupload.TusPath+"/")
+	part := filepath.Join(os.Getenv("TUS_UPLOAD_DIR"), id+".part")
+	if _, err := os.Stat(part); err != nil {
+		t.Fatalf("Part file not created: %v", err)
+	}
+
+	expectUploadState(mock, id, 10, 0)
+	mock.ExpectExec("DELETE FROM resumable_uploads WHERE id = \\$1").
+		WithArgs(id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	rr = httptest.NewRecorder()
+	fileupload.TerminateResumableUpload(rr, tusRequest("DELETE", fileupload.TusPath+"/"+id, nil, nil), db, id)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Terminate: got %v, want %v", rr.Code, http.StatusNoContent)
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("Part file still exists after termination")
+	}
+
+	// Expired uploads are gone
+	mock.ExpectQuery(uploadStateQuery).
+		WithArgs("expired", userA.ID).
+		WillReturnRows(sqlmock.NewRows(uploadStateColumns).
+			AddRow(userA.ID, nil, "", "", 10, 0, nil, time.Now().Add(-time.Minute)))
+	rr = httptest.NewRecorder()
+	fileupload.ResumableUploadStatus(rr, tusRequest("HEAD", fileupload.TusPath+"/expired", nil, nil), db, "expired")
+	if rr.Code != http.StatusGone {
+		t.Errorf("Expired upload: got %v, want %v", rr.Code, http.StatusGone)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestResumableUploadLocking(t *testing.T) {
+	log.Println("--- Starting TestResumableUploadLocking ---")
+	backend := useLocalStorage(t)
+	t.Setenv("TUS_UPLOAD_DIR", t.TempDir())
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	part := filepath.Join(os.Getenv("TUS_UPLOAD_DIR"), "abc.part")
+	if err := os.WriteFile(part, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A chunk sent while another request, on any instance, writes the upload is refused
+	mock.ExpectExec("UPDATE resumable_uploads SET locked_by").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "abc", userA.ID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectUploadState(mock, "abc", 10000, 0)
+	rr := httptest.NewRecorder()
+	fileupload.PatchResumableUpload(rr, patchRequest(fileupload.TusPath+"/abc", "0", []byte("data")), db, nil, "abc")
+	if rr.Code != http.StatusConflict {
+		t.Errorf("Locked upload: got %v, want %v", rr.Code, http.StatusConflict)
+	}
+
+	// Contents refused for their type are discarded once their first bytes are in,
+	// not after the whole file was sent
+	chunk := append([]byte("MZ\x90\x00"), make([]byte, 600)...) // an executable named deposition.mp4
+	expectLeasedUploadState(mock, "abc", 10000, 0)
+	expectNoContentPolicy(mock)
+	mock.ExpectExec("DELETE FROM resumable_uploads WHERE id = \\$1").
+		WithArgs("abc").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLeaseReleased(mock, "abc")
+	rr = httptest.NewRecorder()
+	fileupload.PatchResumableUpload(rr, patchRequest(fileupload.TusPath+"/abc", "0", chunk), db, nil, "abc")
+	if rr.Code != http.StatusUnsupportedMediaType || !strings.Contains(rr.Body.String(), "content_type_mismatch") {
+		t.Errorf("Refused contents: got %v: %s", rr.Code, rr.Body.String())
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("Part file of the refused upload still exists")
+	}
+
+	// A completion that can no longer be recorded on the upload, here because its
+	// lease ran out, registers no file and keeps the bytes to retry from
+	content := []byte("\x00\x00\x00\x14ftypmp42\x00\x00\x00\x00mp42")
+	part = filepath.Join(os.Getenv("TUS_UPLOAD_DIR"), "def.part")
+	if err := os.WriteFile(part, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectLeasedUploadState(mock, "def", 20, 20)
+	mock.ExpectExec("UPDATE resumable_uploads SET upload_offset").
+		WithArgs(int64(20), sqlmock.AnyArg(), "def", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectNoContentPolicy(mock)
+	expectNoExpiryPolicy(mock)
+	expectNoQuota(mock)
+	expectNewBlob(mock)
+	mock.ExpectQuery("INSERT INTO files .* RETURNING id").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(32))
+	mock.ExpectExec("UPDATE resumable_uploads SET file_id").
+		WithArgs(32, "def", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	expectLeaseReleased(mock, "def")
+	rr = httptest.NewRecorder()
+	fileupload.PatchResumableUpload(rr, patchRequest(fileupload.TusPath+"/def", "20", nil), db, nil, "def")
+	if rr.Code != http.StatusInternalServerError || rr.Header().Get("X-File-ID") != "" {
+		t.Errorf("Unrecorded completion: got %v with headers %v", rr.Code, rr.Header())
+	}
+	if _, err := os.Stat(part); err != nil {
+		t.Errorf("Part file of the unrecorded upload is gone: %v", err)
+	}
+	if stored, _ := filepath.Glob(filepath.Join(backend.Dir, "*.mp4")); len(stored) != 0 {
+		t.Errorf("Unrecorded upload left stored files %v", stored)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
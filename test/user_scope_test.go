@@ -0,0 +1,220 @@
+package test
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/middleware"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	userA = models.User{ID: 1, Email: "a@example.com"}
+	userB = models.User{ID: 2, Email: "b@example.com"}
+)
+
+var fileColumns = []string{"id", "file_name", "original_name", "upload_date", "size", "file_type", "s3_url", "description", "is_shared", "expiration_date", "folder_id", "mime_type", "scan_status"}
+
+func requestAs(method, target string, user models.User) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	return req.WithContext(auth.WithUser(req.Context(), user))
+}
+
+func TestAuthMiddlewareStoresUser(t *testing.T) {
+	log.Println("--- Starting TestAuthMiddlewareStoresUser ---")
+	t.Setenv("JWT_SECRET_KEY", "test-secret")
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	auth.SetDB(db, nil)
+
+	token, _, err := auth.GenerateToken(userA, "")
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+
+	expectUserLookup(mock)
+
+	var got models.User
+	handler := middleware.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = auth.UserFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("GET", "/files", nil)
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	if got.ID != userA.ID || got.Email != userA.Email {
+		t.Errorf("Context user = %+v, want %+v", got, userA)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAuthMiddlewareRejectsTokenWithoutSubject(t *testing.T) {
+	log.Println("--- Starting TestAuthMiddlewareRejectsTokenWithoutSubject ---")
+	t.Setenv("JWT_SECRET_KEY", "test-secret")
+
+	// Tokens issued before the subject claim existed only carry an email
+	unsigned := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ":   "access",
+		"email": userA.Email,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	unsigned.Header["kid"] = "default"
+	token, err := unsigned.SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	handler := middleware.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Next handler should not be called")
+	}))
+
+	req := httptest.NewRequest("GET", "/files", nil)
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestFileHandlersRequireUser(t *testing.T) {
+	log.Println("--- Starting TestFileHandlersRequireUser ---")
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	handlers := map[string]func(http.ResponseWriter, *http.Request){
+		"upload": func(w http.ResponseWriter, r *http.Request) { fileupload.UploadFile(w, r, db, nil) },
+		"files":  func(w http.ResponseWriter, r *http.Request) { fileupload.RetrieveFiles(w, r, db, nil) },
+		"search": func(w http.ResponseWriter, r *http.Request) { fileupload.SearchFiles(w, r, db, nil) },
+		"share":  func(w http.ResponseWriter, r *http.Request) { fileupload.ShareFile(w, r, db, nil, 1) },
+	}
+	for name, handler := range handlers {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("GET", "/"+name, nil))
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s returned wrong status code: got %v, want %v", name, rr.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestRetrieveFilesScopedToUser(t *testing.T) {
+	log.Println("--- Starting TestRetrieveFilesScopedToUser ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT .* FROM files WHERE user_id = \\$1").
+		WithArgs(userA.ID).
+		WillReturnRows(sqlmock.NewRows(fileColumns).
+			AddRow(10, "a-brief.pdf", "a-brief.pdf", now, 100, ".pdf", "", "", false, nil, 0, "application/pdf", "clean"))
+	mock.ExpectQuery("SELECT .* FROM files WHERE user_id = \\$1").
+		WithArgs(userB.ID).
+		WillReturnRows(sqlmock.NewRows(fileColumns).
+			AddRow(20, "b-memo.txt", "b-memo.txt", now, 50, ".txt", "", "", false, nil, 0, "text/plain", "clean"))
+
+	for _, tc := range []struct {
+		user    models.User
+		want    int
+		notWant int
+	}{{userA, 10, 20}, {userB, 20, 10}} {
+		rr := httptest.NewRecorder()
+		fileupload.RetrieveFiles(rr, requestAs("GET", "/files", tc.user), db, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+		}
+
+		var files []models.File
+		if err := json.NewDecoder(rr.Body).Decode(&files); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(files) != 1 || files[0].ID != tc.want {
+			t.Errorf("User %d got files %+v, want only file %d", tc.user.ID, files, tc.want)
+		}
+		for _, f := range files {
+			if f.ID == tc.notWant {
+				t.Errorf("User %d can see file %d belonging to another user", tc.user.ID, f.ID)
+			}
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSearchFilesScopedToUser(t *testing.T) {
+	log.Println("--- Starting TestSearchFilesScopedToUser ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT .* FROM files WHERE "+withGrants("user_id = \\$1 AND org_id IS NULL")+" AND deleted_at IS NULL AND "+notExpired("files")+" AND file_name ILIKE \\$2").
+		WithArgs(userB.ID, "%memo%").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "file_name", "original_name", "upload_date", "size", "mime_type"}))
+
+	rr := httptest.NewRecorder()
+	fileupload.SearchFiles(rr, requestAs("GET", "/search?name=memo", userB), db, nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestShareFileOfAnotherUser(t *testing.T) {
+	log.Println("--- Starting TestShareFileOfAnotherUser ---")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	// File 10 belongs to user A, so the owner-scoped lookup for user B finds nothing
+	mock.ExpectQuery("SELECT file_name, .* FROM files WHERE id = \\$1 AND deleted_at IS NULL AND "+notExpired("files")+" AND user_id = \\$2").
+		WithArgs(10, userB.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"file_name", "scan_status"}))
+
+	rr := httptest.NewRecorder()
+	fileupload.ShareFile(rr, requestAs("POST", "/share/10", userB), db, nil, 10)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+	if strings.Contains(rr.Body.String(), "uploads/") {
+		t.Errorf("Response leaked a file path: %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,276 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go_backend_legalForce/auth"
+	"go_backend_legalForce/fileupload"
+	"go_backend_legalForce/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+var loadVersionQuery = "SELECT v.version, .* FROM file_versions v JOIN files f ON f.id = v.file_id\\s+WHERE v.file_id = \\$1 AND v.version = \\$2 AND f.deleted_at IS NULL AND " + notExpired("f") + " AND " +
+	withGrants("user_id = \\$3 AND org_id IS NULL")
+
+var versionColumns = []string{"version", "uploaded_by", "storage_key", "size", "sha256", "mime_type", "scan_status", "original_name", "created_at", "current"}
+
+func expectVersion(mock sqlmock.Sqlmock, fileID, version int, key string, content string, current bool) {
+	mock.ExpectQuery(loadVersionQuery).
+		WithArgs(fileID, version, userA.ID).
+		WillReturnRows(sqlmock.NewRows(append(versionColumns, "file_name", "file_type")).
+			AddRow(version, userA.ID, key, len(content), sha256Hex(content), "text/plain", "clean", "brief.txt", time.Now(), current, "Brief.txt", ".txt"))
+}
+
+func versionUpload(name, content string) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("file", name)
+	io.WriteString(part, content)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/files/7/versions", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req.WithContext(auth.WithUser(req.Context(), userA))
+}
+
+func TestUploadVersion(t *testing.T) {
+	log.Println("--- Starting TestUploadVersion ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+	mr := miniredis.RunT(t)
+	redisClient := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer redisClient.Close()
+
+	mr.Set("user_files:1", "[listing with the old size]")
+
+	content := "Draft 2 of the brief\n"
+	var key string
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM files WHERE id = \\$1 AND deleted_at IS NULL AND "+notExpired("files")+" AND user_id = \\$2 AND org_id IS NULL\\)").
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	expectNoContentPolicy(mock)
+	expectNoQuota(mock)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM files WHERE id = \\$1 AND deleted_at IS NULL AND "+notExpired("files")+" AND user_id = \\$2 AND org_id IS NULL FOR UPDATE").
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec("INSERT INTO blobs").
+		WithArgs(sqlmock.AnyArg(), sha256Hex(content), int64(len(content))).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO file_versions .* SELECT \\$1, COALESCE\\(MAX\\(version\\), 0\\) \\+ 1").
+		WithArgs(7, userA.ID, captureArg{&key}, int64(len(content)), sha256Hex(content), "brief final.txt", "text/plain").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "created_at"}).AddRow(2, time.Now()))
+	mock.ExpectQuery("UPDATE files SET storage_key = \\$1, size = \\$2, original_name = \\$3, s3_url = \\$4, current_version = \\$5, mime_type = \\$6\\s+WHERE id = \\$7 RETURNING").
+		WithArgs(sqlmock.AnyArg(), int64(len(content)), "brief final.txt", "", 2, "text/plain", 7).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns).AddRow(7, userA.ID, 0, "Brief.txt", "brief final.txt",
+			time.Now(), len(content), ".txt", "", "", false, nil, 0, "text/plain", "clean"))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	fileupload.UploadVersion(rr, versionUpload("brief final.txt", content), db, redisClient, 7)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v: %s", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	var version models.FileVersion
+	json.NewDecoder(rr.Body).Decode(&version)
+	if version.Version != 2 || !version.Current || version.SHA256 != sha256Hex(content) || version.UploadedBy != userA.ID {
+		t.Errorf("Unexpected version: %+v", version)
+	}
+
+	// The new contents are stored apart from the old ones
+	body, _, err := backend.Get(context.Background(), key, 0, -1)
+	if err != nil {
+		t.Fatalf("New version not stored: %v", err)
+	}
+	stored, _ := io.ReadAll(body)
+	body.Close()
+	if string(stored) != content {
+		t.Errorf("Stored %q", stored)
+	}
+
+	// The listing shows the new size
+	if mr.Exists("user_files:1") {
+		t.Errorf("Stale cache entries: %v", mr.Keys())
+	}
+
+	// Nothing is read or stored for files the caller cannot see
+	mock.ExpectQuery("SELECT EXISTS\\(SELECT 1 FROM files WHERE id = \\$1").
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	rr = httptest.NewRecorder()
+	fileupload.UploadVersion(rr, versionUpload("brief.txt", "x"), db, redisClient, 7)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Unknown file: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestVersionHistoryDownloadAndRestore(t *testing.T) {
+	log.Println("--- Starting TestVersionHistoryDownloadAndRestore ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	backend.Put(context.Background(), "v1.txt", strings.NewReader("first draft\n"), 12, "")
+
+	// History, newest first, with the storage all versions take
+	mock.ExpectQuery("SELECT v.version, .* FROM file_versions v JOIN files f ON f.id = v.file_id\\s+WHERE v.file_id = \\$1 AND f.deleted_at IS NULL AND "+notExpired("f")+" AND "+withGrants("user_id = \\$2 AND org_id IS NULL")+" ORDER BY v.version DESC").
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows(versionColumns).
+			AddRow(2, userB.ID, "v2.txt", 21, sha256Hex("second"), "text/plain", "clean", "brief final.txt", time.Now(), true).
+			AddRow(1, 0, "v1.txt", 12, "", "", "clean", "brief.txt", time.Now().Add(-time.Hour), false))
+	rr := httptest.NewRecorder()
+	fileupload.ListVersions(rr, requestAs("GET", "/files/7/versions", userA), db, 7)
+	var history struct {
+		TotalSize int64                `json:"total_size"`
+		Versions  []models.FileVersion `json:"versions"`
+	}
+	json.NewDecoder(rr.Body).Decode(&history)
+	if rr.Code != http.StatusOK || history.TotalSize != 33 || len(history.Versions) != 2 ||
+		!history.Versions[0].Current || history.Versions[1].UploadedBy != 0 {
+		t.Errorf("Unexpected history: %v %+v", rr.Code, history)
+	}
+
+	mock.ExpectQuery("SELECT v.version, .* FROM file_versions v").
+		WithArgs(8, userA.ID).
+		WillReturnRows(sqlmock.NewRows(versionColumns))
+	rr = httptest.NewRecorder()
+	fileupload.ListVersions(rr, requestAs("GET", "/files/8/versions", userA), db, 8)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("History of an unknown file: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// A prior version downloads under the file's name
+	expectVersion(mock, 7, 1, "v1.txt", "first draft\n", false)
+	rr = httptest.NewRecorder()
+	fileupload.DownloadVersion(rr, requestAs("GET", "/files/7/versions/1/content", userA), db, 7, 1)
+	if rr.Code != http.StatusOK || rr.Body.String() != "first draft\n" ||
+		rr.Header().Get("Content-Disposition") != `attachment; filename=Brief.txt` {
+		t.Errorf("Download of version 1: got %v %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	// Restoring makes it current again
+	expectVersion(mock, 7, 1, "v1.txt", "first draft\n", false)
+	mock.ExpectQuery("UPDATE files SET storage_key = \\$1, .* current_version = \\$5, mime_type = \\$6\\s+WHERE id = \\$7 AND deleted_at IS NULL AND "+notExpired("files")+" AND user_id = \\$8 AND org_id IS NULL RETURNING").
+		WithArgs("v1.txt", int64(12), "brief.txt", "", 1, "text/plain", 7, userA.ID).
+		WillReturnRows(sqlmock.NewRows(updatedFileColumns).AddRow(7, userA.ID, 0, "Brief.txt", "brief.txt",
+			time.Now(), 12, ".txt", "", "", false, nil, 0, "text/plain", "clean"))
+	rr = httptest.NewRecorder()
+	fileupload.RestoreVersion(rr, requestAs("POST", "/files/7/versions/1/restore", userA), db, nil, 7, 1)
+	var file models.File
+	json.NewDecoder(rr.Body).Decode(&file)
+	if rr.Code != http.StatusOK || file.Size != 12 {
+		t.Errorf("Restore: got %v %+v", rr.Code, file)
+	}
+
+	mock.ExpectQuery(loadVersionQuery).
+		WithArgs(7, 9, userA.ID).
+		WillReturnRows(sqlmock.NewRows(append(versionColumns, "file_name", "file_type")))
+	rr = httptest.NewRecorder()
+	fileupload.RestoreVersion(rr, requestAs("POST", "/files/7/versions/9/restore", userA), db, nil, 7, 9)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Restoring an unknown version: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDiffVersions(t *testing.T) {
+	log.Println("--- Starting TestDiffVersions ---")
+	backend := useLocalStorage(t)
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create mock database: %v", err)
+	}
+	defer db.Close()
+
+	v1 := "AGREEMENT\n\n1. The Seller sells the goods.\n2. The Buyer pays 100 EUR.\n3. Delivery within 30 days.\n4. Warranty of 1 year.\n5. German law applies.\n5a. No arbitration.\n6. Munich courts.\n7. Written form.\n8. Severability.\n9. Signatures."
+	v3 := "AGREEMENT\n\n1. The Seller sells the goods.\n2. The Buyer pays 120 EUR.\n3. Delivery within 30 days.\n4. Warranty of 1 year.\n5. German law applies.\n5a. No arbitration.\n6. Munich courts.\n7. Written form.\n8. Severability.\n9. Signatures.\n10. Annex A.\n"
+	for key, content := range map[string]string{"v1.txt": v1, "v3.txt": v3, "scan.pdf": "%PDF\x00\x01"} {
+		backend.Put(context.Background(), key, strings.NewReader(content), int64(len(content)), "")
+	}
+
+	// Against the current version
+	mock.ExpectQuery("SELECT current_version FROM files WHERE id = \\$1 AND deleted_at IS NULL AND "+notExpired("files")+" AND "+withGrants("user_id = \\$2 AND org_id IS NULL")).
+		WithArgs(7, userA.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"current_version"}).AddRow(3))
+	expectVersion(mock, 7, 1, "v1.txt", v1, false)
+	expectVersion(mock, 7, 3, "v3.txt", v3, true)
+	rr := httptest.NewRecorder()
+	fileupload.DiffVersions(rr, requestAs("GET", "/files/7/diff?from=1", userA), db, 7)
+	want := "--- Brief.txt (version 1)\n" +
+		"+++ Brief.txt (version 3)\n" +
+		"@@ -1,7 +1,7 @@\n" +
+		" AGREEMENT\n" +
+		" \n" +
+		" 1. The Seller sells the goods.\n" +
+		"-2. The Buyer pays 100 EUR.\n" +
+		"+2. The Buyer pays 120 EUR.\n" +
+		" 3. Delivery within 30 days.\n" +
+		" 4. Warranty of 1 year.\n" +
+		" 5. German law applies.\n" +
+		"@@ -9,4 +9,5 @@\n" +
+		" 6. Munich courts.\n" +
+		" 7. Written form.\n" +
+		" 8. Severability.\n" +
+		"-9. Signatures.\n" +
+		"\\ No newline at end of file\n" +
+		"+9. Signatures.\n" +
+		"+10. Annex A.\n"
+	if rr.Code != http.StatusOK || rr.Body.String() != want {
+		t.Errorf("Diff: got %v\n%s\nwant\n%s", rr.Code, rr.Body.String(), want)
+	}
+
+	// The same version twice has no differences
+	expectVersion(mock, 7, 3, "v3.txt", v3, true)
+	expectVersion(mock, 7, 3, "v3.txt", v3, true)
+	rr = httptest.NewRecorder()
+	fileupload.DiffVersions(rr, requestAs("GET", "/files/7/diff?from=3&to=3", userA), db, 7)
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("Identical versions: got %v %q", rr.Code, rr.Body.String())
+	}
+
+	// Binary files are refused
+	expectVersion(mock, 7, 1, "v1.txt", v1, false)
+	expectVersion(mock, 7, 2, "scan.pdf", "%PDF\x00\x01", false)
+	rr = httptest.NewRecorder()
+	fileupload.DiffVersions(rr, requestAs("GET", "/files/7/diff?from=1&to=2", userA), db, 7)
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Binary version: got %v, want %v", rr.Code, http.StatusUnsupportedMediaType)
+	}
+
+	rr = httptest.NewRecorder()
+	fileupload.DiffVersions(rr, requestAs("GET", "/files/7/diff", userA), db, 7)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Missing from: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled expectations: %s", err)
+	}
+}